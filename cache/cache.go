@@ -1,7 +1,9 @@
 package cache
 
 import (
-	"regexp"
+	"time"
+
+	"github.com/valarpirai/vardis/util"
 )
 
 var OBJ_STRING uint8 = 0 /* String object. */
@@ -11,7 +13,19 @@ var OBJ_ZSET uint8 = 3   /* Sorted set object. */
 var OBJ_HASH uint8 = 4   /* Hash object. */
 
 type CacheStorage struct {
-	store map[string]*CacheData
+	store      map[string]*CacheData
+	expires    int /* Number of keys with an expire set */
+	stats      KeyspaceStats
+	onModified func(key string)
+	onNotify   func(class int, event string, key string)
+}
+
+// KeyspaceStats are the keyspace counters reported by INFO stats
+type KeyspaceStats struct {
+	Hits    int64 /* Successful lookups of keys by read commands */
+	Misses  int64 /* Failed lookups of keys by read commands */
+	Expired int64 /* Keys deleted because their time to live elapsed */
+	Evicted int64 /* Keys deleted to free memory */
 }
 type CacheData struct {
 	val      interface{}
@@ -19,9 +33,9 @@ type CacheData struct {
 	dataType uint8
 }
 type Cache interface {
-	Set(string, string) string
-	Get(string) string
-	Exists(string) string
+	Set(string, []byte) string
+	Get(string) ([]byte, bool)
+	Exists(string) int
 }
 
 type ICacheStorage interface {
@@ -46,20 +60,215 @@ func (c *CacheStorage) Store() map[string]*CacheData {
 	return c.store
 }
 
-func (c *CacheStorage) Set(key string, val string) string {
+// SetModifiedHook registers fn, called with the key on every change of the
+// keyspace: writes, deletes, expire changes, expired keys and flushes
+func (c *CacheStorage) SetModifiedHook(fn func(key string)) {
+	c.onModified = fn
+}
+
+func (c *CacheStorage) signalModifiedKey(key string) {
+	if nil != c.onModified {
+		c.onModified(key)
+	}
+}
+
+// Lookup returns the data stored at key, nil if there is none
+// A key whose time to live elapsed is deleted first
+func (c *CacheStorage) Lookup(key string) *CacheData {
+	data, ok := c.store[key]
+	if !ok {
+		return nil
+	}
+	if 0 != data.exp && time.Now().UnixNano() >= data.exp {
+		c.deleteExpiredKey(key)
+		return nil
+	}
+	return data
+}
+
+func (c *CacheStorage) deleteExpiredKey(key string) {
+	delete(c.store, key)
+	c.expires--
+	c.stats.Expired++
+	c.NotifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key)
+	c.signalModifiedKey(key)
+}
+
+const ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP = 20    /* Keys for each DB loop. */
+const ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE = 10 /* % of stale keys after which we do extra efforts. */
+
+// ActiveExpireCycle deletes the expired keys nobody reads, so they don't
+// use memory forever. Keys with an expire are sampled, and the sampling
+// goes on while more than ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE percent of
+// them are expired, until the deadline. Returns the keys deleted.
+func (c *CacheStorage) ActiveExpireCycle(deadline time.Time) int {
+	expired := 0
+	for c.expires > 0 {
+		now := time.Now().UnixNano()
+		sampled, stale, visited := 0, 0, 0
+		/* Map iteration starts at a random key, most keys may have no
+		 * expire so the visit is bounded as well. */
+		for key, data := range c.store {
+			if visited++; visited > ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP*20 ||
+				sampled == ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP {
+				break
+			}
+			if 0 == data.exp {
+				continue
+			}
+			sampled++
+			if now >= data.exp {
+				c.deleteExpiredKey(key)
+				stale++
+			}
+		}
+		expired += stale
+		if sampled == 0 || stale*100/sampled <= ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE ||
+			!time.Now().Before(deadline) {
+			break
+		}
+	}
+	return expired
+}
+
+// LookupRead is Lookup for commands reading the key, a miss raises a
+// keymiss event
+func (c *CacheStorage) LookupRead(key string) *CacheData {
+	data := c.Lookup(key)
+	if nil == data {
+		c.stats.Misses++
+		c.NotifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key)
+	} else {
+		c.stats.Hits++
+	}
+	return data
+}
+
+// Set stores a copy of val, so callers may reuse their buffers
+func (c *CacheStorage) Set(key string, val []byte) string {
+	if old, ok := c.store[key]; ok && old.exp != 0 {
+		c.expires--
+	}
 	c.store[key] = &CacheData{
-		val:      val,
+		val:      append([]byte(nil), val...),
 		exp:      0,
 		dataType: OBJ_STRING,
 	}
+	c.NotifyKeyspaceEvent(NOTIFY_STRING, "set", key)
+	c.signalModifiedKey(key)
 	return "OK"
 }
 
-func (c *CacheStorage) Get(key string) (string, bool) {
+func (c *CacheStorage) Get(key string) ([]byte, bool) {
 	if data, ok := c.store[key]; ok {
-		return data.val.(string), true
+		return data.val.([]byte), true
 	}
-	return "", false
+	return nil, false
+}
+
+// SetExpire sets the absolute expire time of key in unix nanoseconds, 0 removes it
+// Returns 0 if the key doesn't exist, or has no expire to remove
+func (c *CacheStorage) SetExpire(key string, exp int64) int {
+	if data, ok := c.store[key]; ok {
+		if exp == 0 {
+			if data.exp == 0 {
+				return 0
+			}
+			data.exp = 0
+			c.expires--
+			c.NotifyKeyspaceEvent(NOTIFY_GENERIC, "persist", key)
+		} else {
+			if data.exp == 0 {
+				c.expires++
+			}
+			data.exp = exp
+			c.NotifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
+		}
+		c.signalModifiedKey(key)
+		return 1
+	}
+	return 0
+}
+
+func (c *CacheStorage) Delete(key string) int {
+	if data, ok := c.store[key]; ok {
+		delete(c.store, key)
+		if data.exp != 0 {
+			c.expires--
+		}
+		c.NotifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		c.signalModifiedKey(key)
+		return 1
+	}
+	return 0
+}
+
+// Evict removes a key to free memory, returns 1 if the key existed
+func (c *CacheStorage) Evict(key string) int {
+	if data, ok := c.store[key]; ok {
+		delete(c.store, key)
+		if data.exp != 0 {
+			c.expires--
+		}
+		c.stats.Evicted++
+		c.NotifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", key)
+		c.signalModifiedKey(key)
+		return 1
+	}
+	return 0
+}
+
+// Flush removes all the keys, returns how many were removed
+func (c *CacheStorage) Flush() int {
+	removed := len(c.store)
+	old := c.store
+	c.store = make(map[string]*CacheData)
+	c.expires = 0
+	for key := range old {
+		c.signalModifiedKey(key)
+	}
+	return removed
+}
+
+// Size returns the number of keys, and how many of them have an expire
+func (c *CacheStorage) Size() (keys int, expires int) {
+	return len(c.store), c.expires
+}
+
+// AvgTTL estimates the average time to live in milliseconds of the keys
+// with an expire, sampling them like the redis active expire cycle does
+func (c *CacheStorage) AvgTTL() int64 {
+	const sampleKeys = 20
+	const maxVisited = 400
+	if c.expires == 0 {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	var sum, sampled int64
+	visited := 0
+	for _, data := range c.store {
+		if visited++; visited > maxVisited || sampled == sampleKeys {
+			break
+		}
+		if data.exp != 0 && data.exp > now {
+			sum += data.exp - now
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return sum / sampled / int64(time.Millisecond)
+}
+
+// Stats returns the keyspace counters
+func (c *CacheStorage) Stats() KeyspaceStats {
+	return c.stats
+}
+
+// ResetStats clears the keyspace counters, see CONFIG RESETSTAT
+func (c *CacheStorage) ResetStats() {
+	c.stats = KeyspaceStats{}
 }
 
 func (c *CacheStorage) Exists(key string) int {
@@ -69,11 +278,12 @@ func (c *CacheStorage) Exists(key string) int {
 	return 0
 }
 
+// Keys returns the keys matching the glob-style pattern
 func (c *CacheStorage) Keys(pattern string) []string {
-	r, _ := regexp.Compile(pattern)
+	allkeys := pattern == "*"
 	keys := make([]string, 0, len(c.store))
 	for k := range c.store {
-		if r.MatchString(k) {
+		if allkeys || util.StringMatch(util.StringToBytes(pattern), util.StringToBytes(k), false) {
 			keys = append(keys, k)
 		}
 	}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSetGetBinarySafe(t *testing.T) {
+	payloads := [][]byte{
+		{},
+		[]byte("plain"),
+		[]byte("a\r\nb"),
+		[]byte("\x00"),
+		[]byte("k\x00y\r\n"),
+		[]byte("\xff\xfe\x80"),
+	}
+	c := NewCache()
+	for _, key := range payloads {
+		for _, val := range payloads {
+			c.Set(string(key), val)
+			got, ok := c.Get(string(key))
+			if !ok || !bytes.Equal(got, val) {
+				t.Errorf("key %q: got %q, %v want %q", key, got, ok, val)
+			}
+			if c.Exists(string(key)) != 1 {
+				t.Errorf("key %q doesn't exist", key)
+			}
+		}
+	}
+	if keys, _ := c.Size(); keys != len(payloads) {
+		t.Errorf("got %d keys want %d", keys, len(payloads))
+	}
+}
+
+func TestSetCopiesValue(t *testing.T) {
+	c := NewCache()
+	buf := []byte("a\x00b")
+	c.Set("k", buf)
+	buf[0] = 'x'
+	if got, _ := c.Get("k"); string(got) != "a\x00b" {
+		t.Errorf("the stored value changed with the caller buffer: %q", got)
+	}
+}
@@ -0,0 +1,31 @@
+package cache
+
+/* Keyspace events classes, see notify-keyspace-events */
+var NOTIFY_KEYSPACE = (1 << 0)                                                                                                                             /* K */
+var NOTIFY_KEYEVENT = (1 << 1)                                                                                                                             /* E */
+var NOTIFY_GENERIC = (1 << 2)                                                                                                                              /* g */
+var NOTIFY_STRING = (1 << 3)                                                                                                                               /* $ */
+var NOTIFY_LIST = (1 << 4)                                                                                                                                 /* l */
+var NOTIFY_SET = (1 << 5)                                                                                                                                  /* s */
+var NOTIFY_HASH = (1 << 6)                                                                                                                                 /* h */
+var NOTIFY_ZSET = (1 << 7)                                                                                                                                 /* z */
+var NOTIFY_EXPIRED = (1 << 8)                                                                                                                              /* x */
+var NOTIFY_EVICTED = (1 << 9)                                                                                                                              /* e */
+var NOTIFY_STREAM = (1 << 10)                                                                                                                              /* t */
+var NOTIFY_KEY_MISS = (1 << 11)                                                                                                                            /* m (Note: This one is excluded from NOTIFY_ALL on purpose) */
+var NOTIFY_ALL = (NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH | NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM) /* A flag */
+
+// SetNotifyHook registers fn, called for every keyspace event with the
+// event class, the event name such as "set" or "expired", and the key
+// Events are raised by the storage itself, so no command can miss them.
+func (c *CacheStorage) SetNotifyHook(fn func(class int, event string, key string)) {
+	c.onNotify = fn
+}
+
+// NotifyKeyspaceEvent raises an event for a change the storage can't see,
+// such as an element pushed to a list held by key
+func (c *CacheStorage) NotifyKeyspaceEvent(class int, event string, key string) {
+	if nil != c.onNotify {
+		c.onNotify(class, event, key)
+	}
+}
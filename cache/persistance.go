@@ -3,43 +3,75 @@ package cache
 import (
 	"bufio"
 	"os"
+	"sync/atomic"
 	"time"
-
-	log "github.com/Sirupsen/logrus"
 )
 
+/* Append only defines */
+const AOF_FSYNC_NO = 0
+const AOF_FSYNC_ALWAYS = 1
+const AOF_FSYNC_EVERYSEC = 2
+
 // AOF Implementation
 // Log Create, Update, Delete actions to File
 // Write entire command to the file
 // Read and load the file on startup
 type Persistance struct {
 	flushInterval time.Duration
+	fsyncPolicy   int32 // AOF_FSYNC_*, atomic
 	AofFile       *os.File
+	fsyncHook     atomic.Value // func(time.Duration), called after every fsync
 }
 
-// Initialize Persistant store
-func NewStorage() *Persistance {
+// Initialize Persistant store, appending to the file filename
+func NewStorage(filename string) (*Persistance, error) {
 	persist := new(Persistance)
-	persist.flushInterval = 3
-	file_name := "appendonly.aof"
-	f, err := os.OpenFile(file_name, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	persist.flushInterval = 1
+	persist.fsyncPolicy = AOF_FSYNC_EVERYSEC
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Error(err)
+		return nil, err
 	}
 	persist.AofFile = f
 	go persist.flush()
-	return persist
+	return persist, nil
+}
+
+// SetFsyncPolicy sets when the file is fsynced: after every write
+// (AOF_FSYNC_ALWAYS), every second (AOF_FSYNC_EVERYSEC) or when the
+// operating system wants (AOF_FSYNC_NO)
+func (p *Persistance) SetFsyncPolicy(policy int) {
+	atomic.StoreInt32(&p.fsyncPolicy, int32(policy))
 }
 
 func (p *Persistance) flush() {
 	// File sync
-	time.Sleep(p.flushInterval * time.Second)
-	p.AofFile.Sync()
-	p.flush()
+	for {
+		time.Sleep(p.flushInterval * time.Second)
+		if atomic.LoadInt32(&p.fsyncPolicy) != AOF_FSYNC_EVERYSEC {
+			continue
+		}
+		start := time.Now()
+		p.AofFile.Sync()
+		if hook, ok := p.fsyncHook.Load().(func(time.Duration)); ok {
+			hook(time.Since(start))
+		}
+	}
+}
+
+// SetFsyncHook registers the function told how long every fsync took.
+// It is called from the flush goroutine
+func (p *Persistance) SetFsyncHook(hook func(time.Duration)) {
+	p.fsyncHook.Store(hook)
 }
 
-func (p *Persistance) WriteCommand(cmd string) {
-	p.AofFile.WriteString(cmd)
+// WriteCommand appends cmd, with appendfsync always the file is synced
+// before returning
+func (p *Persistance) WriteCommand(cmd []byte) {
+	p.AofFile.Write(cmd)
+	if atomic.LoadInt32(&p.fsyncPolicy) == AOF_FSYNC_ALWAYS {
+		p.AofFile.Sync()
+	}
 }
 
 func (p *Persistance) Reader() *bufio.Reader {
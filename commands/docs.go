@@ -0,0 +1,305 @@
+package commands
+
+// Command documentation
+// redis-commands.json is the command list scraped from redis.io (see tasks.txt),
+// it is embedded in the binary so COMMAND DOCS doesn't depend on the working directory.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+//go:embed redis-commands.json
+var commandsJSON []byte
+
+// Doc describes a command, as served by COMMAND DOCS
+type Doc struct {
+	Name        string
+	Group       string
+	Summary     string
+	Arguments   []*Argument
+	Subcommands map[string]*Doc /* Keyed by "command|subcommand" */
+}
+
+// Argument describes a command argument
+// Type is one of key, string, pure-token, oneof or block. oneof and block
+// arguments have nested Arguments.
+type Argument struct {
+	Name      string
+	Type      string
+	Token     string
+	Optional  bool
+	Multiple  bool
+	Arguments []*Argument
+}
+
+type docEntry struct {
+	Group   string `json:"group"`
+	Name    string `json:"name"`
+	Args    string `json:"args"`
+	Summary string `json:"summary"`
+}
+
+var (
+	docsOnce sync.Once
+	docs     map[string]*Doc
+)
+
+// Docs returns the documentation of all the commands, keyed by lower case name
+// Subcommands such as "CLIENT KILL" are attached to their parent command.
+func Docs() map[string]*Doc {
+	docsOnce.Do(loadDocs)
+	return docs
+}
+
+// Lookup returns the documentation of a command, nil if there is none
+func Lookup(name string) *Doc {
+	return Docs()[strings.ToLower(name)]
+}
+
+func loadDocs() {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(commandsJSON, &raw); err != nil {
+		panic("Unable to load commands: " + err.Error())
+	}
+	var groups []string
+	if err := json.Unmarshal(raw["keys"], &groups); err != nil {
+		panic("Unable to load commands: " + err.Error())
+	}
+
+	docs = make(map[string]*Doc)
+	var subcommands []*Doc
+	for _, group := range groups {
+		var entries []docEntry
+		if err := json.Unmarshal(raw[group], &entries); err != nil {
+			panic("Unable to load commands: " + err.Error())
+		}
+		for _, e := range entries {
+			doc := &Doc{
+				Name:      strings.ToLower(e.Name),
+				Group:     strings.Replace(e.Group, "_", "-", -1),
+				Summary:   e.Summary,
+				Arguments: ParseArguments(e.Args),
+			}
+			if strings.Contains(doc.Name, " ") {
+				doc.Name = strings.Replace(doc.Name, " ", "|", 1)
+				subcommands = append(subcommands, doc)
+			} else {
+				docs[doc.Name] = doc
+			}
+		}
+	}
+
+	for _, sub := range subcommands {
+		parentName := sub.Name[:strings.Index(sub.Name, "|")]
+		parent, ok := docs[parentName]
+		if !ok {
+			parent = &Doc{Name: parentName, Group: sub.Group}
+			docs[parentName] = parent
+		}
+		if nil == parent.Subcommands {
+			parent.Subcommands = make(map[string]*Doc)
+		}
+		parent.Subcommands[sub.Name] = sub
+	}
+}
+
+/* Parse the redis.io argument synopsis into argument specs:
+ *
+ *   key [key ...]                  key, multiple
+ *   [EX seconds|PX milliseconds]   optional oneof of two blocks
+ *   [COUNT count]                  optional count, with token COUNT
+ *   BEFORE|AFTER                   oneof of two pure tokens
+ *   score member [score member ...] multiple block of score and member
+ *
+ * The synopsis is informal, so this is best effort. */
+func ParseArguments(synopsis string) []*Argument {
+	synopsis = strings.Replace(synopsis, "[", " [ ", -1)
+	synopsis = strings.Replace(synopsis, "]", " ] ", -1)
+	return parseArgs(strings.Fields(synopsis))
+}
+
+func parseArgs(tokens []string) []*Argument {
+	var args []*Argument
+	for i := 0; i < len(tokens); i++ {
+		switch tok := tokens[i]; tok {
+		case "[":
+			j := matchingBracket(tokens, i)
+			inner := tokens[i+1 : j]
+			i = j
+			if repeated := repeatedGroup(args, inner); repeated > 0 {
+				args = mergeRepeated(args, repeated)
+				continue
+			}
+			if group := parseGroup(inner); nil != group {
+				group.Optional = true
+				args = append(args, group)
+			}
+		case "]":
+		case "...":
+			if len(args) > 0 {
+				args[len(args)-1].Multiple = true
+			}
+		default:
+			args = append(args, parseWord(tok))
+		}
+	}
+	return args
+}
+
+func matchingBracket(tokens []string, open int) int {
+	depth := 0
+	for j := open; j < len(tokens); j++ {
+		if tokens[j] == "[" {
+			depth++
+		} else if tokens[j] == "]" {
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens)
+}
+
+/* "key [key ...]" and "score member [score member ...]": a bracketed group
+ * repeating the arguments just before it. Returns how many arguments are
+ * repeated, 0 if the group is something else. */
+func repeatedGroup(args []*Argument, inner []string) int {
+	if len(inner) < 2 || inner[len(inner)-1] != "..." {
+		return 0
+	}
+	names := inner[:len(inner)-1]
+	if len(names) > len(args) {
+		return 0
+	}
+	prev := args[len(args)-len(names):]
+	for k, name := range names {
+		if prev[k].Name != strings.ToLower(name) || prev[k].Type == "block" {
+			return 0
+		}
+	}
+	return len(names)
+}
+
+func mergeRepeated(args []*Argument, n int) []*Argument {
+	if n == 1 {
+		args[len(args)-1].Multiple = true
+		return args
+	}
+	repeated := append([]*Argument(nil), args[len(args)-n:]...)
+	names := make([]string, n)
+	for k, arg := range repeated {
+		names[k] = arg.Name
+	}
+	block := &Argument{
+		Name:      strings.Join(names, "_"),
+		Type:      "block",
+		Multiple:  true,
+		Arguments: repeated,
+	}
+	return append(args[:len(args)-n], block)
+}
+
+func parseGroup(inner []string) *Argument {
+	if len(inner) == 0 {
+		return nil
+	}
+	if alternatives := splitAlternatives(inner); nil != alternatives {
+		oneof := &Argument{Type: "oneof"}
+		var names []string
+		for _, alt := range alternatives {
+			arg := parseGroup(alt)
+			oneof.Arguments = append(oneof.Arguments, arg)
+			names = append(names, arg.Name)
+		}
+		oneof.Name = strings.Join(names, "-")
+		return oneof
+	}
+
+	args := parseArgs(inner)
+	if len(args) == 1 {
+		return args[0]
+	}
+	first := args[0]
+	if first.Type == "pure-token" {
+		/* [COUNT count] is the count argument introduced by a token */
+		if len(args) == 2 && args[1].Type != "block" {
+			args[1].Token = first.Token
+			return args[1]
+		}
+		return &Argument{Name: first.Name, Type: "block", Token: first.Token, Arguments: args[1:]}
+	}
+	return &Argument{Name: first.Name, Type: "block", Arguments: args}
+}
+
+/* [EX seconds|PX milliseconds] is a choice between two blocks, while
+ * [OVERFLOW WRAP|SAT|FAIL] is a token followed by a choice between words.
+ * The first form is recognized by alternatives of equal length. */
+func splitAlternatives(inner []string) [][]string {
+	var alternatives [][]string
+	var current []string
+	depth := 0
+	for _, tok := range inner {
+		if tok == "[" {
+			depth++
+		} else if tok == "]" {
+			depth--
+		}
+		if depth > 0 || !strings.Contains(tok, "|") || tok == "|" {
+			current = append(current, tok)
+			continue
+		}
+		parts := strings.Split(tok, "|")
+		current = append(current, parts[0])
+		alternatives = append(alternatives, current)
+		for _, part := range parts[1 : len(parts)-1] {
+			alternatives = append(alternatives, []string{part})
+		}
+		current = []string{parts[len(parts)-1]}
+	}
+	if nil == alternatives {
+		return nil
+	}
+	alternatives = append(alternatives, current)
+	for _, alt := range alternatives {
+		if len(alt) != len(alternatives[0]) || len(alt) < 2 {
+			return nil
+		}
+	}
+	return alternatives
+}
+
+func parseWord(tok string) *Argument {
+	if strings.Contains(tok, "|") && tok != "|" {
+		oneof := &Argument{Name: strings.ToLower(strings.Replace(tok, "|", "-", -1)), Type: "oneof"}
+		for _, alt := range strings.Split(tok, "|") {
+			oneof.Arguments = append(oneof.Arguments, parseWord(alt))
+		}
+		return oneof
+	}
+	name := strings.ToLower(tok)
+	if isToken(tok) {
+		return &Argument{Name: name, Type: "pure-token", Token: tok}
+	}
+	if name == "key" || name == "destination" || name == "source" ||
+		strings.HasSuffix(name, "key") && name != "numkeys" {
+		return &Argument{Name: name, Type: "key"}
+	}
+	return &Argument{Name: name, Type: "string"}
+}
+
+func isToken(tok string) bool {
+	letters := false
+	for _, r := range tok {
+		if r >= 'a' && r <= 'z' {
+			return false
+		}
+		if r >= 'A' && r <= 'Z' {
+			letters = true
+		}
+	}
+	return letters
+}
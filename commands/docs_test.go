@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* The embedded redis-commands.json must load, or the server panics at
+ * the first COMMAND DOCS */
+func TestEmbeddedDocsLoad(t *testing.T) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("redis-commands.json doesn't load: %v", err)
+		}
+	}()
+	if len(Docs()) < 150 {
+		t.Fatalf("only %d commands loaded", len(Docs()))
+	}
+	if doc := Lookup("CLIENT"); nil == doc || nil == doc.Subcommands["client|kill"] {
+		t.Fatal("CLIENT KILL is not a subcommand of CLIENT")
+	}
+}
+
+// checkArguments reports the malformed argument specs
+func checkArguments(t *testing.T, command string, args []*Argument) {
+	for _, arg := range args {
+		if nil == arg || arg.Name == "" {
+			t.Errorf("%s: argument without a name", command)
+			continue
+		}
+		switch arg.Type {
+		case "key", "string":
+		case "pure-token":
+			if arg.Token == "" {
+				t.Errorf("%s: pure-token %s without token", command, arg.Name)
+			}
+		case "oneof":
+			if len(arg.Arguments) < 2 {
+				t.Errorf("%s: oneof %s with %d choices", command, arg.Name, len(arg.Arguments))
+			}
+		case "block":
+			if len(arg.Arguments) == 0 {
+				t.Errorf("%s: empty block %s", command, arg.Name)
+			}
+		default:
+			t.Errorf("%s: argument %s of unknown type %q", command, arg.Name, arg.Type)
+		}
+		checkArguments(t, command, arg.Arguments)
+	}
+}
+
+/* Every synopsis of the embedded file parses to well formed arguments */
+func TestParseEverySynopsis(t *testing.T) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(commandsJSON, &raw); err != nil {
+		t.Fatal(err)
+	}
+	var groups []string
+	if err := json.Unmarshal(raw["keys"], &groups); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		var entries []docEntry
+		if err := json.Unmarshal(raw[group], &entries); err != nil {
+			t.Fatalf("group %s: %v", group, err)
+		}
+		for _, e := range entries {
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						t.Errorf("%s %q: parser panic: %v", e.Name, e.Args, err)
+					}
+				}()
+				args := ParseArguments(e.Args)
+				if strings.TrimSpace(e.Args) != "" && len(args) == 0 {
+					t.Errorf("%s %q: no argument parsed", e.Name, e.Args)
+				}
+				checkArguments(t, e.Name, args)
+			}()
+		}
+	}
+}
+
+func TestParseArguments(t *testing.T) {
+	cases := []struct {
+		synopsis string
+		want     []*Argument
+	}{
+		{"key [key ...]", []*Argument{{Name: "key", Type: "key", Multiple: true}}},
+		{"key value [EX seconds|PX milliseconds]", []*Argument{
+			{Name: "key", Type: "key"},
+			{Name: "value", Type: "string"},
+			{Name: "seconds-milliseconds", Type: "oneof", Optional: true, Arguments: []*Argument{
+				{Name: "seconds", Type: "string", Token: "EX"},
+				{Name: "milliseconds", Type: "string", Token: "PX"},
+			}},
+		}},
+		{"key BEFORE|AFTER pivot", []*Argument{
+			{Name: "key", Type: "key"},
+			{Name: "before-after", Type: "oneof", Arguments: []*Argument{
+				{Name: "before", Type: "pure-token", Token: "BEFORE"},
+				{Name: "after", Type: "pure-token", Token: "AFTER"},
+			}},
+			{Name: "pivot", Type: "string"},
+		}},
+		{"key score member [score member ...]", []*Argument{
+			{Name: "key", Type: "key"},
+			{Name: "score_member", Type: "block", Multiple: true, Arguments: []*Argument{
+				{Name: "score", Type: "string"},
+				{Name: "member", Type: "string"},
+			}},
+		}},
+		{"[COUNT count]", []*Argument{{Name: "count", Type: "string", Token: "COUNT", Optional: true}}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		if got := ParseArguments(c.synopsis); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %s want %s", c.synopsis, dumpArgs(got), dumpArgs(c.want))
+		}
+	}
+}
+
+func dumpArgs(args []*Argument) string {
+	b, _ := json.Marshal(args)
+	return string(b)
+}
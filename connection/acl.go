@@ -0,0 +1,1099 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+/* Access control lists, ported from redis acl.c
+ *
+ * Every client is authenticated as a user. A user has a set of passwords,
+ * the commands it can call (a bitmap indexed by RedisCommand.id), the key
+ * patterns it can access and the Pub/Sub channels it can use. Users are
+ * changed with ACL SETUSER rules:
+ *
+ *   on, off               Enable or disable the user
+ *   +<command>            Allow the command, +<command>|<subcommand> too
+ *   -<command>            Disallow the command
+ *   +@<category>          Allow all the commands in the category
+ *   -@<category>          Disallow all the commands in the category
+ *   allcommands, +@all    Allow every command
+ *   nocommands, -@all     Disallow every command
+ *   ~<pattern>            Allow read and write of the keys matching pattern
+ *   %R~<pattern>          Allow reading the keys matching pattern
+ *   %W~<pattern>          Allow writing the keys matching pattern
+ *   allkeys               Alias for ~*
+ *   resetkeys             Flush the list of allowed key patterns
+ *   &<pattern>            Allow the channels matching pattern
+ *   allchannels           Alias for &*
+ *   resetchannels         Flush the list of allowed channel patterns
+ *   ><password>           Add the password, <<password> removes it
+ *   #<hash>               Add the SHA-256 hash of a password, !<hash> removes it
+ *   nopass                Any password is accepted, removes the passwords
+ *   resetpass             Flush the passwords and remove nopass
+ *   reset                 resetpass resetkeys resetchannels off -@all
+ *
+ * The "default" user can't be removed. Clients start authenticated as
+ * "default" when it is enabled and has nopass, which is the case until
+ * requirepass is set. */
+
+/* User flags */
+const (
+	USER_FLAG_ENABLED     = (1 << 0) /* The user is active. */
+	USER_FLAG_DISABLED    = (1 << 1) /* The user is disabled. */
+	USER_FLAG_ALLKEYS     = (1 << 2) /* The user can mention any key. */
+	USER_FLAG_ALLCOMMANDS = (1 << 3) /* The user can run all commands. */
+	USER_FLAG_NOPASS      = (1 << 4) /* The user requires no password, any
+	   provided password will work. */
+	USER_FLAG_ALLCHANNELS = (1 << 5) /* The user can mention any Pub/Sub channel. */
+)
+
+/* Key permissions of a key pattern */
+const (
+	ACL_READ_PERMISSION  = (1 << 0)
+	ACL_WRITE_PERMISSION = (1 << 1)
+	ACL_ALL_PERMISSION   = ACL_READ_PERMISSION | ACL_WRITE_PERMISSION
+)
+
+/* Result of the permission checks */
+const (
+	ACL_OK             = 0
+	ACL_DENIED_CMD     = 1
+	ACL_DENIED_KEY     = 2
+	ACL_DENIED_AUTH    = 3 /* Only used for ACL LOG entries. */
+	ACL_DENIED_CHANNEL = 4 /* Only used for pub/sub commands */
+)
+
+/* Errors of ACLSetUser, the messages are the ones reported by ACL SETUSER */
+var (
+	errACLUnknownRule     = errors.New("Syntax error")
+	errACLUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	errACLKeyAfterAll     = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errACLChannelAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+	errACLNoSuchPassword  = errors.New("The password you are trying to remove from the user does not exist")
+	errACLBadHash         = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+)
+
+type keyPattern struct {
+	pattern string
+	flags   int /* ACL_READ_PERMISSION and/or ACL_WRITE_PERMISSION */
+}
+
+type aclUser struct {
+	name      string
+	flags     int
+	passwords []string /* SHA-256 of the passwords, hex encoded */
+
+	/* Bit N is set if the command with id N can be called. Subcommands
+	 * allowed for commands whose bit is clear are listed apart. */
+	allowedCommands    []uint64
+	allowedSubcommands map[int][]string
+	commandRules       []string /* +@all or -@all, then the +/- rules applied since */
+
+	patterns []keyPattern /* Key patterns, unless USER_FLAG_ALLKEYS */
+	channels []string     /* Channel patterns, unless USER_FLAG_ALLCHANNELS */
+}
+
+func (s *Server) aclCreateUser(name string) *aclUser {
+	u := &aclUser{name: name, flags: USER_FLAG_DISABLED}
+	u.allowedCommands = make([]uint64, len(s.commandMap)/64+1)
+	u.commandRules = []string{"-@all"}
+	return u
+}
+
+func (u *aclUser) setCommandBit(id int, value bool) {
+	word, bit := id/64, uint64(1)<<uint(id%64)
+	if value {
+		u.allowedCommands[word] |= bit
+	} else {
+		u.allowedCommands[word] &= ^bit
+	}
+}
+
+func (u *aclUser) commandBit(id int) bool {
+	return u.allowedCommands[id/64]&(uint64(1)<<uint(id%64)) != 0
+}
+
+// Remember the rule for ACL LIST, dropping an older rule for the same command
+func (u *aclUser) updateCommandRules(rule string) {
+	for j := 1; j < len(u.commandRules); j++ {
+		if u.commandRules[j][1:] == rule[1:] {
+			u.commandRules = append(u.commandRules[:j], u.commandRules[j+1:]...)
+			break
+		}
+	}
+	u.commandRules = append(u.commandRules, rule)
+}
+
+func (u *aclUser) setAllCommands(s *Server, allow bool) {
+	for _, cmd := range s.commandMap {
+		u.setCommandBit(cmd.id, allow)
+	}
+	u.allowedSubcommands = nil
+	if allow {
+		u.flags |= USER_FLAG_ALLCOMMANDS
+		u.commandRules = []string{"+@all"}
+	} else {
+		u.flags &= ^USER_FLAG_ALLCOMMANDS
+		u.commandRules = []string{"-@all"}
+	}
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for j := 0; j < len(hash); j++ {
+		ch := hash[j]
+		if (ch < 'a' || ch > 'f') && (ch < '0' || ch > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func aclHashPassword(password []byte) string {
+	sum := sha256.Sum256(password)
+	return hex.EncodeToString(sum[:])
+}
+
+// aclSetUser applies a single rule to the user
+func (s *Server) aclSetUser(u *aclUser, op string) error {
+	if len(op) == 0 || (op[0] == '+' || op[0] == '-') && len(op) < 2 {
+		return errACLUnknownRule
+	}
+	lop := strings.ToLower(op)
+	switch {
+	case lop == "on":
+		u.flags |= USER_FLAG_ENABLED
+		u.flags &= ^USER_FLAG_DISABLED
+	case lop == "off":
+		u.flags |= USER_FLAG_DISABLED
+		u.flags &= ^USER_FLAG_ENABLED
+	case lop == "allkeys" || op == "~*":
+		u.flags |= USER_FLAG_ALLKEYS
+		u.patterns = nil
+	case lop == "resetkeys":
+		u.flags &= ^USER_FLAG_ALLKEYS
+		u.patterns = nil
+	case lop == "allchannels" || op == "&*":
+		u.flags |= USER_FLAG_ALLCHANNELS
+		u.channels = nil
+	case lop == "resetchannels":
+		u.flags &= ^USER_FLAG_ALLCHANNELS
+		u.channels = nil
+	case lop == "allcommands" || lop == "+@all":
+		u.setAllCommands(s, true)
+	case lop == "nocommands" || lop == "-@all":
+		u.setAllCommands(s, false)
+	case lop == "nopass":
+		u.flags |= USER_FLAG_NOPASS
+		u.passwords = nil
+	case lop == "resetpass":
+		u.flags &= ^USER_FLAG_NOPASS
+		u.passwords = nil
+	case lop == "reset":
+		for _, rule := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			s.aclSetUser(u, rule)
+		}
+	case op[0] == '>' || op[0] == '#':
+		var hash string
+		if op[0] == '>' {
+			hash = aclHashPassword([]byte(op[1:]))
+		} else {
+			if !validPasswordHash(op[1:]) {
+				return errACLBadHash
+			}
+			hash = op[1:]
+		}
+		/* Avoid re-adding the same password multiple times. */
+		for _, p := range u.passwords {
+			if p == hash {
+				return nil
+			}
+		}
+		u.passwords = append(u.passwords, hash)
+		/* Clear the "nopass" flag, a password is now set. */
+		u.flags &= ^USER_FLAG_NOPASS
+	case op[0] == '<' || op[0] == '!':
+		var hash string
+		if op[0] == '<' {
+			hash = aclHashPassword([]byte(op[1:]))
+		} else {
+			if !validPasswordHash(op[1:]) {
+				return errACLBadHash
+			}
+			hash = op[1:]
+		}
+		for j, p := range u.passwords {
+			if p == hash {
+				u.passwords = append(u.passwords[:j], u.passwords[j+1:]...)
+				return nil
+			}
+		}
+		return errACLNoSuchPassword
+	case op[0] == '~' || op[0] == '%':
+		return u.addKeyPattern(op)
+	case op[0] == '&':
+		if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+			return errACLChannelAfterAll
+		}
+		for _, ch := range u.channels {
+			if ch == op[1:] {
+				return nil
+			}
+		}
+		u.channels = append(u.channels, op[1:])
+	case op[0] == '+' && op[1] != '@':
+		return s.aclSetUserCommand(u, op[1:], true)
+	case op[0] == '-' && op[1] != '@':
+		return s.aclSetUserCommand(u, op[1:], false)
+	case (op[0] == '+' || op[0] == '-') && op[1] == '@':
+		category := ACLGetCommandCategoryFlagByName(op[2:])
+		if category == 0 {
+			return errACLUnknownCommand
+		}
+		allow := op[0] == '+'
+		for _, cmd := range s.commandMap {
+			if cmd.aclCategories()&category != 0 {
+				u.setCommandBit(cmd.id, allow)
+				delete(u.allowedSubcommands, cmd.id)
+			}
+		}
+		if !allow {
+			u.flags &= ^USER_FLAG_ALLCOMMANDS
+		}
+		u.updateCommandRules(strings.ToLower(op))
+	default:
+		return errACLUnknownRule
+	}
+	return nil
+}
+
+/* ~<pattern>, %R~<pattern>, %W~<pattern> and %RW~<pattern> */
+func (u *aclUser) addKeyPattern(op string) error {
+	flags := ACL_ALL_PERMISSION
+	pattern := op[1:]
+	if op[0] == '%' {
+		offset := strings.IndexByte(op, '~')
+		if offset < 2 {
+			return errACLUnknownRule
+		}
+		flags = 0
+		for _, ch := range op[1:offset] {
+			switch ch {
+			case 'R', 'r':
+				flags |= ACL_READ_PERMISSION
+			case 'W', 'w':
+				flags |= ACL_WRITE_PERMISSION
+			default:
+				return errACLUnknownRule
+			}
+		}
+		pattern = op[offset+1:]
+	}
+	if u.flags&USER_FLAG_ALLKEYS != 0 {
+		return errACLKeyAfterAll
+	}
+	if flags == ACL_ALL_PERMISSION && pattern == "*" {
+		u.flags |= USER_FLAG_ALLKEYS
+		u.patterns = nil
+		return nil
+	}
+	for j, p := range u.patterns {
+		if p.pattern == pattern {
+			u.patterns[j].flags |= flags
+			return nil
+		}
+	}
+	u.patterns = append(u.patterns, keyPattern{pattern, flags})
+	return nil
+}
+
+/* +<command>, -<command> and +<command>|<subcommand> */
+func (s *Server) aclSetUserCommand(u *aclUser, name string, allow bool) error {
+	lname := strings.ToLower(name)
+	if cmd := s.commandMap[lname]; nil != cmd {
+		u.setCommandBit(cmd.id, allow)
+		delete(u.allowedSubcommands, cmd.id)
+		if !allow {
+			u.flags &= ^USER_FLAG_ALLCOMMANDS
+		}
+	} else {
+		/* Only allowing subcommands is supported, it's not possible
+		 * to disallow a subcommand of an allowed command. */
+		sep := strings.IndexByte(lname, '|')
+		if sep < 0 || !allow {
+			return errACLUnknownCommand
+		}
+		cmd := s.commandMap[lname[:sep]]
+		sub := lname[sep+1:]
+		if nil == cmd || sub == "" || strings.IndexByte(sub, '|') >= 0 {
+			return errACLUnknownCommand
+		}
+		if u.commandBit(cmd.id) {
+			return nil /* The whole command is already allowed. */
+		}
+		if nil == u.allowedSubcommands {
+			u.allowedSubcommands = make(map[int][]string)
+		}
+		u.allowedSubcommands[cmd.id] = append(u.allowedSubcommands[cmd.id], sub)
+	}
+	if allow {
+		u.updateCommandRules("+" + lname)
+	} else {
+		u.updateCommandRules("-" + lname)
+	}
+	return nil
+}
+
+// aclDescribeUser returns the rules that recreate the user
+func (s *Server) aclDescribeUser(u *aclUser) string {
+	var rules []string
+	if u.flags&USER_FLAG_ENABLED != 0 {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.flags&USER_FLAG_NOPASS != 0 {
+		rules = append(rules, "nopass")
+	}
+	for _, p := range u.passwords {
+		rules = append(rules, "#"+p)
+	}
+	rules = append(rules, aclDescribeKeyPatterns(u)...)
+	rules = append(rules, aclDescribeChannels(u)...)
+	rules = append(rules, aclDescribeCommandRules(u))
+	return strings.Join(rules, " ")
+}
+
+func aclDescribeKeyPatterns(u *aclUser) []string {
+	if u.flags&USER_FLAG_ALLKEYS != 0 {
+		return []string{"~*"}
+	}
+	var rules []string
+	for _, p := range u.patterns {
+		switch p.flags {
+		case ACL_ALL_PERMISSION:
+			rules = append(rules, "~"+p.pattern)
+		case ACL_READ_PERMISSION:
+			rules = append(rules, "%R~"+p.pattern)
+		case ACL_WRITE_PERMISSION:
+			rules = append(rules, "%W~"+p.pattern)
+		}
+	}
+	return rules
+}
+
+func aclDescribeChannels(u *aclUser) []string {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return []string{"&*"}
+	}
+	rules := []string{"resetchannels"}
+	for _, ch := range u.channels {
+		rules = append(rules, "&"+ch)
+	}
+	return rules
+}
+
+func aclDescribeCommandRules(u *aclUser) string {
+	return strings.Join(u.commandRules, " ")
+}
+
+/* ============================ Permission checks ========================== */
+
+// aclCheckCommandPerm checks if the user can run the command with the given
+// arguments. On ACL_DENIED_KEY and ACL_DENIED_CHANNEL, the index of the
+// offending argument is returned too.
+func aclCheckCommandPerm(u *aclUser, cmd *RedisCommand, argv [][]byte) (int, int) {
+	/* If there is no associated user, the connection can run anything. */
+	if nil == u {
+		return ACL_OK, 0
+	}
+
+	/* Check if the user can execute this command or if the command
+	 * doesn't need to be authenticated (hello, auth). */
+	if u.flags&USER_FLAG_ALLCOMMANDS == 0 && cmd.name != "auth" && cmd.name != "hello" &&
+		!u.commandBit(cmd.id) {
+		/* Check if the subcommand matches. */
+		if len(argv) < 2 {
+			return ACL_DENIED_CMD, 0
+		}
+		allowed := false
+		for _, sub := range u.allowedSubcommands[cmd.id] {
+			if strings.EqualFold(sub, string(argv[1])) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ACL_DENIED_CMD, 0
+		}
+	}
+
+	/* Check if the user can execute commands explicitly touching the keys
+	 * mentioned in the command arguments. */
+	if u.flags&USER_FLAG_ALLKEYS == 0 && (nil != cmd.getkeys_proc || cmd.firstkey != 0) {
+		perm := 0
+		if cmd.flags&CMD_READONLY != 0 {
+			perm |= ACL_READ_PERMISSION
+		}
+		if cmd.flags&CMD_WRITE != 0 {
+			perm |= ACL_WRITE_PERMISSION
+		}
+		if perm == 0 {
+			perm = ACL_ALL_PERMISSION
+		}
+		for _, pos := range getKeysFromCommand(cmd, argv) {
+			if !aclKeyAllowed(u, argv[pos], perm) {
+				return ACL_DENIED_KEY, pos
+			}
+		}
+	}
+
+	/* Check if the user can access the channels mentioned in the command
+	 * arguments. PSUBSCRIBE patterns must match a user pattern literally. */
+	if u.flags&USER_FLAG_ALLCHANNELS == 0 {
+		switch cmd.name {
+		case "publish":
+			if !aclChannelAllowed(u, argv[1], false) {
+				return ACL_DENIED_CHANNEL, 1
+			}
+		case "subscribe", "psubscribe":
+			for j := 1; j < len(argv); j++ {
+				if !aclChannelAllowed(u, argv[j], cmd.name == "psubscribe") {
+					return ACL_DENIED_CHANNEL, j
+				}
+			}
+		}
+	}
+	return ACL_OK, 0
+}
+
+func aclKeyAllowed(u *aclUser, key []byte, perm int) bool {
+	if u.flags&USER_FLAG_ALLKEYS != 0 {
+		return true
+	}
+	for _, p := range u.patterns {
+		if p.flags&perm == perm && util.StringMatch(util.StringToBytes(p.pattern), key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func aclChannelAllowed(u *aclUser, channel []byte, literal bool) bool {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return true
+	}
+	for _, pattern := range u.channels {
+		if literal {
+			if pattern == string(channel) {
+				return true
+			}
+		} else if util.StringMatch(util.StringToBytes(pattern), channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclDenied replies to a command refused by the ACLs and logs it
+func aclDenied(c *ClientConnection, cmd *RedisCommand, argv [][]byte, reason int, pos int, context string) {
+	switch reason {
+	case ACL_DENIED_CMD:
+		c.server.addACLLogEntry(c, reason, context, cmd.name, "")
+		c.addReplyErrorCode(ERR_NOPERM, fmt.Sprintf("this user has no permissions to run the '%s' command or its subcommand", cmd.name))
+	case ACL_DENIED_KEY:
+		c.server.addACLLogEntry(c, reason, context, string(argv[pos]), "")
+		c.addReplyErrorCode(ERR_NOPERM, "this user has no permissions to access one of the keys used as arguments")
+	case ACL_DENIED_CHANNEL:
+		c.server.addACLLogEntry(c, reason, context, string(argv[pos]), "")
+		c.addReplyErrorCode(ERR_NOPERM, "this user has no permissions to access one of the channels used as arguments")
+	}
+}
+
+// aclKillPubsubClientsIfNeeded disconnects the clients of the user that are
+// subscribed to channels or patterns the user can't access anymore
+func (s *Server) aclKillPubsubClientsIfNeeded(u *aclUser) {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return
+	}
+	for _, c := range s.clients {
+		if c.user != u || c.flags&CLIENT_PUBSUB == 0 {
+			continue
+		}
+		kill := false
+		for channel := range c.pubsubChannels {
+			if !aclChannelAllowed(u, []byte(channel), false) {
+				kill = true
+			}
+		}
+		for _, pattern := range c.pubsubPatterns {
+			if !aclChannelAllowed(u, []byte(pattern), true) {
+				kill = true
+			}
+		}
+		if kill {
+			c.freeClientAsync()
+		}
+	}
+}
+
+// aclKillUserClients disconnects the clients authenticated as the user
+func (s *Server) aclKillUserClients(u *aclUser) {
+	for _, c := range s.clients {
+		if c.user == u {
+			/* We'll free the connection asynchronously, so in theory to
+			 * set a different user is not needed. However if there are
+			 * bugs in Redis, soon or later this may result in some
+			 * security hole: it's much more defensive to set the
+			 * default user and put it in non authenticated mode. */
+			c.user = s.defaultUser
+			c.authenticated = false
+			c.freeClientAsync()
+		}
+	}
+}
+
+/* ============================ Authentication ============================= */
+
+// authRequired returns true if the client must authenticate first
+func authRequired(c *ClientConnection) bool {
+	du := c.server.defaultUser
+	return (du.flags&USER_FLAG_NOPASS == 0 || du.flags&USER_FLAG_DISABLED != 0) &&
+		!c.authenticated
+}
+
+// checkUserCredentials returns the user if the username and password are
+// valid, nil otherwise
+func (s *Server) checkUserCredentials(username []byte, password []byte) *aclUser {
+	u := s.users[string(username)]
+	if nil == u || u.flags&USER_FLAG_DISABLED != 0 {
+		return nil
+	}
+	if u.flags&USER_FLAG_NOPASS != 0 {
+		return u
+	}
+	hash := []byte(aclHashPassword(password))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			return u
+		}
+	}
+	return nil
+}
+
+// aclAuthenticate authenticates the client, or logs the failure
+func (s *Server) aclAuthenticate(c *ClientConnection, username []byte, password []byte) bool {
+	u := s.checkUserCredentials(username, password)
+	if nil == u {
+		s.addACLLogEntry(c, ACL_DENIED_AUTH, "toplevel", "AUTH", string(username))
+		return false
+	}
+	c.user = u
+	c.authenticated = true
+	return true
+}
+
+// aclUpdateDefaultUserPassword sets requirepass as password of the
+// default user, the empty password makes it nopass
+func (s *Server) aclUpdateDefaultUserPassword(password string) {
+	s.aclSetUser(s.defaultUser, "resetpass")
+	if password == "" {
+		s.aclSetUser(s.defaultUser, "nopass")
+	} else {
+		s.aclSetUser(s.defaultUser, ">"+password)
+	}
+}
+
+/* AUTH <password>
+ * AUTH <username> <password> */
+func authCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	/* Only two or three argument forms are allowed. */
+	if len(argv) > 3 {
+		c.addReplyBytes(shared.syntaxerr)
+		return
+	}
+
+	/* Handle the two different forms here. The form with two arguments
+	 * will just use "default" as username. */
+	var username, password []byte
+	if len(argv) == 2 {
+		/* Mimic the old behavior of giving an error for the two commands
+		 * from if no password is configured. */
+		if c.server.defaultUser.flags&USER_FLAG_NOPASS != 0 {
+			c.addReplyError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+			return
+		}
+		username = []byte("default")
+		password = argv[1]
+	} else {
+		username = argv[1]
+		password = argv[2]
+	}
+
+	if c.server.aclAuthenticate(c, username, password) {
+		c.addReplyBytes(shared.ok)
+	} else {
+		c.addReplyErrorCode(ERR_WRONGPASS, "invalid username-password pair or user is disabled.")
+	}
+}
+
+/* ================================ ACL LOG ================================ */
+
+const ACL_LOG_GROUPING_MAX_TIME_DELTA = 60000 /* Milliseconds */
+const ACL_LOG_MAX_LEN = 128                   /* acllog-max-len */
+
+/* Denied accesses by reason, reported by INFO stats */
+type aclInfo struct {
+	userAuthFailures       int64 /* Auth failure counts on user level */
+	invalidCmdAccesses     int64 /* Invalid command accesses that user doesn't have permission to */
+	invalidKeyAccesses     int64 /* Invalid key accesses that user doesn't have permission to */
+	invalidChannelAccesses int64 /* Invalid channel accesses that user doesn't have permission to */
+}
+
+func (info *aclInfo) update(reason int) {
+	switch reason {
+	case ACL_DENIED_AUTH:
+		info.userAuthFailures++
+	case ACL_DENIED_CMD:
+		info.invalidCmdAccesses++
+	case ACL_DENIED_KEY:
+		info.invalidKeyAccesses++
+	case ACL_DENIED_CHANNEL:
+		info.invalidChannelAccesses++
+	}
+}
+
+type aclLogEntry struct {
+	count    int64
+	reason   int
+	context  string /* toplevel or multi */
+	object   string /* The key name, command name or channel */
+	username string
+	ctime    int64  /* Milliseconds time of last update */
+	cinfo    string /* Client info of the last client that caused it */
+}
+
+// addACLLogEntry logs a denied command, key, channel or authentication
+// Entries identical to a recent one are grouped, the newest come first.
+func (s *Server) addACLLogEntry(c *ClientConnection, reason int, context string, object string, username string) {
+	s.aclInfo.update(reason)
+	if username == "" {
+		username = c.user.name
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, e := range s.aclLog {
+		if e.reason == reason && e.context == context && e.object == object &&
+			e.username == username && now-e.ctime < ACL_LOG_GROUPING_MAX_TIME_DELTA {
+			e.count++
+			e.ctime = now
+			e.cinfo = catClientInfoString(c)
+			return
+		}
+	}
+	entry := &aclLogEntry{1, reason, context, object, username, now, catClientInfoString(c)}
+	s.aclLog = append([]*aclLogEntry{entry}, s.aclLog...)
+	if len(s.aclLog) > ACL_LOG_MAX_LEN {
+		s.aclLog = s.aclLog[:ACL_LOG_MAX_LEN]
+	}
+}
+
+/* ACL LOG [<count> | RESET] */
+func aclLogCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	count := len(s.aclLog)
+	if len(argv) == 3 {
+		if strings.EqualFold(string(argv[2]), "reset") {
+			s.aclLog = nil
+			c.addReplyBytes(shared.ok)
+			return
+		}
+		n, err := strconv.ParseInt(string(argv[2]), 10, 64)
+		if err != nil || n < 0 {
+			c.addReplyError("value is out of range, must be positive")
+			return
+		}
+		if int(n) < count {
+			count = int(n)
+		}
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	c.addReplyArrayLen(count)
+	for _, e := range s.aclLog[:count] {
+		c.addReplyMapLen(7)
+		c.addReplyBulkString("count")
+		c.addReplyLongLong(e.count)
+		c.addReplyBulkString("reason")
+		switch e.reason {
+		case ACL_DENIED_CMD:
+			c.addReplyBulkString("command")
+		case ACL_DENIED_KEY:
+			c.addReplyBulkString("key")
+		case ACL_DENIED_CHANNEL:
+			c.addReplyBulkString("channel")
+		case ACL_DENIED_AUTH:
+			c.addReplyBulkString("auth")
+		}
+		c.addReplyBulkString("context")
+		c.addReplyBulkString(e.context)
+		c.addReplyBulkString("object")
+		c.addReplyBulkString(e.object)
+		c.addReplyBulkString("username")
+		c.addReplyBulkString(e.username)
+		c.addReplyBulkString("age-seconds")
+		c.addReplyDouble(float64(now-e.ctime) / 1000)
+		c.addReplyBulkString("client-info")
+		c.addReplyBulkString(e.cinfo)
+	}
+}
+
+/* ============================== ACL file ================================= */
+
+// aclLoadFromFile replaces the users with the ones of the aclfile
+// Nothing is changed if the file has errors.
+func (s *Server) aclLoadFromFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading ACLs, opening file '%s': %s", filename, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	for linenum := 1; scanner.Scan(); linenum++ {
+		line := strings.TrimSpace(scanner.Text())
+		/* Skip blank lines and comments */
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv := strings.Fields(line)
+		if argv[0] != "user" || len(argv) < 2 {
+			errs = append(errs, fmt.Sprintf("%s:%d: line should start with user keyword", filename, linenum))
+			continue
+		}
+		if _, ok := users[argv[1]]; ok {
+			errs = append(errs, fmt.Sprintf("%s:%d: Duplicate user '%s' found", filename, linenum, argv[1]))
+			continue
+		}
+		u := s.aclCreateUser(argv[1])
+		for _, rule := range argv[2:] {
+			if err := s.aclSetUser(u, rule); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %s", filename, linenum, err))
+				break
+			}
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error loading ACLs, reading file '%s': %s", filename, err)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, " "))
+	}
+
+	/* The default user always exists, the one of the file replaces it.
+	 * The clients keep their user, or are disconnected if it's gone. */
+	if _, ok := users["default"]; !ok {
+		users["default"] = s.defaultUser
+	}
+	old := s.users
+	s.users = users
+	s.defaultUser = users["default"]
+	for _, c := range s.clients {
+		if nil != c.user && old[c.user.name] == c.user {
+			if u, ok := users[c.user.name]; ok {
+				c.user = u
+				continue
+			}
+			c.user = s.defaultUser
+			c.authenticated = false
+			c.freeClientAsync()
+		}
+	}
+	return nil
+}
+
+// LoadACLUsersAtStartup loads the users of the aclfile of the
+// configuration, if any
+func (s *Server) LoadACLUsersAtStartup() error {
+	if s.aclFile == "" {
+		return nil
+	}
+	return s.aclLoadFromFile(s.aclFile)
+}
+
+// aclSaveToFile writes the users to the aclfile, replacing it atomically
+func (s *Server) aclSaveToFile(filename string) error {
+	var buf strings.Builder
+	for _, name := range s.aclUserNames() {
+		buf.WriteString("user " + name + " " + s.aclDescribeUser(s.users[name]) + "\n")
+	}
+
+	tmpfile := fmt.Sprintf("%s.tmp-%d", filename, os.Getpid())
+	if err := os.WriteFile(tmpfile, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) aclUserNames() []string {
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* ============================== ACL command ============================== */
+
+/* ACL -- show and modify the configuration of ACL users.
+ * ACL HELP
+ * ACL LOAD
+ * ACL SAVE
+ * ACL LIST
+ * ACL USERS
+ * ACL CAT [<category>]
+ * ACL SETUSER <username> ... acl rules ...
+ * ACL DELUSER <username> [...]
+ * ACL GETUSER <username>
+ * ACL GENPASS [<bits>]
+ * ACL WHOAMI
+ * ACL LOG [<count> | RESET]
+ * ACL DRYRUN <username> <command> [<arg> ...]
+ */
+func aclCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+	if sub == "setuser" && len(argv) >= 3 {
+		name := string(argv[2])
+		if strings.ContainsAny(name, " \t\r\n\x00") {
+			c.addReplyError("Usernames can't contain spaces or null characters")
+			return
+		}
+		/* Apply the rules to a copy, so that the user is unchanged
+		 * if a rule is invalid. */
+		u := s.aclCreateUser(name)
+		existing := s.users[name]
+		if nil != existing {
+			u.copyFrom(existing)
+		}
+		for _, op := range argv[3:] {
+			if err := s.aclSetUser(u, string(op)); err != nil {
+				c.addReplyErrorFormat("Error in ACL SETUSER modifier '%s': %s", string(op), err)
+				return
+			}
+		}
+		if nil != existing {
+			existing.copyFrom(u)
+			s.aclKillPubsubClientsIfNeeded(existing)
+		} else {
+			s.users[name] = u
+		}
+		c.addReplyBytes(shared.ok)
+	} else if sub == "deluser" && len(argv) >= 3 {
+		deleted := 0
+		for _, name := range argv[2:] {
+			if string(name) == "default" {
+				c.addReplyError("The 'default' user cannot be removed")
+				return
+			}
+		}
+		for _, name := range argv[2:] {
+			if u, ok := s.users[string(name)]; ok {
+				delete(s.users, string(name))
+				s.aclKillUserClients(u)
+				deleted++
+			}
+		}
+		c.addReplyLongLong(int64(deleted))
+	} else if sub == "getuser" && len(argv) == 3 {
+		u := s.users[string(argv[2])]
+		if nil == u {
+			c.addReplyNull()
+			return
+		}
+		c.addReplyMapLen(5)
+
+		c.addReplyBulkString("flags")
+		var flags []string
+		if u.flags&USER_FLAG_ENABLED != 0 {
+			flags = append(flags, "on")
+		} else {
+			flags = append(flags, "off")
+		}
+		if u.flags&USER_FLAG_ALLKEYS != 0 {
+			flags = append(flags, "allkeys")
+		}
+		if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+			flags = append(flags, "allchannels")
+		}
+		if u.flags&USER_FLAG_ALLCOMMANDS != 0 {
+			flags = append(flags, "allcommands")
+		}
+		if u.flags&USER_FLAG_NOPASS != 0 {
+			flags = append(flags, "nopass")
+		}
+		c.addReplySetLen(len(flags))
+		for _, flag := range flags {
+			c.addReplyBulkString(flag)
+		}
+
+		c.addReplyBulkString("passwords")
+		c.addReplyArrayLen(len(u.passwords))
+		for _, p := range u.passwords {
+			c.addReplyBulkString(p)
+		}
+
+		c.addReplyBulkString("commands")
+		c.addReplyBulkString(aclDescribeCommandRules(u))
+
+		c.addReplyBulkString("keys")
+		c.addReplyBulkString(strings.Join(aclDescribeKeyPatterns(u), " "))
+
+		c.addReplyBulkString("channels")
+		c.addReplyBulkString(strings.Join(aclDescribeChannels(u), " "))
+	} else if (sub == "list" || sub == "users") && len(argv) == 2 {
+		names := s.aclUserNames()
+		c.addReplyArrayLen(len(names))
+		for _, name := range names {
+			if sub == "users" {
+				c.addReplyBulkString(name)
+			} else {
+				c.addReplyBulkString("user " + name + " " + s.aclDescribeUser(s.users[name]))
+			}
+		}
+	} else if sub == "whoami" && len(argv) == 2 {
+		c.addReplyBulkString(c.user.name)
+	} else if sub == "load" && len(argv) == 2 {
+		if s.aclFile == "" {
+			c.addReplyError("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+			return
+		}
+		if err := s.aclLoadFromFile(s.aclFile); err != nil {
+			c.addReplyError(err.Error())
+			return
+		}
+		c.addReplyBytes(shared.ok)
+	} else if sub == "save" && len(argv) == 2 {
+		if s.aclFile == "" {
+			c.addReplyError("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+			return
+		}
+		if err := s.aclSaveToFile(s.aclFile); err != nil {
+			log.Warnf("Saving ACL file %s: %s", s.aclFile, err)
+			c.addReplyError("There was an error trying to save the ACLs. Please check the server logs for more information")
+			return
+		}
+		c.addReplyBytes(shared.ok)
+	} else if sub == "cat" && len(argv) == 2 {
+		c.addReplyArrayLen(len(ACLCommandCategories))
+		for _, category := range ACLCommandCategories {
+			c.addReplyBulkString(category.name)
+		}
+	} else if sub == "cat" && len(argv) == 3 {
+		category := ACLGetCommandCategoryFlagByName(string(argv[2]))
+		if category == 0 {
+			c.addReplyErrorFormat("Unknown category '%s'", string(argv[2]))
+			return
+		}
+		var names []string
+		for _, name := range s.sortedCommandNames() {
+			if s.commandMap[name].aclCategories()&category != 0 {
+				names = append(names, name)
+			}
+		}
+		c.addReplyArrayLen(len(names))
+		for _, name := range names {
+			c.addReplyBulkString(name)
+		}
+	} else if sub == "genpass" && (len(argv) == 2 || len(argv) == 3) {
+		bits := int64(256) /* By default generate 256 bits passwords. */
+		if len(argv) == 3 {
+			var err error
+			bits, err = strconv.ParseInt(string(argv[2]), 10, 64)
+			if err != nil || bits <= 0 || bits > 4096 {
+				c.addReplyError("ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+				return
+			}
+		}
+		chars := (bits + 3) / 4 /* Round to number of characters to emit. */
+		buf := make([]byte, (chars+1)/2)
+		if _, err := rand.Read(buf); err != nil {
+			c.addReplyError("Unable to generate a random password")
+			return
+		}
+		c.addReplyBulkString(hex.EncodeToString(buf)[:chars])
+	} else if sub == "log" && (len(argv) == 2 || len(argv) == 3) {
+		aclLogCommand(req, c)
+	} else if sub == "dryrun" && len(argv) >= 4 {
+		u := s.users[string(argv[2])]
+		if nil == u {
+			c.addReplyErrorFormat("User '%s' not found", string(argv[2]))
+			return
+		}
+		cmdArgv := argv[3:]
+		cmd := s.commandMap[strings.ToLower(string(cmdArgv[0]))]
+		if nil == cmd {
+			c.addReplyErrorFormat("Command '%s' not found", string(cmdArgv[0]))
+			return
+		}
+		if !cmd.checkArity(len(cmdArgv)) {
+			c.addReplyErrorFormat("wrong number of arguments for '%s' command", cmd.name)
+			return
+		}
+		switch reason, pos := aclCheckCommandPerm(u, cmd, cmdArgv); reason {
+		case ACL_DENIED_CMD:
+			c.addReplyBulkString(fmt.Sprintf("This user has no permissions to run the '%s' command", cmd.name))
+		case ACL_DENIED_KEY:
+			c.addReplyBulkString(fmt.Sprintf("This user has no permissions to access the '%s' key", cmdArgv[pos]))
+		case ACL_DENIED_CHANNEL:
+			c.addReplyBulkString(fmt.Sprintf("This user has no permissions to access the '%s' channel", cmdArgv[pos]))
+		default:
+			c.addReplyBytes(shared.ok)
+		}
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
+
+func (u *aclUser) copyFrom(src *aclUser) {
+	u.flags = src.flags
+	u.passwords = append([]string(nil), src.passwords...)
+	u.allowedCommands = append(u.allowedCommands[:0], src.allowedCommands...)
+	u.allowedSubcommands = nil
+	for id, subs := range src.allowedSubcommands {
+		if nil == u.allowedSubcommands {
+			u.allowedSubcommands = make(map[int][]string)
+		}
+		u.allowedSubcommands[id] = append([]string(nil), subs...)
+	}
+	u.commandRules = append([]string(nil), src.commandRules...)
+	u.patterns = append([]keyPattern(nil), src.patterns...)
+	u.channels = append([]string(nil), src.channels...)
+}
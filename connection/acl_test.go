@@ -0,0 +1,198 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// aclTestUser returns a new user with the rules applied
+func aclTestUser(t *testing.T, s *Server, rules string) *aclUser {
+	t.Helper()
+	u := s.aclCreateUser("test")
+	for _, rule := range strings.Fields(rules) {
+		if err := s.aclSetUser(u, rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+	return u
+}
+
+func TestACLSetUser(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string /* ACL LIST form of the user, or the error */
+	}{
+		{"", "off resetchannels -@all"},
+		{"on nopass", "on nopass resetchannels -@all"},
+		{"on >pw <pw", "on resetchannels -@all"},
+		{"<pw", "The password you are trying to remove from the user does not exist"},
+		{"#abc", "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"},
+		{"~a:* %R~r:* %W~w:* %RW~rw:*", "off ~a:* %R~r:* %W~w:* ~rw:* resetchannels -@all"},
+		{"%R~k %W~k", "off ~k resetchannels -@all"},
+		{"~a ~*", "off ~* resetchannels -@all"},
+		{"allkeys ~a", "Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns"},
+		{"%X~a", "Syntax error"},
+		{"%~a", "Syntax error"},
+		{"&news.* &news.*", "off resetchannels &news.* -@all"},
+		{"allchannels &a", "Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels"},
+		{"+@all -keys", "off resetchannels +@all -keys"},
+		{"+get +client|getname", "off resetchannels -@all +get +client|getname"},
+		{"+nosuch", "Unknown command or category name in ACL"},
+		{"-client|kill", "Unknown command or category name in ACL"},
+		{"+@nosuch", "Unknown command or category name in ACL"},
+		{"+", "Syntax error"},
+		{"bogus", "Syntax error"},
+		{"on ~* &* +@all reset", "off resetchannels -@all"},
+	}
+	for _, tt := range tests {
+		s := testServer(t)
+		u := s.aclCreateUser("test")
+		var err error
+		for _, rule := range strings.Fields(tt.rules) {
+			if err = s.aclSetUser(u, rule); err != nil {
+				break
+			}
+		}
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = s.aclDescribeUser(u)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q want %q", tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestACLCheckCommandPerm(t *testing.T) {
+	s := testServer(t)
+	u := aclTestUser(t, s, "on nopass ~app:* %R~ro:* %W~wo:* &news.* +@all -keys -client +client|getname")
+	tests := []struct {
+		argv   string
+		reason int
+		pos    int
+	}{
+		{"get app:1", ACL_OK, 0},
+		{"set app:1 v", ACL_OK, 0},
+		{"get ro:1", ACL_OK, 0},
+		{"set ro:1 v", ACL_DENIED_KEY, 1},
+		{"set wo:1 v", ACL_OK, 0},
+		{"get wo:1", ACL_DENIED_KEY, 1},
+		{"get other", ACL_DENIED_KEY, 1},
+		{"del app:1 ro:1", ACL_DENIED_KEY, 2},
+		{"keys *", ACL_DENIED_CMD, 0},
+		{"client getname", ACL_OK, 0},
+		{"client GETNAME", ACL_OK, 0},
+		{"client kill 1.2.3.4:5", ACL_DENIED_CMD, 0},
+		{"publish news.tech x", ACL_OK, 0},
+		{"publish other x", ACL_DENIED_CHANNEL, 1},
+		{"subscribe news.a other", ACL_DENIED_CHANNEL, 2},
+		/* Patterns must match a user pattern literally */
+		{"psubscribe news.*", ACL_OK, 0},
+		{"psubscribe news.a*", ACL_DENIED_CHANNEL, 1},
+		{"auth x", ACL_OK, 0},
+		{"ping", ACL_OK, 0},
+	}
+	for _, tt := range tests {
+		var argv [][]byte
+		for _, arg := range strings.Fields(tt.argv) {
+			argv = append(argv, []byte(arg))
+		}
+		cmd := s.commandMap[string(argv[0])]
+		if reason, pos := aclCheckCommandPerm(u, cmd, argv); reason != tt.reason || pos != tt.pos {
+			t.Errorf("%s: got %d at %d want %d at %d", tt.argv, reason, pos, tt.reason, tt.pos)
+		}
+	}
+
+	/* Nothing but auth and hello without commands */
+	u = aclTestUser(t, s, "on nopass allkeys allchannels")
+	for _, name := range []string{"get", "hello", "auth"} {
+		reason, _ := aclCheckCommandPerm(u, s.commandMap[name], [][]byte{[]byte(name), []byte("x")})
+		if want := name == "get"; (reason == ACL_DENIED_CMD) != want {
+			t.Errorf("%s: got %d", name, reason)
+		}
+	}
+}
+
+func TestACLClients(t *testing.T) {
+	s := testServer(t)
+	admin := testClient(t, s)
+	admin.send("ACL SETUSER app on >pw ~app:* &news.* +@read +publish +subscribe +multi +exec +acl|whoami\r\n")
+	admin.expect("+OK\r\n")
+
+	c := testClient(t, s)
+	c.send("AUTH app wrong\r\nAUTH app pw\r\nACL WHOAMI\r\nGET app:1\r\nGET other\r\nSET app:1 x\r\n" +
+		"PUBLISH news.a x\r\nPUBLISH other x\r\nMULTI\r\nGET other\r\nEXEC\r\n")
+	c.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n+OK\r\n$3\r\napp\r\n$-1\r\n" +
+		"-NOPERM this user has no permissions to access one of the keys used as arguments\r\n" +
+		"-NOPERM this user has no permissions to run the 'set' command or its subcommand\r\n" +
+		":0\r\n-NOPERM this user has no permissions to access one of the channels used as arguments\r\n" +
+		"+OK\r\n-NOPERM this user has no permissions to access one of the keys used as arguments\r\n" +
+		"-EXECABORT Transaction discarded because of previous errors.\r\n")
+
+	/* Revoked at EXEC time */
+	c.send("MULTI\r\nGET app:1\r\n")
+	c.expect("+OK\r\n+QUEUED\r\n")
+	admin.send("ACL SETUSER app resetkeys\r\n")
+	admin.expect("+OK\r\n")
+	c.send("EXEC\r\n")
+	c.expect("*1\r\n-NOPERM this user has no permissions to access one of the keys used as arguments\r\n")
+
+	/* A failed SETUSER leaves the user unchanged */
+	admin.send("ACL SETUSER app ~app:* bogus\r\nACL DRYRUN app get app:1\r\n")
+	admin.expect("-ERR Error in ACL SETUSER modifier 'bogus': Syntax error\r\n" +
+		"$54\r\nThis user has no permissions to access the 'app:1' key\r\n")
+
+	/* Removing the channel disconnects the subscribed clients */
+	sub := testClient(t, s)
+	sub.send("AUTH app pw\r\nSUBSCRIBE news.a\r\n")
+	sub.expect("+OK\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nnews.a\r\n:1\r\n")
+	admin.send("ACL SETUSER app resetchannels\r\n")
+	admin.expect("+OK\r\n")
+	if _, err := sub.r.ReadByte(); err == nil {
+		t.Fatal("the subscriber is still connected")
+	}
+
+	admin.send("ACL DELUSER default\r\nACL DELUSER app nobody\r\n")
+	admin.expect("-ERR The 'default' user cannot be removed\r\n:1\r\n")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("the client of the deleted user is still connected")
+	}
+}
+
+func TestACLSaveLoad(t *testing.T) {
+	s := testServer(t)
+	file := filepath.Join(t.TempDir(), "users.acl")
+	c := testClient(t, s)
+	c.command("CONFIG", "SET", "aclfile", file)
+	c.expect("+OK\r\n")
+	c.send("ACL SETUSER app on >pw %R~ro:* &news.* +get\r\nACL SAVE\r\n")
+	c.expect("+OK\r\n+OK\r\n")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "user app on #") ||
+		!strings.Contains(string(data), " %R~ro:* resetchannels &news.* -@all +get\n") {
+		t.Fatalf("saved:\n%s", data)
+	}
+
+	/* A file with an error is not loaded at all */
+	if err := os.WriteFile(file, append(data, "user bad on +nosuch\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.send("ACL LOAD\r\nACL USERS\r\n")
+	line := strconv.Itoa(strings.Count(string(data), "\n") + 1)
+	c.expect("-ERR " + file + ":" + line + ": Unknown command or category name in ACL\r\n")
+	c.expect("*2\r\n$3\r\napp\r\n$7\r\ndefault\r\n")
+
+	if err := os.WriteFile(file, []byte("user other on nopass ~* +@all\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.send("ACL LOAD\r\nACL USERS\r\n")
+	c.expect("+OK\r\n*2\r\n$7\r\ndefault\r\n$5\r\nother\r\n")
+}
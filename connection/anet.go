@@ -0,0 +1,107 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package connection
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const CONFIG_MIN_RESERVED_FDS = 32
+
+/* anetListenBacklog sets the backlog of the listening socket: calling
+ * listen(2) again on a listening socket updates it. */
+func anetListenBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := raw.Control(func(fd uintptr) { lerr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	return lerr
+}
+
+/* Check that server.tcp_backlog can be actually enforced in Linux according
+ * to the value of /proc/sys/net/core/somaxconn, or warn about it. */
+func checkTcpBacklogSettings(backlog int) {
+	data, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return
+	}
+	somaxconn, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && somaxconn > 0 && somaxconn < backlog {
+		log.Warnf("WARNING: The TCP backlog setting of %d cannot be enforced because /proc/sys/net/core/somaxconn is set to the lower value of %d.", backlog, somaxconn)
+	}
+}
+
+/* This function will try to raise the max number of open files accordingly to
+ * the configured max number of clients. It also reserves a number of file
+ * descriptors (CONFIG_MIN_RESERVED_FDS) for extra operations of
+ * persistence, listening sockets, log files and so forth.
+ *
+ * Returns the max number of clients the limit allows, maxclients when it
+ * could be raised enough, 0 or less when the limit is too low to run. */
+func adjustOpenFilesLimit(maxclients int) int {
+	maxfiles := uint64(maxclients) + CONFIG_MIN_RESERVED_FDS
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		log.Warnf("Unable to obtain the current NOFILE limit (%s), assuming 1024 and setting the max clients configuration accordingly.", err)
+		return 1024 - CONFIG_MIN_RESERVED_FDS
+	}
+	oldlimit := limit.Cur
+
+	/* Set the max number of files if the current limit is not enough
+	 * for our needs. */
+	if oldlimit >= maxfiles {
+		return maxclients
+	}
+
+	/* Try to set the file limit to match 'maxfiles' or at least
+	 * to the higher value supported less than maxfiles. */
+	bestlimit := maxfiles
+	var setErr error
+	for bestlimit > oldlimit {
+		limit.Cur = bestlimit
+		if limit.Max < bestlimit {
+			limit.Max = bestlimit
+		}
+		if setErr = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); setErr == nil {
+			break
+		}
+		/* We failed to set file limit to 'bestlimit'. Try with a
+		 * smaller limit decrementing by a few FDs per iteration. */
+		if bestlimit < 16 {
+			bestlimit = oldlimit
+			break
+		}
+		bestlimit -= 16
+	}
+	if bestlimit < oldlimit {
+		bestlimit = oldlimit
+	}
+	if bestlimit >= maxfiles {
+		log.Infof("Increased maximum number of open files to %d (it was originally set to %d).", maxfiles, oldlimit)
+		return maxclients
+	}
+
+	if bestlimit <= CONFIG_MIN_RESERVED_FDS {
+		log.Warnf("Your current 'ulimit -n' of %d is not enough for the server to start. Please increase your open file limit to at least %d.", oldlimit, maxfiles)
+		return int(bestlimit) - CONFIG_MIN_RESERVED_FDS
+	}
+	log.Warnf("You requested maxclients of %d requiring at least %d max file descriptors.", maxclients, maxfiles)
+	log.Warnf("Server can't set maximum open files to %d because of OS error: %v.", maxfiles, setErr)
+	log.Warnf("Current maximum open files is %d. maxclients has been reduced to %d to compensate for low ulimit. If you need higher maxclients increase 'ulimit -n'.", bestlimit, bestlimit-CONFIG_MIN_RESERVED_FDS)
+	return int(bestlimit - CONFIG_MIN_RESERVED_FDS)
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package connection
+
+import (
+	"net"
+)
+
+// anetListenBacklog is not available, the default backlog is used
+func anetListenBacklog(l net.Listener, backlog int) error {
+	return nil
+}
+
+func checkTcpBacklogSettings(backlog int) {
+}
+
+// adjustOpenFilesLimit leaves the limit to the operating system
+func adjustOpenFilesLimit(maxclients int) int {
+	return maxclients
+}
@@ -0,0 +1,178 @@
+package connection
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/proto"
+)
+
+/* Loading of the AOF on startup.
+ *
+ * The server is put in the loading state before it accepts clients, then
+ * the AOF is replayed in the background while the clients are served: the
+ * commands without the ok-loading flag are refused with -LOADING until the
+ * end of the replay, and INFO persistence reports the progress. Every
+ * command is replayed under s.mu, like the commands of the clients.
+ *
+ * The errors give the offset in the file of the command that could not be
+ * replayed: unknown commands, commands with a wrong number of arguments and
+ * commands replying with an error stop the loading, since skipping them
+ * would load a dataset different from the one that was saved. A file ending
+ * in the middle of a command or of a MULTI/EXEC transaction, like after a
+ * crash while writing it, is truncated to the last complete command when
+ * aof-load-truncated is set.
+ *
+ * When the loading fails the server stays in the loading state, and
+ * AbortStartup shuts it down. */
+
+// aofReader counts the bytes read from the AOF file
+type aofReader struct {
+	r   io.Reader
+	off int64
+}
+
+func (r *aofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+// StartLoading puts the server in the loading state ahead of
+// LoadFromDisk, so that the clients accepted before the replay starts get
+// -LOADING too. Does nothing if the server is already loading
+func (s *Server) StartLoading() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loading {
+		return
+	}
+	s.loading = true
+	s.loadingStartTime = time.Now()
+	s.loadingLoadedBytes = 0
+	s.loadingTotalBytes = 0
+	if fi, err := s.persistance.AofFile.Stat(); err == nil {
+		s.loadingTotalBytes = fi.Size()
+	}
+}
+
+func (s *Server) stopLoading() {
+	s.mu.Lock()
+	s.loading = false
+	s.mu.Unlock()
+}
+
+// LoadFromDisk replays the commands of the AOF file, returns an error if
+// the file can't be loaded
+func (s *Server) LoadFromDisk() error {
+	s.StartLoading()
+	if err := s.loadAppendOnlyFile(); err != nil {
+		return err
+	}
+	s.stopLoading()
+	return nil
+}
+
+// loadAppendOnlyFile replays the AOF file, in the loading state
+func (s *Server) loadAppendOnlyFile() error {
+	filename := s.persistance.AofFile.Name()
+	counter := &aofReader{r: s.persistance.AofFile}
+	reader := bufio.NewReader(counter)
+	cc := new(ClientConnection)
+	cc.server = s
+	cc.cache = s.cache[0]
+	cc.resp = 2
+	cc.authenticated = true
+	request := new(proto.Request)
+
+	/* Offset of the end of the last command replayed, and of the last
+	 * command outside of a transaction */
+	var validUpTo, validBeforeMulti int64
+	shortRead := false
+	for {
+		validUpTo = counter.off - int64(reader.Buffered())
+		if cc.flags&CLIENT_MULTI == 0 {
+			validBeforeMulti = validUpTo
+		}
+		err := proto.ReadRequest(reader, request)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			shortRead = validUpTo != counter.off
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Bad file format reading the append only file %s at offset %d: %s",
+				filename, validUpTo, err)
+		}
+		if request.CommandLength() == 0 {
+			continue
+		}
+
+		s.mu.Lock()
+		cmd := s.commandMap[string(request.Argv()[0])]
+		if nil == cmd {
+			s.mu.Unlock()
+			return fmt.Errorf("Unknown command '%s' reading the append only file %s at offset %d",
+				request.Command(), filename, validUpTo)
+		}
+		if !cmd.checkArity(request.CommandLength()) {
+			s.mu.Unlock()
+			return fmt.Errorf("Bad file format reading the append only file %s at offset %d: "+
+				"wrong number of arguments for '%s' command", filename, validUpTo, request.Command())
+		}
+
+		/* The replies of the fake client are discarded, the error replies
+		 * are counted though. */
+		errorReplies := s.statTotalErrorReplies
+		s.ProcessCommands(request, cc)
+		if s.statTotalErrorReplies != errorReplies {
+			s.mu.Unlock()
+			return fmt.Errorf("Error replaying the command '%s' reading the append only file %s at offset %d",
+				request.Command(), filename, validUpTo)
+		}
+		s.loadingLoadedBytes = counter.off - int64(reader.Buffered())
+		s.mu.Unlock()
+	}
+
+	/* If the client is in the middle of a MULTI/EXEC, handle it as it was
+	 * a short read, even if technically the protocol is correct: we want
+	 * to remove the unprocessed tail and continue. */
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if shortRead || cc.flags&CLIENT_MULTI != 0 {
+		if err := s.aofTruncatedTail(cc, filename, validUpTo, validBeforeMulti); err != nil {
+			return err
+		}
+	}
+	log.Infof("DB loaded from append only file: %.3f seconds", time.Since(s.loadingStartTime).Seconds())
+	return nil
+}
+
+// aofTruncatedTail handles an AOF file ending in the middle of a command,
+// or of a transaction: the incomplete tail is removed when
+// aof-load-truncated is set. Must be called with s.mu held
+func (s *Server) aofTruncatedTail(cc *ClientConnection, filename string, validUpTo, validBeforeMulti int64) error {
+	if cc.flags&CLIENT_MULTI != 0 {
+		log.Warnf("Revert incomplete MULTI/EXEC transaction in AOF file %s", filename)
+		discardTransaction(cc)
+		validUpTo = validBeforeMulti
+	}
+	if s.aofLoadTruncated {
+		log.Warnf("!!! Warning: short read while loading the AOF file %s!!!", filename)
+		log.Warnf("!!! Truncating the AOF %s at offset %d !!!", filename, validUpTo)
+		/* The file is opened in append mode: the next writes go to the
+		 * new end of the file. */
+		if err := s.persistance.AofFile.Truncate(validUpTo); err != nil {
+			log.Warnf("Error truncating the AOF file %s: %s", filename, err)
+		} else {
+			log.Warnf("AOF %s loaded anyway because aof-load-truncated is enabled", filename)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unexpected end of file reading the append only file %s at offset %d. "+
+		"You can: 1) Make a backup of your AOF file, then truncate it at offset %d. "+
+		"2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server.",
+		filename, validUpTo, validUpTo)
+}
@@ -0,0 +1,146 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valarpirai/vardis/cache"
+)
+
+// aofServer returns a server with an AOF holding content
+func aofServer(t *testing.T, content string) *Server {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := cache.NewStorage(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(0, cache.NewCache(), p)
+}
+
+const aofSetA = "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n" /* 27 bytes */
+
+func TestLoadFromDiskErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"protocol error", aofSetA + aofSetA + "*1\r\n+x\r\n" + aofSetA,
+			"Bad file format reading the append only file %s at offset 54: Protocol error"},
+		{"unknown command", aofSetA + "*1\r\n$4\r\nnope\r\n",
+			"Unknown command 'nope' reading the append only file %s at offset 27"},
+		{"wrong arity", aofSetA + "*2\r\n$3\r\nset\r\n$1\r\nb\r\n",
+			"Bad file format reading the append only file %s at offset 27: wrong number of arguments for 'set' command"},
+		{"error reply", aofSetA + "*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n" +
+			"*4\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n$2\r\nEX\r\n",
+			"Error replaying the command 'set' reading the append only file %s at offset 81"},
+		{"error reply in a transaction", "*1\r\n$5\r\nmulti\r\n*4\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n1\r\n$2\r\nEX\r\n" +
+			aofSetA + "*1\r\n$4\r\nexec\r\n",
+			"Error replaying the command 'exec' reading the append only file %s at offset 77"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := aofServer(t, tt.content)
+			err := s.LoadFromDisk()
+			want := strings.Replace(tt.err, "%s", s.persistance.AofFile.Name(), 1)
+			if nil == err || !strings.HasPrefix(err.Error(), want) {
+				t.Fatalf("got %v want %q", err, want)
+			}
+			/* The server is going down, it must not serve the clients */
+			if !s.loading {
+				t.Error("loading ended after an error")
+			}
+		})
+	}
+}
+
+func TestLoadFromDiskTruncated(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		truncated bool /* aof-load-truncated */
+		want      string
+		err       string
+	}{
+		{"short read", aofSetA + "*3\r\n$3\r\nset\r\n$1\r\nb", true, aofSetA, ""},
+		{"incomplete transaction", aofSetA + "*1\r\n$5\r\nmulti\r\n" + aofSetA, true, aofSetA, ""},
+		{"short read not truncated", aofSetA + "*3\r\n$3\r\nset\r\n$1\r\nb", false, "",
+			"Unexpected end of file reading the append only file %s at offset 27."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := aofServer(t, tt.content)
+			s.aofLoadTruncated = tt.truncated
+			err := s.LoadFromDisk()
+			if tt.err != "" {
+				want := strings.Replace(tt.err, "%s", s.persistance.AofFile.Name(), 1)
+				if nil == err || !strings.HasPrefix(err.Error(), want) {
+					t.Fatalf("got %v want %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readAOF(t, s); got != tt.want {
+				t.Errorf("AOF: got %q want %q", got, tt.want)
+			}
+			if s.loading || s.cache[0].Exists("a") != 1 || s.cache[0].Exists("b") != 0 {
+				t.Errorf("loading %v, a %d, b %d", s.loading, s.cache[0].Exists("a"), s.cache[0].Exists("b"))
+			}
+		})
+	}
+}
+
+func TestLoadingRefusesCommands(t *testing.T) {
+	s := aofServer(t, aofSetA)
+	s.StartLoading()
+	c := testClient(t, s)
+	c.send("GET a\r\nMULTI\r\n")
+	c.expect("-LOADING Redis is loading the dataset in memory\r\n" +
+		"-LOADING Redis is loading the dataset in memory\r\n")
+	c.send("INFO persistence\r\n")
+	if info := c.bulk(); !strings.Contains(info, "loading:1\r\n") || !strings.Contains(info, "loading_eta_seconds:") {
+		t.Errorf("INFO persistence: %q", info)
+	}
+	if err := s.LoadFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+	c.send("GET a\r\n")
+	c.expect("$1\r\n1\r\n")
+}
+
+func TestAbortStartup(t *testing.T) {
+	/* Before Start: no client is ever accepted */
+	s := testServer(t)
+	s.AbortStartup()
+	s.PORT = freePort(t)
+	s.bindaddr = []string{"127.0.0.1"}
+	if code := s.Start(); code != 1 {
+		t.Errorf("exit status %d", code)
+	}
+	if nil != s.listeners {
+		t.Error("listening after the startup was aborted")
+	}
+
+	/* While serving: the clients are closed and Start returns */
+	s = testServer(t)
+	s.StartLoading()
+	status := startServer(t, s)
+	c := dialServer(t, s)
+	c.send("GET a\r\n")
+	c.expect("-LOADING Redis is loading the dataset in memory\r\n")
+	s.AbortStartup()
+	if code := waitStatus(t, status); code != 1 {
+		t.Errorf("exit status %d", code)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("client still connected")
+	}
+}
@@ -0,0 +1,102 @@
+package connection
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("AUTH x\r\nAUTH a b c\r\nCONFIG SET requirepass secret\r\nGET a\r\n")
+	c.expect("-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n" +
+		"-ERR syntax error\r\n+OK\r\n$-1\r\n")
+
+	tests := []struct {
+		name     string
+		requests string
+		replies  string
+	}{
+		{"not authenticated", "GET a\r\nPING\r\n", "-NOAUTH Authentication required.\r\n-NOAUTH Authentication required.\r\n"},
+		{"wrong password", "AUTH bad\r\nGET a\r\n",
+			"-WRONGPASS invalid username-password pair or user is disabled.\r\n-NOAUTH Authentication required.\r\n"},
+		{"unknown user", "AUTH nobody secret\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{"password", "AUTH secret\r\nGET a\r\n", "+OK\r\n$-1\r\n"},
+		{"user and password", "AUTH default secret\r\nGET a\r\n", "+OK\r\n$-1\r\n"},
+		/* HELLO doesn't authenticate the client without its AUTH option,
+		 * and must not switch the protocol nor set the name */
+		{"hello", "HELLO 3\r\nHELLO 3 SETNAME x\r\nAUTH secret\r\nGET a\r\nCLIENT GETNAME\r\n",
+			"-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n" +
+				"-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n" +
+				"+OK\r\n$-1\r\n$-1\r\n"},
+		{"hello wrong password", "HELLO 3 AUTH default bad\r\nGET a\r\n",
+			"-WRONGPASS invalid username-password pair or user is disabled.\r\n-NOAUTH Authentication required.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, s)
+			c.send(tt.requests)
+			c.expect(tt.replies)
+		})
+	}
+
+	/* HELLO AUTH authenticates before the name is set */
+	c = testClient(t, s)
+	c.send("HELLO 2 AUTH default secret SETNAME app\r\nGET a\r\nCLIENT GETNAME\r\n")
+	c.skip("$6\r\n")
+	c.skip("modules\r\n")
+	c.expect("*0\r\n$-1\r\n$3\r\napp\r\n")
+}
+
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestProtectedMode(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5}
+	tests := []struct {
+		name   string
+		config func(s *Server)
+		addr   net.Addr
+		refuse bool
+	}{
+		{"remote", nil, remote, true},
+		{"loopback", nil, local, false},
+		{"ipv6 loopback", nil, &net.TCPAddr{IP: net.IPv6loopback}, false},
+		{"unix socket", nil, &net.UnixAddr{Name: "/tmp/redis.sock", Net: "unix"}, false},
+		{"disabled", func(s *Server) { s.protectedMode = false }, remote, false},
+		{"bind", func(s *Server) { s.bindaddr = []string{"10.1.2.1"} }, remote, false},
+		{"password", func(s *Server) { s.defaultUser.flags &^= USER_FLAG_NOPASS }, remote, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			if nil != tt.config {
+				tt.config(s)
+			}
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			refused := make(chan bool, 1)
+			go func() { refused <- s.protectedModeRefuses(&remoteConn{a, tt.addr}) }()
+			b.SetDeadline(time.Now().Add(2 * time.Second))
+			if tt.refuse {
+				line, err := bufio.NewReader(b).ReadString('\n')
+				if err != nil || line != string(protectedModeErr) {
+					t.Fatalf("got %q, %v", line, err)
+				}
+			}
+			if got := <-refused; got != tt.refuse {
+				t.Fatalf("refused: got %v want %v", got, tt.refuse)
+			}
+		})
+	}
+}
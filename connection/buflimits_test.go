@@ -0,0 +1,179 @@
+package connection
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckClientOutputBufferLimits(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		pubsub    bool
+		used      int
+		reachedAt int64 /* Seconds ago the soft limit was reached, -1 for never */
+		want      bool
+		timer     bool /* The soft limit timer is running after the check */
+	}{
+		{"under the limits", false, 49, -1, false, false},
+		{"hard limit", false, 100, -1, true, true},
+		{"soft limit reached", false, 50, -1, false, true},
+		{"soft limit for less than the seconds", false, 60, 10, false, true},
+		{"soft limit for more than the seconds", false, 60, 11, true, true},
+		{"back under the soft limit", false, 49, 11, false, false},
+		{"pubsub limits", true, 60, -1, true, false},
+	}
+	s := testServer(t)
+	s.clientObufLimits[CLIENT_TYPE_NORMAL] = clientBufferLimits{100, 50, 10}
+	s.clientObufLimits[CLIENT_TYPE_PUBSUB] = clientBufferLimits{60, 0, 0}
+	for _, tt := range tests {
+		c := &ClientConnection{server: s}
+		if tt.pubsub {
+			c.flags |= CLIENT_PUBSUB
+		}
+		if tt.reachedAt >= 0 {
+			c.obufSoftLimitReachedTime = now - tt.reachedAt
+		}
+		if got := checkClientOutputBufferLimits(c, tt.used); got != tt.want {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+		if timer := c.obufSoftLimitReachedTime != 0; timer != tt.timer {
+			t.Errorf("%s: soft limit timer running %v want %v", tt.name, timer, tt.timer)
+		}
+	}
+}
+
+func TestClientOutputBufferLimitConfig(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("CONFIG SET client-output-buffer-limit \"pubsub 64mb 16mb 30 replica 1gb 0 0\"\r\n")
+	c.expect("+OK\r\n")
+	c.send("CONFIG GET client-output-buffer-limit\r\n")
+	c.expect("*2\r\n$26\r\nclient-output-buffer-limit\r\n")
+	if got, want := c.bulk(), "normal 0 0 0 slave 1073741824 0 0 pubsub 67108864 16777216 30"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		val, err string
+	}{
+		{"master 1 1 1", "Invalid client class specified in buffer limit configuration."},
+		{"nosuch 1 1 1", "Invalid client class specified in buffer limit configuration."},
+		{"normal 1 1", "Wrong number of arguments in buffer limit configuration."},
+		{"normal 1x 1 1", "Error in hard, soft or soft_seconds setting in buffer limit configuration."},
+		{"normal 1 1 -1", "Error in hard, soft or soft_seconds setting in buffer limit configuration."},
+		/* The classes before the bad one are not changed either */
+		{"normal 1 1 1 pubsub 1 1", "Wrong number of arguments in buffer limit configuration."},
+	} {
+		c.command("CONFIG", "SET", "client-output-buffer-limit", tt.val)
+		c.expect("-ERR CONFIG SET failed (possibly related to argument 'client-output-buffer-limit') - " + tt.err + "\r\n")
+	}
+	s.mu.Lock()
+	if limits := s.clientObufLimits[CLIENT_TYPE_NORMAL]; limits != (clientBufferLimits{}) {
+		t.Errorf("normal limits changed to %+v", limits)
+	}
+	s.mu.Unlock()
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	s := testServer(t)
+	admin := testClient(t, s)
+	admin.send("CONFIG SET client-output-buffer-limit \"normal 1mb 0 0\"\r\n")
+	admin.expect("+OK\r\n")
+	admin.command("SET", "k", strings.Repeat("v", 400000))
+	admin.expect("+OK\r\n")
+
+	/* The replies of a client not reading them pile up in its buffer */
+	c := testClient(t, s)
+	c.send(strings.Repeat("GET k\r\n", 6))
+	waitFor(t, s, "the client to be closed", func() bool { return s.statClientObufLimitDisconn == 1 })
+	if _, err := io.Copy(io.Discard, c.r); err != nil {
+		t.Errorf("got %v, want the client closed", err)
+	}
+	admin.send("PING\r\n")
+	admin.expect("+PONG\r\n")
+}
+
+func TestQueryBufferLimit(t *testing.T) {
+	s := testServer(t)
+	admin := testClient(t, s)
+	admin.send("CONFIG SET client-query-buffer-limit 1mb proto-max-bulk-len 1mb\r\n")
+	admin.expect("+OK\r\n")
+
+	c := testClient(t, s)
+	c.send("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$2000000\r\n")
+	c.expect("-ERR Protocol error: invalid bulk length\r\n")
+
+	/* Every argument is under proto-max-bulk-len, but not the request */
+	big := strings.Repeat("x", 600000)
+	c = testClient(t, s)
+	c.command("SET", big, big)
+	if got, err := io.ReadAll(c.r); err != nil || len(got) != 0 {
+		t.Errorf("got %q, %v want the client closed", got, err)
+	}
+	waitFor(t, s, "the disconnection", func() bool { return s.statClientQbufLimitDisconn == 1 })
+}
+
+func TestProtoMaxBulkLen(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	/* A bulk over 512mb could be stored but not sent back */
+	c.send("CONFIG SET proto-max-bulk-len 1gb\r\nCONFIG GET proto-max-bulk-len\r\n")
+	c.expect("-ERR CONFIG SET failed (possibly related to argument 'proto-max-bulk-len') - " +
+		"argument must be between 1048576 and 536870912 inclusive\r\n" +
+		"*2\r\n$18\r\nproto-max-bulk-len\r\n$9\r\n536870912\r\n")
+
+	c.send("CONFIG SET proto-max-bulk-len 2mb\r\n")
+	c.expect("+OK\r\n")
+	big := strings.Repeat("x", 2*1024*1024)
+	c.command("SET", "k", big)
+	c.expect("+OK\r\n")
+	c.send("GET k\r\n")
+	if got := c.bulk(); got != big {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
+
+func TestEvictClients(t *testing.T) {
+	s := testServer(t)
+	admin := testClient(t, s)
+	admin.send("CLIENT NO-EVICT on\r\n")
+	admin.expect("+OK\r\n")
+	s.mu.Lock()
+	s.cache[0].Set("k", []byte(strings.Repeat("v", 400000)))
+	s.mu.Unlock()
+
+	small := testClient(t, s)
+	small.send("CLIENT SETNAME small\r\n")
+	small.expect("+OK\r\n")
+	big := testClient(t, s)
+	big.send("CLIENT SETNAME big\r\nGET k\r\nGET k\r\n")
+	big.expect("+OK\r\n")
+	waitFor(t, s, "the replies to be queued", func() bool {
+		for _, c := range s.clients {
+			if c.name == "big" {
+				return getClientMemoryUsage(c) > 400000
+			}
+		}
+		return false
+	})
+
+	s.mu.Lock()
+	s.evictClients() /* No limit with maxmemory-clients 0 */
+	s.maxmemoryClients = 200 * 1024
+	s.evictClients()
+	evicted := s.statEvictedClients
+	s.mu.Unlock()
+
+	/* The biggest client goes first, then the total is under the limit */
+	if evicted != 1 {
+		t.Errorf("%d clients evicted", evicted)
+	}
+	io.Copy(io.Discard, big.r)
+	small.send("PING\r\n")
+	small.expect("+PONG\r\n")
+	admin.send("PING\r\n")
+	admin.expect("+PONG\r\n")
+}
@@ -0,0 +1,151 @@
+package connection
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests string
+		replies  string
+	}{
+		{"id", "CLIENT ID\r\n", ":1\r\n"},
+		{"name", "CLIENT GETNAME\r\nCLIENT SETNAME worker\r\nCLIENT GETNAME\r\nCLIENT SETNAME \"\"\r\nCLIENT GETNAME\r\n",
+			"$-1\r\n+OK\r\n$6\r\nworker\r\n+OK\r\n$-1\r\n"},
+		{"bad name", "CLIENT SETNAME \"a b\"\r\nCLIENT SETNAME \"a\\nb\"\r\n",
+			"-ERR Client names cannot contain spaces, newlines or special characters.\r\n" +
+				"-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{"setinfo", "CLIENT SETINFO lib-name go-redis\r\nCLIENT SETINFO lib-ver 9.0\r\nCLIENT SETINFO foo x\r\n",
+			"+OK\r\n+OK\r\n-ERR Unrecognized option 'foo'\r\n"},
+		{"reply off", "CLIENT REPLY OFF\r\nSET a 1\r\nCLIENT REPLY ON\r\nGET a\r\n", "+OK\r\n$1\r\n1\r\n"},
+		{"reply skip", "CLIENT REPLY SKIP\r\nSET a 1\r\nGET a\r\n", "$1\r\n1\r\n"},
+		{"reply syntax", "CLIENT REPLY MAYBE\r\n", "-ERR syntax error\r\n"},
+		{"list type", "CLIENT LIST TYPE foo\r\n", "-ERR Unknown client type 'foo'\r\n"},
+		{"list id", "CLIENT LIST ID 0\r\nCLIENT LIST ID 2\r\n", "-ERR Invalid client ID\r\n$0\r\n\r\n"},
+		{"kill syntax", "CLIENT KILL ID 0\r\nCLIENT KILL TYPE foo\r\nCLIENT KILL USER nobody\r\n" +
+			"CLIENT KILL SKIPME maybe\r\nCLIENT KILL MAXAGE 0\r\nCLIENT KILL 1.2.3.4:5\r\nCLIENT KILL ID 7\r\n",
+			"-ERR client-id should be greater than 0\r\n-ERR Unknown client type 'foo'\r\n-ERR No such user 'nobody'\r\n" +
+				"-ERR syntax error\r\n-ERR maxage should be greater than 0\r\n-ERR No such client\r\n:0\r\n"},
+		{"unknown", "CLIENT FOO\r\n", "-ERR Unknown subcommand or wrong number of arguments for 'FOO'. Try CLIENT HELP.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, testServer(t))
+			c.send(tt.requests)
+			c.expect(tt.replies)
+		})
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	s := testServer(t)
+	a := testClient(t, s)
+	b := testClient(t, s)
+	a.send("CLIENT SETNAME worker\r\nCLIENT SETINFO lib-name go-redis\r\nMULTI\r\nGET x\r\n")
+	a.expect("+OK\r\n+OK\r\n+OK\r\n+QUEUED\r\n")
+	b.send("SUBSCRIBE ch\r\n")
+	b.skip(":1\r\n")
+
+	a.send("CLIENT INFO\r\n")
+	a.expect("+QUEUED\r\n")
+	a.send("EXEC\r\nCLIENT INFO\r\n")
+	a.skip("$-1\r\n") /* EXEC: *2, GET x, then CLIENT INFO in the transaction */
+	a.bulk()
+	info := a.bulk()
+	for _, field := range []string{"id=1 addr=pipe laddr=pipe ", " name=worker ", " flags=N ", " multi=-1 ",
+		" user=default ", " lib-name=go-redis ", " cmd=client", " resp=2"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("CLIENT INFO: %q lacks %q", info, field)
+		}
+	}
+
+	a.send("CLIENT LIST\r\nCLIENT LIST TYPE pubsub\r\nCLIENT LIST ID 2 3\r\n")
+	if list := a.bulk(); strings.Count(list, "\n") != 2 || !strings.HasPrefix(list, "id=1 ") {
+		t.Errorf("CLIENT LIST: %q", list)
+	}
+	for j := 0; j < 2; j++ {
+		if list := a.bulk(); strings.Count(list, "\n") != 1 || !strings.HasPrefix(list, "id=2 ") ||
+			!strings.Contains(list, " flags=P ") || !strings.Contains(list, " sub=1 ") {
+			t.Errorf("CLIENT LIST: %q", list)
+		}
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	tests := []struct {
+		name   string
+		kill   string
+		reply  string
+		killed []bool /* Clients 1 (the killer), 2 and 3 */
+	}{
+		{"id", "CLIENT KILL ID 2\r\n", ":1\r\n", []bool{false, true, false}},
+		{"type", "CLIENT KILL TYPE pubsub\r\n", ":1\r\n", []bool{false, false, true}},
+		{"type skipme", "CLIENT KILL TYPE normal\r\n", ":1\r\n", []bool{false, true, false}},
+		{"type skipme no", "CLIENT KILL TYPE normal SKIPME no\r\n", ":2\r\n", []bool{true, true, false}},
+		{"user", "CLIENT KILL USER app\r\n", ":1\r\n", []bool{false, true, false}},
+		{"filters", "CLIENT KILL USER app TYPE pubsub\r\n", ":0\r\n", []bool{false, false, false}},
+		{"addr", "CLIENT KILL ADDR pipe\r\n", ":2\r\n", []bool{false, true, true}},
+		{"old form", "CLIENT KILL pipe\r\n", "+OK\r\n", []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			c := []*testConn{testClient(t, s), testClient(t, s), testClient(t, s)}
+			c[0].send("ACL SETUSER app on nopass allkeys +@all\r\n")
+			c[0].expect("+OK\r\n")
+			c[1].send("AUTH app x\r\n")
+			c[1].expect("+OK\r\n")
+			c[2].send("SUBSCRIBE ch\r\n")
+			c[2].skip(":1\r\n")
+			c[0].send(tt.kill)
+			c[0].expect(tt.reply)
+			for j, killed := range tt.killed {
+				c[j].send("PING\r\n")
+				_, err := c[j].r.ReadString('\n')
+				if (err != nil) != killed {
+					t.Errorf("client %d: killed %v, want %v", j+1, err != nil, killed)
+				}
+			}
+		})
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	s := testServer(t)
+	a := testClient(t, s)
+	b := testClient(t, s)
+	a.send("CLIENT PAUSE 200 WRITE\r\n")
+	a.expect("+OK\r\n")
+
+	/* Reads go through, writes wait for the end of the pause */
+	start := time.Now()
+	b.send("GET a\r\n")
+	b.expect("$-1\r\n")
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("read paused")
+	}
+	b.send("SET a 1\r\n")
+	b.expect("+OK\r\n")
+	if time.Since(start) < 150*time.Millisecond {
+		t.Error("write not paused")
+	}
+
+	/* UNPAUSE releases the waiting clients */
+	a.send("CLIENT PAUSE 10000 WRITE\r\n")
+	a.expect("+OK\r\n")
+	start = time.Now()
+	b.send("SET a 2\r\n")
+	time.Sleep(50 * time.Millisecond)
+	a.send("CLIENT UNPAUSE\r\n")
+	a.expect("+OK\r\n")
+	b.expect("+OK\r\n")
+	if time.Since(start) > time.Second {
+		t.Error("not unpaused")
+	}
+
+	a.send("CLIENT PAUSE -1\r\nCLIENT PAUSE 10 FOO\r\n")
+	a.expect("-ERR timeout is not an integer or out of range\r\n-ERR CLIENT PAUSE mode must be WRITE or ALL\r\n")
+}
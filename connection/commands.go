@@ -1,12 +1,11 @@
 package connection
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"sort"
 	"strings"
 
+	"github.com/valarpirai/vardis/commands"
 	"github.com/valarpirai/vardis/proto"
 )
 
@@ -141,7 +140,9 @@ type RedisCommand struct {
 }
 
 type redisCommandProc func(req *proto.Request, conn *ClientConnection)
-type redisGetKeysProc func(cmd *RedisCommand, argc int, numkeys int)
+
+/* Returns the positions of the key arguments in argv */
+type redisGetKeysProc func(cmd *RedisCommand, argv [][]byte) []int
 
 var redisCommandTable = []*RedisCommand{
 	// {"module", moduleCommand, -2,
@@ -592,9 +593,9 @@ var redisCommandTable = []*RedisCommand{
 	// 	"read-only fast @keyspace",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"auth", authCommand, -2,
-	// 	"no-script ok-loading ok-stale fast no-monitor no-slowlog @connection",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"auth", authCommand, -2,
+		"no-script ok-loading ok-stale fast no-slowlog @connection",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// /* We don't allow PING during loading since in Redis PING is used as
 	//  * failure detection, and a loading server is considered to be
@@ -619,9 +620,9 @@ var redisCommandTable = []*RedisCommand{
 	// 	"admin no-script",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"shutdown", shutdownCommand, -1,
-	// 	"admin no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"shutdown", shutdownCommand, -1,
+		"admin no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"lastsave", lastsaveCommand, 1,
 	// 	"read-only random fast @admin @dangerous",
@@ -631,17 +632,17 @@ var redisCommandTable = []*RedisCommand{
 	// 	"read-only fast @keyspace",
 	// 	0, nil, 1, 1, 1, 0, 0, 0},
 
-	// {"multi", multiCommand, 1,
-	// 	"no-script fast @transaction",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"multi", multiCommand, 1,
+		"no-script fast @transaction",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"exec", execCommand, 1,
-	// 	"no-script no-monitor no-slowlog @transaction",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"exec", execCommand, 1,
+		"no-script no-slowlog @transaction",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"discard", discardCommand, 1,
-	// 	"no-script fast @transaction",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"discard", discardCommand, 1,
+		"no-script fast @transaction",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"sync", syncCommand, 1,
 	// 	"admin no-script",
@@ -655,25 +656,25 @@ var redisCommandTable = []*RedisCommand{
 	// 	"admin no-script ok-loading ok-stale",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"flushdb", flushdbCommand, -1,
-	// 	"write @keyspace @dangerous",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"flushdb", flushdbCommand, -1,
+		"write @keyspace @dangerous",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"flushall", flushallCommand, -1,
-	// 	"write @keyspace @dangerous",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"flushall", flushallCommand, -1,
+		"write @keyspace @dangerous",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"sort", sortCommand, -2,
 	// 	"write use-memory @list @set @sortedset @dangerous",
 	// 	0, sortGetKeys, 1, 1, 1, 0, 0, 0},
 
-	// {"info", infoCommand, -1,
-	// 	"ok-loading ok-stale random @dangerous",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"info", infoCommand, -1,
+		"ok-loading ok-stale random @dangerous",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"monitor", monitorCommand, 1,
-	// 	"admin no-script",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"monitor", monitorCommand, 1,
+		"admin no-script",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"ttl", ttlCommand, 2,
 	// 	"read-only fast random @keyspace",
@@ -707,41 +708,41 @@ var redisCommandTable = []*RedisCommand{
 	// 	"admin no-script",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"config", configCommand, -2,
-	// 	"admin ok-loading ok-stale no-script",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"config", configCommand, -2,
+		"admin ok-loading ok-stale no-script",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"subscribe", subscribeCommand, -2,
-	// 	"pub-sub no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"subscribe", subscribeCommand, -2,
+		"pub-sub no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"unsubscribe", unsubscribeCommand, -1,
-	// 	"pub-sub no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"unsubscribe", unsubscribeCommand, -1,
+		"pub-sub no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"psubscribe", psubscribeCommand, -2,
-	// 	"pub-sub no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"psubscribe", psubscribeCommand, -2,
+		"pub-sub no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"punsubscribe", punsubscribeCommand, -1,
-	// 	"pub-sub no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"punsubscribe", punsubscribeCommand, -1,
+		"pub-sub no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"publish", publishCommand, 3,
-	// 	"pub-sub ok-loading ok-stale fast",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"publish", publishCommand, 3,
+		"pub-sub ok-loading ok-stale fast",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"pubsub", pubsubCommand, -2,
-	// 	"pub-sub ok-loading ok-stale random",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"pubsub", pubsubCommand, -2,
+		"pub-sub ok-loading ok-stale random",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"watch", watchCommand, -2,
-	// 	"no-script fast @transaction",
-	// 	0, nil, 1, -1, 1, 0, 0, 0},
+	{"watch", watchCommand, -2,
+		"no-script fast @transaction",
+		0, nil, 1, -1, 1, 0, 0, 0},
 
-	// {"unwatch", unwatchCommand, 1,
-	// 	"no-script fast @transaction",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"unwatch", unwatchCommand, 1,
+		"no-script fast @transaction",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"cluster", clusterCommand, -2,
 	// 	"admin ok-stale random",
@@ -783,13 +784,13 @@ var redisCommandTable = []*RedisCommand{
 	// 	"random read-only",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"client", clientCommand, -2,
-	// 	"admin no-script random @connection",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"client", clientCommand, -2,
+		"admin no-script random @connection",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"hello", helloCommand, -2,
-	// 	"no-script fast no-monitor no-slowlog @connection",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"hello", helloCommand, -1,
+		"no-script fast ok-loading ok-stale no-slowlog @connection",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// /* EVAL can modify the dataset, however it is not flagged as a write
 	//  * command since we do the check while running commands from Lua. */
@@ -801,9 +802,9 @@ var redisCommandTable = []*RedisCommand{
 	// 	"no-script @scripting",
 	// 	0, evalGetKeys, 0, 0, 0, 0, 0, 0},
 
-	// {"slowlog", slowlogCommand, -2,
-	// 	"admin random",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"slowlog", slowlogCommand, -2,
+		"admin random",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"script", scriptCommand, -2,
 	// 	"no-script @scripting",
@@ -829,9 +830,9 @@ var redisCommandTable = []*RedisCommand{
 	// 	"no-script @keyspace",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"command", commandCommand, -1,
-	// 	"ok-loading ok-stale random @connection",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"command", commandCommand, -1,
+		"ok-loading ok-stale random @connection",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"geoadd", geoaddCommand, -5,
 	// 	"write use-memory @geo",
@@ -954,29 +955,17 @@ var redisCommandTable = []*RedisCommand{
 	// 	"ok-loading ok-stale read-only",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"latency", latencyCommand, -2,
-	// 	"admin no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
+	{"latency", latencyCommand, -2,
+		"admin no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 
 	// {"lolwut", lolwutCommand, -1,
 	// 	"read-only fast",
 	// 	0, nil, 0, 0, 0, 0, 0, 0},
 
-	// {"acl", aclCommand, -2,
-	// 	"admin no-script ok-loading ok-stale",
-	// 	0, nil, 0, 0, 0, 0, 0, 0},
-}
-
-func LoadFromFile() {
-	filename := "redis-commands.json"
-	plan, _ := ioutil.ReadFile(filename)
-	var data interface{}
-	err := json.Unmarshal(plan, &data)
-	if nil != err {
-		fmt.Println(err)
-		panic("Unable to load commands")
-	}
-	fmt.Println(data.(map[string]interface{})["keys"])
+	{"acl", aclCommand, -2,
+		"admin no-script ok-loading ok-stale",
+		0, nil, 0, 0, 0, 0, 0, 0},
 }
 
 var CMD_WRITE uint64 = (1 << 0)           /* "write" flag */
@@ -997,6 +986,88 @@ var CMD_FAST uint64 = (1 << 14)           /* "fast" flag */
 
 var CMD_SLOW uint64 = (1 << 15) /* slow flag*/
 
+/* Command flag names, as reported by COMMAND INFO */
+var commandFlagNames = []struct {
+	flag uint64
+	name string
+}{
+	{CMD_WRITE, "write"},
+	{CMD_READONLY, "readonly"},
+	{CMD_DENYOOM, "denyoom"},
+	{CMD_MODULE, "module"},
+	{CMD_ADMIN, "admin"},
+	{CMD_PUBSUB, "pubsub"},
+	{CMD_NOSCRIPT, "noscript"},
+	{CMD_RANDOM, "random"},
+	{CMD_SORT_FOR_SCRIPT, "sort_for_script"},
+	{CMD_LOADING, "loading"},
+	{CMD_STALE, "stale"},
+	{CMD_SKIP_MONITOR, "skip_monitor"},
+	{CMD_SKIP_SLOWLOG, "skip_slowlog"},
+	{CMD_ASKING, "asking"},
+	{CMD_FAST, "fast"},
+}
+
+/* ACL command categories, the '@' flags of the command table */
+var CMD_CATEGORY_KEYSPACE uint64 = (1 << 0)
+var CMD_CATEGORY_READ uint64 = (1 << 1)
+var CMD_CATEGORY_WRITE uint64 = (1 << 2)
+var CMD_CATEGORY_SET uint64 = (1 << 3)
+var CMD_CATEGORY_SORTEDSET uint64 = (1 << 4)
+var CMD_CATEGORY_LIST uint64 = (1 << 5)
+var CMD_CATEGORY_HASH uint64 = (1 << 6)
+var CMD_CATEGORY_STRING uint64 = (1 << 7)
+var CMD_CATEGORY_BITMAP uint64 = (1 << 8)
+var CMD_CATEGORY_HYPERLOGLOG uint64 = (1 << 9)
+var CMD_CATEGORY_GEO uint64 = (1 << 10)
+var CMD_CATEGORY_STREAM uint64 = (1 << 11)
+var CMD_CATEGORY_PUBSUB uint64 = (1 << 12)
+var CMD_CATEGORY_ADMIN uint64 = (1 << 13)
+var CMD_CATEGORY_FAST uint64 = (1 << 14)
+var CMD_CATEGORY_SLOW uint64 = (1 << 15)
+var CMD_CATEGORY_BLOCKING uint64 = (1 << 16)
+var CMD_CATEGORY_DANGEROUS uint64 = (1 << 17)
+var CMD_CATEGORY_CONNECTION uint64 = (1 << 18)
+var CMD_CATEGORY_TRANSACTION uint64 = (1 << 19)
+var CMD_CATEGORY_SCRIPTING uint64 = (1 << 20)
+
+var ACLCommandCategories = []struct {
+	name string
+	flag uint64
+}{
+	{"keyspace", CMD_CATEGORY_KEYSPACE},
+	{"read", CMD_CATEGORY_READ},
+	{"write", CMD_CATEGORY_WRITE},
+	{"set", CMD_CATEGORY_SET},
+	{"sortedset", CMD_CATEGORY_SORTEDSET},
+	{"list", CMD_CATEGORY_LIST},
+	{"hash", CMD_CATEGORY_HASH},
+	{"string", CMD_CATEGORY_STRING},
+	{"bitmap", CMD_CATEGORY_BITMAP},
+	{"hyperloglog", CMD_CATEGORY_HYPERLOGLOG},
+	{"geo", CMD_CATEGORY_GEO},
+	{"stream", CMD_CATEGORY_STREAM},
+	{"pubsub", CMD_CATEGORY_PUBSUB},
+	{"admin", CMD_CATEGORY_ADMIN},
+	{"fast", CMD_CATEGORY_FAST},
+	{"slow", CMD_CATEGORY_SLOW},
+	{"blocking", CMD_CATEGORY_BLOCKING},
+	{"dangerous", CMD_CATEGORY_DANGEROUS},
+	{"connection", CMD_CATEGORY_CONNECTION},
+	{"transaction", CMD_CATEGORY_TRANSACTION},
+	{"scripting", CMD_CATEGORY_SCRIPTING},
+}
+
+/* Return the category flag given its name, 0 if not found. */
+func ACLGetCommandCategoryFlagByName(name string) uint64 {
+	for _, category := range ACLCommandCategories {
+		if strings.EqualFold(category.name, name) {
+			return category.flag
+		}
+	}
+	return 0
+}
+
 func populateCommandTableParseFlags(c *RedisCommand, flags string) error {
 	/* Split the line into arguments for processing. */
 	argv := strings.Split(flags, " ")
@@ -1049,6 +1120,7 @@ func PopulateCommandTable() map[string]*RedisCommand {
 
 	for j := 0; j < numcommands; j++ {
 		c := redisCommandTable[j]
+		c.id = j
 		if populateCommandTableParseFlags(c, c.sflags) != nil {
 			panic("Unsupported command flag")
 		}
@@ -1057,6 +1129,240 @@ func PopulateCommandTable() map[string]*RedisCommand {
 	return commandMap
 }
 
+/* Arity check: arity N means exactly N arguments, -N means at least N.
+ * The command name is counted as an argument. */
+func (cmd *RedisCommand) checkArity(argc int) bool {
+	if cmd.arity > 0 {
+		return argc == cmd.arity
+	}
+	return argc >= -cmd.arity
+}
+
+/* ACL categories of the command: the '@' flags plus the categories
+ * implied by the other flags, see the notes at the top of this file. */
+func (cmd *RedisCommand) aclCategories() uint64 {
+	var categories uint64
+	for _, flag := range strings.Fields(cmd.sflags) {
+		if strings.HasPrefix(flag, "@") {
+			categories |= ACLGetCommandCategoryFlagByName(flag[1:])
+		}
+	}
+	if cmd.flags&CMD_WRITE != 0 {
+		categories |= CMD_CATEGORY_WRITE
+	}
+	if cmd.flags&CMD_READONLY != 0 {
+		categories |= CMD_CATEGORY_READ
+	}
+	if cmd.flags&CMD_ADMIN != 0 {
+		categories |= CMD_CATEGORY_ADMIN | CMD_CATEGORY_DANGEROUS
+	}
+	if cmd.flags&CMD_PUBSUB != 0 {
+		categories |= CMD_CATEGORY_PUBSUB
+	}
+	if cmd.flags&CMD_FAST != 0 {
+		categories |= CMD_CATEGORY_FAST
+	} else {
+		categories |= CMD_CATEGORY_SLOW
+	}
+	return categories
+}
+
 func (cmd *RedisCommand) Writable() bool {
 	return CMD_WRITE == (cmd.flags & CMD_WRITE)
 }
+
+/* -----------------------------------------------------------------------------
+ * COMMAND introspection
+ * -------------------------------------------------------------------------- */
+
+/* Output the representation of a command for COMMAND INFO. */
+func addReplyCommand(c *ClientConnection, cmd *RedisCommand) {
+	if nil == cmd {
+		c.addReplyNullArray()
+		return
+	}
+	c.addReplyArrayLen(7)
+	c.addReplyBulkString(cmd.name)
+	c.addReplyLongLong(int64(cmd.arity))
+
+	var flags []string
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	if nil != cmd.getkeys_proc {
+		flags = append(flags, "movablekeys")
+	}
+	c.addReplySetLen(len(flags))
+	for _, flag := range flags {
+		c.addReplyStatus(flag)
+	}
+
+	c.addReplyLongLong(int64(cmd.firstkey))
+	c.addReplyLongLong(int64(cmd.lastkey))
+	c.addReplyLongLong(int64(cmd.keystep))
+
+	categories := cmd.aclCategories()
+	var names []string
+	for _, category := range ACLCommandCategories {
+		if categories&category.flag != 0 {
+			names = append(names, "@"+category.name)
+		}
+	}
+	c.addReplySetLen(len(names))
+	for _, name := range names {
+		c.addReplyStatus(name)
+	}
+}
+
+/* Output the documentation of a command for COMMAND DOCS. */
+func addReplyCommandDocs(c *ClientConnection, doc *commands.Doc) {
+	fields := 2
+	if len(doc.Arguments) > 0 {
+		fields++
+	}
+	if len(doc.Subcommands) > 0 {
+		fields++
+	}
+	c.addReplyMapLen(fields)
+	c.addReplyBulkString("summary")
+	c.addReplyBulkString(doc.Summary)
+	c.addReplyBulkString("group")
+	c.addReplyBulkString(doc.Group)
+	if len(doc.Arguments) > 0 {
+		c.addReplyBulkString("arguments")
+		addReplyCommandArgs(c, doc.Arguments)
+	}
+	if len(doc.Subcommands) > 0 {
+		names := make([]string, 0, len(doc.Subcommands))
+		for name := range doc.Subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.addReplyBulkString("subcommands")
+		c.addReplyMapLen(len(names))
+		for _, name := range names {
+			c.addReplyBulkString(name)
+			addReplyCommandDocs(c, doc.Subcommands[name])
+		}
+	}
+}
+
+func addReplyCommandArgs(c *ClientConnection, args []*commands.Argument) {
+	c.addReplyArrayLen(len(args))
+	for _, arg := range args {
+		var flags []string
+		if arg.Optional {
+			flags = append(flags, "optional")
+		}
+		if arg.Multiple {
+			flags = append(flags, "multiple")
+		}
+		fields := 2
+		if arg.Token != "" {
+			fields++
+		}
+		if len(flags) > 0 {
+			fields++
+		}
+		if len(arg.Arguments) > 0 {
+			fields++
+		}
+		c.addReplyMapLen(fields)
+		c.addReplyBulkString("name")
+		c.addReplyBulkString(arg.Name)
+		c.addReplyBulkString("type")
+		c.addReplyBulkString(arg.Type)
+		if arg.Token != "" {
+			c.addReplyBulkString("token")
+			c.addReplyBulkString(arg.Token)
+		}
+		if len(flags) > 0 {
+			c.addReplyBulkString("flags")
+			c.addReplySetLen(len(flags))
+			for _, flag := range flags {
+				c.addReplyStatus(flag)
+			}
+		}
+		if len(arg.Arguments) > 0 {
+			c.addReplyBulkString("arguments")
+			addReplyCommandArgs(c, arg.Arguments)
+		}
+	}
+}
+
+func (s *Server) sortedCommandNames() []string {
+	names := make([]string, 0, len(s.commandMap))
+	for name := range s.commandMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* COMMAND [COUNT | INFO name ... | DOCS [name ...] | GETKEYS cmd arg ...] */
+func commandCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	server := c.server
+	if len(argv) == 1 {
+		names := server.sortedCommandNames()
+		c.addReplyArrayLen(len(names))
+		for _, name := range names {
+			addReplyCommand(c, server.commandMap[name])
+		}
+		return
+	}
+
+	sub := strings.ToLower(string(argv[1]))
+	if sub == "count" && len(argv) == 2 {
+		c.addReplyLongLong(int64(len(server.commandMap)))
+	} else if sub == "info" {
+		c.addReplyArrayLen(len(argv) - 2)
+		for _, name := range argv[2:] {
+			addReplyCommand(c, server.commandMap[strings.ToLower(string(name))])
+		}
+	} else if sub == "docs" {
+		var names []string
+		if len(argv) == 2 {
+			names = server.sortedCommandNames()
+		} else {
+			for _, name := range argv[2:] {
+				lname := strings.ToLower(string(name))
+				if nil != server.commandMap[lname] {
+					names = append(names, lname)
+				}
+			}
+		}
+		c.addReplyMapLen(len(names))
+		for _, name := range names {
+			c.addReplyBulkString(name)
+			doc := commands.Lookup(name)
+			if nil == doc {
+				doc = &commands.Doc{Name: name}
+			}
+			addReplyCommandDocs(c, doc)
+		}
+	} else if sub == "getkeys" && len(argv) >= 3 {
+		cmd := server.commandMap[strings.ToLower(string(argv[2]))]
+		cmdArgv := argv[2:]
+		if nil == cmd {
+			c.addReplyError("Invalid command specified")
+			return
+		} else if !cmd.checkArity(len(cmdArgv)) {
+			c.addReplyError("Invalid number of arguments specified for command")
+			return
+		}
+		keys := getKeysFromCommand(cmd, cmdArgv)
+		if len(keys) == 0 {
+			c.addReplyError("The command has no key arguments")
+			return
+		}
+		c.addReplyArrayLen(len(keys))
+		for _, pos := range keys {
+			c.addReplyBulk(cmdArgv[pos])
+		}
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
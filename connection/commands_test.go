@@ -0,0 +1,56 @@
+package connection
+
+import (
+	"testing"
+
+	"github.com/valarpirai/vardis/commands"
+)
+
+func TestCheckArity(t *testing.T) {
+	cases := []struct {
+		arity, argc int
+		ok          bool
+	}{
+		{2, 2, true},
+		{2, 1, false},
+		{2, 3, false},
+		{-2, 1, false},
+		{-2, 2, true},
+		{-2, 10, true},
+		{-1, 1, true},
+	}
+	for _, c := range cases {
+		cmd := &RedisCommand{arity: c.arity}
+		if got := cmd.checkArity(c.argc); got != c.ok {
+			t.Errorf("arity %d argc %d: got %v", c.arity, c.argc, got)
+		}
+	}
+}
+
+func TestArityErrors(t *testing.T) {
+	c := testClient(t, testServer(t))
+	c.send("GET\r\nGET a b\r\nSET k\r\nDEL\r\nset k v\r\n")
+	c.expect("-ERR wrong number of arguments for 'get' command\r\n" +
+		"-ERR wrong number of arguments for 'get' command\r\n" +
+		"-ERR wrong number of arguments for 'set' command\r\n" +
+		"-ERR wrong number of arguments for 'del' command\r\n" +
+		"+OK\r\n")
+}
+
+/* COMMAND DOCS needs a documentation entry for every command of the table */
+func TestEveryCommandHasDocs(t *testing.T) {
+	for _, cmd := range redisCommandTable {
+		doc := commands.Lookup(cmd.name)
+		if nil == doc {
+			t.Errorf("%s: no documentation", cmd.name)
+			continue
+		}
+		argc := cmd.arity
+		if argc < 0 {
+			argc = -argc
+		}
+		if argc > 1 && len(doc.Arguments) == 0 && len(doc.Subcommands) == 0 {
+			t.Errorf("%s: no argument documented", cmd.name)
+		}
+	}
+}
@@ -0,0 +1,727 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/cache"
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+/* The config registry: every parameter the config file, CONFIG GET,
+ * CONFIG SET and CONFIG REWRITE know about, with its default value.
+ *
+ * set parses and validates the value, storing it or returning an error
+ * that says why it is invalid. apply, when not nil, makes the server use
+ * the new value after set succeeded; it is not called for the defaults,
+ * that NewServer uses directly. */
+
+/* Config flags */
+const MODIFIABLE_CONFIG = 0          /* This is the implied default for a standard config, which is mutable. */
+const IMMUTABLE_CONFIG = (1 << 0)    /* Can this value only be set at startup? */
+const STRING_CONFIG_QUOTE = (1 << 1) /* Quote the value when rewriting the config file */
+
+const CONFIG_DEFAULT_MAX_CLIENTS = 10000
+
+/* Log levels */
+const LL_DEBUG = 0
+const LL_VERBOSE = 1
+const LL_NOTICE = 2
+const LL_WARNING = 3
+const LL_NOTHING = 4
+
+type configParam struct {
+	name  string
+	flags int
+	dflt  string /* Default value, in the format of get */
+	get   func(s *Server) string
+	set   func(s *Server, val string) error
+	apply func(s *Server) error
+}
+
+type configEnum struct {
+	name string
+	val  int
+}
+
+var configParams = []configParam{
+	createSpecialConfig("port", IMMUTABLE_CONFIG, "6379",
+		func(s *Server) string { return strconv.Itoa(int(s.PORT)) },
+		func(s *Server, val string) error {
+			port, err := parseConfigNumber(val, 0, 65535)
+			if err != nil {
+				return err
+			}
+			s.PORT = uint16(port)
+			return nil
+		}),
+	createSpecialConfig("bind", IMMUTABLE_CONFIG, CONFIG_DEFAULT_BIND,
+		func(s *Server) string { return strings.Join(s.bindaddr, " ") },
+		func(s *Server, val string) error {
+			addresses := strings.Fields(val)
+			if len(addresses) > CONFIG_BINDADDR_MAX {
+				return errors.New("Too many bind addresses specified.")
+			}
+			s.bindaddr = addresses
+			return nil
+		}),
+	createStringConfig("unixsocket", IMMUTABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.unixsocket }, nil),
+	createSpecialConfig("unixsocketperm", IMMUTABLE_CONFIG, "0",
+		func(s *Server) string { return strconv.FormatUint(uint64(s.unixsocketperm), 8) },
+		func(s *Server, val string) error {
+			perm, err := strconv.ParseUint(val, 8, 32)
+			if err != nil || perm > 0777 {
+				return errors.New("argument must be an octal number between 0 and 777")
+			}
+			s.unixsocketperm = uint32(perm)
+			return nil
+		}),
+	createIntConfig("tls-port", IMMUTABLE_CONFIG, 0, 65535, 0,
+		func(s *Server) *int { return &s.tlsPort }, nil),
+	createStringConfig("tls-cert-file", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.certFile }, applyTlsCfg),
+	createStringConfig("tls-key-file", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.keyFile }, applyTlsCfg),
+	createStringConfig("tls-ca-cert-file", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.caCertFile }, applyTlsCfg),
+	createStringConfig("tls-ca-cert-dir", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.caCertDir }, applyTlsCfg),
+	createStringConfig("tls-protocols", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.protocols }, applyTlsCfg),
+	createStringConfig("tls-ciphers", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.tlsCtxConfig.ciphers }, applyTlsCfg),
+	createEnumConfig("tls-auth-clients", MODIFIABLE_CONFIG, []configEnum{
+		{"no", TLS_CLIENT_AUTH_NO},
+		{"yes", TLS_CLIENT_AUTH_YES},
+		{"optional", TLS_CLIENT_AUTH_OPTIONAL},
+	}, TLS_CLIENT_AUTH_YES, func(s *Server) *int { return &s.tlsAuthClients }, applyTlsCfg),
+	createEnumConfig("tls-auth-clients-user", MODIFIABLE_CONFIG, []configEnum{
+		{"off", TLS_CLIENT_FIELD_OFF},
+		{"CN", TLS_CLIENT_FIELD_CN},
+	}, TLS_CLIENT_FIELD_OFF, func(s *Server) *int { return &s.tlsAuthClientsUser }, nil),
+	createStringConfig("appendfilename", IMMUTABLE_CONFIG|STRING_CONFIG_QUOTE, "appendonly.aof",
+		func(s *Server) *string { return &s.aofFilename }, nil),
+	createEnumConfig("appendfsync", MODIFIABLE_CONFIG, []configEnum{
+		{"everysec", cache.AOF_FSYNC_EVERYSEC},
+		{"always", cache.AOF_FSYNC_ALWAYS},
+		{"no", cache.AOF_FSYNC_NO},
+	}, cache.AOF_FSYNC_EVERYSEC, func(s *Server) *int { return &s.aofFsync },
+		func(s *Server) error {
+			if nil != s.persistance {
+				s.persistance.SetFsyncPolicy(s.aofFsync)
+			}
+			return nil
+		}),
+	createBoolConfig("aof-load-truncated", MODIFIABLE_CONFIG, true,
+		func(s *Server) *bool { return &s.aofLoadTruncated }, nil),
+	createEnumConfig("loglevel", MODIFIABLE_CONFIG, []configEnum{
+		{"debug", LL_DEBUG},
+		{"verbose", LL_VERBOSE},
+		{"notice", LL_NOTICE},
+		{"warning", LL_WARNING},
+		{"nothing", LL_NOTHING},
+	}, LL_NOTICE, func(s *Server) *int { return &s.verbosity }, applyLogLevel),
+	createStringConfig("logfile", IMMUTABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.logfile },
+		func(s *Server) error {
+			if s.logfile == "" {
+				log.SetOutput(os.Stdout)
+				return nil
+			}
+			f, err := os.OpenFile(s.logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("Can't open the log file: %s", err)
+			}
+			log.SetOutput(f)
+			return nil
+		}),
+	createSpecialConfig("notify-keyspace-events", MODIFIABLE_CONFIG, "",
+		func(s *Server) string { return keyspaceEventsFlagsToString(s.notifyKeyspaceEvents) },
+		func(s *Server, val string) error {
+			flags := keyspaceEventsStringToFlags(val)
+			if flags == -1 {
+				return errors.New("Invalid event class character. Use 'Ag$lshzxeKEtm'.")
+			}
+			s.notifyKeyspaceEvents = flags
+			return nil
+		}),
+	createIntConfig("maxclients", MODIFIABLE_CONFIG, 1, 1<<31-1, CONFIG_DEFAULT_MAX_CLIENTS,
+		func(s *Server) *int { return &s.maxclients },
+		func(s *Server) error {
+			/* Start adjusts the open files limit of the servers not started yet */
+			if len(s.listeners) == 0 {
+				return nil
+			}
+			if allowed := adjustOpenFilesLimit(s.maxclients); allowed < s.maxclients {
+				return fmt.Errorf("The operating system is not able to handle the specified number of clients, try with %d", allowed)
+			}
+			return nil
+		}),
+	createIntConfig("timeout", MODIFIABLE_CONFIG, 0, 1<<31-1, 0,
+		func(s *Server) *int { return &s.maxidletime }, nil),
+	createIntConfig("tcp-keepalive", MODIFIABLE_CONFIG, 0, 1<<31-1, 300,
+		func(s *Server) *int { return &s.tcpkeepalive }, nil),
+	createIntConfig("tcp-backlog", IMMUTABLE_CONFIG, 0, 1<<31-1, 511,
+		func(s *Server) *int { return &s.tcpBacklog }, nil),
+	createIntConfig("shutdown-timeout", MODIFIABLE_CONFIG, 0, 1<<31-1, 10,
+		func(s *Server) *int { return &s.shutdownTimeout }, nil),
+	createMemoryConfig("client-query-buffer-limit", MODIFIABLE_CONFIG, 1024*1024, 1<<63-1, 1024*1024*1024,
+		func(s *Server) *int64 { return &s.clientMaxQuerybufLen }, nil),
+	/* Unlike redis the bulks can't be over 512mb, the replies can't have
+	 * bigger ones, see proto.AppendBulk */
+	createMemoryConfig("proto-max-bulk-len", MODIFIABLE_CONFIG, 1024*1024, 512*1024*1024, 512*1024*1024,
+		func(s *Server) *int64 { return &s.protoMaxBulkLen }, nil),
+	createSpecialConfig("client-output-buffer-limit", MODIFIABLE_CONFIG,
+		"normal 0 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60",
+		func(s *Server) string {
+			var buf strings.Builder
+			for class, limits := range s.clientObufLimits {
+				if class != 0 {
+					buf.WriteByte(' ')
+				}
+				fmt.Fprintf(&buf, "%s %d %d %d", getClientTypeName(class),
+					limits.hardLimitBytes, limits.softLimitBytes, limits.softLimitSeconds)
+			}
+			return buf.String()
+		},
+		func(s *Server, val string) error {
+			/* client-output-buffer-limit <class> <hard> <soft> <soft_seconds>
+			 * [<class> <hard> <soft> <soft_seconds> ...], only the classes
+			 * given are changed. */
+			args := strings.Fields(val)
+			if len(args)%4 != 0 {
+				return errors.New("Wrong number of arguments in buffer limit configuration.")
+			}
+			limits := s.clientObufLimits
+			for j := 0; j < len(args); j += 4 {
+				class := getClientTypeByName(args[j])
+				if class == -1 || class == CLIENT_TYPE_MASTER {
+					return errors.New("Invalid client class specified in buffer limit configuration.")
+				}
+				hard, okHard := util.Memtoull(args[j+1])
+				soft, okSoft := util.Memtoull(args[j+2])
+				softSeconds, err := strconv.ParseInt(args[j+3], 10, 64)
+				if !okHard || !okSoft || err != nil || softSeconds < 0 || hard > 1<<63-1 || soft > 1<<63-1 {
+					return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+				}
+				limits[class] = clientBufferLimits{int64(hard), int64(soft), softSeconds}
+			}
+			s.clientObufLimits = limits
+			return nil
+		}),
+	createSpecialConfig("maxmemory-clients", MODIFIABLE_CONFIG, "0",
+		func(s *Server) string {
+			if s.maxmemoryClients < 0 {
+				return strconv.FormatInt(-s.maxmemoryClients, 10) + "%"
+			}
+			return strconv.FormatInt(s.maxmemoryClients, 10)
+		},
+		func(s *Server, val string) error {
+			/* Bytes, or a percentage of maxmemory stored as a negative
+			 * number like in redis. */
+			if strings.HasSuffix(val, "%") {
+				pct, err := strconv.ParseInt(val[:len(val)-1], 10, 64)
+				if err != nil || pct < 0 || pct > 100 {
+					return errors.New("argument must be a memory or percent value")
+				}
+				s.maxmemoryClients = -pct
+				return nil
+			}
+			n, ok := util.Memtoull(val)
+			if !ok || n > 1<<63-1 {
+				return errors.New("argument must be a memory or percent value")
+			}
+			s.maxmemoryClients = int64(n)
+			return nil
+		}),
+	createStringConfig("requirepass", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.requirePass },
+		func(s *Server) error {
+			s.aclUpdateDefaultUserPassword(s.requirePass)
+			return nil
+		}),
+	createStringConfig("aclfile", MODIFIABLE_CONFIG|STRING_CONFIG_QUOTE, "",
+		func(s *Server) *string { return &s.aclFile }, nil),
+	createBoolConfig("protected-mode", MODIFIABLE_CONFIG, true,
+		func(s *Server) *bool { return &s.protectedMode }, nil),
+	createIntConfig("tracking-table-max-keys", MODIFIABLE_CONFIG, 0, 1<<31-1, 1000000,
+		func(s *Server) *int { return &s.trackingTableMaxKeys },
+		func(s *Server) error {
+			trackingLimitUsedSlots(s)
+			return nil
+		}),
+	createLongLongConfig("slowlog-log-slower-than", MODIFIABLE_CONFIG, -1, 1<<63-1, 10000,
+		func(s *Server) *int64 { return &s.slowlogLogSlowerThan }, nil),
+	createIntConfig("slowlog-max-len", MODIFIABLE_CONFIG, 0, 1<<31-1, 128,
+		func(s *Server) *int { return &s.slowlogMaxLen },
+		func(s *Server) error {
+			s.slowlogTrim()
+			return nil
+		}),
+	createLongLongConfig("latency-monitor-threshold", MODIFIABLE_CONFIG, 0, 1<<63-1, 0,
+		func(s *Server) *int64 { return &s.latencyMonitorThreshold }, nil),
+	createBoolConfig("latency-tracking", MODIFIABLE_CONFIG, true,
+		func(s *Server) *bool { return &s.latencyTrackingEnabled }, nil),
+	createSpecialConfig("latency-tracking-info-percentiles", MODIFIABLE_CONFIG, "50 99 99.9",
+		func(s *Server) string {
+			values := make([]string, len(s.latencyTrackingPercentiles))
+			for j, p := range s.latencyTrackingPercentiles {
+				values[j] = strconv.FormatFloat(p, 'f', -1, 64)
+			}
+			return strings.Join(values, " ")
+		},
+		func(s *Server, val string) error {
+			var percentiles []float64
+			for _, field := range strings.Fields(val) {
+				p, err := strconv.ParseFloat(field, 64)
+				if err != nil || p < 0 || p > 100 {
+					return errors.New("latency-tracking-info-percentiles parameter should contain numbers between 0 and 100")
+				}
+				percentiles = append(percentiles, p)
+			}
+			s.latencyTrackingPercentiles = percentiles
+			return nil
+		}),
+}
+
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func yesnotoi(val string) int {
+	switch strings.ToLower(val) {
+	case "yes":
+		return 1
+	case "no":
+		return 0
+	}
+	return -1
+}
+
+func parseConfigNumber(val string, lower int64, upper int64) (int64, error) {
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < lower || n > upper {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+	}
+	return n, nil
+}
+
+func createBoolConfig(name string, flags int, dflt bool, field func(s *Server) *bool, apply func(s *Server) error) configParam {
+	return configParam{name, flags, yesno(dflt),
+		func(s *Server) string { return yesno(*field(s)) },
+		func(s *Server, val string) error {
+			yn := yesnotoi(val)
+			if yn == -1 {
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			*field(s) = yn == 1
+			return nil
+		}, apply}
+}
+
+func createIntConfig(name string, flags int, lower int, upper int, dflt int, field func(s *Server) *int, apply func(s *Server) error) configParam {
+	return configParam{name, flags, strconv.Itoa(dflt),
+		func(s *Server) string { return strconv.Itoa(*field(s)) },
+		func(s *Server, val string) error {
+			n, err := parseConfigNumber(val, int64(lower), int64(upper))
+			if err != nil {
+				return err
+			}
+			*field(s) = int(n)
+			return nil
+		}, apply}
+}
+
+func createLongLongConfig(name string, flags int, lower int64, upper int64, dflt int64, field func(s *Server) *int64, apply func(s *Server) error) configParam {
+	return configParam{name, flags, strconv.FormatInt(dflt, 10),
+		func(s *Server) string { return strconv.FormatInt(*field(s), 10) },
+		func(s *Server, val string) error {
+			n, err := parseConfigNumber(val, lower, upper)
+			if err != nil {
+				return err
+			}
+			*field(s) = n
+			return nil
+		}, apply}
+}
+
+// createMemoryConfig accepts the memory units of util.Memtoull, like 1gb
+func createMemoryConfig(name string, flags int, lower int64, upper int64, dflt int64, field func(s *Server) *int64, apply func(s *Server) error) configParam {
+	return configParam{name, flags, strconv.FormatInt(dflt, 10),
+		func(s *Server) string { return strconv.FormatInt(*field(s), 10) },
+		func(s *Server, val string) error {
+			n, ok := util.Memtoull(val)
+			if !ok || n > 1<<63-1 {
+				return errors.New("argument must be a memory value")
+			}
+			if int64(n) < lower || int64(n) > upper {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+			*field(s) = int64(n)
+			return nil
+		}, apply}
+}
+
+func createStringConfig(name string, flags int, dflt string, field func(s *Server) *string, apply func(s *Server) error) configParam {
+	return configParam{name, flags, dflt,
+		func(s *Server) string { return *field(s) },
+		func(s *Server, val string) error {
+			*field(s) = val
+			return nil
+		}, apply}
+}
+
+func createEnumConfig(name string, flags int, enum []configEnum, dflt int, field func(s *Server) *int, apply func(s *Server) error) configParam {
+	enumName := func(val int) string {
+		for _, e := range enum {
+			if e.val == val {
+				return e.name
+			}
+		}
+		return "unknown"
+	}
+	return configParam{name, flags, enumName(dflt),
+		func(s *Server) string { return enumName(*field(s)) },
+		func(s *Server, val string) error {
+			for _, e := range enum {
+				if strings.EqualFold(e.name, val) {
+					*field(s) = e.val
+					return nil
+				}
+			}
+			names := make([]string, len(enum))
+			for j, e := range enum {
+				names[j] = "'" + e.name + "'"
+			}
+			return errors.New("argument(s) must be one of the following: " + strings.Join(names, ", "))
+		}, apply}
+}
+
+func createSpecialConfig(name string, flags int, dflt string, get func(s *Server) string, set func(s *Server, val string) error) configParam {
+	return configParam{name, flags, dflt, get, set, nil}
+}
+
+func lookupConfig(name string) *configParam {
+	for j := range configParams {
+		if strings.EqualFold(configParams[j].name, name) {
+			return &configParams[j]
+		}
+	}
+	return nil
+}
+
+// initConfigValues sets every parameter to its default value
+func initConfigValues(s *Server) {
+	for _, param := range configParams {
+		if err := param.set(s, param.dflt); err != nil {
+			panic(fmt.Sprintf("Invalid default for config %s: %s", param.name, err))
+		}
+	}
+}
+
+func applyLogLevel(s *Server) error {
+	switch s.verbosity {
+	case LL_DEBUG:
+		log.SetLevel(log.DebugLevel)
+	case LL_VERBOSE, LL_NOTICE:
+		log.SetLevel(log.InfoLevel)
+	case LL_WARNING:
+		log.SetLevel(log.WarnLevel)
+	default:
+		log.SetLevel(log.PanicLevel)
+	}
+	return nil
+}
+
+/*-----------------------------------------------------------------------------
+ * Config file parsing
+ *----------------------------------------------------------------------------*/
+
+// LoadServerConfig loads the config file filename, if not empty, then
+// the options given as a string, with the same format, that override it.
+// The options are the ones of the command line, like "port 6380\n"
+func (s *Server) LoadServerConfig(filename string, options string) error {
+	var config []byte
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("Fatal error, can't open config file '%s': %s", filename, err)
+		}
+		config = data
+		if s.configfile, err = filepath.Abs(filename); err != nil {
+			s.configfile = filename
+		}
+	}
+	config = append(config, '\n')
+	config = append(config, options...)
+	return s.loadServerConfigFromString(string(config))
+}
+
+func (s *Server) loadServerConfigFromString(config string) error {
+	lines := strings.Split(config, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+
+		/* Skip comments and blank lines */
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		/* Split into arguments */
+		argv, ok := proto.SplitArgs([]byte(line))
+		if !ok {
+			return configLoadError(i+1, line, "Unbalanced quotes in configuration line")
+		}
+		param := lookupConfig(string(argv[0]))
+		if nil == param || len(argv) < 2 {
+			return configLoadError(i+1, line, "Bad directive or wrong number of arguments")
+		}
+		args := make([]string, len(argv)-1)
+		for j, arg := range argv[1:] {
+			args[j] = string(arg)
+		}
+		if err := param.set(s, strings.Join(args, " ")); err != nil {
+			return configLoadError(i+1, line, err.Error())
+		}
+		if nil != param.apply {
+			if err := param.apply(s); err != nil {
+				return configLoadError(i+1, line, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func configLoadError(linenum int, line string, err string) error {
+	return fmt.Errorf("\n*** FATAL CONFIG FILE ERROR (Redis %s) ***\n"+
+		"Reading the configuration file, at line %d\n"+
+		">>> '%s'\n"+
+		"%s", REDIS_VERSION, linenum, line, err)
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG REWRITE implementation
+ *----------------------------------------------------------------------------*/
+
+const CONFIG_REWRITE_SIGNATURE = "# Generated by CONFIG REWRITE"
+
+// rewriteConfigLine formats the line of the config file for param
+func (s *Server) rewriteConfigLine(param *configParam) string {
+	val := param.get(s)
+	if param.flags&STRING_CONFIG_QUOTE != 0 || val == "" {
+		return param.name + " " + string(util.AppendRepr(nil, []byte(val)))
+	}
+	return param.name + " " + val
+}
+
+/* Rewrite the configuration file at "path".
+ * If the configuration file already exists, we try at best to retain comments
+ * and overall structure.
+ *
+ * Configuration parameters that are at their default value, unless already
+ * explicitly included in the old configuration file, are not rewritten. */
+func (s *Server) rewriteConfig(path string) error {
+	var lines []string
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	/* Rewrite the options of the old file in place, dropping the duplicates,
+	 * keep comments and the options we don't know about. */
+	rewritten := make(map[string]bool)
+	signature := false
+	var out []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			if trimmed == CONFIG_REWRITE_SIGNATURE {
+				signature = true
+			}
+			out = append(out, line)
+			continue
+		}
+		argv, ok := proto.SplitArgs([]byte(trimmed))
+		if !ok || len(argv) == 0 {
+			out = append(out, line)
+			continue
+		}
+		param := lookupConfig(string(argv[0]))
+		if nil == param {
+			out = append(out, line)
+			continue
+		}
+		if !rewritten[param.name] {
+			out = append(out, s.rewriteConfigLine(param))
+			rewritten[param.name] = true
+		}
+	}
+
+	/* Append the options that are not at their default value, after the
+	 * signature unless the file already has it. */
+	for j := range configParams {
+		param := &configParams[j]
+		if rewritten[param.name] || param.get(s) == param.dflt {
+			continue
+		}
+		if !signature {
+			out = append(out, CONFIG_REWRITE_SIGNATURE)
+			signature = true
+		}
+		out = append(out, s.rewriteConfigLine(param))
+	}
+
+	/* Write the new file atomically */
+	tmpfile := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(out, "\n") + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, path)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG command entry point
+ *----------------------------------------------------------------------------*/
+
+func configGetCommand(c *ClientConnection, patterns [][]byte) {
+	s := c.server
+	var matches []*configParam
+	for j := range configParams {
+		param := &configParams[j]
+		for _, pattern := range patterns {
+			if util.StringMatch(pattern, []byte(param.name), true) {
+				matches = append(matches, param)
+				break
+			}
+		}
+	}
+	c.addReplyMapLen(len(matches))
+	for _, param := range matches {
+		c.addReplyBulkString(param.name)
+		c.addReplyBulkString(param.get(s))
+	}
+}
+
+/* CONFIG SET parameter value [parameter value ...]
+ *
+ * The parameters are set all together: if one of them can't be set, the
+ * ones set before it are restored. */
+func configSetCommand(c *ClientConnection, args [][]byte) {
+	s := c.server
+	params := make([]*configParam, 0, len(args)/2)
+	values := make([]string, 0, len(args)/2)
+
+	for j := 0; j < len(args); j += 2 {
+		name := string(args[j])
+		param := lookupConfig(name)
+		if nil == param {
+			c.addReplyErrorFormat("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+			return
+		}
+		if param.flags&IMMUTABLE_CONFIG != 0 {
+			c.addReplyErrorFormat("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+			return
+		}
+		for _, prev := range params {
+			if prev == param {
+				c.addReplyErrorFormat("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)
+				return
+			}
+		}
+		params = append(params, param)
+		values = append(values, string(args[j+1]))
+	}
+
+	olds := make([]string, len(params))
+	restore := func(n int) {
+		for j := 0; j < n; j++ {
+			params[j].set(s, olds[j])
+		}
+	}
+	for j, param := range params {
+		olds[j] = param.get(s)
+		if err := param.set(s, values[j]); err != nil {
+			restore(j)
+			c.addReplyErrorFormat("CONFIG SET failed (possibly related to argument '%s') - %s", param.name, err)
+			return
+		}
+	}
+	for j, param := range params {
+		if nil == param.apply {
+			continue
+		}
+		if err := param.apply(s); err != nil {
+			restore(len(params))
+			for _, applied := range params[:j+1] {
+				if nil != applied.apply {
+					applied.apply(s)
+				}
+			}
+			c.addReplyErrorFormat("CONFIG SET failed (possibly related to argument '%s') - %s", param.name, err)
+			return
+		}
+	}
+	c.addReplyBytes(shared.ok)
+}
+
+/* CONFIG GET pattern [pattern ...]
+ * CONFIG SET parameter value [parameter value ...]
+ * CONFIG REWRITE
+ * CONFIG RESETSTAT */
+func configCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+	if sub == "get" && len(argv) >= 3 {
+		configGetCommand(c, argv[2:])
+	} else if sub == "set" && len(argv) >= 4 && len(argv)%2 == 0 {
+		configSetCommand(c, argv[2:])
+	} else if sub == "resetstat" && len(argv) == 2 {
+		s.resetServerStats()
+		c.addReplyBytes(shared.ok)
+	} else if sub == "rewrite" && len(argv) == 2 {
+		if s.configfile == "" {
+			c.addReplyError("The server is running without a config file")
+			return
+		}
+		if err := s.rewriteConfig(s.configfile); err != nil {
+			log.Warnf("CONFIG REWRITE failed: %s", err)
+			c.addReplyErrorFormat("Rewriting config file: %s", err)
+			return
+		}
+		log.Infof("CONFIG REWRITE executed with success.")
+		c.addReplyBytes(shared.ok)
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
@@ -0,0 +1,178 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valarpirai/vardis/cache"
+)
+
+func TestParseConfigNumber(t *testing.T) {
+	tests := []struct {
+		val  string
+		want int64
+		err  string
+	}{
+		{"0", 0, ""},
+		{"65535", 65535, ""},
+		{"-1", 0, "argument must be between 0 and 65535 inclusive"},
+		{"65536", 0, "argument must be between 0 and 65535 inclusive"},
+		{"1x", 0, "argument couldn't be parsed into an integer"},
+		{"", 0, "argument couldn't be parsed into an integer"},
+	}
+	for _, tt := range tests {
+		n, err := parseConfigNumber(tt.val, 0, 65535)
+		if tt.err != "" {
+			if nil == err || err.Error() != tt.err {
+				t.Errorf("%q: got error %v want %q", tt.val, err, tt.err)
+			}
+		} else if err != nil || n != tt.want {
+			t.Errorf("%q: got %d, %v want %d", tt.val, n, err, tt.want)
+		}
+	}
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		options string
+		err     string
+	}{
+		{"unknown directive", "port 7000\n\nnope 1\n", "", "at line 3\n>>> 'nope 1'\nBad directive or wrong number of arguments"},
+		{"missing argument", "port\n", "", "at line 1\n>>> 'port'\nBad directive or wrong number of arguments"},
+		{"unbalanced quotes", "requirepass \"a\n", "", "Unbalanced quotes in configuration line"},
+		{"out of range", "", "port 99999", "argument must be between 0 and 65535 inclusive"},
+		{"bad enum", "loglevel loud\n", "", "argument(s) must be one of the following"},
+		{"bad bool", "protected-mode maybe\n", "", "argument must be 'yes' or 'no'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "vardis.conf")
+			if err := os.WriteFile(file, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := testServer(t).LoadServerConfig(file, tt.options)
+			if nil == err || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v want %q", err, tt.err)
+			}
+		})
+	}
+
+	/* The last occurrence wins, and the options override the file */
+	file := filepath.Join(t.TempDir(), "vardis.conf")
+	config := "# comment\nport 7000\nslowlog-max-len 10\nslowlog-max-len 20\nrequirepass \"a b\"\n" +
+		"latency-tracking-info-percentiles 50 90\n"
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t)
+	if err := s.LoadServerConfig(file, "port 7001\nappendfsync always"); err != nil {
+		t.Fatal(err)
+	}
+	if s.PORT != 7001 || s.slowlogMaxLen != 20 || s.requirePass != "a b" ||
+		len(s.latencyTrackingPercentiles) != 2 || s.aofFsync != cache.AOF_FSYNC_ALWAYS {
+		t.Errorf("got port %d, slowlog-max-len %d, requirepass %q, percentiles %v, appendfsync %d",
+			s.PORT, s.slowlogMaxLen, s.requirePass, s.latencyTrackingPercentiles, s.aofFsync)
+	}
+	if s.configfile != file {
+		t.Errorf("got config file %q want %q", s.configfile, file)
+	}
+	if err := s.LoadServerConfig(filepath.Join(t.TempDir(), "nosuch.conf"), ""); nil == err ||
+		!strings.HasPrefix(err.Error(), "Fatal error, can't open config file") {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	/* The options are listed in the order of the table */
+	c.send("CONFIG GET slowlog-max* port\r\n")
+	c.expect("*4\r\n$4\r\nport\r\n$4\r\n6379\r\n$15\r\nslowlog-max-len\r\n$3\r\n128\r\n")
+	c.send("CONFIG SET slowlog-max-len 5 latency-monitor-threshold 3\r\n")
+	c.expect("+OK\r\n")
+	c.send("CONFIG GET slowlog-max-len latency-monitor-threshold\r\n")
+	c.expect("*4\r\n$15\r\nslowlog-max-len\r\n$1\r\n5\r\n$25\r\nlatency-monitor-threshold\r\n$1\r\n3\r\n")
+
+	tests := []struct {
+		args  string
+		reply string
+	}{
+		{"slowlog-max-len 7 loglevel loud", "-ERR CONFIG SET failed (possibly related to argument 'loglevel') - " +
+			"argument(s) must be one of the following: 'debug', 'verbose', 'notice', 'warning', 'nothing'\r\n"},
+		{"slowlog-max-len 7 port 1", "-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config\r\n"},
+		{"slowlog-max-len 7 nope 1", "-ERR Unknown option or number of arguments for CONFIG SET - 'nope'\r\n"},
+		{"slowlog-max-len 7 slowlog-max-len 8", "-ERR CONFIG SET failed (possibly related to argument 'slowlog-max-len') - duplicate parameter\r\n"},
+		{"slowlog-max-len x", "-ERR CONFIG SET failed (possibly related to argument 'slowlog-max-len') - " +
+			"argument couldn't be parsed into an integer\r\n"},
+		{"slowlog-max-len", "-ERR Unknown subcommand or wrong number of arguments for 'SET'. Try CONFIG HELP.\r\n"},
+	}
+	for _, tt := range tests {
+		c.send("CONFIG SET " + tt.args + "\r\n")
+		c.expect(tt.reply)
+		/* The parameters are set all together or not at all */
+		c.send("CONFIG GET slowlog-max-len\r\n")
+		c.expect("*2\r\n$15\r\nslowlog-max-len\r\n$1\r\n5\r\n")
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("CONFIG REWRITE\r\n")
+	c.expect("-ERR The server is running without a config file\r\n")
+
+	file := filepath.Join(t.TempDir(), "vardis.conf")
+	config := "# my config\nport 7000\n\n# slow\nslowlog-max-len 10\nslowlog-max-len 20\n"
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	err := s.LoadServerConfig(file, "")
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* The options are rewritten in place without the duplicates, keeping
+	 * the comments, and the others not at their default are appended */
+	c.send("CONFIG SET requirepass \"a b\" appendfsync always slowlog-max-len 5\r\n")
+	c.expect("+OK\r\n")
+	c.send("CONFIG REWRITE\r\n")
+	c.expect("+OK\r\n")
+	want := "# my config\nport 7000\n\n# slow\nslowlog-max-len 5\n" +
+		CONFIG_REWRITE_SIGNATURE + "\nappendfsync always\nrequirepass \"a b\"\n"
+	data, err := os.ReadFile(file)
+	if err != nil || string(data) != want {
+		t.Fatalf("got %q (%v) want %q", data, err, want)
+	}
+
+	/* Rewriting again is stable, and the file loads back */
+	c.send("CONFIG REWRITE\r\n")
+	c.expect("+OK\r\n")
+	if data, err = os.ReadFile(file); err != nil || string(data) != want {
+		t.Fatalf("second rewrite: got %q (%v) want %q", data, err, want)
+	}
+	s2 := testServer(t)
+	if err := s2.LoadServerConfig(file, ""); err != nil || s2.requirePass != "a b" || s2.slowlogMaxLen != 5 {
+		t.Errorf("reload: got %v, requirepass %q, slowlog-max-len %d", err, s2.requirePass, s2.slowlogMaxLen)
+	}
+}
+
+func TestConfigResetStat(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("SET a 1\r\nNOSUCH\r\nCONFIG RESETSTAT\r\nGET a\r\nINFO stats\r\n")
+	c.expect("+OK\r\n")
+	c.skip("+OK\r\n")
+	c.expect("$1\r\n1\r\n")
+	info := c.bulk()
+	for _, want := range []string{"total_commands_processed:2\r\n", "total_error_replies:0\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO stats: no %q in %q", want, info)
+		}
+	}
+}
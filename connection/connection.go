@@ -2,158 +2,778 @@ package connection
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/valarpirai/vardis/cache"
 	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
 )
 
 const MAX_DB_COUNT = 15
 
+// Redis version whose protocol and command set vardis follows
+// Reported to clients by HELLO
+const REDIS_VERSION = "6.0.0"
+
 type Server struct {
-	PORT        uint16
-	cache       [MAX_DB_COUNT]*cache.CacheStorage
-	persistance *cache.Persistance
-	commandMap  map[string]*RedisCommand
+	PORT         uint16
+	cache        [MAX_DB_COUNT]*cache.CacheStorage
+	persistance  *cache.Persistance
+	commandMap   map[string]*RedisCommand
+	nextClientID int64
+
+	/* Commands are executed one at a time, like in the single threaded
+	 * redis event loop. Everything below, the keyspace and the per client
+	 * command state are protected by mu. */
+	mu          sync.Mutex
+	watchedKeys map[watchedKey][]*ClientConnection /* WATCHed keys, see multi.go */
+	dirty       int64                              /* Changes to DB, a command that changes it is propagated to the AOF */
+
+	pubsubChannels map[string][]*ClientConnection /* Subscribers of each channel, see pubsub.go */
+	pubsubPatterns []pubsubPattern                /* Pattern subscriptions */
+
+	notifyKeyspaceEvents int /* Events to propagate via Pub/Sub, see notify.go */
+
+	configfile       string /* Absolute config file path, empty for none */
+	aofFilename      string /* Name of the AOF file */
+	aofFsync         int    /* Kind of fsync() policy, cache.AOF_FSYNC_* */
+	aofLoadTruncated bool   /* Don't stop on unexpected AOF EOF. */
+	verbosity        int    /* Loglevel, LL_* */
+	logfile          string /* Path of log file, empty for stdout */
+
+	loading            bool      /* We are loading data from disk if true, see aof.go */
+	loadingStartTime   time.Time /* Time the loading started */
+	loadingTotalBytes  int64     /* Size of the AOF file */
+	loadingLoadedBytes int64     /* Bytes of the AOF file replayed so far */
+
+	requirePass   string /* Password of the default user, empty for none */
+	protectedMode bool   /* Refuse non loopback clients when there is no password */
+
+	clients     map[int64]*ClientConnection /* Connected clients by id */
+	users       map[string]*aclUser         /* ACL users by name, see acl.go */
+	defaultUser *aclUser
+	aclLog      []*aclLogEntry /* Denied commands and authentications, newest first */
+	aclFile     string
+
+	bindaddr       []string /* Addresses we should bind to, "-" prefixed when optional */
+	unixsocket     string   /* UNIX socket path */
+	unixsocketperm uint32   /* UNIX socket permission (see mode_t) */
+
+	tlsPort            int              /* TLS listening port, 0 for none */
+	tlsCtxConfig       tlsContextConfig /* tls-* files, protocols and ciphers, see tls.go */
+	tlsAuthClients     int              /* TLS_CLIENT_AUTH_* */
+	tlsAuthClientsUser int              /* TLS_CLIENT_FIELD_*, authenticate by certificate */
+	tlsContext         atomic.Value     /* *tls.Config of the new TLS connections */
+
+	maxclients   int /* Max number of simultaneous clients */
+	maxidletime  int /* Client timeout in seconds */
+	tcpkeepalive int /* Set SO_KEEPALIVE if non-zero. */
+	tcpBacklog   int /* TCP listen() backlog */
+
+	clientMaxQuerybufLen int64                                      /* Limit for client query buffer length */
+	protoMaxBulkLen      int64                                      /* Protocol bulk length maximum size. */
+	clientObufLimits     [CLIENT_TYPE_OBUF_COUNT]clientBufferLimits /* Output buffer limits by client class */
+	maxmemoryClients     int64                                      /* Memory limit for total client buffers, negative for a percent */
+
+	listeners       []net.Listener /* Accept the clients, closed on shutdown */
+	shutdownAsap    bool           /* Shutdown started, see shutdown.go */
+	shutdownStatus  int            /* Exit status returned by Start */
+	shutdownTimeout int            /* Seconds to wait for the replies on shutdown */
+	writers         sync.WaitGroup /* Running client write loops */
+
+	pauseType int           /* CLIENT_PAUSE_OFF, CLIENT_PAUSE_WRITE or CLIENT_PAUSE_ALL */
+	pauseEnd  time.Time     /* Time when the clients are unpaused */
+	pauseCh   chan struct{} /* Closed when the clients are unpaused */
+
+	monitors []*ClientConnection /* Clients in MONITOR mode, see monitor.go */
+
+	slowlog              []*slowlogEntry /* Slow commands, oldest first, see slowlog.go */
+	slowlogEntryID       int64           /* SLOWLOG current entry ID */
+	slowlogLogSlowerThan int64           /* SLOWLOG time limit (to get logged) */
+	slowlogMaxLen        int             /* SLOWLOG max number of items logged */
+
+	/* Fields used only for stats, see info.go */
+	startTime                  time.Time        /* Server start time */
+	runID                      string           /* ID always different at every exec. */
+	replID                     string           /* Replication ID, reported by INFO replication */
+	commandStats               []commandStats   /* Per command stats, by command id */
+	latencyTrackingEnabled     bool             /* latency-tracking */
+	latencyTrackingPercentiles []float64        /* latency-tracking-info-percentiles */
+	errorStats                 map[string]int64 /* Error replies by error code */
+	statNumCommands            int64            /* Number of processed commands */
+	statNumConnections         int64            /* Number of connections received */
+	statRejectedConn           int64            /* Clients rejected because of maxclients */
+	statEvictedClients         int64            /* Clients evicted because of maxmemory-clients */
+	statClientQbufLimitDisconn int64            /* Clients closed for reaching the query buffer limit */
+	statClientObufLimitDisconn int64            /* Clients closed for reaching the output buffer limits */
+	statTotalErrorReplies      int64            /* Total number of issued error replies */
+	statNetInputBytes          int64            /* Bytes read from network, atomic */
+	statNetOutputBytes         int64            /* Bytes written to network, atomic */
+	statTotalReadsProcessed    int64            /* Reads from the sockets, atomic */
+	statTotalWritesProcessed   int64            /* Writes to the sockets, atomic */
+	statPeakMemory             uint64           /* Max used memory seen, atomic */
+	aclInfo                    aclInfo          /* Denied ACL accesses */
+	instMetrics                [STATS_METRIC_COUNT]instMetric
+
+	latencyEvents           map[string]*latencyTimeSeries /* Latency monitor events, see latency.go */
+	latencyMonitorThreshold int64                         /* latency-monitor-threshold, in milliseconds */
+
+	currentClient        *ClientConnection             /* Client running the current command, nil for expires */
+	trackingTable        map[string]map[int64]struct{} /* Client ids that read each key, see tracking.go */
+	prefixTable          map[string]*bcastState        /* BCAST tracking prefixes */
+	trackingClients      int                           /* Clients with tracking enabled */
+	trackingTableMaxKeys int                           /* tracking-table-max-keys, 0 for no limit */
 }
 
+/* Client flags */
+var CLIENT_SLAVE uint64 = (1 << 0)             /* This client is a replica server */
+var CLIENT_MONITOR uint64 = (1 << 2)           /* This client is a slave monitor, see MONITOR */
+var CLIENT_MULTI uint64 = (1 << 3)             /* This client is in a MULTI context */
+var CLIENT_BLOCKED uint64 = (1 << 4)           /* The client is waiting in a blocking operation */
+var CLIENT_DIRTY_CAS uint64 = (1 << 5)         /* Watched keys modified. EXEC will fail. */
+var CLIENT_CLOSE_AFTER_REPLY uint64 = (1 << 6) /* Close after writing entire reply. */
+var CLIENT_CLOSE_ASAP uint64 = (1 << 10)       /* Close this client ASAP */
+var CLIENT_UNIX_SOCKET uint64 = (1 << 11)      /* Client connected via Unix domain socket */
+var CLIENT_DIRTY_EXEC uint64 = (1 << 12)       /* EXEC will fail for errors while queueing */
+var CLIENT_PUBSUB uint64 = (1 << 18)           /* Client is in Pub/Sub mode. */
+var CLIENT_PREVENT_AOF_PROP uint64 = (1 << 19) /* Don't propagate to AOF. */
+var CLIENT_REPLY_OFF uint64 = (1 << 22)        /* Don't send replies to client. */
+var CLIENT_REPLY_SKIP_NEXT uint64 = (1 << 23)  /* Set CLIENT_REPLY_SKIP for next cmd */
+var CLIENT_REPLY_SKIP uint64 = (1 << 24)       /* Don't send just this reply. */
+var CLIENT_NO_EVICT uint64 = (1 << 43)         /* This client is protected against client
+   memory eviction. */
+
 type ClientConnection struct {
+	server  *Server
 	cconn   net.Conn
 	cache   *cache.CacheStorage
 	reader  *bufio.Reader
 	storage *cache.Persistance
+	req     *proto.Request
+	out     *replyBuffer
+	aofBuf  []byte
+	id      int64
+	name    string
+	resp    int /* RESP protocol version, 2 or 3 */
+	dbid    int
+	flags   uint64
+
+	ctime           time.Time     /* Client creation time. */
+	lastinteraction time.Time     /* Time of the last interaction, used for timeout */
+	lastcmd         *RedisCommand /* Last command executed. */
+	qbuf            int           /* Bytes read from the socket, not yet processed */
+	libName         string        /* CLIENT SETINFO lib-name */
+	libVer          string        /* CLIENT SETINFO lib-ver */
+
+	authenticated bool     /* Needed when the default user has a password */
+	user          *aclUser /* User associated with this connection, nil for AOF loading */
+
+	mstate      []multiCmd   /* MULTI/EXEC queued commands */
+	watchedKeys []watchedKey /* Keys WATCHed for MULTI/EXEC CAS */
+
+	pubsubChannels           map[string]struct{} /* Channels the client is subscribed to */
+	pubsubPatterns           []string            /* Patterns the client is subscribed to */
+	obufSoftLimitReachedTime int64               /* Unix time the soft output limit was first reached */
+
+	clientTrackingRedirection int64               /* Client id invalidations are sent to, 0 for itself */
+	clientTrackingPrefixes    map[string]struct{} /* BCAST prefixes of the client */
+
+	monitorDropped int64 /* Commands not sent to this MONITOR since its buffer is full */
 }
 
-// NewServer
+// NewServer creates a server with the default configuration, port
+// overrides the configured one when not 0
 func NewServer(port uint16, cacheStore *cache.CacheStorage, persistant *cache.Persistance) *Server {
 	server := new(Server)
-	server.PORT = port
+	initConfigValues(server)
+	if 0 != port {
+		server.PORT = port
+	}
 	server.cache[0] = cacheStore
-	server.persistance = persistant
 	server.commandMap = PopulateCommandTable()
+	server.watchedKeys = make(map[watchedKey][]*ClientConnection)
+	server.pubsubChannels = make(map[string][]*ClientConnection)
+	server.startTime = time.Now()
+	server.runID = util.RandomHex(CONFIG_RUN_ID_SIZE)
+	server.replID = util.RandomHex(CONFIG_RUN_ID_SIZE)
+	server.commandStats = make([]commandStats, len(redisCommandTable))
+	server.errorStats = make(map[string]int64)
+	server.latencyEvents = make(map[string]*latencyTimeSeries)
+	server.clients = make(map[int64]*ClientConnection)
+	server.users = make(map[string]*aclUser)
+	server.defaultUser = server.aclCreateUser("default")
+	for _, rule := range []string{"+@all", "~*", "&*", "on", "nopass"} {
+		server.aclSetUser(server.defaultUser, rule)
+	}
+	server.users["default"] = server.defaultUser
+	if nil != persistant {
+		server.setPersistance(persistant)
+	}
+	for j, db := range server.cache {
+		if nil != db {
+			dbid := j
+			db.SetModifiedHook(func(key string) {
+				server.touchWatchedKey(dbid, key)
+				server.trackingInvalidateKey(server.currentClient, key, true)
+			})
+			db.SetNotifyHook(func(class int, event string, key string) {
+				server.notifyKeyspaceEvent(class, event, key, dbid)
+			})
+		}
+	}
 	return server
 }
 
-func (s *Server) Start() {
-	l, err := net.Listen("tcp4", ":"+fmt.Sprint(s.PORT))
+// OpenAppendOnlyFile opens the AOF named by appendfilename, once the
+// config is loaded, for the servers created without persistance
+func (s *Server) OpenAppendOnlyFile() error {
+	persistant, err := cache.NewStorage(s.aofFilename)
+	if err != nil {
+		return fmt.Errorf("Can't open the append-only file: %s", err)
+	}
+	s.setPersistance(persistant)
+	return nil
+}
+
+func (s *Server) setPersistance(persistant *cache.Persistance) {
+	s.persistance = persistant
+	persistant.SetFsyncPolicy(s.aofFsync)
+	persistant.SetFsyncHook(func(d time.Duration) {
+		s.mu.Lock()
+		s.latencyAddSampleIfNeeded("aof-fsync", d)
+		s.mu.Unlock()
+	})
+}
+
+// Start serves the clients until the server is shut down, returning the
+// exit status of the process
+func (s *Server) Start() int {
+	s.mu.Lock()
+	if s.shutdownAsap {
+		/* The startup was aborted before the listeners were created */
+		s.mu.Unlock()
+		return s.finishShutdown()
+	}
+	if allowed := adjustOpenFilesLimit(s.maxclients); allowed < s.maxclients {
+		if allowed < 1 {
+			s.mu.Unlock()
+			return 1
+		}
+		s.maxclients = allowed
+	}
+	err := s.initListeners()
+	listeners := s.listeners
+	backlog := s.tcpBacklog
+	s.mu.Unlock()
 	if err != nil {
 		log.Errorln(err)
-		return
+		return 1
+	}
+	checkTcpBacklogSettings(backlog)
+
+	if s.PORT != 0 {
+		log.Infof("Started vardis server on port: %d\n", s.PORT)
+	}
+	if s.tlsPort != 0 {
+		log.Infof("Started vardis server on TLS port: %d", s.tlsPort)
+	}
+	if s.unixsocket != "" {
+		log.Infof("The server is now ready to accept connections at %s", s.unixsocket)
+	}
+	go s.serverCron()
+	stopSignals := s.setupSignalHandlers()
+	defer stopSignals()
+
+	/* Every listener feeds the same dispatcher, Start returns once the
+	 * first of them fails, which is how a shutdown closes them. */
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go s.acceptHandler(l, errs)
+	}
+	err = <-errs
+	s.mu.Lock()
+	shutdown := s.shutdownAsap
+	if !shutdown {
+		s.closeListeners()
+	}
+	s.mu.Unlock()
+	if shutdown {
+		return s.finishShutdown()
+	}
+	log.Errorln(err)
+	return 1
+}
+
+const CONFIG_BINDADDR_MAX = 16
+const CONFIG_DEFAULT_BIND = "* -::*"
+
+/* initListeners creates the listeners of the configured bind addresses on
+ * the TCP port and on the TLS port, unless they are 0, and of the unix
+ * socket, if any. Must be called with s.mu held */
+func (s *Server) initListeners() error {
+	if s.PORT != 0 {
+		if err := s.listenToPort(int(s.PORT), nil); err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed listening on port %d (tcp), aborting.", s.PORT)
+		}
+	}
+	if s.tlsPort != 0 {
+		if err := s.tlsConfigure(); err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed to configure TLS: %s", err)
+		}
+		if err := s.listenToPort(s.tlsPort, s.tlsListenerConfig()); err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed listening on port %d (tls), aborting.", s.tlsPort)
+		}
+	}
+
+	/* Open the listening Unix domain socket. */
+	if s.unixsocket != "" {
+		os.Remove(s.unixsocket) /* don't care if this fails */
+		l, err := net.Listen("unix", s.unixsocket)
+		if err == nil && s.unixsocketperm != 0 {
+			if err = os.Chmod(s.unixsocket, os.FileMode(s.unixsocketperm)); err != nil {
+				l.Close()
+			}
+		}
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed opening Unix socket: %s", err)
+		}
+		if err := anetListenBacklog(l, s.tcpBacklog); err != nil {
+			log.Warnf("Unable to set the listen backlog to %d: %s", s.tcpBacklog, err)
+		}
+		s.listeners = append(s.listeners, l)
+	}
+
+	/* Abort if there are no listening sockets at all. */
+	if len(s.listeners) == 0 {
+		return errors.New("Configured to not listen anywhere, exiting.")
+	}
+	return nil
+}
+
+/* listenToPort adds to s.listeners the listeners of the bind addresses on
+ * port, TLS ones when tlsConfig is not nil.
+ *
+ * "*" binds every IPv4 address and "::*" every IPv6 address. An address
+ * starting with "-" is optional: when it is not available on this host it
+ * is skipped instead of failing. */
+func (s *Server) listenToPort(port int, tlsConfig *tls.Config) error {
+	for _, addr := range s.bindaddr {
+		optional := strings.HasPrefix(addr, "-")
+		if optional {
+			addr = addr[1:]
+		}
+		network, host := "tcp4", addr
+		if addr == "*" {
+			host = "0.0.0.0"
+		} else if addr == "::*" {
+			network, host = "tcp6", "::"
+		} else if strings.Contains(addr, ":") {
+			/* Bind IPv6 address. */
+			network = "tcp6"
+		}
+		l, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			log.Warnf("Warning: Could not create server TCP listening socket %s:%d: %s", addr, port, err)
+			if optional && anetIsUnavailableAddr(err) {
+				/* Optional bind, the address or the protocol is not
+				 * available on this host, continue. */
+				continue
+			}
+			return err
+		}
+		if err := anetListenBacklog(l, s.tcpBacklog); err != nil {
+			log.Warnf("Unable to set the listen backlog to %d: %s", s.tcpBacklog, err)
+		}
+		if nil != tlsConfig {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+// anetIsUnavailableAddr returns true for the errors of listen telling the
+// address or the protocol doesn't exist on this host
+func anetIsUnavailableAddr(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT) ||
+		errors.Is(err, syscall.EPROTONOSUPPORT)
+}
+
+// closeListeners stops accepting clients, the unix socket file is removed
+// Must be called with s.mu held
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
 	}
-	defer l.Close()
+	s.listeners = nil
+}
 
-	log.Infof("Started vardis server on port: %d\n", s.PORT)
+// acceptHandler accepts the clients of l until it is closed, sending the
+// error that stopped it to errs
+func (s *Server) acceptHandler(l net.Listener, errs chan<- error) {
 	for {
-		connection, err := l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Errorln(err)
+			errs <- err
 			return
 		}
-		cc := new(ClientConnection)
-		cc.cconn = connection
-		cc.cache = s.cache[0]
-		cc.reader = bufio.NewReader(connection)
-		go s.handleConnection(cc, s.persistance)
+		if s.protectedModeRefuses(conn) {
+			continue
+		}
+		if c := s.acceptCommonHandler(conn); nil != c {
+			go s.handleConnection(c)
+		}
 	}
 }
 
-func (s *Server) handleConnection(c_conn *ClientConnection, persistance *cache.Persistance) {
-	conn := c_conn.cconn
-	defer conn.Close()
-	log.Infof("Serving client: %s\n", conn.RemoteAddr().String())
+var protectedModeErr = []byte("-DENIED Redis is running in protected mode because protected mode is enabled, no bind address was specified, no authentication password is requested to clients. In this mode connections are only accepted from the loopback interface. If you want to connect from external computers to Redis you may adopt one of the following solutions: 1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, however MAKE SURE Redis is not publicly accessible from internet if you do so. 2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. 3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. 4) Setup a bind address or an authentication password. NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.\r\n")
+
+// acceptCommonHandler sets the socket options of a new client and links
+// it, or closes it with an error when there are already maxclients clients
+func (s *Server) acceptCommonHandler(conn net.Conn) *ClientConnection {
+	cc := s.createClient(conn)
+
+	/* Limit the number of connections we take at the same time. The
+	 * client is linked in the same critical section, so the listeners
+	 * accepting concurrently can't take more than maxclients. */
+	s.mu.Lock()
+	rejected := len(s.clients) >= s.maxclients
+	if rejected {
+		s.statRejectedConn++
+	} else {
+		s.linkClient(cc)
+	}
+	tcpkeepalive := s.tcpkeepalive
+	s.mu.Unlock()
+	if rejected {
+		rejectConn(conn, []byte("-ERR max number of clients reached\r\n"))
+		return nil
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if tcpkeepalive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(time.Duration(tcpkeepalive) * time.Second)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+	return cc
+}
+
+// rejectConn sends the error to a refused client and closes it. The write
+// is done by its own goroutine, outside s.mu: a slow client, or the TLS
+// handshake the write starts, must not block the accept loop
+func rejectConn(conn net.Conn, msg []byte) {
+	go func() {
+		/* That's a best effort error message, don't check write errors.
+		 * The deadline bounds the TLS handshake too. */
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(msg)
+		conn.Close()
+	}()
+}
+
+// protectedModeRefuses closes connections from other hosts when protected
+// mode is on, no bind address is configured and no password is set, and
+// returns true if it did. The unix socket clients are local
+func (s *Server) protectedModeRefuses(conn net.Conn) bool {
+	s.mu.Lock()
+	refuse := s.protectedMode && strings.Join(s.bindaddr, " ") == CONFIG_DEFAULT_BIND &&
+		s.defaultUser.flags&USER_FLAG_NOPASS != 0
+	s.mu.Unlock()
+	if !refuse {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || addr.IP.IsLoopback() {
+		return false
+	}
+	log.Warnf("Refused connection from %s, protected mode is enabled", addr.String())
+	rejectConn(conn, protectedModeErr)
+	return true
+}
+
+// newClient creates the client of conn and links it
+func (s *Server) newClient(conn net.Conn) *ClientConnection {
+	cc := s.createClient(conn)
+	s.mu.Lock()
+	s.linkClient(cc)
+	s.mu.Unlock()
+	return cc
+}
+
+// createClient allocates the client of conn, it's not visible to the
+// other clients until linkClient
+func (s *Server) createClient(conn net.Conn) *ClientConnection {
+	cc := new(ClientConnection)
+	cc.id = atomic.AddInt64(&s.nextClientID, 1)
+	cc.resp = 2
+	cc.server = s
+	cc.cconn = conn
+	if _, ok := conn.(*net.UnixConn); ok {
+		cc.flags |= CLIENT_UNIX_SOCKET
+	}
+	cc.reader = bufio.NewReaderSize(connReader{conn, s}, 16*1024)
+	cc.req = new(proto.Request)
+	cc.out = newReplyBuffer()
+	cc.ctime = time.Now()
+	cc.lastinteraction = cc.ctime
+	return cc
+}
+
+// linkClient adds the client to s.clients, must be called with s.mu held.
+// The client is visible to the other clients and to serverCron once in
+// s.clients, so it must be fully initialized before
+func (s *Server) linkClient(cc *ClientConnection) {
+	s.writers.Add(1)
+	cc.cache = s.cache[0]
+	cc.storage = s.persistance
+	cc.user = s.defaultUser
+	cc.authenticated = s.defaultUser.flags&USER_FLAG_NOPASS != 0 &&
+		s.defaultUser.flags&USER_FLAG_DISABLED == 0
+	cc.req.SetLimits(int(s.protoMaxBulkLen), int(s.clientMaxQuerybufLen))
+	s.clients[cc.id] = cc
+	s.statNumConnections++
+}
+
+func (s *Server) handleConnection(c_conn *ClientConnection) {
+	defer s.freeClient(c_conn)
+	go c_conn.writeLoop()
+	log.Infof("Serving client: %s\n", c_conn.cconn.RemoteAddr().String())
+	if !s.tlsHandshake(c_conn) {
+		return
+	}
 	for {
 		// Reading Commands and decoding
-		// Parse RAW commands properly
-		netData, rawCmd, err := proto.Decode(c_conn.reader)
+		request := c_conn.req
+		err := proto.ReadRequest(c_conn.reader, request)
+		if err == proto.ErrQueryBufferLimit {
+			s.mu.Lock()
+			log.Warnf("Closing client that reached max query buffer length: %s", catClientInfoString(c_conn))
+			s.statClientQbufLimitDisconn++
+			s.mu.Unlock()
+			return
+		}
 		if err != nil {
-			log.Error(err)
+			if _, ok := err.(*proto.ProtocolError); ok {
+				s.mu.Lock()
+				c_conn.addReplyError(err.Error())
+				s.mu.Unlock()
+			}
+			log.Debug(err)
 			return
 		}
+		log.Debugf("REQEUST -> %s\n", request)
 
-		request := proto.ParseCommand(netData)
-		request.SetRawCommand(rawCmd)
-		log.Debugf("REQEUST -> %#v\n", request)
-		// log.Debugf("RAW -> %#v", rawCmd)
+		if request.CommandLength() > 0 {
+			s.mu.Lock()
+			c_conn.lastinteraction = time.Now()
+			c_conn.qbuf = c_conn.reader.Buffered()
+			c_conn.req.SetLimits(int(s.protoMaxBulkLen), int(s.clientMaxQuerybufLen))
+			if request.Command() == "quit" {
+				c_conn.addReplyBytes(shared.ok)
+				s.mu.Unlock()
+				return
+			}
+			s.waitIfPaused(c_conn, request)
+			/* Commands received after a shutdown started are not executed */
+			if s.shutdownAsap {
+				s.mu.Unlock()
+				return
+			}
+			s.ProcessCommands(request, c_conn)
 
-		log.Debugf("Full command %#v\n", netData)
-		// log.Debugln(netData)
-		// log.Debugf("%T\n", netData)
+			/* Remove the CLIENT_REPLY_SKIP flag if any so that the reply
+			 * to the next command will be sent, but set the flag if the command
+			 * we just processed was "CLIENT REPLY SKIP". */
+			c_conn.flags &= ^CLIENT_REPLY_SKIP
+			if c_conn.flags&CLIENT_REPLY_SKIP_NEXT != 0 {
+				c_conn.flags |= CLIENT_REPLY_SKIP
+				c_conn.flags &= ^CLIENT_REPLY_SKIP_NEXT
+			}
 
-		if netData == "STOP" || netData == "QUIT" {
-			return
+			/* Remove the CLIENT_TRACKING_CACHING flag unless the command is
+			 * CLIENT CACHING, then send the keys modified to the BCAST clients. */
+			if c_conn.flags&CLIENT_MULTI == 0 && (nil == c_conn.lastcmd || c_conn.lastcmd.name != "client") {
+				c_conn.flags &= ^CLIENT_TRACKING_CACHING
+			}
+			s.trackingBroadcastInvalidationMessages()
+			closeAfterReply := c_conn.flags&CLIENT_CLOSE_AFTER_REPLY != 0
+			s.mu.Unlock()
+			if closeAfterReply {
+				return
+			}
 		}
 
-		if !request.Error() {
-			// result := c_conn.cache.ProcessCommands(request)
-			s.ProcessCommands(request, c_conn)
-			// c_conn.resultHandler(result)
-		} else {
-			c_conn.resultHandler(nil)
+		// Flush once the pipelined batch already read is processed
+		if c_conn.reader.Buffered() == 0 {
+			c_conn.flush()
 		}
 	}
 }
 
-func (s *Server) ProcessCommands(req *proto.Request, conn *ClientConnection) {
-	log.Debug("Command Length: " + strconv.Itoa(req.CommandLength()))
-	log.Debugf("COMMAND -> %#v", req.Command())
+func (s *Server) freeClient(c *ClientConnection) {
+	s.mu.Lock()
+	delete(s.clients, c.id)
+	unwatchAllKeys(c)
+	pubsubUnsubscribeAllChannels(c, false)
+	pubsubUnsubscribeAllPatterns(c, false)
+	disableTracking(c)
+	unmonitorClient(c)
+	s.mu.Unlock()
+	c.closeAfterReply()
+}
 
-	redisCmd := s.commandMap[req.Command()]
+// ProcessCommands looks up and checks the command, then executes or queues it
+// Must be called with s.mu held
+func (s *Server) ProcessCommands(req *proto.Request, conn *ClientConnection) {
+	redisCmd := s.commandMap[string(req.Argv()[0])]
 	if nil == redisCmd {
+		conn.lastcmd = nil
 		log.Infof("unknown command `%s`", req.Command())
 		// Unknown command
-		conn.cconn.Write(proto.EncodeError(fmt.Sprintf("unknown command `%s`", req.Command())))
+		flagTransaction(conn)
+		conn.addReplyErrorFormat("unknown command `%s`", req.Command())
+		return
+	}
+	conn.lastcmd = redisCmd
+	if !redisCmd.checkArity(req.CommandLength()) {
+		s.commandStats[redisCmd.id].rejectedCalls++
+		flagTransaction(conn)
+		conn.addReplyErrorArity(req)
 		return
 	}
 
-	if redisCmd.Writable() == true {
-		s.persistance.WriteCommand(req.String())
+	/* Check if the user is authenticated. AUTH and HELLO are valid even
+	 * in non-authenticated state, QUIT is handled by the caller. */
+	if authRequired(conn) && redisCmd.name != "auth" && redisCmd.name != "hello" {
+		s.commandStats[redisCmd.id].rejectedCalls++
+		flagTransaction(conn)
+		conn.addReplyBytes(shared.noautherr)
+		return
 	}
 
-	redisCmd.Proc(req, conn)
+	/* Check if the user can run this command according to the current
+	 * ACLs. */
+	if reason, pos := aclCheckCommandPerm(conn.user, redisCmd, req.Argv()); reason != ACL_OK {
+		s.commandStats[redisCmd.id].rejectedCalls++
+		flagTransaction(conn)
+		aclDenied(conn, redisCmd, req.Argv(), reason, pos, "toplevel")
+		return
+	}
+
+	/* Only allow a subset of commands in the context of Pub/Sub if the
+	 * connection is in RESP2 mode. With RESP3 there are no limits. */
+	if conn.flags&CLIENT_PUBSUB != 0 && conn.resp == 2 &&
+		redisCmd.name != "ping" && redisCmd.name != "subscribe" &&
+		redisCmd.name != "unsubscribe" && redisCmd.name != "psubscribe" &&
+		redisCmd.name != "punsubscribe" {
+		s.commandStats[redisCmd.id].rejectedCalls++
+		conn.addReplyErrorFormat("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", redisCmd.name)
+		return
+	}
+
+	/* Loading DB? Return an error if the command has not the
+	 * CMD_LOADING flag. The AOF client, without a socket, replays it. */
+	if s.loading && nil != conn.cconn && redisCmd.flags&CMD_LOADING == 0 {
+		s.commandStats[redisCmd.id].rejectedCalls++
+		flagTransaction(conn)
+		conn.addReplyBytes(shared.loadingerr)
+		return
+	}
+
+	/* Exec the command */
+	if conn.flags&CLIENT_MULTI != 0 &&
+		redisCmd.name != "exec" && redisCmd.name != "discard" &&
+		redisCmd.name != "multi" && redisCmd.name != "watch" {
+		queueMultiCommand(conn, redisCmd, req.Argv())
+		conn.addReplyBytes(shared.queued)
+		return
+	}
+	s.call(conn, redisCmd, req)
 }
 
-func (s *ClientConnection) resultHandler(result interface{}) {
-	// Handling string, int, array(set) and hash resposes
+// call executes the command and propagates it to the AOF if it changed
+// the dataset
+func (s *Server) call(conn *ClientConnection, redisCmd *RedisCommand, req *proto.Request) {
+	dirty := s.dirty
+	conn.flags &^= CLIENT_PREVENT_AOF_PROP
+	s.execute(conn, redisCmd, req)
 
-	log.Debugf("Result  -> %#v\n", result)
-	// log.Debugf("Result Type  -> %T\n", result)
-	switch result.(type) {
-	case int:
-		num_result := result.(int)
-		s.cconn.Write([]byte(proto.EncodeInt(int64(num_result))))
-	case string:
-		str_result := result.(string)
-		s.cconn.Write([]byte(proto.EncodeString(str_result)))
-	case []string:
-		aInterface := result.([]string)
-		aString := make([][]byte, len(aInterface))
-		for i, v := range aInterface {
-			aString[i] = proto.EncodeBulkString(v)
-		}
-		s.cconn.Write([]byte(proto.EncodeArray(aString)))
-	default:
-		// Write nil as response
-		s.cconn.Write([]byte(proto.EncodeNull()))
+	/* Only the commands that changed the dataset are propagated: a write
+	 * command that failed, or that had nothing to change, is not.
+	 * Commands replayed from the AOF (no socket) must not be appended again,
+	 * and EXEC propagates the transaction by itself */
+	prevent := conn.flags&CLIENT_PREVENT_AOF_PROP != 0
+	conn.flags &^= CLIENT_PREVENT_AOF_PROP
+	if s.dirty != dirty && nil != conn.cconn && !prevent {
+		conn.aofBuf = proto.AppendCommand(conn.aofBuf[:0], req.Argv())
+		start := time.Now()
+		s.persistance.WriteCommand(conn.aofBuf)
+		s.latencyAddSampleIfNeeded("aof-write", time.Since(start))
 	}
 }
 
-func (server *Server) LoadFromDisk() {
-	log.SetLevel(log.WarnLevel)
-	defer log.SetLevel(log.DebugLevel)
-	reader := bufio.NewReader(server.persistance.AofFile)
-	cc := new(ClientConnection)
-	cc.cache = server.cache[0]
-	for {
-		netData, _, err := proto.Decode(reader)
-		if err != nil {
-			log.Error(err)
-			break
-		}
-		request := proto.ParseCommand(netData)
-		server.ProcessCommands(request, cc)
+// execute runs the command, times it and takes care of what follows
+// every execution: the command stats, slowlog, tracked keys and monitors.
+// Used by call() and by EXEC for the queued commands.
+func (s *Server) execute(conn *ClientConnection, redisCmd *RedisCommand, req *proto.Request) {
+	s.currentClient = conn
+	prevErrCount := s.statTotalErrorReplies
+	/* The command may rewrite its argv for the AOF, the slowlog and the
+	 * monitors get the original one */
+	argv := req.Argv()
+	start := time.Now()
+	redisCmd.Proc(req, conn)
+	elapsed := time.Since(start)
+	duration := elapsed.Microseconds()
+	s.currentClient = nil
+
+	redisCmd.microseconds += int(duration)
+	redisCmd.calls++
+	s.statNumCommands++
+	stats := &s.commandStats[redisCmd.id]
+	if s.statTotalErrorReplies > prevErrCount {
+		stats.failedCalls++
+	}
+	if s.latencyTrackingEnabled {
+		stats.recordLatency(elapsed.Nanoseconds())
+	}
+	if redisCmd.flags&CMD_FAST != 0 {
+		s.latencyAddSampleIfNeeded("fast-command", elapsed)
+	} else {
+		s.latencyAddSampleIfNeeded("command", elapsed)
+	}
+
+	/* Log the command into the Slow log if needed. */
+	if redisCmd.flags&CMD_SKIP_SLOWLOG == 0 && nil != conn.cconn {
+		s.slowlogPushEntryIfNeeded(conn, argv, duration)
+	}
+	s.replicationFeedMonitors(conn, redisCmd, argv)
+
+	/* If the client has keys tracking enabled for client side caching,
+	 * make sure to remember the keys it fetched via this command. */
+	if redisCmd.flags&CMD_READONLY != 0 &&
+		conn.flags&CLIENT_TRACKING != 0 && conn.flags&CLIENT_TRACKING_BCAST == 0 {
+		trackingRememberKeys(conn, redisCmd, argv)
 	}
-	log.Warn("Data Loaded successfully")
 }
@@ -0,0 +1,287 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/cache"
+	"github.com/valarpirai/vardis/proto"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+// testServer returns a server with its AOF in a temporary directory
+func testServer(t testing.TB) *Server {
+	t.Helper()
+	p, err := cache.NewStorage(filepath.Join(t.TempDir(), "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(0, cache.NewCache(), p)
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// testClient connects a new client to s through a pipe
+func testClient(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	c := s.newClient(a)
+	go func() {
+		s.handleConnection(c)
+		close(done)
+	}()
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		b.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	})
+	return &testConn{t, b, bufio.NewReader(b)}
+}
+
+// send writes the requests without waiting for the replies
+func (c *testConn) send(requests string) {
+	go c.conn.Write([]byte(requests))
+}
+
+// command sends argv as a multi bulk request
+func (c *testConn) command(argv ...string) {
+	args := make([][]byte, len(argv))
+	for j, arg := range argv {
+		args[j] = []byte(arg)
+	}
+	c.send(string(proto.AppendCommand(nil, args)))
+}
+
+// expect reads exactly the bytes of want
+func (c *testConn) expect(want string) {
+	c.t.Helper()
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatalf("read: %v (want %q)", err, want)
+	}
+	if !bytes.Equal(buf, []byte(want)) {
+		c.t.Fatalf("got %q want %q", buf, want)
+	}
+}
+
+// skip reads the replies up to the line end, included
+func (c *testConn) skip(end string) {
+	c.t.Helper()
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read: %v (waiting for %q)", err, end)
+		}
+		if line == end {
+			return
+		}
+	}
+}
+
+// bulk reads a bulk string reply
+func (c *testConn) bulk() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil || len(line) < 4 || line[0] != '$' {
+		c.t.Fatalf("got %q (%v), want a bulk string", line, err)
+	}
+	n, err := strconv.Atoi(line[1 : len(line)-2])
+	if err != nil || n < 0 {
+		c.t.Fatalf("got %q, want a bulk string", line)
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return string(buf[:n])
+}
+
+// waitFor polls cond, called with s.mu held, until it returns true
+func waitFor(t *testing.T, s *Server, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		s.mu.Lock()
+		done := cond()
+		s.mu.Unlock()
+		if done {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// readAOF returns the content of the AOF of s
+func readAOF(t *testing.T, s *Server) string {
+	t.Helper()
+	data, err := os.ReadFile(s.persistance.AofFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// freePort returns a TCP port of 127.0.0.1 free for listening
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// startServer runs s.Start on a free port of 127.0.0.1, and returns the
+// channel of its exit status once the clients can connect. The server is
+// shut down at the end of the test
+func startServer(t *testing.T, s *Server) chan int {
+	t.Helper()
+	s.PORT = freePort(t)
+	s.bindaddr = []string{"127.0.0.1"}
+	status := make(chan int, 1)
+	done := make(chan struct{})
+	go func() {
+		status <- s.Start()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.mu.Lock()
+		s.prepareForShutdown(SHUTDOWN_NOSAVE)
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	})
+	waitFor(t, s, "the listeners", func() bool { return len(s.listeners) > 0 || s.shutdownAsap })
+	return status
+}
+
+// dialServer connects a new client to the TCP port of s
+func dialServer(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.PORT))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t, conn, bufio.NewReader(conn)}
+}
+
+func TestBinarySafeKeysAndValues(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	payloads := []string{"a\r\nb", "\x00", "k\x00y\r\n", "$1\r\nx\r\n", ""}
+	var aof []byte
+	for _, key := range payloads {
+		for _, val := range payloads {
+			c.command("SET", key, val)
+			c.expect("+OK\r\n")
+			c.command("GET", key)
+			c.expect(string(proto.AppendBulk(nil, []byte(val))))
+			aof = proto.AppendCommand(aof, [][]byte{[]byte("set"), []byte(key), []byte(val)})
+		}
+	}
+	if got := readAOF(t, s); got != string(aof) {
+		t.Errorf("AOF: got %q want %q", got, aof)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	c := testClient(t, testServer(t))
+	c.send("PING\r\nset a b\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n*1\r\n$3\r\nfoo\r\n")
+	c.expect("+PONG\r\n+OK\r\n$1\r\nb\r\n-ERR unknown command `foo`\r\n")
+}
+
+func TestProtocolErrorClosesClient(t *testing.T) {
+	c := testClient(t, testServer(t))
+	c.send("*1\r\n+x\r\nPING\r\n")
+	c.expect("-ERR Protocol error: expected '$', got '+x'\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("got %v, the client is not closed", err)
+	}
+}
+
+func TestOnlyChangesArePropagated(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("set k v\r\nset k v badopt\r\nset k v NX\r\ndel nokey\r\ndel k\r\nget k\r\nflushall\r\n" +
+		"multi\r\ndel k\r\nexec\r\nmulti\r\nset k v\r\nexec\r\n")
+	c.expect("+OK\r\n-ERR syntax error\r\n$-1\r\n:0\r\n:1\r\n$-1\r\n+OK\r\n" +
+		"+OK\r\n+QUEUED\r\n*1\r\n:0\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n")
+	want := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n" +
+		"*2\r\n$3\r\ndel\r\n$1\r\nk\r\n" +
+		"*1\r\n$8\r\nflushall\r\n" +
+		"*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n*1\r\n$4\r\nexec\r\n"
+	if got := readAOF(t, s); got != want {
+		t.Errorf("AOF: got %q want %q", got, want)
+	}
+}
+
+func startBenchServer(b *testing.B) (*Server, net.Conn) {
+	s := testServer(b)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(s.newClient(conn))
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+/* GET requests sent P at a time, like redis-benchmark -P */
+func benchmarkPipeline(b *testing.B, pipeline int) {
+	s, conn := startBenchServer(b)
+	s.cache[0].Set("key", []byte("xxx"))
+	r := bufio.NewReader(conn)
+	batch := bytes.Repeat([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"), pipeline)
+	reply := []byte("$3\r\nxxx\r\n")
+	buf := make([]byte, len(reply)*pipeline)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += pipeline {
+		if _, err := conn.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipeline1(b *testing.B)  { benchmarkPipeline(b, 1) }
+func BenchmarkPipeline16(b *testing.B) { benchmarkPipeline(b, 16) }
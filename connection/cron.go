@@ -0,0 +1,135 @@
+package connection
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* serverCron runs CONFIG_DEFAULT_HZ times per second, with s.mu held,
+ * for the tasks that are not triggered by a command:
+ *
+ * - Sampling of the instantaneous metrics of INFO stats.
+ * - Active expire cycle, deleting the expired keys nobody reads.
+ * - Close the clients idle for more than timeout seconds.
+ * - Evict the clients using the most memory over maxmemory-clients.
+ * - Update of the memory peak. */
+
+const CONFIG_DEFAULT_HZ = 10 /* Time interrupt calls/sec. */
+
+const ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC = 25 /* Max % of CPU to use. */
+
+/* Instantaneous metrics tracking. */
+const STATS_METRIC_SAMPLES = 16   /* Number of samples per metric. */
+const STATS_METRIC_COMMAND = 0    /* Number of commands executed. */
+const STATS_METRIC_NET_INPUT = 1  /* Bytes read to network. */
+const STATS_METRIC_NET_OUTPUT = 2 /* Bytes written to network. */
+const STATS_METRIC_COUNT = 3
+
+type instMetric struct {
+	lastSampleTime  time.Time /* Timestamp of last sample */
+	lastSampleCount int64     /* Count in last sample */
+	samples         [STATS_METRIC_SAMPLES]int64
+	idx             int
+}
+
+func (s *Server) serverCron() {
+	ticker := time.NewTicker(time.Second / CONFIG_DEFAULT_HZ)
+	defer ticker.Stop()
+	cronloops := 0
+	for range ticker.C {
+		s.mu.Lock()
+		s.trackInstantaneousMetric(STATS_METRIC_COMMAND, s.statNumCommands)
+		s.trackInstantaneousMetric(STATS_METRIC_NET_INPUT, atomic.LoadInt64(&s.statNetInputBytes))
+		s.trackInstantaneousMetric(STATS_METRIC_NET_OUTPUT, atomic.LoadInt64(&s.statNetOutputBytes))
+		s.activeExpireCycle()
+		if cronloops%CONFIG_DEFAULT_HZ == 0 {
+			s.clientsCronHandleTimeout(time.Now())
+		}
+		s.evictClients()
+		s.mu.Unlock()
+
+		/* Record the max memory used since the server was started, once
+		 * per second: reading the memory stats stops the world. */
+		if cronloops%CONFIG_DEFAULT_HZ == 0 {
+			s.updatePeakMemory()
+		}
+		cronloops++
+	}
+}
+
+// clientsCronHandleTimeout closes the clients idle for more than timeout
+// seconds, replicas, blocked and Pub/Sub clients are expected to be idle
+func (s *Server) clientsCronHandleTimeout(now time.Time) {
+	if s.maxidletime == 0 {
+		return
+	}
+	maxidle := time.Duration(s.maxidletime) * time.Second
+	for _, c := range s.clients {
+		if c.flags&(CLIENT_SLAVE|CLIENT_BLOCKED|CLIENT_PUBSUB) == 0 &&
+			now.Sub(c.lastinteraction) > maxidle {
+			log.Debugf("Closing idle client")
+			c.freeClientAsync()
+		}
+	}
+}
+
+// activeExpireCycle runs the expire cycle of every db, using at most
+// ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC percent of the cron period
+func (s *Server) activeExpireCycle() {
+	start := time.Now()
+	deadline := start.Add(time.Second / CONFIG_DEFAULT_HZ * ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC / 100)
+	expired := 0
+	for _, db := range s.cache {
+		if nil != db {
+			expired += db.ActiveExpireCycle(deadline)
+		}
+	}
+	s.latencyAddSampleIfNeeded("expire-cycle", time.Since(start))
+	if expired > 0 {
+		s.trackingBroadcastInvalidationMessages()
+	}
+}
+
+// trackInstantaneousMetric adds a sample to the operations per second
+// array of samples
+func (s *Server) trackInstantaneousMetric(metric int, currentReading int64) {
+	m := &s.instMetrics[metric]
+	now := time.Now()
+	if !m.lastSampleTime.IsZero() {
+		t := now.Sub(m.lastSampleTime).Milliseconds()
+		ops := currentReading - m.lastSampleCount
+		opsSec := int64(0)
+		if t > 0 {
+			opsSec = ops * 1000 / t
+		}
+		m.samples[m.idx] = opsSec
+		m.idx = (m.idx + 1) % STATS_METRIC_SAMPLES
+	}
+	m.lastSampleTime = now
+	m.lastSampleCount = currentReading
+}
+
+// getInstantaneousMetric returns the mean of all the samples
+func (s *Server) getInstantaneousMetric(metric int) int64 {
+	var sum int64
+	for _, sample := range s.instMetrics[metric].samples {
+		sum += sample
+	}
+	return sum / STATS_METRIC_SAMPLES
+}
+
+// updatePeakMemory returns the memory stats, recording the peak
+func (s *Server) updatePeakMemory() runtime.MemStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	for {
+		peak := atomic.LoadUint64(&s.statPeakMemory)
+		if ms.HeapAlloc <= peak || atomic.CompareAndSwapUint64(&s.statPeakMemory, peak, ms.HeapAlloc) {
+			break
+		}
+	}
+	return ms
+}
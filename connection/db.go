@@ -0,0 +1,120 @@
+package connection
+
+import (
+	"strings"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+// Keyspace commands, not bound to a data type
+
+func delCommand(req *proto.Request, conn *ClientConnection) {
+	deleted := 0
+	for _, key := range req.Argv()[1:] {
+		deleted += conn.cache.Delete(string(key))
+	}
+	conn.server.dirty += int64(deleted)
+	conn.addReplyLongLong(int64(deleted))
+}
+
+func existsCommand(req *proto.Request, conn *ClientConnection) {
+	count := 0
+	for _, key := range req.Argv()[1:] {
+		if nil != expireIfNeeded(string(key), conn.cache) {
+			count++
+		}
+	}
+	conn.addReplyLongLong(int64(count))
+}
+
+func keysCommand(req *proto.Request, conn *ClientConnection) {
+	keys := conn.cache.Keys(req.Key())
+	conn.addReplyArrayLen(len(keys))
+	for _, key := range keys {
+		conn.addReplyBulkString(key)
+	}
+}
+
+/* -----------------------------------------------------------------------------
+ * API to get key arguments from commands
+ * Used by ACLs, client side caching, WATCH and, one day, cluster redirection.
+ * -------------------------------------------------------------------------- */
+
+/* Return the positions of the keys in argv, using the command getkeys_proc
+ * if any, or the firstkey, lastkey and keystep fields of the command table.
+ * A negative lastkey counts from the end of argv. */
+func getKeysFromCommand(cmd *RedisCommand, argv [][]byte) []int {
+	if nil != cmd.getkeys_proc {
+		return cmd.getkeys_proc(cmd, argv)
+	}
+	return getKeysUsingCommandTable(cmd, argv)
+}
+
+func getKeysUsingCommandTable(cmd *RedisCommand, argv [][]byte) []int {
+	if 0 == cmd.firstkey {
+		return nil
+	}
+	argc := len(argv)
+	last := cmd.lastkey
+	if last < 0 {
+		last = argc + last
+	}
+	if last < cmd.firstkey {
+		return nil
+	}
+	step := cmd.keystep
+	if step < 1 {
+		step = 1
+	}
+	keys := make([]int, 0, (last-cmd.firstkey)/step+1)
+	for j := cmd.firstkey; j <= last && j < argc; j += step {
+		keys = append(keys, j)
+	}
+	return keys
+}
+
+/* Like getKeysFromCommand() but returns the key names */
+func getKeyNamesFromCommand(cmd *RedisCommand, argv [][]byte) [][]byte {
+	positions := getKeysFromCommand(cmd, argv)
+	keys := make([][]byte, len(positions))
+	for i, pos := range positions {
+		keys[i] = argv[pos]
+	}
+	return keys
+}
+
+func flushdbCommand(req *proto.Request, conn *ClientConnection) {
+	if !getFlushAsync(req, conn) {
+		return
+	}
+	conn.server.dirty += int64(conn.cache.Flush())
+	/* Without the dirty++, when DB was already empty, FLUSHDB will not
+	 * be put into the AOF. */
+	conn.server.dirty++
+	conn.addReplyBytes(shared.ok)
+}
+
+func flushallCommand(req *proto.Request, conn *ClientConnection) {
+	if !getFlushAsync(req, conn) {
+		return
+	}
+	for _, db := range conn.server.cache {
+		if nil != db {
+			conn.server.dirty += int64(db.Flush())
+		}
+	}
+	/* Without the dirty++, when DB was already empty, FLUSHALL will not
+	 * be put into the AOF. */
+	conn.server.dirty++
+	conn.addReplyBytes(shared.ok)
+}
+
+/* FLUSHDB and FLUSHALL accept ASYNC, the flush is always synchronous here */
+func getFlushAsync(req *proto.Request, conn *ClientConnection) bool {
+	argv := req.Argv()
+	if len(argv) > 2 || (len(argv) == 2 && !strings.EqualFold(string(argv[1]), "async")) {
+		conn.addReplyBytes(shared.syntaxerr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package connection
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyspaceCommands(t *testing.T) {
+	c := testClient(t, testServer(t))
+	cases := []struct{ in, want string }{
+		{"set a 1\r\nset b 2\r\n", "+OK\r\n+OK\r\n"},
+		{"exists a b c a\r\n", ":3\r\n"},
+		{"keys a\r\n", "*1\r\n$1\r\na\r\n"},
+		{"keys ?x\r\n", "*0\r\n"},
+		{"del a c\r\n", ":1\r\n"},
+		{"exists a\r\n", ":0\r\n"},
+		{"get a\r\n", "$-1\r\n"},
+		{"flushdb\r\nexists b\r\n", "+OK\r\n:0\r\n"},
+		{"flushdb sync\r\n", "-ERR syntax error\r\n"},
+		{"flushall async\r\n", "+OK\r\n"},
+	}
+	for _, tc := range cases {
+		c.send(tc.in)
+		c.expect(tc.want)
+	}
+}
+
+func TestGetKeysFromCommand(t *testing.T) {
+	s := testServer(t)
+	cases := []struct {
+		argv []string
+		keys []int
+	}{
+		{[]string{"get", "k"}, []int{1}},
+		{[]string{"set", "k", "v", "EX", "10"}, []int{1}},
+		{[]string{"del", "a", "b", "c"}, []int{1, 2, 3}},
+		{[]string{"exists", "a"}, []int{1}},
+		{[]string{"ping"}, nil},
+		{[]string{"keys", "*"}, nil},
+	}
+	for _, c := range cases {
+		argv := make([][]byte, len(c.argv))
+		for j, arg := range c.argv {
+			argv[j] = []byte(arg)
+		}
+		got := getKeysFromCommand(s.commandMap[c.argv[0]], argv)
+		if !reflect.DeepEqual(got, c.keys) && !(len(got) == 0 && len(c.keys) == 0) {
+			t.Errorf("%q: got %v want %v", c.argv, got, c.keys)
+		}
+	}
+}
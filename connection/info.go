@@ -0,0 +1,419 @@
+package connection
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valarpirai/vardis/cache"
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+/* INFO
+ *
+ * The sections and fields follow the names of redis INFO, so that the
+ * existing dashboards and exporters can read them. Fields that have no
+ * meaning here, like the RDB ones, are left out. */
+
+const CONFIG_RUN_ID_SIZE = 40
+const ERROR_STATS_NUMBER = 128 /* Error codes tracked by errorstats */
+
+/* Stats of a command, besides its calls and microseconds */
+type commandStats struct {
+	rejectedCalls int64 /* Calls rejected before execution: arity, auth, ACL... */
+	failedCalls   int64 /* Calls that replied with an error */
+	latency       *util.Histogram
+}
+
+func (stats *commandStats) recordLatency(ns int64) {
+	if nil == stats.latency {
+		stats.latency = new(util.Histogram)
+	}
+	stats.latency.Record(ns)
+}
+
+// afterErrorReply counts the error reply in errorstats, code being the
+// reply without its '-' prefix
+func (s *Server) afterErrorReply(code []byte) {
+	s.statTotalErrorReplies++
+	if j := bytesIndexAny(code, " \r"); j != -1 {
+		code = code[:j]
+	}
+	name := string(code)
+	if _, ok := s.errorStats[name]; !ok && len(s.errorStats) >= ERROR_STATS_NUMBER {
+		/* Stop tracking new error codes once the table is full,
+		 * a client could otherwise fill it with made up errors. */
+		return
+	}
+	s.errorStats[name]++
+}
+
+func bytesIndexAny(b []byte, chars string) int {
+	for j, c := range b {
+		if strings.IndexByte(chars, c) != -1 {
+			return j
+		}
+	}
+	return -1
+}
+
+// resetServerStats clears the stats reported by INFO, see CONFIG RESETSTAT
+func (s *Server) resetServerStats() {
+	for _, cmd := range s.commandMap {
+		cmd.microseconds = 0
+		cmd.calls = 0
+	}
+	for j := range s.commandStats {
+		s.commandStats[j] = commandStats{}
+	}
+	s.errorStats = make(map[string]int64)
+	s.statNumCommands = 0
+	s.statNumConnections = 0
+	s.statRejectedConn = 0
+	s.statEvictedClients = 0
+	s.statClientQbufLimitDisconn = 0
+	s.statClientObufLimitDisconn = 0
+	s.statTotalErrorReplies = 0
+	atomic.StoreInt64(&s.statNetInputBytes, 0)
+	atomic.StoreInt64(&s.statNetOutputBytes, 0)
+	atomic.StoreInt64(&s.statTotalReadsProcessed, 0)
+	atomic.StoreInt64(&s.statTotalWritesProcessed, 0)
+	s.aclInfo = aclInfo{}
+	s.instMetrics = [STATS_METRIC_COUNT]instMetric{}
+	for _, db := range s.cache {
+		if nil != db {
+			db.ResetStats()
+		}
+	}
+}
+
+// bytesToHuman formats a number of bytes like redis does: 1.50M
+func bytesToHuman(n uint64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	case n < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	default:
+		return fmt.Sprintf("%.2fT", d/(1024*1024*1024*1024))
+	}
+}
+
+/* The sections of INFO, in order. Those not in the default set are only
+ * shown when asked by name, or with "all" and "everything". */
+var infoSections = []struct {
+	name      string
+	title     string
+	isDefault bool
+	gen       func(s *Server, info *strings.Builder)
+}{
+	{"server", "Server", true, genInfoServer},
+	{"clients", "Clients", true, genInfoClients},
+	{"memory", "Memory", true, genInfoMemory},
+	{"persistence", "Persistence", true, genInfoPersistence},
+	{"stats", "Stats", true, genInfoStats},
+	{"replication", "Replication", true, genInfoReplication},
+	{"cpu", "CPU", true, genInfoCPU},
+	{"commandstats", "Commandstats", false, genInfoCommandStats},
+	{"errorstats", "Errorstats", true, genInfoErrorStats},
+	{"latencystats", "Latencystats", false, genInfoLatencyStats},
+	{"cluster", "Cluster", true, genInfoCluster},
+	{"keyspace", "Keyspace", true, genInfoKeyspace},
+}
+
+// genRedisInfoString creates the string returned by the INFO command
+// Must be called with s.mu held
+func (s *Server) genRedisInfoString(sections map[string]bool) string {
+	all := sections["all"] || sections["everything"]
+	defaults := len(sections) == 0 || sections["default"]
+	var info strings.Builder
+	for _, section := range infoSections {
+		if !all && !sections[section.name] && !(defaults && section.isDefault) {
+			continue
+		}
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		info.WriteString("# " + section.title + "\r\n")
+		section.gen(s, &info)
+	}
+	return info.String()
+}
+
+func infoField(info *strings.Builder, name string, format string, args ...interface{}) {
+	info.WriteString(name)
+	info.WriteByte(':')
+	fmt.Fprintf(info, format, args...)
+	info.WriteString("\r\n")
+}
+
+func genInfoServer(s *Server, info *strings.Builder) {
+	uptime := int64(time.Since(s.startTime) / time.Second)
+	executable, _ := os.Executable()
+	infoField(info, "redis_version", "%s", REDIS_VERSION)
+	infoField(info, "redis_git_sha1", "%s", "00000000")
+	infoField(info, "redis_git_dirty", "%d", 0)
+	infoField(info, "redis_mode", "%s", "standalone")
+	infoField(info, "os", "%s %s", runtime.GOOS, runtime.GOARCH)
+	infoField(info, "arch_bits", "%d", strconv.IntSize)
+	infoField(info, "multiplexing_api", "%s", "goroutines")
+	infoField(info, "go_version", "%s", runtime.Version())
+	infoField(info, "process_id", "%d", os.Getpid())
+	infoField(info, "run_id", "%s", s.runID)
+	infoField(info, "tcp_port", "%d", s.PORT)
+	infoField(info, "server_time_usec", "%d", time.Now().UnixNano()/int64(time.Microsecond))
+	infoField(info, "uptime_in_seconds", "%d", uptime)
+	infoField(info, "uptime_in_days", "%d", uptime/(3600*24))
+	infoField(info, "hz", "%d", CONFIG_DEFAULT_HZ)
+	infoField(info, "executable", "%s", executable)
+	infoField(info, "config_file", "%s", s.configfile)
+}
+
+func genInfoClients(s *Server, info *strings.Builder) {
+	maxIn, maxOut := 0, 0
+	pubsubClients, watchingClients, blockedClients := 0, 0, 0
+	for _, c := range s.clients {
+		if c.qbuf > maxIn {
+			maxIn = c.qbuf
+		}
+		if omem := c.outputBufferMemory(); omem > maxOut {
+			maxOut = omem
+		}
+		if c.flags&CLIENT_PUBSUB != 0 {
+			pubsubClients++
+		}
+		if len(c.watchedKeys) > 0 {
+			watchingClients++
+		}
+		if c.flags&CLIENT_BLOCKED != 0 {
+			blockedClients++
+		}
+	}
+	infoField(info, "connected_clients", "%d", len(s.clients))
+	infoField(info, "cluster_connections", "%d", 0)
+	infoField(info, "maxclients", "%d", s.maxclients)
+	infoField(info, "client_recent_max_input_buffer", "%d", maxIn)
+	infoField(info, "client_recent_max_output_buffer", "%d", maxOut)
+	infoField(info, "blocked_clients", "%d", blockedClients)
+	infoField(info, "tracking_clients", "%d", s.trackingClients)
+	infoField(info, "pubsub_clients", "%d", pubsubClients)
+	infoField(info, "watching_clients", "%d", watchingClients)
+	infoField(info, "clients_in_timeout_table", "%d", 0)
+	infoField(info, "total_watched_keys", "%d", len(s.watchedKeys))
+	infoField(info, "total_blocking_keys", "%d", 0)
+}
+
+func genInfoMemory(s *Server, info *strings.Builder) {
+	ms := s.updatePeakMemory()
+	used := ms.HeapAlloc
+	rss := ms.Sys - ms.HeapReleased
+	peak := atomic.LoadUint64(&s.statPeakMemory)
+	clientsMem := 0
+	for _, c := range s.clients {
+		clientsMem += getClientMemoryUsage(c)
+	}
+	infoField(info, "used_memory", "%d", used)
+	infoField(info, "used_memory_human", "%s", bytesToHuman(used))
+	infoField(info, "used_memory_rss", "%d", rss)
+	infoField(info, "used_memory_rss_human", "%s", bytesToHuman(rss))
+	infoField(info, "used_memory_peak", "%d", peak)
+	infoField(info, "used_memory_peak_human", "%s", bytesToHuman(peak))
+	infoField(info, "used_memory_peak_perc", "%.2f%%", float64(used)*100/float64(peak))
+	infoField(info, "maxmemory", "%d", 0)
+	infoField(info, "maxmemory_human", "%s", bytesToHuman(0))
+	infoField(info, "maxmemory_policy", "%s", "noeviction")
+	infoField(info, "mem_fragmentation_ratio", "%.2f", float64(rss)/float64(used))
+	infoField(info, "mem_allocator", "%s", "go-"+runtime.Version())
+	infoField(info, "mem_clients_normal", "%d", clientsMem)
+}
+
+func genInfoPersistence(s *Server, info *strings.Builder) {
+	aofSize := int64(0)
+	if nil != s.persistance && nil != s.persistance.AofFile {
+		if fi, err := s.persistance.AofFile.Stat(); err == nil {
+			aofSize = fi.Size()
+		}
+	}
+	loading := 0
+	if s.loading {
+		loading = 1
+	}
+	infoField(info, "loading", "%d", loading)
+	infoField(info, "async_loading", "%d", 0)
+	infoField(info, "aof_enabled", "%d", 1)
+	infoField(info, "aof_rewrite_in_progress", "%d", 0)
+	infoField(info, "aof_rewrite_scheduled", "%d", 0)
+	infoField(info, "aof_last_write_status", "%s", "ok")
+	infoField(info, "aof_current_size", "%d", aofSize)
+
+	if s.loading {
+		perc := float64(s.loadingLoadedBytes) / float64(s.loadingTotalBytes+1) * 100
+		elapsed := int64(time.Since(s.loadingStartTime).Seconds())
+		remainingBytes := s.loadingTotalBytes - s.loadingLoadedBytes
+		var eta int64
+		if elapsed == 0 {
+			eta = 1 /* A fake 1 second figure if we don't have enough info */
+		} else {
+			eta = (elapsed * remainingBytes) / (s.loadingLoadedBytes + 1)
+		}
+		infoField(info, "loading_start_time", "%d", s.loadingStartTime.Unix())
+		infoField(info, "loading_total_bytes", "%d", s.loadingTotalBytes)
+		infoField(info, "loading_loaded_bytes", "%d", s.loadingLoadedBytes)
+		infoField(info, "loading_loaded_perc", "%.2f", perc)
+		infoField(info, "loading_eta_seconds", "%d", eta)
+	}
+}
+
+func genInfoStats(s *Server, info *strings.Builder) {
+	var ks cache.KeyspaceStats
+	for _, db := range s.cache {
+		if nil != db {
+			stats := db.Stats()
+			ks.Hits += stats.Hits
+			ks.Misses += stats.Misses
+			ks.Expired += stats.Expired
+			ks.Evicted += stats.Evicted
+		}
+	}
+	trackingItems := 0
+	for _, ids := range s.trackingTable {
+		trackingItems += len(ids)
+	}
+	infoField(info, "total_connections_received", "%d", s.statNumConnections)
+	infoField(info, "total_commands_processed", "%d", s.statNumCommands)
+	infoField(info, "instantaneous_ops_per_sec", "%d", s.getInstantaneousMetric(STATS_METRIC_COMMAND))
+	infoField(info, "total_net_input_bytes", "%d", atomic.LoadInt64(&s.statNetInputBytes))
+	infoField(info, "total_net_output_bytes", "%d", atomic.LoadInt64(&s.statNetOutputBytes))
+	infoField(info, "instantaneous_input_kbps", "%.2f", float64(s.getInstantaneousMetric(STATS_METRIC_NET_INPUT))/1024)
+	infoField(info, "instantaneous_output_kbps", "%.2f", float64(s.getInstantaneousMetric(STATS_METRIC_NET_OUTPUT))/1024)
+	infoField(info, "rejected_connections", "%d", s.statRejectedConn)
+	infoField(info, "expired_keys", "%d", ks.Expired)
+	infoField(info, "evicted_keys", "%d", ks.Evicted)
+	infoField(info, "evicted_clients", "%d", s.statEvictedClients)
+	infoField(info, "keyspace_hits", "%d", ks.Hits)
+	infoField(info, "keyspace_misses", "%d", ks.Misses)
+	infoField(info, "pubsub_channels", "%d", len(s.pubsubChannels))
+	infoField(info, "pubsub_patterns", "%d", len(s.pubsubPatterns))
+	infoField(info, "latest_fork_usec", "%d", 0)
+	infoField(info, "total_forks", "%d", 0)
+	infoField(info, "tracking_total_keys", "%d", len(s.trackingTable))
+	infoField(info, "tracking_total_items", "%d", trackingItems)
+	infoField(info, "tracking_total_prefixes", "%d", len(s.prefixTable))
+	infoField(info, "total_error_replies", "%d", s.statTotalErrorReplies)
+	infoField(info, "total_reads_processed", "%d", atomic.LoadInt64(&s.statTotalReadsProcessed))
+	infoField(info, "total_writes_processed", "%d", atomic.LoadInt64(&s.statTotalWritesProcessed))
+	infoField(info, "client_query_buffer_limit_disconnections", "%d", s.statClientQbufLimitDisconn)
+	infoField(info, "client_output_buffer_limit_disconnections", "%d", s.statClientObufLimitDisconn)
+	infoField(info, "acl_access_denied_auth", "%d", s.aclInfo.userAuthFailures)
+	infoField(info, "acl_access_denied_cmd", "%d", s.aclInfo.invalidCmdAccesses)
+	infoField(info, "acl_access_denied_key", "%d", s.aclInfo.invalidKeyAccesses)
+	infoField(info, "acl_access_denied_channel", "%d", s.aclInfo.invalidChannelAccesses)
+}
+
+func genInfoReplication(s *Server, info *strings.Builder) {
+	infoField(info, "role", "%s", "master")
+	infoField(info, "connected_slaves", "%d", 0)
+	infoField(info, "master_failover_state", "%s", "no-failover")
+	infoField(info, "master_replid", "%s", s.replID)
+	infoField(info, "master_replid2", "%s", strings.Repeat("0", CONFIG_RUN_ID_SIZE))
+	infoField(info, "master_repl_offset", "%d", 0)
+	infoField(info, "second_repl_offset", "%d", -1)
+	infoField(info, "repl_backlog_active", "%d", 0)
+	infoField(info, "repl_backlog_size", "%d", 1024*1024)
+	infoField(info, "repl_backlog_first_byte_offset", "%d", 0)
+	infoField(info, "repl_backlog_histlen", "%d", 0)
+}
+
+func genInfoCPU(s *Server, info *strings.Builder) {
+	sys, user := processCPUTimes()
+	infoField(info, "used_cpu_sys", "%.6f", sys.Seconds())
+	infoField(info, "used_cpu_user", "%.6f", user.Seconds())
+}
+
+// sortedCommands returns the commands ordered by name
+func (s *Server) sortedCommands() []*RedisCommand {
+	cmds := make([]*RedisCommand, 0, len(s.commandMap))
+	for _, cmd := range s.commandMap {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+func genInfoCommandStats(s *Server, info *strings.Builder) {
+	for _, cmd := range s.sortedCommands() {
+		stats := &s.commandStats[cmd.id]
+		if cmd.calls == 0 && stats.failedCalls == 0 && stats.rejectedCalls == 0 {
+			continue
+		}
+		usecPerCall := float64(0)
+		if cmd.calls > 0 {
+			usecPerCall = float64(cmd.microseconds) / float64(cmd.calls)
+		}
+		infoField(info, "cmdstat_"+cmd.name, "calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			cmd.calls, cmd.microseconds, usecPerCall, stats.rejectedCalls, stats.failedCalls)
+	}
+}
+
+func genInfoErrorStats(s *Server, info *strings.Builder) {
+	codes := make([]string, 0, len(s.errorStats))
+	for code := range s.errorStats {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		infoField(info, "errorstat_"+code, "count=%d", s.errorStats[code])
+	}
+}
+
+func genInfoLatencyStats(s *Server, info *strings.Builder) {
+	for _, cmd := range s.sortedCommands() {
+		h := s.commandStats[cmd.id].latency
+		if nil == h || h.TotalCount() == 0 {
+			continue
+		}
+		var values []string
+		for _, p := range s.latencyTrackingPercentiles {
+			values = append(values, fmt.Sprintf("p%s=%.3f",
+				strconv.FormatFloat(p, 'f', -1, 64), float64(h.ValueAtPercentile(p))/1000))
+		}
+		infoField(info, "latency_percentiles_usec_"+cmd.name, "%s", strings.Join(values, ","))
+	}
+}
+
+func genInfoCluster(s *Server, info *strings.Builder) {
+	infoField(info, "cluster_enabled", "%d", 0)
+}
+
+func genInfoKeyspace(s *Server, info *strings.Builder) {
+	for j, db := range s.cache {
+		if nil == db {
+			continue
+		}
+		keys, vkeys := db.Size()
+		if keys == 0 && vkeys == 0 {
+			continue
+		}
+		infoField(info, "db"+strconv.Itoa(j), "keys=%d,expires=%d,avg_ttl=%d", keys, vkeys, db.AvgTTL())
+	}
+}
+
+/* INFO [section [section ...]] */
+func infoCommand(req *proto.Request, c *ClientConnection) {
+	sections := make(map[string]bool)
+	for _, arg := range req.Argv()[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	c.addReplyVerbatim([]byte(c.server.genRedisInfoString(sections)), "txt")
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package connection
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTimes returns the system and user CPU time used by the server
+func processCPUTimes() (sys time.Duration, user time.Duration) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return time.Duration(ru.Stime.Nano()), time.Duration(ru.Utime.Nano())
+}
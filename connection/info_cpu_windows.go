@@ -0,0 +1,10 @@
+package connection
+
+import (
+	"time"
+)
+
+// processCPUTimes is not available on windows
+func processCPUTimes() (sys time.Duration, user time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,131 @@
+package connection
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBytesToHuman(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.00K"},
+		{1536, "1.50K"},
+		{1024 * 1024, "1.00M"},
+		{5 * 1024 * 1024 * 1024 / 2, "2.50G"},
+		{1 << 40, "1.00T"},
+		{1 << 50, "1024.00T"},
+	}
+	for _, tt := range tests {
+		if got := bytesToHuman(tt.n); got != tt.want {
+			t.Errorf("%d: got %q want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+var sectionTitle = regexp.MustCompile(`(?m)^# (\w+)\r$`)
+
+func TestInfoSections(t *testing.T) {
+	defaults := "Server Clients Memory Persistence Stats Replication CPU Errorstats Cluster Keyspace"
+	everything := "Server Clients Memory Persistence Stats Replication CPU Commandstats Errorstats Latencystats Cluster Keyspace"
+	tests := []struct {
+		sections string
+		want     string
+	}{
+		{"", defaults},
+		{"default", defaults},
+		{"all", everything},
+		{"everything", everything},
+		{"CPU", "CPU"},
+		{"keyspace server", "Server Keyspace"},
+		{"default commandstats", "Server Clients Memory Persistence Stats Replication CPU Commandstats Errorstats Cluster Keyspace"},
+		{"nosuch", ""},
+	}
+	s := testServer(t)
+	for _, tt := range tests {
+		sections := make(map[string]bool)
+		for _, name := range strings.Fields(tt.sections) {
+			sections[strings.ToLower(name)] = true
+		}
+		s.mu.Lock()
+		info := s.genRedisInfoString(sections)
+		s.mu.Unlock()
+		var titles []string
+		for _, m := range sectionTitle.FindAllStringSubmatch(info, -1) {
+			titles = append(titles, m[1])
+		}
+		if got := strings.Join(titles, " "); got != tt.want {
+			t.Errorf("%q: got %q want %q", tt.sections, got, tt.want)
+		}
+	}
+}
+
+func TestErrorStats(t *testing.T) {
+	s := testServer(t)
+	for _, reply := range []string{"ERR syntax error\r\n", "ERR x", "WRONGTYPE Operation\r\n", "NOAUTH\r\n", "CUSTOM"} {
+		s.afterErrorReply([]byte(reply))
+	}
+	want := map[string]int64{"ERR": 2, "WRONGTYPE": 1, "NOAUTH": 1, "CUSTOM": 1}
+	if len(s.errorStats) != len(want) || s.statTotalErrorReplies != 5 {
+		t.Fatalf("got %v, %d errors", s.errorStats, s.statTotalErrorReplies)
+	}
+	for code, n := range want {
+		if s.errorStats[code] != n {
+			t.Errorf("%s: got %d want %d", code, s.errorStats[code], n)
+		}
+	}
+
+	/* Past ERROR_STATS_NUMBER codes only the known ones are counted */
+	for j := 0; len(s.errorStats) < ERROR_STATS_NUMBER; j++ {
+		s.afterErrorReply([]byte("E" + strconv.Itoa(j)))
+	}
+	s.afterErrorReply([]byte("NEWCODE"))
+	s.afterErrorReply([]byte("ERR again"))
+	if _, ok := s.errorStats["NEWCODE"]; ok || s.errorStats["ERR"] != 3 {
+		t.Errorf("got NEWCODE %v, ERR %d", ok, s.errorStats["ERR"])
+	}
+	if s.statTotalErrorReplies != int64(ERROR_STATS_NUMBER)+3 {
+		t.Errorf("got %d errors", s.statTotalErrorReplies)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	/* The command table, and its call counts, is shared by the servers */
+	c.send("CONFIG RESETSTAT\r\n")
+	c.expect("+OK\r\n")
+	c.send("SET a 1\r\nSET b 2\r\nSET c 3 EX 100\r\nGET a\r\nGET zz\r\nGET\r\nFOO\r\nCLIENT BAR\r\nINFO\r\n")
+	c.skip("-ERR Unknown subcommand or wrong number of arguments for 'BAR'. Try CLIENT HELP.\r\n")
+	info := c.bulk()
+	for _, want := range []string{"# Server\r\n", "\r\nredis_version:", "\r\n# CPU\r\nused_cpu_sys:",
+		"\r\nconnected_clients:1\r\n", "\r\nkeyspace_hits:1\r\n", "\r\nkeyspace_misses:1\r\n",
+		"\r\n# Errorstats\r\nerrorstat_ERR:count=3\r\n", "\r\ndb0:keys=3,expires=1,avg_ttl=",
+		"\r\nused_memory_human:", "\r\ntotal_error_replies:3\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("%q not in\n%s", want, info)
+		}
+	}
+
+	c.send("INFO commandstats latencystats\r\n")
+	info = c.bulk()
+	for _, want := range []string{"# Commandstats\r\ncmdstat_client:calls=1,", ",rejected_calls=0,failed_calls=1\r\n",
+		"\r\ncmdstat_get:calls=2,", ",rejected_calls=1,failed_calls=0\r\n",
+		"\r\ncmdstat_set:calls=3,", "\r\nlatency_percentiles_usec_set:p50=", ",p99=", ",p99.9="} {
+		if !strings.Contains(info, want) {
+			t.Errorf("%q not in\n%s", want, info)
+		}
+	}
+
+	c.send("CONFIG RESETSTAT\r\nINFO stats\r\n")
+	c.expect("+OK\r\n")
+	if info = c.bulk(); !strings.Contains(info, "\r\nkeyspace_hits:0\r\n") ||
+		!strings.Contains(info, "\r\ntotal_error_replies:0\r\n") {
+		t.Errorf("stats not reset:\n%s", info)
+	}
+}
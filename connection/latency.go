@@ -0,0 +1,579 @@
+package connection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+/* The latency monitor allows to easily observe the sources of latency
+ * in a Redis instance using the LATENCY command. Different latency
+ * sources are monitored, like slow commands, AOF writes and fsyncs,
+ * or the expire cycle. Every time a source takes at least
+ * latency-monitor-threshold milliseconds, a sample is added to the time
+ * series of the event, and LATENCY reports on them.
+ *
+ * The events are:
+ *
+ * command           Regular commands.
+ * fast-command      O(1) and O(log N) commands.
+ * aof-write         Writing to the AOF file.
+ * aof-fsync         The AOF fsync done every second in background.
+ * expire-cycle      The active expire cycle of serverCron.
+ * eviction-cycle    The eviction of the clients over maxmemory-clients.
+ *
+ * There are no fork or snapshot events: vardis has no RDB and no AOF
+ * rewrite, nothing is saved by a forked child, so the only persistence
+ * latency is the one of the AOF writes and fsyncs.
+ *
+ * Besides the latency monitor, every command records the latency of its
+ * calls in a histogram, reported by LATENCY HISTOGRAM and INFO latencystats. */
+
+const LATENCY_TS_LEN = 160 /* History length for every monitored event. */
+const LATENCY_GRAPH_COLS = 80
+
+/* Representation of a latency sample: the sampling time and the latency
+ * observed in milliseconds. */
+type latencySample struct {
+	time    int64  /* Unix time of the sample, in seconds. */
+	latency uint32 /* Latency in milliseconds. */
+}
+
+/* The latency time series for a given event. */
+type latencyTimeSeries struct {
+	idx     int    /* Index of the next sample to store. */
+	max     uint32 /* Max latency observed for this event. */
+	samples [LATENCY_TS_LEN]latencySample
+}
+
+/* Latency statistics structure. */
+type latencyStats struct {
+	all     uint32 /* Absolute max observed since latest reset. */
+	avg     uint32 /* Average of current samples. */
+	min     uint32 /* Min of current samples. */
+	max     uint32 /* Max of current samples. */
+	mad     uint32 /* Mean absolute deviation. */
+	samples int    /* Number of non-zero samples. */
+	period  int64  /* Number of seconds since first event and now. */
+}
+
+// latencyAddSampleIfNeeded adds the sample if the latency monitor is
+// enabled and the duration is over latency-monitor-threshold
+func (s *Server) latencyAddSampleIfNeeded(event string, d time.Duration) {
+	ms := d.Milliseconds()
+	if s.latencyMonitorThreshold != 0 && ms >= s.latencyMonitorThreshold {
+		s.latencyAddSample(event, uint32(ms))
+	}
+}
+
+/* Add the specified sample to the specified time series "event".
+ * This function is usually called via latencyAddSampleIfNeeded(), that
+ * is a macro that only adds the sample if the latency is higher than
+ * server.latency_monitor_threshold. */
+func (s *Server) latencyAddSample(event string, latency uint32) {
+	ts := s.latencyEvents[event]
+	now := time.Now().Unix()
+
+	/* Create the time series if it does not exist. */
+	if nil == ts {
+		ts = new(latencyTimeSeries)
+		s.latencyEvents[event] = ts
+	}
+
+	if latency > ts.max {
+		ts.max = latency
+	}
+
+	/* If the previous sample is in the same second, we update our old sample
+	 * if this latency is > of the old one, or just return. */
+	prev := (ts.idx + LATENCY_TS_LEN - 1) % LATENCY_TS_LEN
+	if ts.samples[prev].time == now {
+		if latency > ts.samples[prev].latency {
+			ts.samples[prev].latency = latency
+		}
+		return
+	}
+
+	ts.samples[ts.idx].time = now
+	ts.samples[ts.idx].latency = latency
+
+	ts.idx++
+	if ts.idx == LATENCY_TS_LEN {
+		ts.idx = 0
+	}
+}
+
+/* Reset data for the specified event, or all the events data if 'event' is
+ * empty.
+ *
+ * Note: this is O(N) even when event_to_reset is not NULL because makes
+ * the code simpler and we have a small fixed max number of events. */
+func (s *Server) latencyResetEvent(event string) int {
+	resets := 0
+	for name := range s.latencyEvents {
+		if event == "" || strings.EqualFold(name, event) {
+			delete(s.latencyEvents, name)
+			resets++
+		}
+	}
+	return resets
+}
+
+/* Analyze the samples available for a given event and return a structure
+ * populate with different metrics, average, MAD, min, max, and so forth.
+ * Check latency.h definition of struct latencyStats for more info. */
+func analyzeLatencyForEvent(ts *latencyTimeSeries) latencyStats {
+	var ls latencyStats
+	var sum uint64
+	ls.all = ts.max
+
+	/* First pass, populate everything but the MAD. */
+	for _, sample := range ts.samples {
+		if sample.time == 0 {
+			continue
+		}
+		ls.samples++
+		if ls.samples == 1 {
+			ls.min, ls.max = sample.latency, sample.latency
+		} else {
+			if ls.min > sample.latency {
+				ls.min = sample.latency
+			}
+			if ls.max < sample.latency {
+				ls.max = sample.latency
+			}
+		}
+		sum += uint64(sample.latency)
+
+		/* Track the oldest event time in ls->period. */
+		if ls.period == 0 || sample.time < ls.period {
+			ls.period = sample.time
+		}
+	}
+
+	/* So far avg is actually the sum of the latencies, and period is
+	 * the oldest event time. We need to make the first an average and
+	 * the second a range of seconds. */
+	if ls.samples > 0 {
+		ls.avg = uint32(sum / uint64(ls.samples))
+		ls.period = time.Now().Unix() - ls.period
+		if ls.period == 0 {
+			ls.period = 1
+		}
+	}
+
+	/* Second pass, compute MAD. */
+	sum = 0
+	for _, sample := range ts.samples {
+		if sample.time == 0 {
+			continue
+		}
+		delta := int64(ls.avg) - int64(sample.latency)
+		if delta < 0 {
+			delta = -delta
+		}
+		sum += uint64(delta)
+	}
+	if ls.samples > 0 {
+		ls.mad = uint32(sum / uint64(ls.samples))
+	}
+	return ls
+}
+
+// sortedLatencyEvents returns the names of the monitored events
+func (s *Server) sortedLatencyEvents() []string {
+	events := make([]string, 0, len(s.latencyEvents))
+	for event := range s.latencyEvents {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return events
+}
+
+/* Create a human readable report of latency events for this Redis
+ * instance. */
+func (s *Server) createLatencyReport() string {
+	var report strings.Builder
+	advisePersistence := false
+	adviseSlowCommands := false
+	adviseExpires := false
+
+	/* Return ASAP if the latency engine is disabled and it looks like it
+	 * was never enabled so far. */
+	if len(s.latencyEvents) == 0 && s.latencyMonitorThreshold == 0 {
+		return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this Redis instance. You may use \"CONFIG SET latency-monitor-threshold <milliseconds>.\" in order to enable it. If we weren't in a deep space mission I'd suggest to take a look at https://redis.io/topics/latency-monitor.\n"
+	}
+	if len(s.latencyEvents) == 0 {
+		return "Dave, no latency spike was observed during the lifetime of this Redis instance, not in the slightest bit. I honestly think you ought to sleep.\n"
+	}
+
+	/* Show all the events stats and add for each event some event-related
+	 * comment depending on the values. */
+	report.WriteString("Dave, I have observed latency spikes in this Redis instance. You don't mind talking about it, do you Dave?\n\n")
+	for j, event := range s.sortedLatencyEvents() {
+		ts := s.latencyEvents[event]
+		ls := analyzeLatencyForEvent(ts)
+		if ls.samples == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&report,
+			"%d. %s: %d latency spikes (average %dms, mean deviation %dms, period %.2f sec). Worst all time event %dms.",
+			j+1, event, ls.samples, ls.avg, ls.mad, float64(ls.period)/float64(ls.samples), ts.max)
+
+		switch event {
+		case "command", "fast-command":
+			/* Slow commands. */
+			if event == "fast-command" {
+				report.WriteString(" Fast commands are not expected to take so much time: the latency is probably caused by the system, like swapping or an overloaded host.")
+			}
+			adviseSlowCommands = true
+		case "aof-write", "aof-fsync":
+			/* AOF */
+			advisePersistence = true
+		case "expire-cycle":
+			/* Expire cycle. */
+			adviseExpires = true
+		}
+		report.WriteString("\n")
+	}
+
+	report.WriteString("\nI have a few advices for you:\n\n")
+	if adviseSlowCommands {
+		fmt.Fprintf(&report, "- Check your Slow Log to understand what are the commands you are running which are too slow to execute. Please check https://redis.io/commands/slowlog for more information.\n")
+		if s.slowlogLogSlowerThan < 0 || s.slowlogLogSlowerThan/1000 > s.latencyMonitorThreshold {
+			fmt.Fprintf(&report, "- The slow log is not logging the commands over the latency threshold: consider CONFIG SET slowlog-log-slower-than %d.\n",
+				s.latencyMonitorThreshold*1000)
+		}
+		report.WriteString("- Deleting, expiring or evicting (because of maxmemory policy) large objects is a blocking operation. If you have very large objects that are often deleted, expired, or evicted, try to fragment those objects into multiple smaller objects.\n")
+	}
+	if advisePersistence {
+		report.WriteString("- The AOF file is written and fsynced while serving the clients: check that the disk is not busy with other processes, and consider a faster disk.\n")
+	}
+	if adviseExpires {
+		report.WriteString("- Many keys are expiring at the same time: the expire cycle deletes them while blocking the clients. Consider to add some random jitter to the time to live of the keys.\n")
+	}
+	return report.String()
+}
+
+/* ------------------------- sparkline, from redis sparkline.c ------------ */
+
+const SPARKLINE_FILL = 1 /* Fill the area under the curve. */
+
+var sparklineCharset = "_-`"
+var sparklineCharsetFill = "_o#"
+var sparklineLabelMarginTop = 1
+
+type sparklineSample struct {
+	value float64
+	label string
+}
+
+type sparklineSequence struct {
+	samples []sparklineSample
+	min     float64
+	max     float64
+}
+
+func (seq *sparklineSequence) addSample(value float64, label string) {
+	if len(seq.samples) == 0 {
+		seq.min, seq.max = value, value
+	} else if value < seq.min {
+		seq.min = value
+	} else if value > seq.max {
+		seq.max = value
+	}
+	seq.samples = append(seq.samples, sparklineSample{value, label})
+}
+
+/* Render part of a sequence, so that render_sequence() call call this function
+ * with different parts in order to create the full output without overflowing
+ * the current terminal columns. */
+func sparklineRenderRange(output *strings.Builder, seq *sparklineSequence, rows int, offset int, length int, flags int) {
+	charsetLen := len(sparklineCharset)
+	relmax := seq.max - seq.min
+	steps := charsetLen * rows
+	row := 0
+	chars := make([]byte, length)
+	loop := true
+	optFill := flags&SPARKLINE_FILL != 0
+
+	if relmax == 0 {
+		relmax = 1
+	}
+
+	for loop {
+		loop = false
+		for j := range chars {
+			chars[j] = ' '
+		}
+		for j := 0; j < length; j++ {
+			sample := seq.samples[j+offset]
+			relval := sample.value - seq.min
+			step := int(float64(int(relval*float64(steps))) / relmax)
+			if step < 0 {
+				step = 0
+			}
+			if step >= steps {
+				step = steps - 1
+			}
+
+			if row < rows {
+				/* Print the character needed to create the sparkline */
+				charidx := step - ((rows - row - 1) * charsetLen)
+				loop = true
+				if charidx >= 0 && charidx < charsetLen {
+					if optFill {
+						chars[j] = sparklineCharsetFill[charidx]
+					} else {
+						chars[j] = sparklineCharset[charidx]
+					}
+				} else if optFill && charidx >= charsetLen {
+					chars[j] = '|'
+				}
+			} else {
+				/* Labels spacing */
+				if row-rows < sparklineLabelMarginTop {
+					loop = true
+					break
+				}
+				/* Print the label if needed. */
+				labelChar := row - rows - sparklineLabelMarginTop
+				if len(sample.label) > labelChar {
+					loop = true
+					chars[j] = sample.label[labelChar]
+				}
+			}
+		}
+		if loop {
+			row++
+			output.Write(chars)
+			output.WriteByte('\n')
+		}
+	}
+}
+
+/* Turn a sequence into its ASCII representation */
+func sparklineRender(output *strings.Builder, seq *sparklineSequence, columns int, rows int, flags int) {
+	for j := 0; j < len(seq.samples); j += columns {
+		sublen := len(seq.samples) - j
+		if sublen > columns {
+			sublen = columns
+		}
+		if j != 0 {
+			output.WriteByte('\n')
+		}
+		sparklineRenderRange(output, seq, rows, j, sublen, flags)
+	}
+}
+
+/* ---------------------- Latency command implementation -------------------- */
+
+/* latencyCommand() helper to produce a map of time buckets,
+ * each representing a latency range,
+ * between 1 nanosecond and roughly 1 second.
+ * Each bucket covers twice the previous bucket's range.
+ * Empty buckets are not printed.
+ * Everything above 1 sec is considered +Inf.
+ * At max there will be log2(1000000000)=30 buckets */
+func fillCommandCDF(c *ClientConnection, stats *commandStats) {
+	h := stats.latency
+	c.addReplyMapLen(2)
+	c.addReplyBulkString("calls")
+	c.addReplyLongLong(h.TotalCount())
+	c.addReplyBulkString("histogram_usec")
+	var buckets []int64
+	previousCount := int64(0)
+	h.CumulativeCounts(1024, func(upTo int64, count int64) {
+		if count > previousCount {
+			buckets = append(buckets, upTo/1000, count)
+		}
+		previousCount = count
+	})
+	c.addReplyMapLen(len(buckets) / 2)
+	for _, n := range buckets {
+		c.addReplyLongLong(n)
+	}
+}
+
+/* latencyCommand() helper to produce for all commands,
+ * a per command cumulative distribution of latencies. */
+func latencyAllCommandsFillCDF(c *ClientConnection) {
+	s := c.server
+	var cmds []*RedisCommand
+	for _, cmd := range s.sortedCommands() {
+		if h := s.commandStats[cmd.id].latency; nil != h && h.TotalCount() > 0 {
+			cmds = append(cmds, cmd)
+		}
+	}
+	c.addReplyMapLen(len(cmds))
+	for _, cmd := range cmds {
+		c.addReplyBulkString(cmd.name)
+		fillCommandCDF(c, &s.commandStats[cmd.id])
+	}
+}
+
+/* latencyCommand() helper to produce for a specific command set,
+ * a per command cumulative distribution of latencies. */
+func latencySpecificCommandsFillCDF(c *ClientConnection, names [][]byte) {
+	s := c.server
+	var cmds []*RedisCommand
+	for _, name := range names {
+		cmd := s.commandMap[strings.ToLower(string(name))]
+		if nil == cmd {
+			continue
+		}
+		if h := s.commandStats[cmd.id].latency; nil != h && h.TotalCount() > 0 {
+			cmds = append(cmds, cmd)
+		}
+	}
+	c.addReplyMapLen(len(cmds))
+	for _, cmd := range cmds {
+		c.addReplyBulkString(cmd.name)
+		fillCommandCDF(c, &s.commandStats[cmd.id])
+	}
+}
+
+/* latencyCommand() helper to produce a time-delay reply for all the samples
+ * in memory for the specified time series. */
+func latencyCommandReplyWithSamples(c *ClientConnection, ts *latencyTimeSeries) {
+	var samples []latencySample
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		i := (ts.idx + j) % LATENCY_TS_LEN
+		if ts.samples[i].time == 0 {
+			continue
+		}
+		samples = append(samples, ts.samples[i])
+	}
+	c.addReplyArrayLen(len(samples))
+	for _, sample := range samples {
+		c.addReplyArrayLen(2)
+		c.addReplyLongLong(sample.time)
+		c.addReplyLongLong(int64(sample.latency))
+	}
+}
+
+/* latencyCommand() helper to produce the reply for the LATEST subcommand,
+ * listing the last latency sample for every event type registered so far. */
+func latencyCommandReplyWithLatestEvents(c *ClientConnection) {
+	s := c.server
+	events := s.sortedLatencyEvents()
+	c.addReplyArrayLen(len(events))
+	for _, event := range events {
+		ts := s.latencyEvents[event]
+		last := (ts.idx + LATENCY_TS_LEN - 1) % LATENCY_TS_LEN
+		c.addReplyArrayLen(4)
+		c.addReplyBulkString(event)
+		c.addReplyLongLong(ts.samples[last].time)
+		c.addReplyLongLong(int64(ts.samples[last].latency))
+		c.addReplyLongLong(int64(ts.max))
+	}
+}
+
+func latencyCommandGenSparkeline(event string, ts *latencyTimeSeries) string {
+	var graph strings.Builder
+	seq := new(sparklineSequence)
+	var min, max uint32
+	now := time.Now().Unix()
+
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		i := (ts.idx + j) % LATENCY_TS_LEN
+		if ts.samples[i].time == 0 {
+			continue
+		}
+		/* Update min and max. */
+		if len(seq.samples) == 0 {
+			min, max = ts.samples[i].latency, ts.samples[i].latency
+		} else {
+			if ts.samples[i].latency > max {
+				max = ts.samples[i].latency
+			}
+			if ts.samples[i].latency < min {
+				min = ts.samples[i].latency
+			}
+		}
+		/* Use as label the number of seconds / minutes / hours / days
+		 * ago the event happened. */
+		var label string
+		elapsed := now - ts.samples[i].time
+		if elapsed < 60 {
+			label = fmt.Sprintf("%ds", elapsed)
+		} else if elapsed < 3600 {
+			label = fmt.Sprintf("%dm", elapsed/60)
+		} else if elapsed < 3600*24 {
+			label = fmt.Sprintf("%dh", elapsed/3600)
+		} else {
+			label = fmt.Sprintf("%dd", elapsed/(3600*24))
+		}
+		seq.addSample(float64(ts.samples[i].latency), label)
+	}
+
+	fmt.Fprintf(&graph, "%s - high %d ms, low %d ms (all time high %d ms)\n", event, max, min, ts.max)
+	graph.WriteString(strings.Repeat("-", LATENCY_GRAPH_COLS))
+	graph.WriteByte('\n')
+	sparklineRender(&graph, seq, LATENCY_GRAPH_COLS, 4, SPARKLINE_FILL)
+	return graph.String()
+}
+
+/* LATENCY command implementations.
+ *
+ * LATENCY HISTORY: return time-latency samples for the specified event.
+ * LATENCY LATEST: return the latest latency for all the events classes.
+ * LATENCY DOCTOR: returns a human readable analysis of instance latency.
+ * LATENCY GRAPH: provide an ASCII graph of the latency of the specified event.
+ * LATENCY RESET: reset data of a specified event or all the data if no event provided.
+ * LATENCY HISTOGRAM: return a cumulative distribution of latencies in the format of a histogram for the specified command names.
+ */
+func latencyCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+
+	if sub == "history" && len(argv) == 3 {
+		/* LATENCY HISTORY <event> */
+		ts := s.latencyEvents[string(argv[2])]
+		if nil == ts {
+			c.addReplyArrayLen(0)
+		} else {
+			latencyCommandReplyWithSamples(c, ts)
+		}
+	} else if sub == "graph" && len(argv) == 3 {
+		/* LATENCY GRAPH <event> */
+		event := string(argv[2])
+		ts := s.latencyEvents[event]
+		if nil == ts {
+			c.addReplyErrorFormat("No samples available for event '%s'", event)
+			return
+		}
+		c.addReplyVerbatim([]byte(latencyCommandGenSparkeline(event, ts)), "txt")
+	} else if sub == "latest" && len(argv) == 2 {
+		/* LATENCY LATEST */
+		latencyCommandReplyWithLatestEvents(c)
+	} else if sub == "doctor" && len(argv) == 2 {
+		/* LATENCY DOCTOR */
+		c.addReplyVerbatim([]byte(s.createLatencyReport()), "txt")
+	} else if sub == "reset" && len(argv) >= 2 {
+		/* LATENCY RESET */
+		if len(argv) == 2 {
+			c.addReplyLongLong(int64(s.latencyResetEvent("")))
+		} else {
+			resets := 0
+			for _, event := range argv[2:] {
+				resets += s.latencyResetEvent(string(event))
+			}
+			c.addReplyLongLong(int64(resets))
+		}
+	} else if sub == "histogram" && len(argv) >= 2 {
+		/* LATENCY HISTOGRAM*/
+		if len(argv) == 2 {
+			latencyAllCommandsFillCDF(c)
+		} else {
+			latencySpecificCommandsFillCDF(c, argv[2:])
+		}
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
@@ -0,0 +1,122 @@
+package connection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeLatencyForEvent(t *testing.T) {
+	now := time.Now().Unix()
+	ts := &latencyTimeSeries{max: 50}
+	for j, latency := range []uint32{10, 20, 30} {
+		ts.samples[j] = latencySample{now - 10 + int64(j), latency}
+	}
+	ts.idx = 3
+	ls := analyzeLatencyForEvent(ts)
+	/* The period may take one more second if the clock ticked */
+	want := latencyStats{all: 50, avg: 20, min: 10, max: 30, mad: 6, samples: 3, period: ls.period}
+	if ls != want || ls.period < 10 || ls.period > 11 {
+		t.Errorf("got %+v want %+v", ls, want)
+	}
+	if ls = analyzeLatencyForEvent(new(latencyTimeSeries)); ls != (latencyStats{}) {
+		t.Errorf("empty series: got %+v", ls)
+	}
+}
+
+func TestLatencyAddSample(t *testing.T) {
+	s := testServer(t)
+	/* The AOF fsyncs add samples too */
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencyAddSampleIfNeeded("command", 5*time.Millisecond)
+	if len(s.latencyEvents) != 0 {
+		t.Fatal("sample added with the latency monitor disabled")
+	}
+	s.latencyMonitorThreshold = 2
+	s.latencyAddSampleIfNeeded("command", time.Millisecond)
+	s.latencyAddSampleIfNeeded("command", 5*time.Millisecond)
+	s.latencyAddSampleIfNeeded("command", 3*time.Millisecond)
+	ts := s.latencyEvents["command"]
+	/* The samples of the same second are merged, keeping the highest */
+	if nil == ts || ts.idx != 1 || ts.samples[0].latency != 5 || ts.max != 5 {
+		t.Fatalf("got %+v", ts)
+	}
+
+	/* The series is a ring of the last LATENCY_TS_LEN seconds */
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		ts.samples[ts.idx].time = 1
+		ts.idx = (ts.idx + 1) % LATENCY_TS_LEN
+	}
+	s.latencyAddSample("command", 7)
+	if ts.idx != 2 || ts.samples[1].latency != 7 || ts.max != 7 {
+		t.Fatalf("got idx %d, %+v", ts.idx, ts.samples[:3])
+	}
+}
+
+func TestLatencyCommand(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("LATENCY DOCTOR\r\n")
+	if report := c.bulk(); !strings.Contains(report, "Latency monitoring is disabled") {
+		t.Errorf("LATENCY DOCTOR: %q", report)
+	}
+	c.send("LATENCY GRAPH command\r\nLATENCY HISTORY command\r\nLATENCY LATEST\r\nLATENCY FOO\r\n")
+	c.expect("-ERR No samples available for event 'command'\r\n*0\r\n*0\r\n" +
+		"-ERR Unknown subcommand or wrong number of arguments for 'FOO'. Try LATENCY HELP.\r\n")
+
+	s.mu.Lock()
+	s.latencyMonitorThreshold = 1
+	s.latencyAddSampleIfNeeded("command", 5*time.Millisecond)
+	s.latencyAddSampleIfNeeded("aof-fsync", 12*time.Millisecond)
+	now := s.latencyEvents["command"].samples[0].time
+	s.mu.Unlock()
+
+	c.send("LATENCY HISTORY command\r\n")
+	c.expect("*1\r\n*2\r\n:" + strconv.FormatInt(now, 10) + "\r\n:5\r\n")
+	c.send("LATENCY LATEST\r\n")
+	c.expect("*2\r\n*4\r\n$9\r\naof-fsync\r\n:" + strconv.FormatInt(now, 10) + "\r\n:12\r\n:12\r\n" +
+		"*4\r\n$7\r\ncommand\r\n:" + strconv.FormatInt(now, 10) + "\r\n:5\r\n:5\r\n")
+	c.send("LATENCY GRAPH aof-fsync\r\n")
+	if graph := c.bulk(); !strings.HasPrefix(graph, "aof-fsync - high 12 ms, low 12 ms (all time high 12 ms)\n"+
+		strings.Repeat("-", LATENCY_GRAPH_COLS)+"\n") {
+		t.Errorf("LATENCY GRAPH: %q", graph)
+	}
+	c.send("LATENCY DOCTOR\r\n")
+	if report := c.bulk(); !strings.Contains(report, "aof-fsync: 1 latency spikes") {
+		t.Errorf("LATENCY DOCTOR: %q", report)
+	}
+	c.send("LATENCY RESET COMMAND nosuch\r\nLATENCY LATEST\r\nLATENCY RESET\r\nLATENCY LATEST\r\n")
+	c.expect(":1\r\n*1\r\n*4\r\n$9\r\naof-fsync\r\n")
+	c.skip(":12\r\n")
+	c.skip(":12\r\n")
+	c.expect(":1\r\n*0\r\n")
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("SET a b\r\nGET a\r\nGET a\r\nLATENCY HISTOGRAM get nosuch client\r\n")
+	c.expect("+OK\r\n$1\r\nb\r\n$1\r\nb\r\n")
+	/* Only the commands called, with their calls count */
+	c.expect("*2\r\n$3\r\nget\r\n*4\r\n$5\r\ncalls\r\n:2\r\n$14\r\nhistogram_usec\r\n")
+	/* The buckets are cumulative: the last one counts all the calls */
+	var n int
+	if _, err := fmt.Fscanf(c.r, "*%d\r\n", &n); err != nil || n == 0 || n%2 != 0 {
+		t.Fatalf("histogram_usec: %d buckets (%v)", n, err)
+	}
+	var bucket, count int64
+	for j := 0; j < n/2; j++ {
+		if _, err := fmt.Fscanf(c.r, ":%d\r\n:%d\r\n", &bucket, &count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != 2 {
+		t.Errorf("histogram_usec: %d calls in the last bucket", count)
+	}
+
+	c.send("CONFIG SET latency-tracking no\r\nCONFIG RESETSTAT\r\nGET a\r\nLATENCY HISTOGRAM\r\n")
+	c.expect("+OK\r\n+OK\r\n$1\r\nb\r\n*0\r\n")
+}
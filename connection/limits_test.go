@@ -0,0 +1,111 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientsCronHandleTimeout(t *testing.T) {
+	s := testServer(t)
+	idle := testClient(t, s)
+	active := testClient(t, s)
+	subscriber := testClient(t, s)
+	active.send("CLIENT SETNAME active\r\n")
+	active.expect("+OK\r\n")
+	subscriber.send("SUBSCRIBE ch\r\n")
+	subscriber.skip(":1\r\n")
+
+	now := time.Now().Add(2 * time.Second)
+	s.mu.Lock()
+	s.clientsCronHandleTimeout(now) /* timeout 0 never closes the clients */
+	s.maxidletime = 1
+	for _, c := range s.clients {
+		if c.name == "active" {
+			c.lastinteraction = now
+		}
+	}
+	s.clientsCronHandleTimeout(now)
+	s.mu.Unlock()
+
+	/* Only the idle client is closed, the subscribers never time out */
+	if _, err := idle.r.ReadByte(); err != io.EOF {
+		t.Errorf("idle client: got %v, want closed", err)
+	}
+	active.send("PING\r\n")
+	active.expect("+PONG\r\n")
+	subscriber.send("PING\r\n")
+	subscriber.expect("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := testServer(t)
+	startServer(t, s)
+	c := dialServer(t, s)
+	c.send("CONFIG SET timeout 1\r\n")
+	c.expect("+OK\r\n")
+	start := time.Now()
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("got %v, want the client closed", err)
+	}
+	/* The timeouts are checked once per second */
+	if d := time.Since(start); d < time.Second || d > 3*time.Second {
+		t.Errorf("client closed after %s", d)
+	}
+}
+
+func TestMaxclients(t *testing.T) {
+	s := testServer(t)
+	startServer(t, s)
+	c := dialServer(t, s)
+	c.send("CONFIG SET maxclients 2\r\n")
+	c.expect("+OK\r\n")
+	second := dialServer(t, s)
+	second.send("PING\r\n")
+	second.expect("+PONG\r\n")
+
+	third := dialServer(t, s)
+	if got, err := io.ReadAll(third.r); err != nil || string(got) != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	c.send("INFO\r\n")
+	info := c.bulk()
+	for _, want := range []string{"connected_clients:2\r\n", "maxclients:2\r\n", "rejected_connections:1\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO: no %q in %q", want, info)
+		}
+	}
+
+	/* A client leaving makes room for a new one */
+	second.conn.Close()
+	waitFor(t, s, "the client to leave", func() bool { return len(s.clients) == 1 })
+	fourth := dialServer(t, s)
+	fourth.send("PING\r\n")
+	fourth.expect("+PONG\r\n")
+}
+
+/* The listeners accept concurrently, the client slots are taken in the
+ * critical section that checks maxclients */
+func TestMaxclientsConcurrentAccept(t *testing.T) {
+	s := testServer(t)
+	s.maxclients = 5
+	var wg sync.WaitGroup
+	for j := 0; j < 20; j++ {
+		a, b := net.Pipe()
+		t.Cleanup(func() { a.Close(); b.Close() })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acceptCommonHandler(a)
+		}()
+	}
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) != 5 || s.statRejectedConn != 15 {
+		t.Errorf("%d clients, %d rejected", len(s.clients), s.statRejectedConn)
+	}
+}
@@ -0,0 +1,122 @@
+package connection
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenToPort(t *testing.T) {
+	tests := []struct {
+		bind  string
+		addrs []string /* The hosts listened on, nil for an error */
+	}{
+		{"127.0.0.1", []string{"127.0.0.1"}},
+		{"*", []string{"0.0.0.0"}},
+		/* 192.0.2.0/24 is reserved for the documentation */
+		{"-192.0.2.1 127.0.0.1", []string{"127.0.0.1"}},
+		{"192.0.2.1 127.0.0.1", nil},
+		{"127.0.0.1 -192.0.2.1", []string{"127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		s := testServer(t)
+		s.bindaddr = strings.Fields(tt.bind)
+		port := freePort(t)
+		s.mu.Lock()
+		err := s.listenToPort(int(port), nil)
+		var addrs []string
+		for _, l := range s.listeners {
+			addrs = append(addrs, l.Addr().(*net.TCPAddr).IP.String())
+		}
+		s.closeListeners()
+		s.mu.Unlock()
+		if nil == tt.addrs {
+			if nil == err {
+				t.Errorf("bind %s: listening on %v", tt.bind, addrs)
+			}
+		} else if err != nil || strings.Join(addrs, " ") != strings.Join(tt.addrs, " ") {
+			t.Errorf("bind %s: got %v, %v want %v", tt.bind, addrs, err, tt.addrs)
+		}
+	}
+}
+
+func TestBindConfig(t *testing.T) {
+	s := testServer(t)
+	if err := s.loadServerConfigFromString("bind " + strings.Repeat("127.0.0.1 ", CONFIG_BINDADDR_MAX+1)); nil == err ||
+		!strings.Contains(err.Error(), "Too many bind addresses specified.") {
+		t.Errorf("got %v", err)
+	}
+	if err := s.loadServerConfigFromString("bind 127.0.0.1 -::1\nunixsocketperm 778\n"); nil == err ||
+		!strings.Contains(err.Error(), "at line 2") {
+		t.Errorf("got %v", err)
+	}
+
+	c := testClient(t, s)
+	c.send("CONFIG GET bind\r\nCONFIG SET bind *\r\n")
+	c.expect("*2\r\n$4\r\nbind\r\n$14\r\n127.0.0.1 -::1\r\n" +
+		"-ERR CONFIG SET failed (possibly related to argument 'bind') - can't set immutable config\r\n")
+}
+
+func TestInitListenersNowhere(t *testing.T) {
+	s := testServer(t)
+	s.PORT = 0
+	s.mu.Lock()
+	err := s.initListeners()
+	s.mu.Unlock()
+	if nil == err || err.Error() != "Configured to not listen anywhere, exiting." {
+		t.Errorf("got %v", err)
+	}
+	if code := s.Start(); code != 1 {
+		t.Errorf("exit status %d", code)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "vardis.sock")
+	s := testServer(t)
+	if err := s.loadServerConfigFromString("unixsocket " + sock + "\nunixsocketperm 700\n"); err != nil {
+		t.Fatal(err)
+	}
+	status := startServer(t, s)
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("unix socket: %v, %v", fi, err)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testConn{t, conn, bufio.NewReader(conn)}
+	tcp := dialServer(t, s)
+	tcp.send("PING\r\n")
+	tcp.expect("+PONG\r\n")
+
+	c.send("CLIENT SETNAME unix\r\nCLIENT LIST\r\n")
+	c.expect("+OK\r\n")
+	list := c.bulk()
+	for _, want := range []string{
+		"addr=" + sock + ":0 laddr=" + sock + ":0 name=unix age=0 idle=0 flags=U ",
+		"laddr=127.0.0.1:" + strconv.Itoa(int(s.PORT)) + " ",
+	} {
+		if !strings.Contains(list, want) {
+			t.Errorf("CLIENT LIST: no %q in %q", want, list)
+		}
+	}
+	tcp.send("CLIENT KILL LADDR " + sock + ":0\r\n")
+	tcp.expect(":1\r\n")
+
+	/* The socket file is removed on shutdown */
+	tcp.send("SHUTDOWN\r\n")
+	if code := waitStatus(t, status); code != 0 {
+		t.Errorf("exit status %d", code)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("unix socket not removed: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package connection
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+/* MONITOR
+ *
+ * Every command executed is sent to the clients in server.monitors as a
+ * status reply like:
+ *
+ *   +1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value"
+ *
+ * Commands flagged no-monitor and admin commands are not shown, and the
+ * secrets of AUTH and HELLO are redacted.
+ *
+ * A monitor that doesn't read fast enough must not slow down the server:
+ * once its output buffer is over monitorBufferLimit the commands are
+ * dropped, instead of being queued, until it catches up. */
+
+var monitorBufferLimit = 1024 * 1024 * 4
+
+const redactedArg = "(redacted)"
+
+// monitorRedactArgv returns the arguments to show for the command,
+// hiding the passwords given to AUTH and HELLO
+func monitorRedactArgv(cmd *RedisCommand, argv [][]byte) [][]byte {
+	redact := func(from int, to int) [][]byte {
+		redacted := append([][]byte(nil), argv...)
+		for j := from; j < to && j < len(redacted); j++ {
+			redacted[j] = []byte(redactedArg)
+		}
+		return redacted
+	}
+	switch cmd.name {
+	case "auth":
+		/* AUTH [username] password */
+		return redact(1, len(argv))
+	case "hello":
+		/* HELLO [protover [AUTH username password] [SETNAME clientname]]
+		 * The options are walked like helloCommand() does, so that a
+		 * client named "auth" doesn't hide the real AUTH option. */
+		for j := 2; j < len(argv); j++ {
+			if strings.EqualFold(string(argv[j]), "auth") {
+				return redact(j+1, j+3)
+			} else if strings.EqualFold(string(argv[j]), "setname") {
+				j++
+			}
+		}
+	}
+	return argv
+}
+
+// replicationFeedMonitors sends the command executed by c to the monitors
+// Must be called with s.mu held
+func (s *Server) replicationFeedMonitors(c *ClientConnection, cmd *RedisCommand, argv [][]byte) {
+	/* Commands replayed from the AOF are not shown */
+	if len(s.monitors) == 0 || nil == c.cconn {
+		return
+	}
+	if cmd.flags&(CMD_SKIP_MONITOR|CMD_ADMIN) != 0 {
+		return
+	}
+	argv = monitorRedactArgv(cmd, argv)
+
+	now := time.Now()
+	cmdrepr := make([]byte, 0, 64)
+	cmdrepr = strconv.AppendInt(cmdrepr, now.Unix(), 10)
+	cmdrepr = append(cmdrepr, '.')
+	usec := strconv.Itoa(now.Nanosecond() / 1000)
+	cmdrepr = append(cmdrepr, "000000"[len(usec):]...)
+	cmdrepr = append(cmdrepr, usec...)
+	cmdrepr = append(cmdrepr, " ["...)
+	cmdrepr = strconv.AppendInt(cmdrepr, int64(c.dbid), 10)
+	cmdrepr = append(cmdrepr, ' ')
+	cmdrepr = append(cmdrepr, getClientPeerId(c)...)
+	cmdrepr = append(cmdrepr, "] "...)
+	for j, arg := range argv {
+		if j != 0 {
+			cmdrepr = append(cmdrepr, ' ')
+		}
+		cmdrepr = util.AppendRepr(cmdrepr, arg)
+	}
+
+	for _, monitor := range s.monitors {
+		monitorDeliver(monitor, cmdrepr)
+	}
+}
+
+// monitorDeliver queues the line, or drops it if the monitor is too slow
+func monitorDeliver(monitor *ClientConnection, line []byte) {
+	if monitor.outputBufferSize() >= monitorBufferLimit {
+		if monitor.monitorDropped == 0 {
+			log.Warnf("MONITOR client %s can't keep up, dropping commands until its output buffer is consumed.",
+				catClientInfoString(monitor))
+		}
+		monitor.monitorDropped++
+		return
+	}
+	if monitor.monitorDropped != 0 {
+		log.Warnf("MONITOR client id=%d caught up, %d commands were dropped.",
+			monitor.id, monitor.monitorDropped)
+		monitor.monitorDropped = 0
+	}
+	monitor.addReplyStatus(util.BytesToString(line))
+	monitor.flush()
+}
+
+// unmonitorClient removes the client from the monitors
+func unmonitorClient(c *ClientConnection) {
+	s := c.server
+	if c.flags&CLIENT_MONITOR == 0 {
+		return
+	}
+	for j, monitor := range s.monitors {
+		if monitor == c {
+			s.monitors = append(s.monitors[:j], s.monitors[j+1:]...)
+			break
+		}
+	}
+	c.flags &= ^(CLIENT_SLAVE | CLIENT_MONITOR)
+}
+
+/* MONITOR */
+func monitorCommand(req *proto.Request, c *ClientConnection) {
+	s := c.server
+	if c.flags&CLIENT_MULTI != 0 {
+		c.addReplyError("MONITOR isn't allowed for DENY BLOCKING client")
+		return
+	}
+
+	/* ignore MONITOR if already slave or in monitor mode */
+	if c.flags&CLIENT_SLAVE != 0 {
+		return
+	}
+
+	c.flags |= CLIENT_SLAVE | CLIENT_MONITOR
+	s.monitors = append(s.monitors, c)
+	c.addReplyBytes(shared.ok)
+}
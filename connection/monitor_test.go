@@ -0,0 +1,92 @@
+package connection
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMonitorRedactArgv(t *testing.T) {
+	s := testServer(t)
+	tests := []struct{ argv, want string }{
+		{"auth pw", "auth (redacted)"},
+		{"auth user pw", "auth (redacted) (redacted)"},
+		{"hello 3", "hello 3"},
+		{"hello 3 AUTH user pw SETNAME x", "hello 3 AUTH (redacted) (redacted) SETNAME x"},
+		{"hello 3 SETNAME x auth user pw", "hello 3 SETNAME x auth (redacted) (redacted)"},
+		{"hello 3 SETNAME AUTH AUTH user pw", "hello 3 SETNAME AUTH AUTH (redacted) (redacted)"},
+		{"hello 3 AUTH user", "hello 3 AUTH (redacted)"},
+		{"set auth pw", "set auth pw"},
+	}
+	for _, tt := range tests {
+		var argv [][]byte
+		for _, arg := range strings.Fields(tt.argv) {
+			argv = append(argv, []byte(arg))
+		}
+		got := monitorRedactArgv(s.commandMap[string(argv[0])], argv)
+		if joined := string(bytes.Join(got, []byte(" "))); joined != tt.want {
+			t.Errorf("%q: got %q want %q", tt.argv, joined, tt.want)
+		}
+		if string(bytes.Join(argv, []byte(" "))) != tt.argv {
+			t.Errorf("%q: the arguments of the command were changed", tt.argv)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	s := testServer(t)
+	m := testClient(t, s)
+	c := testClient(t, s)
+	m.send("MONITOR\r\n")
+	m.expect("+OK\r\n")
+	c.send("SET k \"a\\\"b\\n\\x01\"\r\nAUTH secret\r\nCONFIG GET maxclients\r\nMULTI\r\nGET k\r\nEXEC\r\nPING\r\n")
+	c.skip("+PONG\r\n")
+	want := []string{
+		`"set" "k" "a\"b\n\x01"`,
+		`"auth" "(redacted)"`,
+		`"multi"`,
+		`"get" "k"`,
+		`"exec"`,
+		`"ping"`,
+	}
+	for _, w := range want {
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		/* +<unix time>.<microseconds> [<db> <addr>] <argv> */
+		dot := strings.IndexByte(line, '.')
+		if line[0] != '+' || dot < 2 || len(line) < dot+8 || line[dot+7:] != " [0 pipe] "+w+"\r\n" {
+			t.Errorf("got %q want %s", line, w)
+		}
+	}
+}
+
+/* A monitor over the buffer limit misses the commands instead of
+ * buffering them */
+func TestMonitorDropsWhenBehind(t *testing.T) {
+	s := testServer(t)
+	m := testClient(t, s)
+	c := testClient(t, s)
+	m.send("MONITOR\r\n")
+	m.expect("+OK\r\n")
+
+	limit := monitorBufferLimit
+	monitorBufferLimit = 0
+	c.send("GET dropped\r\n")
+	c.expect("$-1\r\n")
+	monitorBufferLimit = limit
+	s.mu.Lock()
+	dropped := s.monitors[0].monitorDropped
+	s.mu.Unlock()
+	if dropped != 1 {
+		t.Errorf("dropped %d commands, want 1", dropped)
+	}
+
+	c.send("GET delivered\r\n")
+	c.expect("$-1\r\n")
+	line, err := m.r.ReadString('\n')
+	if err != nil || !strings.HasSuffix(line, `"get" "delivered"`+"\r\n") {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
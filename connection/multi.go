@@ -0,0 +1,191 @@
+package connection
+
+import (
+	"github.com/valarpirai/vardis/proto"
+)
+
+/* ================================ MULTI/EXEC ============================== */
+
+/* A queued command, argv is copied since the request buffer is reused */
+type multiCmd struct {
+	cmd  *RedisCommand
+	argv [][]byte
+}
+
+/* Add a new command into the MULTI commands queue */
+func queueMultiCommand(c *ClientConnection, cmd *RedisCommand, argv [][]byte) {
+	size := 0
+	for _, arg := range argv {
+		size += len(arg)
+	}
+	buf := make([]byte, 0, size)
+	copied := make([][]byte, len(argv))
+	for j, arg := range argv {
+		buf = append(buf, arg...)
+		copied[j] = buf[len(buf)-len(arg):]
+	}
+	c.mstate = append(c.mstate, multiCmd{cmd, copied})
+}
+
+func discardTransaction(c *ClientConnection) {
+	c.mstate = nil
+	c.flags &^= CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC
+	unwatchAllKeys(c)
+}
+
+/* Flag the transaction as DIRTY_EXEC so that EXEC will fail.
+ * Should be called every time there is an error while queueing a command. */
+func flagTransaction(c *ClientConnection) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.flags |= CLIENT_DIRTY_EXEC
+	}
+}
+
+func multiCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.addReplyError("MULTI calls can not be nested")
+		return
+	}
+	c.flags |= CLIENT_MULTI
+	c.addReplyBytes(shared.ok)
+}
+
+func discardCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.addReplyError("DISCARD without MULTI")
+		return
+	}
+	discardTransaction(c)
+	c.addReplyBytes(shared.ok)
+}
+
+/* Run the queued commands. The server lock is held by the caller for the
+ * whole EXEC, so no other client runs commands in between.
+ * The writes are appended to the AOF wrapped in MULTI ... EXEC with a
+ * single write, so a partial transaction is never replayed. */
+func execCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.addReplyError("EXEC without MULTI")
+		return
+	}
+
+	/* Check if we need to propagate MULTI/EXEC to AOF. Abort if there were
+	 * errors while queueing, or if a WATCHed key was touched: in the latter
+	 * case the reply is a null array, the transaction did not fail. */
+	if c.flags&(CLIENT_DIRTY_CAS|CLIENT_DIRTY_EXEC) != 0 {
+		if c.flags&CLIENT_DIRTY_EXEC != 0 {
+			c.addReplyBytes(shared.execaborterr)
+		} else {
+			c.addReplyNullArray()
+		}
+		discardTransaction(c)
+		return
+	}
+
+	/* Exec all the queued commands. Unwatch ASAP otherwise we'll waste
+	 * CPU cycles flagging the keys we are going to modify. */
+	unwatchAllKeys(c)
+	c.addReplyArrayLen(len(c.mstate))
+	aof := c.aofBuf[:0]
+	propagated := false
+	for _, queued := range c.mstate {
+		/* ACL permissions are also checked at the time of execution in case
+		 * they were changed after the commands were queued. */
+		if reason, pos := aclCheckCommandPerm(c.user, queued.cmd, queued.argv); reason != ACL_OK {
+			aclDenied(c, queued.cmd, queued.argv, reason, pos, "multi")
+			continue
+		}
+		dirty := c.server.dirty
+		queuedReq := proto.NewRequest(queued.argv)
+		c.server.execute(c, queued.cmd, queuedReq)
+		if c.server.dirty != dirty {
+			if !propagated {
+				aof = proto.AppendCommand(aof, [][]byte{[]byte("multi")})
+				propagated = true
+			}
+			aof = proto.AppendCommand(aof, queuedReq.Argv())
+		}
+	}
+	if propagated && nil != c.cconn {
+		aof = proto.AppendCommand(aof, [][]byte{[]byte("exec")})
+		c.server.persistance.WriteCommand(aof)
+	}
+	c.aofBuf = aof
+	c.flags |= CLIENT_PREVENT_AOF_PROP
+	discardTransaction(c)
+}
+
+/* ===================== WATCH (CAS alike for MULTI/EXEC) ===================
+ *
+ * The implementation uses a per-server map of WATCHed keys pointing to the
+ * clients WATCHing them, so that on a modification we can flag all those
+ * clients as dirty. Every client also keeps its list of WATCHed keys, so
+ * they can be removed on EXEC, DISCARD, UNWATCH or disconnection. */
+
+type watchedKey struct {
+	db  int
+	key string
+}
+
+/* Watch for the specified key */
+func watchForKey(c *ClientConnection, key string) {
+	wk := watchedKey{c.dbid, key}
+	for _, k := range c.watchedKeys {
+		if k == wk {
+			return /* Key already watched */
+		}
+	}
+	c.server.watchedKeys[wk] = append(c.server.watchedKeys[wk], c)
+	c.watchedKeys = append(c.watchedKeys, wk)
+}
+
+/* Unwatch all the keys watched by this client. To clean the EXEC dirty
+ * flag is up to the caller. */
+func unwatchAllKeys(c *ClientConnection) {
+	if len(c.watchedKeys) == 0 {
+		return
+	}
+	for _, wk := range c.watchedKeys {
+		clients := c.server.watchedKeys[wk]
+		for j, other := range clients {
+			if other == c {
+				clients = append(clients[:j], clients[j+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(c.server.watchedKeys, wk)
+		} else {
+			c.server.watchedKeys[wk] = clients
+		}
+	}
+	c.watchedKeys = nil
+}
+
+/* "Touch" a key, so that if this key is being WATCHed by some client the
+ * next EXEC will fail. Called on every keyspace change. */
+func (s *Server) touchWatchedKey(db int, key string) {
+	if len(s.watchedKeys) == 0 {
+		return
+	}
+	for _, c := range s.watchedKeys[watchedKey{db, key}] {
+		c.flags |= CLIENT_DIRTY_CAS
+	}
+}
+
+func watchCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.addReplyError("WATCH inside MULTI is not allowed")
+		return
+	}
+	for _, key := range req.Argv()[1:] {
+		watchForKey(c, string(key))
+	}
+	c.addReplyBytes(shared.ok)
+}
+
+func unwatchCommand(req *proto.Request, c *ClientConnection) {
+	unwatchAllKeys(c)
+	c.flags &^= CLIENT_DIRTY_CAS
+	c.addReplyBytes(shared.ok)
+}
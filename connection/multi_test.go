@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests string
+		replies  string
+	}{
+		{"exec", "MULTI\r\nset a 1\r\nget a\r\nEXEC\r\n",
+			"+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n$1\r\n1\r\n"},
+		{"empty", "MULTI\r\nEXEC\r\n", "+OK\r\n*0\r\n"},
+		{"queueing errors abort", "MULTI\r\nset a 1\r\nnope\r\nget\r\nEXEC\r\nget a\r\n",
+			"+OK\r\n+QUEUED\r\n-ERR unknown command `nope`\r\n" +
+				"-ERR wrong number of arguments for 'get' command\r\n" +
+				"-EXECABORT Transaction discarded because of previous errors.\r\n$-1\r\n"},
+		{"runtime errors don't abort", "MULTI\r\nset a 1\r\nset a 2 badopt\r\nget a\r\nEXEC\r\n",
+			"+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n+OK\r\n-ERR syntax error\r\n$1\r\n1\r\n"},
+		{"discard", "MULTI\r\nset a 1\r\nDISCARD\r\nget a\r\n", "+OK\r\n+QUEUED\r\n+OK\r\n$-1\r\n"},
+		{"nested", "MULTI\r\nMULTI\r\nEXEC\r\n", "+OK\r\n-ERR MULTI calls can not be nested\r\n*0\r\n"},
+		{"exec without multi", "EXEC\r\n", "-ERR EXEC without MULTI\r\n"},
+		{"discard without multi", "DISCARD\r\n", "-ERR DISCARD without MULTI\r\n"},
+		{"watch inside multi", "MULTI\r\nWATCH a\r\nEXEC\r\n",
+			"+OK\r\n-ERR WATCH inside MULTI is not allowed\r\n*0\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, testServer(t))
+			c.send(tt.requests)
+			c.expect(tt.replies)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		exists  bool   /* The watched key exists */
+		watcher string /* Sent after WATCH a by the watching client */
+		other   string /* Sent by another client before EXEC */
+		replies string /* Replies to the other client */
+		touched bool
+	}{
+		{"untouched", false, "", "get a\r\n", "$-1\r\n", false},
+		{"set", false, "", "set a 3\r\n", "+OK\r\n", true},
+		{"deleted", true, "", "del a\r\n", ":1\r\n", true},
+		{"failed delete", false, "", "del a\r\n", ":0\r\n", false},
+		{"flushed", true, "", "flushall\r\n", "+OK\r\n", true},
+		{"flushed without the key", false, "", "set b 1\r\nflushall\r\n", "+OK\r\n+OK\r\n", false},
+		{"other key", false, "", "set b 3\r\n", "+OK\r\n", false},
+		{"unwatch", false, "UNWATCH\r\n", "set a 3\r\n", "+OK\r\n", false},
+		{"touched by the watcher", false, "set a 1\r\n", "", "", true},
+		{"touched before unwatch", false, "set a 1\r\nUNWATCH\r\n", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			c1 := testClient(t, s)
+			if tt.exists {
+				c1.send("set a 1\r\n")
+				c1.expect("+OK\r\n")
+			}
+			c1.send("WATCH a\r\n" + tt.watcher + "MULTI\r\nset a 2\r\nPING\r\n")
+			c1.expect("+OK\r\n" + strings.Repeat("+OK\r\n", strings.Count(tt.watcher, "\n")))
+			c1.expect("+OK\r\n+QUEUED\r\n+QUEUED\r\n")
+			if tt.other != "" {
+				c2 := testClient(t, s)
+				c2.send(tt.other)
+				c2.expect(tt.replies)
+			}
+			c1.send("EXEC\r\n")
+			if tt.touched {
+				c1.expect("*-1\r\n")
+			} else {
+				c1.expect("*2\r\n+OK\r\n+PONG\r\n")
+			}
+		})
+	}
+}
+
+/* Only the commands that changed the dataset are propagated, wrapped in
+ * MULTI/EXEC, and a transaction without changes isn't propagated at all */
+func TestExecPropagation(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("MULTI\r\nget a\r\ndel a\r\nEXEC\r\n")
+	c.expect("+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n$-1\r\n:0\r\n")
+	if got := readAOF(t, s); got != "" {
+		t.Fatalf("AOF: got %q want nothing", got)
+	}
+	c.send("MULTI\r\nset a 1 badopt\r\nset a 1\r\nget a\r\nEXEC\r\n")
+	c.expect("+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n-ERR syntax error\r\n+OK\r\n$1\r\n1\r\n")
+	want := "*1\r\n$5\r\nmulti\r\n" +
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*1\r\n$4\r\nexec\r\n"
+	if got := readAOF(t, s); got != want {
+		t.Errorf("AOF: got %q want %q", got, want)
+	}
+}
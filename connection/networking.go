@@ -0,0 +1,1090 @@
+package connection
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+// Client output buffer
+// Replies are appended to an in-memory buffer. The buffer is handed to the
+// writeLoop once the pipeline read from the socket is drained, so a batch of
+// pipelined commands costs one write syscall instead of one per reply.
+// Two buffers are swapped between the command loop and the writer, so no
+// allocation happens once they have grown.
+type replyBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	spare   []byte
+	wake    chan struct{}
+	closing bool
+
+	inflight int /* Bytes handed to the socket, not yet written */
+}
+
+func newReplyBuffer() *replyBuffer {
+	rb := new(replyBuffer)
+	rb.wake = make(chan struct{}, 1)
+	return rb
+}
+
+// prepareClientToWrite returns false for the clients whose replies are
+// discarded: clients without a socket (AOF loading), clients that turned
+// replies off with CLIENT REPLY and clients being closed
+func (c *ClientConnection) prepareClientToWrite() bool {
+	return nil != c.cconn && c.flags&(CLIENT_REPLY_OFF|CLIENT_REPLY_SKIP|CLIENT_CLOSE_ASAP) == 0
+}
+
+// addReplyBytes appends an encoded reply to the client output buffer
+func (c *ClientConnection) addReplyBytes(b []byte) {
+	if len(b) > 0 && b[0] == '-' {
+		c.server.afterErrorReply(b[1:])
+	}
+	if !c.prepareClientToWrite() {
+		return
+	}
+	c.out.mu.Lock()
+	c.out.buf = append(c.out.buf, b...)
+	used := len(c.out.buf) + c.out.inflight
+	c.out.mu.Unlock()
+	closeClientOnOutputBufferLimitReached(c, used)
+}
+
+// appendReply lets the caller encode straight into the output buffer
+func (c *ClientConnection) appendReply(encode func(dst []byte) []byte) {
+	if !c.prepareClientToWrite() {
+		return
+	}
+	c.out.mu.Lock()
+	c.out.buf = encode(c.out.buf)
+	used := len(c.out.buf) + c.out.inflight
+	c.out.mu.Unlock()
+	closeClientOnOutputBufferLimitReached(c, used)
+}
+
+// flush asks the writeLoop to send the pending output, it never blocks
+func (c *ClientConnection) flush() {
+	if nil == c.cconn {
+		return
+	}
+	select {
+	case c.out.wake <- struct{}{}:
+	default:
+	}
+}
+
+// closeAfterReply flushes the pending output and closes the socket
+func (c *ClientConnection) closeAfterReply() {
+	if nil == c.cconn {
+		return
+	}
+	c.out.mu.Lock()
+	c.out.closing = true
+	c.out.mu.Unlock()
+	c.flush()
+}
+
+// freeClientAsync drops the pending output and closes the socket now
+// The connection goroutine then fails its read and frees the client.
+func (c *ClientConnection) freeClientAsync() {
+	if nil == c.cconn {
+		return
+	}
+	c.out.mu.Lock()
+	c.out.closing = true
+	c.out.buf = c.out.buf[:0]
+	c.out.mu.Unlock()
+	c.cconn.Close()
+	c.flush()
+}
+
+// outputBufferSize returns the bytes queued for the client, not yet written
+func (c *ClientConnection) outputBufferSize() int {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return len(c.out.buf) + c.out.inflight
+}
+
+// outputBufferMemory returns the memory used by the output buffer, the
+// one being filled plus the replies being written
+func (c *ClientConnection) outputBufferMemory() int {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return cap(c.out.buf) + c.out.inflight
+}
+
+/* Output buffer limits
+ *
+ * client-output-buffer-limit sets, for each class of clients, a hard limit
+ * that frees the client as soon as its output buffer reaches it, and a
+ * soft limit that frees the client once its output buffer stays over it
+ * for more than the soft seconds. 0 disables a limit. The limits are
+ * checked every time a reply is queued. */
+
+const CLIENT_TYPE_OBUF_COUNT = 3 /* Number of clients to expose to output
+   buffer configuration. Just the first three: normal, slave, pubsub. */
+
+type clientBufferLimits struct {
+	hardLimitBytes   int64
+	softLimitBytes   int64
+	softLimitSeconds int64
+}
+
+// checkClientOutputBufferLimits returns true if the hard limit is reached,
+// or the soft limit was reached for longer than the configured seconds
+func checkClientOutputBufferLimits(c *ClientConnection, used int) bool {
+	limits := c.server.clientObufLimits[getClientType(c)]
+	hard := limits.hardLimitBytes > 0 && int64(used) >= limits.hardLimitBytes
+	soft := limits.softLimitBytes > 0 && int64(used) >= limits.softLimitBytes
+
+	/* We need to check if the soft limit is reached continuously for the
+	 * specified amount of seconds. */
+	if soft {
+		now := time.Now().Unix()
+		if c.obufSoftLimitReachedTime == 0 {
+			c.obufSoftLimitReachedTime = now
+			soft = false /* First time we see the soft limit reached */
+		} else if now-c.obufSoftLimitReachedTime <= limits.softLimitSeconds {
+			soft = false /* The client still did not reached the max number of
+			   seconds for the soft limit to be considered reached. */
+		}
+	} else {
+		c.obufSoftLimitReachedTime = 0
+	}
+	return hard || soft
+}
+
+// closeClientOnOutputBufferLimitReached frees the client if used, the size
+// of its output buffer, is over the limits of its class. Returns true if
+// the client is being closed
+func closeClientOnOutputBufferLimitReached(c *ClientConnection, used int) bool {
+	if c.flags&CLIENT_CLOSE_ASAP != 0 {
+		return true
+	}
+	if !checkClientOutputBufferLimits(c, used) {
+		return false
+	}
+	c.flags |= CLIENT_CLOSE_ASAP
+	c.server.statClientObufLimitDisconn++
+	log.Warnf("Client %s scheduled to be closed ASAP for overcoming of output buffer limits.",
+		catClientInfoString(c))
+	c.freeClientAsync()
+	return true
+}
+
+// getClientMemoryUsage returns the memory used by the client buffers: the
+// socket reader, the request being read and the output buffer
+func getClientMemoryUsage(c *ClientConnection) int {
+	mem := c.outputBufferMemory()
+	if nil != c.reader {
+		mem += c.reader.Size()
+	}
+	if nil != c.req {
+		mem += c.req.BufferSize()
+	}
+	return mem
+}
+
+/* Client eviction
+ *
+ * Once the memory used by the buffers of all the clients reaches
+ * maxmemory-clients, the clients using the most memory are freed until the
+ * total is under the limit again. Clients with CLIENT NO-EVICT on are never
+ * evicted. The memory is checked by serverCron, so the limit can be
+ * overcome for up to a cron period. */
+
+// getClientEvictionLimit returns maxmemory-clients in bytes, 0 for no limit
+func (s *Server) getClientEvictionLimit() int64 {
+	limit := s.maxmemoryClients
+	if limit < 0 {
+		/* A percentage of maxmemory: vardis has no maxmemory, so there is
+		 * no limit as in redis with maxmemory 0. */
+		limit = 0
+	}
+	/* Don't allow a too small maxmemory-clients to avoid cases where we
+	 * can't communicate at all with the server because of bad
+	 * configuration */
+	if limit > 0 && limit < 1024*128 {
+		limit = 1024 * 128
+	}
+	return limit
+}
+
+// evictClients frees the clients using the most memory until the memory
+// used by all the clients is under maxmemory-clients
+// Must be called with s.mu held
+func (s *Server) evictClients() {
+	limit := s.getClientEvictionLimit()
+	if limit == 0 {
+		return
+	}
+	start := time.Now()
+	type clientMem struct {
+		c   *ClientConnection
+		mem int64
+	}
+	var total int64
+	candidates := make([]clientMem, 0, len(s.clients))
+	for _, c := range s.clients {
+		mem := int64(getClientMemoryUsage(c))
+		total += mem
+		if c.flags&(CLIENT_NO_EVICT|CLIENT_CLOSE_ASAP) == 0 {
+			candidates = append(candidates, clientMem{c, mem})
+		}
+	}
+	if total < limit {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].mem > candidates[j].mem
+	})
+	for _, cm := range candidates {
+		if total < limit {
+			break
+		}
+		log.Infof("Evicting client: %s", catClientInfoString(cm.c))
+		cm.c.flags |= CLIENT_CLOSE_ASAP
+		cm.c.freeClientAsync()
+		total -= cm.mem
+		s.statEvictedClients++
+	}
+	s.latencyAddSampleIfNeeded("eviction-cycle", time.Since(start))
+}
+
+// connReader counts the bytes read from the client sockets
+type connReader struct {
+	conn   net.Conn
+	server *Server
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	atomic.AddInt64(&r.server.statNetInputBytes, int64(n))
+	atomic.AddInt64(&r.server.statTotalReadsProcessed, 1)
+	return n, err
+}
+
+func (c *ClientConnection) writeLoop() {
+	defer c.server.writers.Done()
+	defer c.cconn.Close()
+	for range c.out.wake {
+		c.out.mu.Lock()
+		pending, closing := c.out.buf, c.out.closing
+		c.out.buf = c.out.spare[:0]
+		c.out.inflight = len(pending)
+		c.out.mu.Unlock()
+
+		if len(pending) > 0 {
+			n, err := c.cconn.Write(pending)
+			atomic.AddInt64(&c.server.statNetOutputBytes, int64(n))
+			atomic.AddInt64(&c.server.statTotalWritesProcessed, 1)
+			if err != nil {
+				return
+			}
+		}
+		c.out.mu.Lock()
+		c.out.spare = pending[:0]
+		c.out.inflight = 0
+		c.out.mu.Unlock()
+		if closing {
+			return
+		}
+	}
+}
+
+/* Reply writer API
+ *
+ * Commands reply only through these methods, one per reply type:
+ *
+ * addReplyStatus      +status, for fixed status replies only, never user data
+ * addReplyError       -ERR message
+ * addReplyErrorCode   -CODE message, CODE being WRONGTYPE, NOAUTH, OOM ...
+ * addReplyLongLong    :integer
+ * addReplyBulk        $bulk, binary safe
+ * addReplyNull        null bulk, or RESP3 null
+ * addReplyArrayLen    *array header, followed by the elements
+ * addReplyMapLen      map header, followed by the key value pairs
+ * addReplyDouble      double, a bulk string in RESP2
+ *
+ * plus the other RESP3 types below. addReplyBytes writes pre-encoded
+ * replies such as the shared ones. */
+
+// Error codes, the first word of an error reply
+const (
+	ERR_GENERIC    = "ERR"
+	ERR_WRONGTYPE  = "WRONGTYPE"
+	ERR_NOAUTH     = "NOAUTH"
+	ERR_WRONGPASS  = "WRONGPASS"
+	ERR_NOPERM     = "NOPERM"
+	ERR_NOPROTO    = "NOPROTO"
+	ERR_OOM        = "OOM"
+	ERR_LOADING    = "LOADING"
+	ERR_READONLY   = "READONLY"
+	ERR_BUSYKEY    = "BUSYKEY"
+	ERR_EXECABORT  = "EXECABORT"
+	ERR_NOSCRIPT   = "NOSCRIPT"
+	ERR_BUSY       = "BUSY"
+	ERR_MASTERDOWN = "MASTERDOWN"
+	ERR_MISCONF    = "MISCONF"
+	ERR_NOREPLICAS = "NOREPLICAS"
+)
+
+/* Shared replies, pre-encoded once like createSharedObjects() in redis */
+var shared = struct {
+	crlf, ok, emptybulk, czero, cone, emptyarray, pong, queued,
+	emptyscan, wrongtypeerr, nokeyerr, syntaxerr, sameobjecterr,
+	outofrangeerr, noscripterr, loadingerr, slowscripterr, masterdownerr,
+	bgsaveerr, roslaveerr, noautherr, oomerr, execaborterr, noreplicaserr,
+	busykeyerr []byte
+}{
+	crlf:          []byte("\r\n"),
+	ok:            []byte("+OK\r\n"),
+	emptybulk:     []byte("$0\r\n\r\n"),
+	czero:         []byte(":0\r\n"),
+	cone:          []byte(":1\r\n"),
+	emptyarray:    []byte("*0\r\n"),
+	pong:          []byte("+PONG\r\n"),
+	queued:        []byte("+QUEUED\r\n"),
+	emptyscan:     []byte("*2\r\n$1\r\n0\r\n*0\r\n"),
+	wrongtypeerr:  proto.EncodeErrorCode(ERR_WRONGTYPE, "Operation against a key holding the wrong kind of value"),
+	nokeyerr:      proto.EncodeError("no such key"),
+	syntaxerr:     proto.EncodeError("syntax error"),
+	sameobjecterr: proto.EncodeError("source and destination objects are the same"),
+	outofrangeerr: proto.EncodeError("index out of range"),
+	noscripterr:   proto.EncodeErrorCode(ERR_NOSCRIPT, "No matching script. Please use EVAL."),
+	loadingerr:    proto.EncodeErrorCode(ERR_LOADING, "Redis is loading the dataset in memory"),
+	slowscripterr: proto.EncodeErrorCode(ERR_BUSY, "Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."),
+	masterdownerr: proto.EncodeErrorCode(ERR_MASTERDOWN, "Link with MASTER is down and replica-serve-stale-data is set to 'no'."),
+	bgsaveerr:     proto.EncodeErrorCode(ERR_MISCONF, "Redis is configured to save RDB snapshots, but it is currently not able to persist on disk. Commands that may modify the data set are disabled, because this instance is configured to report errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error."),
+	roslaveerr:    proto.EncodeErrorCode(ERR_READONLY, "You can't write against a read only replica."),
+	noautherr:     proto.EncodeErrorCode(ERR_NOAUTH, "Authentication required."),
+	oomerr:        proto.EncodeErrorCode(ERR_OOM, "command not allowed when used memory > 'maxmemory'."),
+	execaborterr:  proto.EncodeErrorCode(ERR_EXECABORT, "Transaction discarded because of previous errors."),
+	noreplicaserr: proto.EncodeErrorCode(ERR_NOREPLICAS, "Not enough good replicas to write."),
+	busykeyerr:    proto.EncodeErrorCode(ERR_BUSYKEY, "Target key name already exists."),
+}
+
+func (c *ClientConnection) addReplyStatus(s string) {
+	c.appendReply(func(dst []byte) []byte { return proto.AppendString(dst, s) })
+}
+
+func (c *ClientConnection) addReplyError(s string) {
+	c.addReplyErrorCode(ERR_GENERIC, s)
+}
+
+func (c *ClientConnection) addReplyErrorCode(code string, s string) {
+	c.server.afterErrorReply(util.StringToBytes(code))
+	c.appendReply(func(dst []byte) []byte { return proto.AppendErrorCode(dst, code, s) })
+}
+
+func (c *ClientConnection) addReplyErrorFormat(format string, args ...interface{}) {
+	c.addReplyError(fmt.Sprintf(format, args...))
+}
+
+func (c *ClientConnection) addReplyErrorArity(req *proto.Request) {
+	c.addReplyErrorFormat("wrong number of arguments for '%s' command", req.Command())
+}
+
+func (c *ClientConnection) addReplySubcommandSyntaxError(req *proto.Request) {
+	c.addReplyErrorFormat("Unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.",
+		string(req.Argv()[1]), strings.ToUpper(req.Command()))
+}
+
+func (c *ClientConnection) addReplyBulk(b []byte) {
+	c.appendReply(func(dst []byte) []byte { return proto.AppendBulk(dst, b) })
+}
+
+func (c *ClientConnection) addReplyBulkString(s string) {
+	c.appendReply(func(dst []byte) []byte { return proto.AppendBulkString(dst, s) })
+}
+
+func (c *ClientConnection) addReplyLongLong(n int64) {
+	c.appendReply(func(dst []byte) []byte { return proto.AppendInt(dst, n) })
+}
+
+func (c *ClientConnection) addReplyArrayLen(n int) {
+	c.appendReply(func(dst []byte) []byte { return proto.AppendArrayLen(dst, n) })
+}
+
+// Replies below depend on the protocol negotiated with HELLO,
+// RESP2 clients get the closest RESP2 type
+
+func (c *ClientConnection) addReplyNull() {
+	if c.resp == 2 {
+		c.appendReply(proto.AppendNull)
+	} else {
+		c.appendReply(proto.AppendNil)
+	}
+}
+
+func (c *ClientConnection) addReplyNullArray() {
+	if c.resp == 2 {
+		c.appendReply(proto.AppendNullArray)
+	} else {
+		c.appendReply(proto.AppendNil)
+	}
+}
+
+// addReplyMapLen is followed by n key value pairs, a flat array in RESP2
+func (c *ClientConnection) addReplyMapLen(n int) {
+	if c.resp == 2 {
+		c.addReplyArrayLen(n * 2)
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendMapLen(dst, n) })
+	}
+}
+
+func (c *ClientConnection) addReplySetLen(n int) {
+	if c.resp == 2 {
+		c.addReplyArrayLen(n)
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendSetLen(dst, n) })
+	}
+}
+
+// addReplyAttributeLen is followed by n key value pairs
+// Attributes don't exist in RESP2, the caller must not send the pairs
+func (c *ClientConnection) addReplyAttributeLen(n int) {
+	if c.resp == 2 {
+		return
+	}
+	c.appendReply(func(dst []byte) []byte { return proto.AppendAttributeLen(dst, n) })
+}
+
+func (c *ClientConnection) addReplyPushLen(n int) {
+	if c.resp == 2 {
+		c.addReplyArrayLen(n)
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendPushLen(dst, n) })
+	}
+}
+
+func (c *ClientConnection) addReplyDouble(f float64) {
+	if c.resp == 2 {
+		c.appendReply(func(dst []byte) []byte {
+			var tmp [32]byte
+			return proto.AppendBulk(dst, proto.FormatDouble(tmp[:0], f))
+		})
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendDouble(dst, f) })
+	}
+}
+
+func (c *ClientConnection) addReplyBool(b bool) {
+	if c.resp == 2 {
+		if b {
+			c.addReplyLongLong(1)
+		} else {
+			c.addReplyLongLong(0)
+		}
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendBoolean(dst, b) })
+	}
+}
+
+func (c *ClientConnection) addReplyBigNum(n string) {
+	if c.resp == 2 {
+		c.addReplyBulkString(n)
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendBigNumber(dst, n) })
+	}
+}
+
+func (c *ClientConnection) addReplyVerbatim(b []byte, ext string) {
+	if c.resp == 2 {
+		c.addReplyBulk(b)
+	} else {
+		c.appendReply(func(dst []byte) []byte { return proto.AppendVerbatim(dst, ext, b) })
+	}
+}
+
+/* HELLO [protover [AUTH username password] [SETNAME clientname]] */
+func helloCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	ver := c.resp
+	if len(argv) >= 2 {
+		v, err := strconv.ParseInt(string(argv[1]), 10, 64)
+		if err != nil {
+			c.addReplyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			c.addReplyErrorCode(ERR_NOPROTO, "unsupported protocol version")
+			return
+		}
+		ver = int(v)
+	}
+
+	var name []byte
+	setName := false
+	for j := 2; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		opt := strings.ToLower(string(argv[j]))
+		if opt == "auth" && moreargs >= 2 {
+			if !c.server.aclAuthenticate(c, argv[j+1], argv[j+2]) {
+				c.addReplyErrorCode(ERR_WRONGPASS, "invalid username-password pair or user is disabled.")
+				return
+			}
+			j += 2
+		} else if opt == "setname" && moreargs >= 1 {
+			name = argv[j+1]
+			setName = true
+			j++
+		} else {
+			c.addReplyError("Syntax error in HELLO option '" + string(argv[j]) + "'")
+			return
+		}
+	}
+	/* At this point we need to be authenticated to continue. */
+	if authRequired(c) {
+		c.addReplyErrorCode(ERR_NOAUTH, "HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	if setName {
+		if !validClientName(name) {
+			c.addReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = string(name)
+	}
+
+	c.resp = ver
+	c.addReplyMapLen(7)
+
+	c.addReplyBulkString("server")
+	c.addReplyBulkString("redis")
+
+	c.addReplyBulkString("version")
+	c.addReplyBulkString(REDIS_VERSION)
+
+	c.addReplyBulkString("proto")
+	c.addReplyLongLong(int64(c.resp))
+
+	c.addReplyBulkString("id")
+	c.addReplyLongLong(c.id)
+
+	c.addReplyBulkString("mode")
+	c.addReplyBulkString("standalone")
+
+	c.addReplyBulkString("role")
+	c.addReplyBulkString("master")
+
+	c.addReplyBulkString("modules")
+	c.addReplyArrayLen(0)
+}
+
+// Client names must be printable and without spaces, like in redis
+func validClientName(name []byte) bool {
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/* Client types, for CLIENT LIST TYPE and CLIENT KILL TYPE */
+const (
+	CLIENT_TYPE_NORMAL = 0 /* Normal req-reply clients + MONITORs */
+	CLIENT_TYPE_SLAVE  = 1 /* Slaves. */
+	CLIENT_TYPE_PUBSUB = 2 /* Clients subscribed to PubSub channels. */
+	CLIENT_TYPE_MASTER = 3 /* Master. */
+)
+
+/* Client pause types, the most restrictive comes last */
+const (
+	CLIENT_PAUSE_OFF   = 0 /* Pause no commands */
+	CLIENT_PAUSE_WRITE = 1 /* Pause write commands */
+	CLIENT_PAUSE_ALL   = 2 /* Pause all commands */
+)
+
+func getClientType(c *ClientConnection) int {
+	if c.flags&CLIENT_PUBSUB != 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "slave", "replica":
+		return CLIENT_TYPE_SLAVE
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	case "master":
+		return CLIENT_TYPE_MASTER
+	}
+	return -1
+}
+
+func getClientTypeName(class int) string {
+	switch class {
+	case CLIENT_TYPE_NORMAL:
+		return "normal"
+	case CLIENT_TYPE_SLAVE:
+		return "slave"
+	case CLIENT_TYPE_PUBSUB:
+		return "pubsub"
+	case CLIENT_TYPE_MASTER:
+		return "master"
+	}
+	return ""
+}
+
+// getClientPeerId returns the address of the client, ip:port, or
+// path:0 for the clients connected to the unix socket
+func getClientPeerId(c *ClientConnection) string {
+	if nil == c.cconn {
+		return ""
+	}
+	if c.flags&CLIENT_UNIX_SOCKET != 0 {
+		/* Unix socket client. */
+		return c.server.unixsocket + ":0"
+	}
+	return c.cconn.RemoteAddr().String()
+}
+
+// getClientSockname returns the local address of the connection, the
+// address of the listener that accepted it
+func getClientSockname(c *ClientConnection) string {
+	if nil == c.cconn {
+		return ""
+	}
+	if c.flags&CLIENT_UNIX_SOCKET != 0 {
+		return c.server.unixsocket + ":0"
+	}
+	return c.cconn.LocalAddr().String()
+}
+
+// catClientInfoString describes the client as a CLIENT LIST line
+func catClientInfoString(c *ClientConnection) string {
+	flags := ""
+	if c.flags&CLIENT_MONITOR != 0 {
+		flags += "O"
+	}
+	if c.flags&CLIENT_PUBSUB != 0 {
+		flags += "P"
+	}
+	if c.flags&CLIENT_MULTI != 0 {
+		flags += "x"
+	}
+	if c.flags&CLIENT_BLOCKED != 0 {
+		flags += "b"
+	}
+	if c.flags&CLIENT_DIRTY_CAS != 0 {
+		flags += "d"
+	}
+	if c.flags&CLIENT_CLOSE_ASAP != 0 {
+		flags += "A"
+	}
+	if c.flags&CLIENT_UNIX_SOCKET != 0 {
+		flags += "U"
+	}
+	if c.flags&CLIENT_NO_EVICT != 0 {
+		flags += "e"
+	}
+	if c.flags&CLIENT_TRACKING != 0 {
+		flags += "t"
+	}
+	if c.flags&CLIENT_TRACKING_BROKEN_REDIR != 0 {
+		flags += "R"
+	}
+	if c.flags&CLIENT_TRACKING_BCAST != 0 {
+		flags += "B"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	multi := -1
+	if c.flags&CLIENT_MULTI != 0 {
+		multi = len(c.mstate)
+	}
+	cmd := "NULL"
+	if nil != c.lastcmd {
+		cmd = c.lastcmd.name
+	}
+	user := ""
+	if nil != c.user {
+		user = c.user.name
+	}
+	qbuf, qbufFree := c.qbuf, 0
+	if nil != c.reader {
+		qbufFree = c.reader.Size() - qbuf
+	}
+	obl, omem, totMem := 0, 0, 0
+	if nil != c.cconn {
+		obl = c.outputBufferSize()
+		omem = c.outputBufferMemory()
+		totMem = getClientMemoryUsage(c)
+	}
+	redir := int64(-1)
+	if c.flags&CLIENT_TRACKING != 0 {
+		redir = c.clientTrackingRedirection
+	}
+	now := time.Now()
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d qbuf=%d qbuf-free=%d obl=%d omem=%d tot-mem=%d cmd=%s user=%s redir=%d resp=%d lib-name=%s lib-ver=%s",
+		c.id, getClientPeerId(c), getClientSockname(c), c.name,
+		int64(now.Sub(c.ctime)/time.Second), int64(now.Sub(c.lastinteraction)/time.Second),
+		flags, c.dbid, len(c.pubsubChannels), len(c.pubsubPatterns), multi,
+		qbuf, qbufFree, obl, omem, totMem, cmd, user, redir, c.resp, c.libName, c.libVer)
+}
+
+// sortedClients returns the connected clients ordered by id
+func (s *Server) sortedClients() []*ClientConnection {
+	clients := make([]*ClientConnection, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// pauseClients pauses the commands of the clients until end. An ongoing
+// pause is never shortened nor made less restrictive.
+func (s *Server) pauseClients(end time.Time, ptype int) {
+	if ptype > s.pauseType {
+		s.pauseType = ptype
+	}
+	if end.After(s.pauseEnd) {
+		s.pauseEnd = end
+	}
+	if nil == s.pauseCh {
+		s.pauseCh = make(chan struct{})
+	}
+	time.AfterFunc(time.Until(end), func() {
+		s.mu.Lock()
+		if nil != s.pauseCh && !time.Now().Before(s.pauseEnd) {
+			s.unpauseClients()
+		}
+		s.mu.Unlock()
+	})
+}
+
+// unpauseClients resumes the paused clients
+func (s *Server) unpauseClients() {
+	s.pauseType = CLIENT_PAUSE_OFF
+	s.pauseEnd = time.Time{}
+	if nil != s.pauseCh {
+		close(s.pauseCh)
+		s.pauseCh = nil
+	}
+}
+
+// waitIfPaused waits, releasing s.mu, while the clients are paused for
+// the command. In WRITE mode only the commands that may change the dataset
+// or propagate, like PUBLISH, wait.
+func (s *Server) waitIfPaused(c *ClientConnection, req *proto.Request) {
+	for nil != s.pauseCh {
+		if s.pauseType == CLIENT_PAUSE_WRITE && !mayReplicate(c, s.commandMap[string(req.Argv()[0])]) {
+			return
+		}
+		pause := s.pauseCh
+		c.flags |= CLIENT_BLOCKED
+		s.mu.Unlock()
+		<-pause
+		s.mu.Lock()
+		c.flags &= ^CLIENT_BLOCKED
+	}
+}
+
+func mayReplicate(c *ClientConnection, cmd *RedisCommand) bool {
+	if nil == cmd {
+		return false
+	}
+	if cmd.Writable() || cmd.name == "publish" {
+		return true
+	}
+	if cmd.name == "exec" {
+		for _, queued := range c.mstate {
+			if mayReplicate(c, queued.cmd) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* CLIENT ID | INFO | LIST [TYPE type] [ID id ...] | SETNAME name | GETNAME |
+ * KILL ... | PAUSE timeout [WRITE|ALL] | UNPAUSE | REPLY ON|OFF|SKIP |
+ * NO-EVICT ON|OFF | SETINFO LIB-NAME|LIB-VER value | TRACKING ON|OFF ... |
+ * CACHING YES|NO | GETREDIR */
+func clientCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+
+	if sub == "id" && len(argv) == 2 {
+		/* CLIENT ID */
+		c.addReplyLongLong(c.id)
+	} else if sub == "info" && len(argv) == 2 {
+		/* CLIENT INFO */
+		c.addReplyVerbatim([]byte(catClientInfoString(c)+"\n"), "txt")
+	} else if sub == "list" {
+		/* CLIENT LIST [TYPE <type>] [ID <id> ...] */
+		ctype := -1
+		var ids map[int64]bool
+		if len(argv) == 4 && strings.EqualFold(string(argv[2]), "type") {
+			ctype = getClientTypeByName(string(argv[3]))
+			if ctype == -1 {
+				c.addReplyErrorFormat("Unknown client type '%s'", string(argv[3]))
+				return
+			}
+		} else if len(argv) > 3 && strings.EqualFold(string(argv[2]), "id") {
+			ids = make(map[int64]bool)
+			for _, arg := range argv[3:] {
+				id, err := strconv.ParseInt(string(arg), 10, 64)
+				if err != nil || id <= 0 {
+					c.addReplyError("Invalid client ID")
+					return
+				}
+				ids[id] = true
+			}
+		} else if len(argv) != 2 {
+			c.addReplyBytes(shared.syntaxerr)
+			return
+		}
+		var list strings.Builder
+		for _, client := range s.sortedClients() {
+			if ctype != -1 && getClientType(client) != ctype {
+				continue
+			}
+			if nil != ids && !ids[client.id] {
+				continue
+			}
+			list.WriteString(catClientInfoString(client))
+			list.WriteByte('\n')
+		}
+		c.addReplyVerbatim([]byte(list.String()), "txt")
+	} else if sub == "reply" && len(argv) == 3 {
+		/* CLIENT REPLY ON|OFF|SKIP */
+		mode := strings.ToLower(string(argv[2]))
+		if mode == "on" {
+			c.flags &= ^(CLIENT_REPLY_SKIP | CLIENT_REPLY_OFF)
+			c.addReplyBytes(shared.ok)
+		} else if mode == "off" {
+			c.flags |= CLIENT_REPLY_OFF
+		} else if mode == "skip" {
+			if c.flags&CLIENT_REPLY_OFF == 0 {
+				c.flags |= CLIENT_REPLY_SKIP_NEXT
+			}
+		} else {
+			c.addReplyBytes(shared.syntaxerr)
+		}
+	} else if sub == "no-evict" && len(argv) == 3 {
+		/* CLIENT NO-EVICT ON|OFF */
+		mode := strings.ToLower(string(argv[2]))
+		if mode == "on" {
+			c.flags |= CLIENT_NO_EVICT
+			c.addReplyBytes(shared.ok)
+		} else if mode == "off" {
+			c.flags &= ^CLIENT_NO_EVICT
+			c.addReplyBytes(shared.ok)
+		} else {
+			c.addReplyBytes(shared.syntaxerr)
+		}
+	} else if sub == "kill" {
+		clientKillCommand(req, c)
+	} else if sub == "setname" && len(argv) == 3 {
+		/* CLIENT SETNAME <name>, the empty name removes it */
+		if !validClientName(argv[2]) {
+			c.addReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = string(argv[2])
+		c.addReplyBytes(shared.ok)
+	} else if sub == "getname" && len(argv) == 2 {
+		/* CLIENT GETNAME */
+		if c.name == "" {
+			c.addReplyNull()
+		} else {
+			c.addReplyBulkString(c.name)
+		}
+	} else if sub == "setinfo" && len(argv) == 4 {
+		/* CLIENT SETINFO LIB-NAME|LIB-VER <value> */
+		attr := strings.ToLower(string(argv[2]))
+		if attr != "lib-name" && attr != "lib-ver" {
+			c.addReplyErrorFormat("Unrecognized option '%s'", string(argv[2]))
+			return
+		}
+		if !validClientName(argv[3]) {
+			c.addReplyErrorFormat("%s cannot contain spaces, newlines or special characters.", attr)
+			return
+		}
+		if attr == "lib-name" {
+			c.libName = string(argv[3])
+		} else {
+			c.libVer = string(argv[3])
+		}
+		c.addReplyBytes(shared.ok)
+	} else if sub == "unpause" && len(argv) == 2 {
+		/* CLIENT UNPAUSE */
+		s.unpauseClients()
+		c.addReplyBytes(shared.ok)
+	} else if sub == "pause" && (len(argv) == 3 || len(argv) == 4) {
+		/* CLIENT PAUSE <timeout> [WRITE|ALL] */
+		ptype := CLIENT_PAUSE_ALL
+		if len(argv) == 4 {
+			mode := strings.ToLower(string(argv[3]))
+			if mode == "write" {
+				ptype = CLIENT_PAUSE_WRITE
+			} else if mode != "all" {
+				c.addReplyError("CLIENT PAUSE mode must be WRITE or ALL")
+				return
+			}
+		}
+		timeout, err := strconv.ParseInt(string(argv[2]), 10, 64)
+		if err != nil || timeout < 0 {
+			c.addReplyError("timeout is not an integer or out of range")
+			return
+		}
+		s.pauseClients(time.Now().Add(time.Duration(timeout)*time.Millisecond), ptype)
+		c.addReplyBytes(shared.ok)
+	} else if sub == "tracking" && len(argv) >= 3 {
+		clientTrackingCommand(argv, c)
+	} else if sub == "caching" && len(argv) == 3 {
+		clientCachingCommand(argv, c)
+	} else if sub == "getredir" && len(argv) == 2 {
+		/* CLIENT GETREDIR */
+		if c.flags&CLIENT_TRACKING != 0 {
+			c.addReplyLongLong(c.clientTrackingRedirection)
+		} else {
+			c.addReplyLongLong(-1)
+		}
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
+
+/* CLIENT KILL <ip:port>
+ * CLIENT KILL <option> [value] ... <option> [value] */
+func clientKillCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	var addr, laddr string
+	var user *aclUser
+	var id int64
+	ctype := -1
+	skipme := true
+	maxage := int64(0)
+	oldForm := false
+
+	if len(argv) == 3 {
+		/* Old style syntax: CLIENT KILL <addr> */
+		addr = string(argv[2])
+		skipme = false /* With the old form, you can kill yourself. */
+		oldForm = true
+	} else if len(argv) > 3 && len(argv)%2 == 0 {
+		/* New style syntax: parse options. */
+		for i := 2; i < len(argv); i += 2 {
+			opt, val := strings.ToLower(string(argv[i])), string(argv[i+1])
+			switch opt {
+			case "id":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					c.addReplyError("client-id should be greater than 0")
+					return
+				}
+				id = n
+			case "type":
+				ctype = getClientTypeByName(val)
+				if ctype == -1 {
+					c.addReplyErrorFormat("Unknown client type '%s'", val)
+					return
+				}
+			case "addr":
+				addr = val
+			case "laddr":
+				laddr = val
+			case "user":
+				user = s.users[val]
+				if nil == user {
+					c.addReplyErrorFormat("No such user '%s'", val)
+					return
+				}
+			case "skipme":
+				if strings.EqualFold(val, "yes") {
+					skipme = true
+				} else if strings.EqualFold(val, "no") {
+					skipme = false
+				} else {
+					c.addReplyBytes(shared.syntaxerr)
+					return
+				}
+			case "maxage":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					c.addReplyError("maxage should be greater than 0")
+					return
+				}
+				maxage = n
+			default:
+				c.addReplyBytes(shared.syntaxerr)
+				return
+			}
+		}
+	} else {
+		c.addReplyBytes(shared.syntaxerr)
+		return
+	}
+
+	/* Iterate clients killing all the matching clients. */
+	killed := 0
+	now := time.Now()
+	for _, client := range s.sortedClients() {
+		if addr != "" && getClientPeerId(client) != addr {
+			continue
+		}
+		if laddr != "" && getClientSockname(client) != laddr {
+			continue
+		}
+		if ctype != -1 && getClientType(client) != ctype {
+			continue
+		}
+		if id != 0 && client.id != id {
+			continue
+		}
+		if nil != user && client.user != user {
+			continue
+		}
+		if maxage != 0 && int64(now.Sub(client.ctime)/time.Second) < maxage {
+			continue
+		}
+		if c == client && skipme {
+			continue
+		}
+
+		/* Kill it. */
+		if c == client {
+			/* Reply before closing, see handleConnection */
+			c.flags |= CLIENT_CLOSE_AFTER_REPLY
+		} else {
+			client.freeClientAsync()
+		}
+		killed++
+	}
+
+	/* Reply according to old/new format. */
+	if oldForm {
+		if killed == 0 {
+			c.addReplyError("No such client")
+		} else {
+			c.addReplyBytes(shared.ok)
+		}
+	} else {
+		c.addReplyLongLong(int64(killed))
+	}
+}
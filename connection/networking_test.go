@@ -0,0 +1,138 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+func BenchmarkAddReplyBulk(b *testing.B) {
+	s := testServer(b)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	defer conn.Close()
+	c := s.newClient(conn)
+	val := bytes.Repeat([]byte("x"), 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.addReplyBulk(val)
+		/* The writer hands the buffer back once written */
+		if i%16 == 15 {
+			c.out.buf = c.out.buf[:0]
+		}
+	}
+}
+
+// replyOf returns what fn adds to the output buffer of a client using
+// the protocol resp
+func replyOf(t *testing.T, resp int, fn func(c *ClientConnection)) string {
+	t.Helper()
+	s := testServer(t)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	defer conn.Close()
+	c := s.newClient(conn)
+	c.resp = resp
+	fn(c)
+	return string(c.out.buf)
+}
+
+func TestReplyTypesByProtocol(t *testing.T) {
+	cases := []struct {
+		name         string
+		fn           func(c *ClientConnection)
+		resp2, resp3 string
+	}{
+		{"null", func(c *ClientConnection) { c.addReplyNull() }, "$-1\r\n", "_\r\n"},
+		{"null array", func(c *ClientConnection) { c.addReplyNullArray() }, "*-1\r\n", "_\r\n"},
+		{"map", func(c *ClientConnection) { c.addReplyMapLen(2) }, "*4\r\n", "%2\r\n"},
+		{"set", func(c *ClientConnection) { c.addReplySetLen(3) }, "*3\r\n", "~3\r\n"},
+		{"attribute", func(c *ClientConnection) { c.addReplyAttributeLen(1) }, "", "|1\r\n"},
+		{"push", func(c *ClientConnection) { c.addReplyPushLen(3) }, "*3\r\n", ">3\r\n"},
+		{"double", func(c *ClientConnection) { c.addReplyDouble(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"true", func(c *ClientConnection) { c.addReplyBool(true) }, ":1\r\n", "#t\r\n"},
+		{"false", func(c *ClientConnection) { c.addReplyBool(false) }, ":0\r\n", "#f\r\n"},
+		{"bignum", func(c *ClientConnection) { c.addReplyBigNum("12345678901234567890") }, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{"verbatim", func(c *ClientConnection) { c.addReplyVerbatim([]byte("hi"), "txt") }, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+	}
+	for _, c := range cases {
+		if got := replyOf(t, 2, c.fn); got != c.resp2 {
+			t.Errorf("%s RESP2: got %q want %q", c.name, got, c.resp2)
+		}
+		if got := replyOf(t, 3, c.fn); got != c.resp3 {
+			t.Errorf("%s RESP3: got %q want %q", c.name, got, c.resp3)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	c := testClient(t, testServer(t))
+	c.send("HELLO 3 SETNAME app\r\n")
+	c.expect("%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n6.0.0\r\n$5\r\nproto\r\n:3\r\n")
+	c.expect("$2\r\nid\r\n:1\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n")
+	c.send("GET nokey\r\nCLIENT GETNAME\r\n")
+	c.expect("_\r\n$3\r\napp\r\n")
+
+	cases := []struct{ in, want string }{
+		{"HELLO 4\r\n", "-NOPROTO unsupported protocol version\r\n"},
+		{"HELLO 1\r\n", "-NOPROTO unsupported protocol version\r\n"},
+		{"HELLO x\r\n", "-ERR Protocol version is not an integer or out of range\r\n"},
+		{"HELLO 3 FOO\r\n", "-ERR Syntax error in HELLO option 'FOO'\r\n"},
+		{"HELLO 3 SETNAME\r\n", "-ERR Syntax error in HELLO option 'SETNAME'\r\n"},
+		{"HELLO 3 SETNAME \"a b\"\r\n", "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+	}
+	for _, tc := range cases {
+		c.send(tc.in)
+		c.expect(tc.want)
+	}
+	/* The failed HELLOs didn't switch protocol */
+	c.send("GET nokey\r\nHELLO 2\r\n")
+	c.expect("_\r\n*14\r\n")
+}
+
+func TestReplyWriter(t *testing.T) {
+	req := proto.NewRequest([][]byte{[]byte("client"), []byte("foo")})
+	cases := []struct {
+		fn   func(c *ClientConnection)
+		want string
+	}{
+		{func(c *ClientConnection) { c.addReplyStatus("OK") }, "+OK\r\n"},
+		{func(c *ClientConnection) { c.addReplyError("bad") }, "-ERR bad\r\n"},
+		{func(c *ClientConnection) { c.addReplyError("bad\r\nkey") }, "-ERR bad  key\r\n"},
+		{func(c *ClientConnection) { c.addReplyErrorCode(ERR_WRONGTYPE, "no") }, "-WRONGTYPE no\r\n"},
+		{func(c *ClientConnection) { c.addReplyErrorFormat("n=%d", 3) }, "-ERR n=3\r\n"},
+		{func(c *ClientConnection) { c.addReplyErrorArity(req) }, "-ERR wrong number of arguments for 'client' command\r\n"},
+		{func(c *ClientConnection) { c.addReplySubcommandSyntaxError(req) }, "-ERR Unknown subcommand or wrong number of arguments for 'foo'. Try CLIENT HELP.\r\n"},
+		{func(c *ClientConnection) { c.addReplyBulk([]byte("a\x00\r\n")) }, "$4\r\na\x00\r\n\r\n"},
+		{func(c *ClientConnection) { c.addReplyBulkString("") }, "$0\r\n\r\n"},
+		{func(c *ClientConnection) { c.addReplyLongLong(-1) }, ":-1\r\n"},
+		{func(c *ClientConnection) { c.addReplyArrayLen(0) }, "*0\r\n"},
+		{func(c *ClientConnection) { c.addReplyBytes(shared.wrongtypeerr) }, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+	}
+	for _, c := range cases {
+		if got := replyOf(t, 2, c.fn); got != c.want {
+			t.Errorf("got %q want %q", got, c.want)
+		}
+	}
+}
+
+func TestErrorRepliesAreCounted(t *testing.T) {
+	s := testServer(t)
+	c := &ClientConnection{server: s}
+	/* Clients without a socket get no reply, the errors still count */
+	c.addReplyError("bad")
+	c.addReplyErrorCode(ERR_NOPERM, "no")
+	c.addReplyBytes(shared.noautherr)
+	c.addReplyBytes(shared.ok)
+	if s.statTotalErrorReplies != 3 {
+		t.Errorf("got %d errors", s.statTotalErrorReplies)
+	}
+	for code, want := range map[string]int64{"ERR": 1, "NOPERM": 1, "NOAUTH": 1} {
+		if s.errorStats[code] != want {
+			t.Errorf("%s: got %d want %d", code, s.errorStats[code], want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package connection
+
+import (
+	"strconv"
+
+	"github.com/valarpirai/vardis/cache"
+)
+
+/* Keyspace events notification
+ *
+ * The storage raises an event on every change, such as "set", "del" or
+ * "expired". When the event class is enabled with notify-keyspace-events it
+ * is published to
+ *
+ *   __keyspace@<db>__:<key>    message is the event name    (K)
+ *   __keyevent@<db>__:<event>  message is the key name      (E) */
+
+// keyspaceEventsStringToFlags turns the notify-keyspace-events string into
+// the classes bitmask, -1 if the string contains an unknown class
+func keyspaceEventsStringToFlags(classes string) int {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= cache.NOTIFY_ALL
+		case 'g':
+			flags |= cache.NOTIFY_GENERIC
+		case '$':
+			flags |= cache.NOTIFY_STRING
+		case 'l':
+			flags |= cache.NOTIFY_LIST
+		case 's':
+			flags |= cache.NOTIFY_SET
+		case 'h':
+			flags |= cache.NOTIFY_HASH
+		case 'z':
+			flags |= cache.NOTIFY_ZSET
+		case 'x':
+			flags |= cache.NOTIFY_EXPIRED
+		case 'e':
+			flags |= cache.NOTIFY_EVICTED
+		case 'K':
+			flags |= cache.NOTIFY_KEYSPACE
+		case 'E':
+			flags |= cache.NOTIFY_KEYEVENT
+		case 't':
+			flags |= cache.NOTIFY_STREAM
+		case 'm':
+			flags |= cache.NOTIFY_KEY_MISS
+		default:
+			return -1
+		}
+	}
+	return flags
+}
+
+// keyspaceEventsFlagsToString is the inverse of keyspaceEventsStringToFlags
+func keyspaceEventsFlagsToString(flags int) string {
+	res := ""
+	if flags&cache.NOTIFY_ALL == cache.NOTIFY_ALL {
+		res += "A"
+	} else {
+		if flags&cache.NOTIFY_GENERIC != 0 {
+			res += "g"
+		}
+		if flags&cache.NOTIFY_STRING != 0 {
+			res += "$"
+		}
+		if flags&cache.NOTIFY_LIST != 0 {
+			res += "l"
+		}
+		if flags&cache.NOTIFY_SET != 0 {
+			res += "s"
+		}
+		if flags&cache.NOTIFY_HASH != 0 {
+			res += "h"
+		}
+		if flags&cache.NOTIFY_ZSET != 0 {
+			res += "z"
+		}
+		if flags&cache.NOTIFY_EXPIRED != 0 {
+			res += "x"
+		}
+		if flags&cache.NOTIFY_EVICTED != 0 {
+			res += "e"
+		}
+		if flags&cache.NOTIFY_STREAM != 0 {
+			res += "t"
+		}
+	}
+	if flags&cache.NOTIFY_KEYSPACE != 0 {
+		res += "K"
+	}
+	if flags&cache.NOTIFY_KEYEVENT != 0 {
+		res += "E"
+	}
+	if flags&cache.NOTIFY_KEY_MISS != 0 {
+		res += "m"
+	}
+	return res
+}
+
+// notifyKeyspaceEvent publishes the event if its class is enabled
+// Must be called with s.mu held
+func (s *Server) notifyKeyspaceEvent(class int, event string, key string, dbid int) {
+	if s.notifyKeyspaceEvents&class == 0 {
+		return
+	}
+	db := strconv.Itoa(dbid)
+
+	/* __keyspace@<db>__:<key> <event> notifications. */
+	if s.notifyKeyspaceEvents&cache.NOTIFY_KEYSPACE != 0 {
+		s.pubsubPublishMessage("__keyspace@"+db+"__:"+key, []byte(event))
+	}
+
+	/* __keyevent@<db>__:<event> <key> notifications. */
+	if s.notifyKeyspaceEvents&cache.NOTIFY_KEYEVENT != 0 {
+		s.pubsubPublishMessage("__keyevent@"+db+"__:"+event, []byte(key))
+	}
+}
@@ -0,0 +1,81 @@
+package connection
+
+import (
+	"testing"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+func TestKeyspaceEventsFlags(t *testing.T) {
+	tests := []struct {
+		classes string
+		want    string /* Canonical form, "" when rejected */
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Kx$gz", "g$zxK"},
+		{"Eg", "gE"},
+		{"AKEm", "AKEm"},
+		{"lshzxetK", "lshzxetK"},
+		{"g$lshzxet", "A"},
+		{"Q", ""},
+		{"KE ", ""},
+	}
+	for _, tt := range tests {
+		flags := keyspaceEventsStringToFlags(tt.classes)
+		if tt.want == "" && tt.classes != "" {
+			if flags != -1 {
+				t.Errorf("%q: got %d, want rejected", tt.classes, flags)
+			}
+			continue
+		}
+		if got := keyspaceEventsFlagsToString(flags); got != tt.want {
+			t.Errorf("%q: got %q want %q", tt.classes, got, tt.want)
+		}
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	message := func(channel, msg string) string {
+		reply := []byte("*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n")
+		reply = proto.AppendBulk(reply, []byte(channel))
+		return string(proto.AppendBulk(reply, []byte(msg)))
+	}
+	tests := []struct {
+		name   string
+		events string
+		want   string
+	}{
+		{"disabled", "", ""},
+		{"keyspace", "K$g", message("__keyspace@0__:foo", "set") + message("__keyspace@0__:foo", "del")},
+		{"keyevent", "E$g", message("__keyevent@0__:set", "foo") + message("__keyevent@0__:del", "foo")},
+		{"string class only", "KE$", message("__keyspace@0__:foo", "set") + message("__keyevent@0__:set", "foo")},
+		{"generic class only", "Kg", message("__keyspace@0__:foo", "del")},
+		{"no type", "A", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			sub := testClient(t, s)
+			c := testClient(t, s)
+			c.command("CONFIG", "SET", "notify-keyspace-events", tt.events)
+			c.expect("+OK\r\n")
+			sub.send("PSUBSCRIBE __key*__:*\r\n")
+			sub.expect("*3\r\n$10\r\npsubscribe\r\n$10\r\n__key*__:*\r\n:1\r\n")
+			/* Nothing for the commands that don't change the key */
+			c.send("SET foo bar\r\nGET foo\r\nSET foo baz NX\r\nDEL foo\r\nDEL foo\r\n")
+			c.expect("+OK\r\n$3\r\nbar\r\n$-1\r\n:1\r\n:0\r\n")
+			/* The PING reply follows the notifications */
+			sub.send("PING\r\n")
+			sub.expect(tt.want + "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		})
+	}
+}
+
+func TestNotifyKeyspaceEventsConfig(t *testing.T) {
+	c := testClient(t, testServer(t))
+	c.send("CONFIG SET notify-keyspace-events Kx$gz\r\nCONFIG GET notify*\r\nCONFIG SET notify-keyspace-events Q\r\nCONFIG GET notify*\r\n")
+	c.expect("+OK\r\n*2\r\n$22\r\nnotify-keyspace-events\r\n$5\r\ng$zxK\r\n" +
+		"-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtm'.\r\n" +
+		"*2\r\n$22\r\nnotify-keyspace-events\r\n$5\r\ng$zxK\r\n")
+}
@@ -0,0 +1,303 @@
+package connection
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/valarpirai/vardis/proto"
+	"github.com/valarpirai/vardis/util"
+)
+
+/* Pub/Sub
+ *
+ * server.pubsubChannels maps a channel to the clients subscribed to it,
+ * server.pubsubPatterns lists every (client, pattern) subscription. Each
+ * client keeps its own channels and patterns as well, so it can be
+ * unsubscribed from everything when it disconnects.
+ *
+ * Messages are written to the subscriber output buffer right away. A
+ * subscriber that doesn't read fast enough is disconnected once its output
+ * buffer grows over the pubsub class of client-output-buffer-limit. */
+
+type pubsubPattern struct {
+	client  *ClientConnection
+	pattern string
+}
+
+/* Replies sent to subscribers, a push in RESP3 */
+
+func addReplyPubsubMessage(c *ClientConnection, channel string, msg []byte) {
+	c.addReplyPushLen(3)
+	c.addReplyBulkString("message")
+	c.addReplyBulkString(channel)
+	c.addReplyBulk(msg)
+}
+
+func addReplyPubsubPatMessage(c *ClientConnection, pat string, channel string, msg []byte) {
+	c.addReplyPushLen(4)
+	c.addReplyBulkString("pmessage")
+	c.addReplyBulkString(pat)
+	c.addReplyBulkString(channel)
+	c.addReplyBulk(msg)
+}
+
+func addReplyPubsubSubscribed(c *ClientConnection, kind string, channel string) {
+	c.addReplyPushLen(3)
+	c.addReplyBulkString(kind)
+	c.addReplyBulkString(channel)
+	c.addReplyLongLong(int64(clientSubscriptionsCount(c)))
+}
+
+// addReplyPubsubUnsubscribed replies to UNSUBSCRIBE and PUNSUBSCRIBE
+// A nil channel is sent when the client wasn't subscribed to anything
+func addReplyPubsubUnsubscribed(c *ClientConnection, kind string, channel *string) {
+	c.addReplyPushLen(3)
+	c.addReplyBulkString(kind)
+	if nil == channel {
+		c.addReplyNull()
+	} else {
+		c.addReplyBulkString(*channel)
+	}
+	c.addReplyLongLong(int64(clientSubscriptionsCount(c)))
+}
+
+// Channels plus patterns the client is subscribed to
+func clientSubscriptionsCount(c *ClientConnection) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+func updatePubsubFlag(c *ClientConnection) {
+	if clientSubscriptionsCount(c) == 0 {
+		c.flags &= ^CLIENT_PUBSUB
+	} else {
+		c.flags |= CLIENT_PUBSUB
+	}
+}
+
+// Returns true if the client was not already subscribed to the channel
+func pubsubSubscribeChannel(c *ClientConnection, channel string) bool {
+	s := c.server
+	_, subscribed := c.pubsubChannels[channel]
+	if !subscribed {
+		if nil == c.pubsubChannels {
+			c.pubsubChannels = make(map[string]struct{})
+		}
+		c.pubsubChannels[channel] = struct{}{}
+		s.pubsubChannels[channel] = append(s.pubsubChannels[channel], c)
+	}
+	updatePubsubFlag(c)
+	addReplyPubsubSubscribed(c, "subscribe", channel)
+	return !subscribed
+}
+
+// Returns true if the client was subscribed to the channel
+func pubsubUnsubscribeChannel(c *ClientConnection, channel string, notify bool) bool {
+	s := c.server
+	_, subscribed := c.pubsubChannels[channel]
+	if subscribed {
+		delete(c.pubsubChannels, channel)
+		clients := s.pubsubChannels[channel]
+		for j, sub := range clients {
+			if sub == c {
+				clients = append(clients[:j], clients[j+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(s.pubsubChannels, channel)
+		} else {
+			s.pubsubChannels[channel] = clients
+		}
+	}
+	updatePubsubFlag(c)
+	if notify {
+		addReplyPubsubUnsubscribed(c, "unsubscribe", &channel)
+	}
+	return subscribed
+}
+
+func pubsubSubscribePattern(c *ClientConnection, pattern string) bool {
+	s := c.server
+	subscribed := false
+	for _, pat := range c.pubsubPatterns {
+		if pat == pattern {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		c.pubsubPatterns = append(c.pubsubPatterns, pattern)
+		s.pubsubPatterns = append(s.pubsubPatterns, pubsubPattern{c, pattern})
+	}
+	updatePubsubFlag(c)
+	addReplyPubsubSubscribed(c, "psubscribe", pattern)
+	return !subscribed
+}
+
+func pubsubUnsubscribePattern(c *ClientConnection, pattern string, notify bool) bool {
+	s := c.server
+	subscribed := false
+	for j, pat := range c.pubsubPatterns {
+		if pat == pattern {
+			c.pubsubPatterns = append(c.pubsubPatterns[:j], c.pubsubPatterns[j+1:]...)
+			subscribed = true
+			break
+		}
+	}
+	if subscribed {
+		for j, pat := range s.pubsubPatterns {
+			if pat.client == c && pat.pattern == pattern {
+				s.pubsubPatterns = append(s.pubsubPatterns[:j], s.pubsubPatterns[j+1:]...)
+				break
+			}
+		}
+	}
+	updatePubsubFlag(c)
+	if notify {
+		addReplyPubsubUnsubscribed(c, "punsubscribe", &pattern)
+	}
+	return subscribed
+}
+
+// Unsubscribe from all the channels, returns the number of channels
+func pubsubUnsubscribeAllChannels(c *ClientConnection, notify bool) int {
+	count := 0
+	for _, channel := range sortedSubscriptions(c.pubsubChannels) {
+		if pubsubUnsubscribeChannel(c, channel, notify) {
+			count++
+		}
+	}
+	/* We were subscribed to nothing? Still reply to the client. */
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(c, "unsubscribe", nil)
+	}
+	return count
+}
+
+func pubsubUnsubscribeAllPatterns(c *ClientConnection, notify bool) int {
+	count := 0
+	for _, pattern := range append([]string(nil), c.pubsubPatterns...) {
+		if pubsubUnsubscribePattern(c, pattern, notify) {
+			count++
+		}
+	}
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(c, "punsubscribe", nil)
+	}
+	return count
+}
+
+func sortedSubscriptions(channels map[string]struct{}) []string {
+	names := make([]string, 0, len(channels))
+	for channel := range channels {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pubsubPublishMessage delivers the message to channel and pattern
+// subscribers, and returns the number of clients that received it
+// Must be called with s.mu held
+func (s *Server) pubsubPublishMessage(channel string, message []byte) int {
+	receivers := 0
+	for _, c := range s.pubsubChannels[channel] {
+		addReplyPubsubMessage(c, channel, message)
+		c.flush()
+		receivers++
+	}
+	for _, pat := range s.pubsubPatterns {
+		if util.StringMatch(util.StringToBytes(pat.pattern), util.StringToBytes(channel), false) {
+			addReplyPubsubPatMessage(pat.client, pat.pattern, channel, message)
+			pat.client.flush()
+			receivers++
+		}
+	}
+	return receivers
+}
+
+/* SUBSCRIBE channel [channel ...] */
+func subscribeCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.addReplyError("SUBSCRIBE isn't allowed for a client in MULTI state")
+		return
+	}
+	for _, channel := range req.Argv()[1:] {
+		pubsubSubscribeChannel(c, string(channel))
+	}
+}
+
+/* UNSUBSCRIBE [channel ...] */
+func unsubscribeCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	if len(argv) == 1 {
+		pubsubUnsubscribeAllChannels(c, true)
+		return
+	}
+	for _, channel := range argv[1:] {
+		pubsubUnsubscribeChannel(c, string(channel), true)
+	}
+}
+
+/* PSUBSCRIBE pattern [pattern ...] */
+func psubscribeCommand(req *proto.Request, c *ClientConnection) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.addReplyError("PSUBSCRIBE isn't allowed for a client in MULTI state")
+		return
+	}
+	for _, pattern := range req.Argv()[1:] {
+		pubsubSubscribePattern(c, string(pattern))
+	}
+}
+
+/* PUNSUBSCRIBE [pattern ...] */
+func punsubscribeCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	if len(argv) == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+		return
+	}
+	for _, pattern := range argv[1:] {
+		pubsubUnsubscribePattern(c, string(pattern), true)
+	}
+}
+
+/* PUBLISH channel message */
+func publishCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	receivers := c.server.pubsubPublishMessage(string(argv[1]), argv[2])
+	c.addReplyLongLong(int64(receivers))
+}
+
+/* PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT */
+func pubsubCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+	if sub == "channels" && (len(argv) == 2 || len(argv) == 3) {
+		/* PUBSUB CHANNELS [<pattern>] */
+		var channels []string
+		for channel := range s.pubsubChannels {
+			if len(argv) == 2 || util.StringMatch(argv[2], util.StringToBytes(channel), false) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		c.addReplyArrayLen(len(channels))
+		for _, channel := range channels {
+			c.addReplyBulkString(channel)
+		}
+	} else if sub == "numsub" {
+		/* PUBSUB NUMSUB [Channel_1 ... Channel_N] */
+		c.addReplyMapLen(len(argv) - 2)
+		for _, channel := range argv[2:] {
+			c.addReplyBulk(channel)
+			c.addReplyLongLong(int64(len(s.pubsubChannels[string(channel)])))
+		}
+	} else if sub == "numpat" && len(argv) == 2 {
+		/* PUBSUB NUMPAT */
+		c.addReplyLongLong(int64(len(s.pubsubPatterns)))
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
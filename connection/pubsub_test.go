@@ -0,0 +1,72 @@
+package connection
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubsub(t *testing.T) {
+	s := testServer(t)
+	sub := testClient(t, s)
+	pub := testClient(t, s)
+	sub.send("SUBSCRIBE news\r\nPSUBSCRIBE n*\r\n")
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:2\r\n")
+	pub.send("PUBLISH news hi\r\nPUBLISH other hi\r\nPUBSUB NUMSUB news x\r\nPUBSUB NUMPAT\r\n" +
+		"PUBSUB CHANNELS\r\nPUBSUB CHANNELS x*\r\nPUBSUB foo\r\n")
+	pub.expect(":2\r\n:0\r\n*4\r\n$4\r\nnews\r\n:1\r\n$1\r\nx\r\n:0\r\n:1\r\n*1\r\n$4\r\nnews\r\n*0\r\n" +
+		"-ERR Unknown subcommand or wrong number of arguments for 'foo'. Try PUBSUB HELP.\r\n")
+	sub.expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n" +
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$2\r\nhi\r\n")
+
+	/* Only the pubsub commands are allowed in RESP2 */
+	sub.send("GET a\r\nPING\r\n")
+	sub.expect("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n" +
+		"*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	sub.send("UNSUBSCRIBE\r\nPUNSUBSCRIBE\r\nPUNSUBSCRIBE\r\nPING\r\n")
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+		"*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n" +
+		"*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n+PONG\r\n")
+}
+
+func TestPubsubResp3(t *testing.T) {
+	s := testServer(t)
+	sub := testClient(t, s)
+	pub := testClient(t, s)
+	sub.send("HELLO 3\r\nPING\r\n")
+	sub.skip("+PONG\r\n")
+	sub.send("SUBSCRIBE a b\r\n")
+	sub.expect(">3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n>3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n")
+	pub.command("PUBLISH", "b", "x\r\ny")
+	pub.expect(":1\r\n")
+	sub.expect(">3\r\n$7\r\nmessage\r\n$1\r\nb\r\n$4\r\nx\r\ny\r\n")
+	/* Any command is allowed in RESP3 */
+	sub.send("GET a\r\n")
+	sub.expect("_\r\n")
+}
+
+/* A client closing its connection leaves its channels and patterns */
+func TestPubsubDisconnect(t *testing.T) {
+	s := testServer(t)
+	sub := testClient(t, s)
+	sub.send("SUBSCRIBE ch\r\nPSUBSCRIBE c*\r\n")
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n*3\r\n$10\r\npsubscribe\r\n$2\r\nc*\r\n:2\r\n")
+	sub.conn.Close()
+	pub := testClient(t, s)
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		pub.send("PUBLISH ch x\r\n")
+		line, err := pub.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == ":0\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still %s subscribers", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub.send("PUBSUB NUMPAT\r\n")
+	pub.expect(":0\r\n")
+}
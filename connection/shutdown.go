@@ -0,0 +1,204 @@
+package connection
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/valarpirai/vardis/cache"
+	"github.com/valarpirai/vardis/proto"
+)
+
+/* Shutdown of the server, by SHUTDOWN or by SIGTERM / SIGINT:
+ *
+ * 1. The AOF is fsynced, an error stops the shutdown unless FORCE is given.
+ *    The AOF is the only persistence, so it takes the place of the RDB
+ *    save of redis: it is fsynced unless appendfsync is no, like redis
+ *    saves only with save points configured. SAVE fsyncs it anyway and
+ *    NOSAVE skips the fsync.
+ * 2. The listeners are closed, no new connections are accepted, and the
+ *    unix socket file is removed.
+ * 3. The command being executed completes, since it holds s.mu, and the
+ *    commands the clients sent after it are not executed.
+ * 4. The replies already queued are written to the clients, waiting up
+ *    to shutdown-timeout seconds, then the clients are closed.
+ * 5. The AOF is closed and Start returns the exit status.
+ *
+ * vardis has no replicas to wait for, so a shutdown never stays pending:
+ * NOW is accepted for compatibility, and ABORT, that cancels a pending
+ * shutdown, always replies that there is none in progress. */
+
+/* SHUTDOWN flags */
+const SHUTDOWN_NOFLAGS = 0 /* No flags. */
+const SHUTDOWN_SAVE = 1    /* Force SAVE on SHUTDOWN even if no save points are configured. */
+const SHUTDOWN_NOSAVE = 2  /* Don't SAVE on SHUTDOWN. */
+const SHUTDOWN_NOW = 4     /* Don't wait for replicas to catch up. */
+const SHUTDOWN_FORCE = 8   /* Don't let errors prevent shutdown. */
+
+/* prepareForShutdown stops the server from accepting clients and commands,
+ * once the data is safe on disk. Start then finishes the shutdown.
+ * Must be called with s.mu held */
+func (s *Server) prepareForShutdown(flags int) error {
+	if s.shutdownAsap {
+		return nil
+	}
+	log.Warnf("User requested shutdown...")
+
+	/* Flush the AOF to make sure the data is on disk. With appendfsync no
+	 * or NOSAVE the writes are left to the operating system, unless SAVE
+	 * is given. */
+	save := flags&SHUTDOWN_SAVE != 0 || (flags&SHUTDOWN_NOSAVE == 0 && s.aofFsync != cache.AOF_FSYNC_NO)
+	if nil != s.persistance && save {
+		log.Infof("Calling fsync() on the AOF file.")
+		if err := s.persistance.AofFile.Sync(); err != nil {
+			if flags&SHUTDOWN_FORCE == 0 {
+				log.Warnf("Error trying to fsync the AOF file: %s", err)
+				log.Warnf("Errors trying to shut down the server. Check the logs for more information.")
+				return err
+			}
+			log.Warnf("Error trying to fsync the AOF file: %s, exit anyway", err)
+			s.shutdownStatus = 1
+		}
+	}
+
+	s.stopAcceptingClients()
+	return nil
+}
+
+/* stopAcceptingClients stops accepting connections, and commands of the
+ * connected clients. Must be called with s.mu held */
+func (s *Server) stopAcceptingClients() {
+	s.shutdownAsap = true
+	if s.unixsocket != "" {
+		log.Infof("Removing the unix socket file.")
+	}
+	s.closeListeners()
+	for _, c := range s.clients {
+		c.closeAfterReply()
+	}
+}
+
+// AbortStartup shuts the server down with the exit status 1 when it can't
+// start, like when the AOF can't be loaded: the listeners and the clients
+// are closed and Start returns, or returns at once if it was not called
+// yet. The AOF is left as it is
+func (s *Server) AbortStartup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdownStatus = 1
+	s.stopAcceptingClients()
+}
+
+/* finishShutdown waits for the replies to be written to the clients, at
+ * most shutdown-timeout seconds, then closes the AOF. Returns the exit
+ * status. */
+func (s *Server) finishShutdown() int {
+	done := make(chan struct{})
+	go func() {
+		s.writers.Wait()
+		close(done)
+	}()
+	s.mu.Lock()
+	timeout := time.Duration(s.shutdownTimeout) * time.Second
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("Timed out writing the replies to the clients, closing them anyway")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		c.freeClientAsync()
+	}
+	if nil != s.persistance {
+		if err := s.persistance.AofFile.Close(); err != nil {
+			log.Warnf("Error closing the AOF file: %s", err)
+			s.shutdownStatus = 1
+		}
+	}
+	log.Warnf("Redis is now ready to exit, bye bye...")
+	return s.shutdownStatus
+}
+
+// setupSignalHandlers shuts the server down on SIGTERM and SIGINT, until
+// the returned function is called
+func (s *Server) setupSignalHandlers() (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go s.handleSignals(sigs)
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+}
+
+func (s *Server) handleSignals(sigs chan os.Signal) {
+	for sig := range sigs {
+		msg := "Received SIGTERM scheduling shutdown..."
+		if sig == syscall.SIGINT {
+			msg = "Received SIGINT scheduling shutdown..."
+		}
+		s.mu.Lock()
+		/* SIGINT is often delivered via Ctrl+C in an interactive session.
+		 * If we receive the signal the second time, we interpret this as
+		 * the user really wanting to quit ASAP without waiting to persist
+		 * on disk and without waiting for lagging replicas. */
+		if s.shutdownAsap && sig == syscall.SIGINT {
+			log.Warnf("You insist... exiting now.")
+			os.Exit(1)
+		}
+		log.Warn(msg)
+		if err := s.prepareForShutdown(SHUTDOWN_NOFLAGS); err != nil {
+			log.Warnf("%s received but errors trying to shut down the server, check the logs for more information", sig)
+		}
+		s.mu.Unlock()
+	}
+}
+
+/* SHUTDOWN [[NOSAVE | SAVE]] [NOW] [FORCE] [ABORT] */
+func shutdownCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	flags := SHUTDOWN_NOFLAGS
+	abort := false
+	for _, arg := range argv[1:] {
+		switch strings.ToLower(string(arg)) {
+		case "nosave":
+			flags |= SHUTDOWN_NOSAVE
+		case "save":
+			flags |= SHUTDOWN_SAVE
+		case "now":
+			flags |= SHUTDOWN_NOW
+		case "force":
+			flags |= SHUTDOWN_FORCE
+		case "abort":
+			abort = true
+		default:
+			c.addReplyBytes(shared.syntaxerr)
+			return
+		}
+	}
+	if (abort && flags != SHUTDOWN_NOFLAGS) || (flags&SHUTDOWN_NOSAVE != 0 && flags&SHUTDOWN_SAVE != 0) {
+		/* Illegal combo. */
+		c.addReplyBytes(shared.syntaxerr)
+		return
+	}
+
+	if abort {
+		/* There is never a shutdown waiting for replicas to abort */
+		c.addReplyError("No shutdown in progress.")
+		return
+	}
+
+	if err := c.server.prepareForShutdown(flags); err != nil {
+		c.addReplyError("Errors trying to SHUTDOWN. Check logs.")
+		return
+	}
+	/* The client is closed without a reply, like in redis where the
+	 * process exits. */
+	c.flags |= CLIENT_CLOSE_AFTER_REPLY
+}
@@ -0,0 +1,100 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valarpirai/vardis/cache"
+)
+
+// waitStatus returns the exit status of Start
+func waitStatus(t *testing.T, status chan int) int {
+	t.Helper()
+	select {
+	case code := <-status:
+		return code
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start did not return")
+	}
+	return -1
+}
+
+func TestShutdownSyntax(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	for _, args := range []string{"SAVE NOSAVE", "NOW ABORT", "foo"} {
+		c.send("SHUTDOWN " + args + "\r\n")
+		c.expect("-ERR syntax error\r\n")
+	}
+	c.send("SHUTDOWN ABORT\r\n")
+	c.expect("-ERR No shutdown in progress.\r\n")
+	c.send("PING\r\n")
+	c.expect("+PONG\r\n")
+}
+
+func TestShutdownSave(t *testing.T) {
+	tests := []struct {
+		flags    int
+		fsync    int
+		err      bool /* The fsync of the closed AOF fails */
+		shutdown bool
+		status   int
+	}{
+		{SHUTDOWN_NOFLAGS, cache.AOF_FSYNC_EVERYSEC, true, false, 0},
+		{SHUTDOWN_NOFLAGS, cache.AOF_FSYNC_NO, false, true, 0},
+		{SHUTDOWN_SAVE, cache.AOF_FSYNC_NO, true, false, 0},
+		{SHUTDOWN_NOSAVE, cache.AOF_FSYNC_ALWAYS, false, true, 0},
+		{SHUTDOWN_SAVE | SHUTDOWN_FORCE, cache.AOF_FSYNC_EVERYSEC, false, true, 1},
+	}
+	for _, tt := range tests {
+		s := testServer(t)
+		s.aofFsync = tt.fsync
+		s.persistance.AofFile.Close()
+		err := s.prepareForShutdown(tt.flags)
+		if (err != nil) != tt.err || s.shutdownAsap != tt.shutdown || s.shutdownStatus != tt.status {
+			t.Errorf("flags %d, appendfsync %d: got error %v, shutdown %v, status %d",
+				tt.flags, tt.fsync, err, s.shutdownAsap, s.shutdownStatus)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := testServer(t)
+	status := startServer(t, s)
+	c := dialServer(t, s)
+	c.send("SET a 1\r\nSHUTDOWN NOSAVE\r\nGET a\r\n")
+	c.expect("+OK\r\n")
+	/* No reply to SHUTDOWN, and the commands after it are not executed */
+	if rest, err := io.ReadAll(c.r); err != nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after SHUTDOWN", rest, err)
+	}
+	if code := waitStatus(t, status); code != 0 {
+		t.Errorf("exit status %d", code)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(s.PORT))); err == nil {
+		conn.Close()
+		t.Error("still accepting clients")
+	}
+	if got := readAOF(t, s); got != "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n" {
+		t.Errorf("AOF: got %q", got)
+	}
+}
+
+func TestShutdownOnSigterm(t *testing.T) {
+	s := testServer(t)
+	status := startServer(t, s)
+	c := dialServer(t, s)
+	c.send("PING\r\n")
+	c.expect("+PONG\r\n")
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	if code := waitStatus(t, status); code != 0 {
+		t.Errorf("exit status %d", code)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want the client closed", err)
+	}
+}
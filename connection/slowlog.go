@@ -0,0 +1,130 @@
+package connection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+/* Slowlog implements a system that is able to remember the latest N
+ * queries that took more than M microseconds to execute.
+ *
+ * The execution time to reach to be logged in the slow log is set
+ * using the 'slowlog-log-slower-than' config directive, that is also
+ * readable and writable using the CONFIG SET/GET command.
+ *
+ * The slow queries log is actually not "logged" in the Redis log file
+ * but is accessible thanks to the SLOWLOG command. */
+
+const SLOWLOG_ENTRY_MAX_ARGC = 32    /* Max number of args per entry */
+const SLOWLOG_ENTRY_MAX_STRING = 128 /* Max length of every arg */
+
+/* This structure defines an entry inside the slow log list */
+type slowlogEntry struct {
+	argv     []string
+	id       int64  /* Unique entry identifier. */
+	duration int64  /* Time spent by the query, in microseconds. */
+	time     int64  /* Unix time at which the query was executed. */
+	cname    string /* Client name. */
+	peerid   string /* Client network address. */
+}
+
+// slowlogCreateEntry copies the arguments, trimming the ones too long
+// and the ones past SLOWLOG_ENTRY_MAX_ARGC
+func slowlogCreateEntry(c *ClientConnection, argv [][]byte, duration int64) *slowlogEntry {
+	s := c.server
+	se := new(slowlogEntry)
+	slargc := len(argv)
+	if slargc > SLOWLOG_ENTRY_MAX_ARGC {
+		slargc = SLOWLOG_ENTRY_MAX_ARGC
+	}
+	se.argv = make([]string, slargc)
+	for j := 0; j < slargc; j++ {
+		/* Logging too many arguments is a useless memory waste, so we stop
+		 * at SLOWLOG_ENTRY_MAX_ARGC, but use the last argument to specify
+		 * how many remaining arguments there were in the original command. */
+		if slargc != len(argv) && j == slargc-1 {
+			se.argv[j] = fmt.Sprintf("... (%d more arguments)", len(argv)-slargc+1)
+		} else if len(argv[j]) > SLOWLOG_ENTRY_MAX_STRING {
+			/* Trim too long strings as well... */
+			se.argv[j] = fmt.Sprintf("%s... (%d more bytes)",
+				argv[j][:SLOWLOG_ENTRY_MAX_STRING], len(argv[j])-SLOWLOG_ENTRY_MAX_STRING)
+		} else {
+			se.argv[j] = string(argv[j])
+		}
+	}
+	se.time = time.Now().Unix()
+	se.duration = duration
+	se.id = s.slowlogEntryID
+	s.slowlogEntryID++
+	se.peerid = getClientPeerId(c)
+	se.cname = c.name
+	return se
+}
+
+// slowlogPushEntryIfNeeded logs the command if it ran for longer than
+// slowlog-log-slower-than, dropping the oldest entries over slowlog-max-len
+func (s *Server) slowlogPushEntryIfNeeded(c *ClientConnection, argv [][]byte, duration int64) {
+	if s.slowlogLogSlowerThan < 0 {
+		return /* Slowlog disabled */
+	}
+	if duration >= s.slowlogLogSlowerThan {
+		s.slowlog = append(s.slowlog, slowlogCreateEntry(c, argv, duration))
+	}
+
+	/* Remove old entries if needed. */
+	s.slowlogTrim()
+}
+
+func (s *Server) slowlogTrim() {
+	if len(s.slowlog) > s.slowlogMaxLen {
+		s.slowlog = append([]*slowlogEntry(nil), s.slowlog[len(s.slowlog)-s.slowlogMaxLen:]...)
+	}
+}
+
+/* SLOWLOG GET [count] | LEN | RESET */
+func slowlogCommand(req *proto.Request, c *ClientConnection) {
+	argv := req.Argv()
+	s := c.server
+	sub := strings.ToLower(string(argv[1]))
+	if sub == "reset" && len(argv) == 2 {
+		s.slowlog = nil
+		c.addReplyBytes(shared.ok)
+	} else if sub == "len" && len(argv) == 2 {
+		c.addReplyLongLong(int64(len(s.slowlog)))
+	} else if sub == "get" && (len(argv) == 2 || len(argv) == 3) {
+		count := 10
+		if len(argv) == 3 {
+			n, err := strconv.Atoi(string(argv[2]))
+			if err != nil || n < -1 {
+				c.addReplyError("count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		if count == -1 || count > len(s.slowlog) {
+			count = len(s.slowlog)
+		}
+
+		/* Newest entries first */
+		c.addReplyArrayLen(count)
+		for j := 0; j < count; j++ {
+			se := s.slowlog[len(s.slowlog)-1-j]
+			c.addReplyArrayLen(6)
+			c.addReplyLongLong(se.id)
+			c.addReplyLongLong(se.time)
+			c.addReplyLongLong(se.duration)
+			c.addReplyArrayLen(len(se.argv))
+			for _, arg := range se.argv {
+				c.addReplyBulkString(arg)
+			}
+			c.addReplyBulkString(se.peerid)
+			c.addReplyBulkString(se.cname)
+		}
+	} else {
+		c.addReplySubcommandSyntaxError(req)
+	}
+}
@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSlowlogCreateEntry(t *testing.T) {
+	s := testServer(t)
+	c := &ClientConnection{server: s, name: "app"}
+	long := strings.Repeat("x", SLOWLOG_ENTRY_MAX_STRING)
+	many := make([]string, SLOWLOG_ENTRY_MAX_ARGC+8)
+	for j := range many {
+		many[j] = strconv.Itoa(j)
+	}
+	tests := []struct {
+		name string
+		argv []string
+		want []string
+	}{
+		{"short", []string{"set", "k", "v"}, []string{"set", "k", "v"}},
+		{"max string", []string{"set", "k", long}, []string{"set", "k", long}},
+		{"long string", []string{"set", "k", long + "yyy"}, []string{"set", "k", long + "... (3 more bytes)"}},
+		{"max args", many[:SLOWLOG_ENTRY_MAX_ARGC], many[:SLOWLOG_ENTRY_MAX_ARGC]},
+		{"too many args", many, append(append([]string(nil), many[:SLOWLOG_ENTRY_MAX_ARGC-1]...), "... (9 more arguments)")},
+	}
+	for _, tt := range tests {
+		argv := make([][]byte, len(tt.argv))
+		for j, arg := range tt.argv {
+			argv[j] = []byte(arg)
+		}
+		se := slowlogCreateEntry(c, argv, 42)
+		if strings.Join(se.argv, " ") != strings.Join(tt.want, " ") || len(se.argv) != len(tt.want) {
+			t.Errorf("%s: got %q want %q", tt.name, se.argv, tt.want)
+		}
+		if se.duration != 42 || se.cname != "app" {
+			t.Errorf("%s: got duration %d name %q", tt.name, se.duration, se.cname)
+		}
+	}
+}
+
+func TestSlowlog(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("CONFIG SET slowlog-log-slower-than 0\r\nCLIENT SETNAME me\r\nSLOWLOG RESET\r\n" +
+		"SET k v EX 100\r\nAUTH foo\r\nSLOWLOG LEN\r\n")
+	c.skip("+OK\r\n")
+	c.skip("+OK\r\n")
+	c.skip("+OK\r\n")
+	c.skip("+OK\r\n")
+	c.skip("-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n")
+	/* SLOWLOG RESET is logged after the reset, AUTH never is */
+	c.expect(":2\r\n")
+
+	/* Newest first, with the arguments given by the client. The ids
+	 * are not reset */
+	c.send("SLOWLOG GET 2\r\n")
+	c.expect("*2\r\n*6\r\n:4\r\n")
+	c.skip("*2\r\n")
+	c.expect("$7\r\nslowlog\r\n$3\r\nLEN\r\n$4\r\npipe\r\n$2\r\nme\r\n*6\r\n:3\r\n")
+	c.skip("*5\r\n")
+	c.expect("$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n$2\r\nEX\r\n$3\r\n100\r\n$4\r\npipe\r\n$2\r\nme\r\n")
+
+	c.send("SLOWLOG GET -2\r\nSLOWLOG GET x\r\nSLOWLOG FOO\r\n")
+	c.expect("-ERR count should be greater than or equal to -1\r\n-ERR count should be greater than or equal to -1\r\n" +
+		"-ERR Unknown subcommand or wrong number of arguments for 'FOO'. Try SLOWLOG HELP.\r\n")
+
+	/* The oldest entries are dropped past slowlog-max-len */
+	c.send("CONFIG SET slowlog-max-len 2\r\nSLOWLOG LEN\r\nSLOWLOG GET -1\r\n")
+	c.expect("+OK\r\n:2\r\n*2\r\n*6\r\n:10\r\n")
+
+	c.send("CONFIG SET slowlog-log-slower-than -1\r\nSLOWLOG RESET\r\nPING\r\nSLOWLOG LEN\r\n")
+	c.skip("+PONG\r\n")
+	c.expect(":0\r\n")
+}
@@ -1,98 +1,87 @@
 package connection
 
 import (
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/valarpirai/vardis/cache"
 	"github.com/valarpirai/vardis/proto"
 )
 
-// "\r\n"
-// "+OK\r\n"
-// "-ERR\r\n"
-// "$0\r\n\r\n"
-// ":0\r\n"
-// ":1\r\n"
-// "*0\r\n"
-// "+PONG\r\n"
-// "+QUEUED\r\n"
-// "*2\r\n$1\r\n0\r\n*0\r\n"
-// "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
-// "-ERR no such key\r\n"
-// "-ERR syntax error\r\n"
-// "-ERR source and destination objects are the same\r\n"
-// "-ERR index out of range\r\n"
-// "-NOSCRIPT No matching script. Please use EVAL.\r\n"
-// "-LOADING Redis is loading the dataset in memory\r\n"
-// "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"
-// "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n"
-// "-MISCONF Redis is configured to save RDB snapshots, but it is currently not able to persist on disk. Commands that may modify the data set are disabled, because this instance is configured to report errors during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.\r\n"
-// "-READONLY You can't write against a read only replica.\r\n"
-// "-NOAUTH Authentication required.\r\n"
-// "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
-// "-EXECABORT Transaction discarded because of previous errors.\r\n"
-// "-NOREPLICAS Not enough good replicas to write.\r\n"
-// "-BUSYKEY Target key name already exists.\r\n"
-
 func genericGet(key string, conn *ClientConnection) {
-	// Check key exists
-	// Expire if needed, don't delete key and return nil
-	data := expireIfNeeded(key, conn.cache)
+	// Check key exists, expired keys are deleted
+	data := conn.cache.LookupRead(key)
 	if data == nil {
-		addReply(conn, nil)
+		conn.addReplyNull()
+		return
+	}
+	if data.Type() != cache.OBJ_STRING {
+		conn.addReplyBytes(shared.wrongtypeerr)
+		return
 	}
 
-	addReply(conn, data)
-	// If string or other object
-	// To avoid additional memory allocation
-	// Don't construct full response,
-	// just write the response bytes to Connection
+	// The value is encoded straight into the output buffer
+	conn.addReplyBulk(data.Value().([]byte))
+}
 
-	// Reduce memory allocation and GC as much as possible
+// Returns the key data, nil if missing or expired. Expired keys are deleted.
+func expireIfNeeded(key string, db *cache.CacheStorage) *cache.CacheData {
+	return db.Lookup(key)
 }
 
-func expireIfNeeded(key string, db cache.ICacheStorage) *cache.CacheData {
-	store := db.Store()
-	if data, ok := store[key]; ok {
-		if 0 == data.Expires() || time.Now().UnixNano() < data.Expires() {
-			return data
+/* Flags for SET */
+const (
+	OBJ_SET_NO_FLAGS = 0
+	OBJ_SET_NX       = (1 << 0) /* Set if key not exists. */
+	OBJ_SET_XX       = (1 << 1) /* Set if key exists. */
+	OBJ_SET_EX       = (1 << 2) /* Set if time in seconds is given */
+	OBJ_SET_PX       = (1 << 3) /* Set if time in ms in given */
+	OBJ_SET_KEEPTTL  = (1 << 4) /* Set and keep the ttl */
+	OBJ_SET_PXAT     = (1 << 5) /* Set if timestamp in ms is given */
+)
+
+// genericeSet sets key, expire is the TTL in unit, or with OBJ_SET_PXAT
+// the unix time in milliseconds. Returns the absolute expire time in unix
+// nanoseconds, 0 for none, and false if the key was not set
+func genericeSet(conn *ClientConnection, flags int, key string, value []byte, expire []byte, unit time.Duration) (int64, bool) {
+	// set expiry in SECONDS, MILLI-SECONDS
+	var when int64
+	if nil != expire {
+		ttl, err := strconv.ParseInt(string(expire), 10, 64)
+		if err != nil {
+			conn.addReplyError("value is not an integer or out of range")
+			return 0, false
+		}
+		/* The expire time is kept in unix nanoseconds */
+		now := time.Now().UnixNano()
+		if flags&OBJ_SET_PXAT != 0 {
+			now = 0
+		}
+		if ttl <= 0 || ttl > math.MaxInt64/int64(unit) || ttl*int64(unit) > math.MaxInt64-now {
+			conn.addReplyError("invalid expire time in set")
+			return 0, false
 		}
+		when = now + ttl*int64(unit)
 	}
-	return nil
-}
 
-func addReply(c *ClientConnection, reply *cache.CacheData) {
-	if nil == c.cconn {
-		return
+	existing := expireIfNeeded(key, conn.cache)
+	if (flags&OBJ_SET_NX != 0 && existing != nil) ||
+		(flags&OBJ_SET_XX != 0 && existing == nil) {
+		conn.addReplyNull()
+		return 0, false
 	}
-	if nil != reply {
-		switch reply.Type() {
-		case cache.OBJ_STRING:
-			str_result := reply.Value().(string)
-			WriteStringReply(c, str_result)
-		case cache.OBJ_LIST:
-			aInterface := reply.Value().([]string)
-			aString := make([][]byte, len(aInterface))
-			for i, v := range aInterface {
-				aString[i] = proto.EncodeBulkString(v)
-			}
-			c.cconn.Write(proto.EncodeArray(aString))
-		case cache.OBJ_SET:
-		case cache.OBJ_ZSET:
-		case cache.OBJ_HASH:
-		}
-	} else {
-		c.cconn.Write(proto.EncodeNull())
+	if flags&OBJ_SET_KEEPTTL != 0 && existing != nil {
+		when = existing.Expires()
 	}
-}
-
-func WriteStringReply(c *ClientConnection, msg string) {
-	c.cconn.Write(proto.EncodeString(msg))
-}
-
-func genericeSet(key string, value string) {
-	// set expiry in SECONDS, MILLI-SECONDS
-
+	conn.cache.Set(key, value)
+	if when != 0 {
+		conn.cache.SetExpire(key, when)
+	}
+	conn.server.dirty++
+	conn.addReplyBytes(shared.ok)
+	return when, true
 }
 
 // String command implementation
@@ -100,23 +89,80 @@ func getCommand(req *proto.Request, conn *ClientConnection) {
 	genericGet(req.Key(), conn)
 }
 
-/* SET key value [NX] [XX] [EX <seconds>] [PX <milliseconds>] */
+/* SET key value [NX] [XX] [KEEPTTL] [EX <seconds>] [PX <milliseconds>]
+ *     [PXAT <unix-time-milliseconds>] */
 func setCommand(req *proto.Request, conn *ClientConnection) {
-	key, val := req.Key(), req.Value()
-	conn.cache.Set(key, val)
-}
-func delCommand(req *proto.Request, conn *ClientConnection) {
-}
-func keysCommand(req *proto.Request, conn *ClientConnection) {
-	response := new(cache.CacheData)
-	response.SetValue(conn.cache.Keys(req.Key()))
-	response.SetType(cache.OBJ_LIST)
-	addReply(conn, response)
-}
-func existsCommand(req *proto.Request, conn *ClientConnection) {
-	key := req.Key()
-	conn.cache.Exists(key)
+	argv := req.Argv()
+	var expire []byte
+	unit := time.Second
+	flags := OBJ_SET_NO_FLAGS
+	expireFlags := OBJ_SET_KEEPTTL | OBJ_SET_EX | OBJ_SET_PX | OBJ_SET_PXAT
+
+	for j := 3; j < len(argv); j++ {
+		a := strings.ToLower(string(argv[j]))
+		var next []byte
+		if j < len(argv)-1 {
+			next = argv[j+1]
+		}
+
+		if a == "nx" && flags&OBJ_SET_XX == 0 {
+			flags |= OBJ_SET_NX
+		} else if a == "xx" && flags&OBJ_SET_NX == 0 {
+			flags |= OBJ_SET_XX
+		} else if a == "keepttl" && flags&expireFlags == 0 {
+			flags |= OBJ_SET_KEEPTTL
+		} else if a == "ex" && flags&expireFlags == 0 && next != nil {
+			flags |= OBJ_SET_EX
+			unit = time.Second
+			expire = next
+			j++
+		} else if a == "px" && flags&expireFlags == 0 && next != nil {
+			flags |= OBJ_SET_PX
+			unit = time.Millisecond
+			expire = next
+			j++
+		} else if a == "pxat" && flags&expireFlags == 0 && next != nil {
+			flags |= OBJ_SET_PXAT
+			unit = time.Millisecond
+			expire = next
+			j++
+		} else {
+			conn.addReplyBytes(shared.syntaxerr)
+			return
+		}
+	}
+
+	when, ok := genericeSet(conn, flags, req.Key(), req.Value(), expire, unit)
+	if ok && flags&(OBJ_SET_EX|OBJ_SET_PX) != 0 {
+		/* Propagate as SET key value PXAT <unix-time-milliseconds>: a
+		 * relative TTL would start over every time the AOF is replayed,
+		 * and bring back the keys that expired in between. */
+		req.Rewrite([][]byte{argv[0], argv[1], argv[2], []byte("PXAT"),
+			strconv.AppendInt(nil, when/int64(time.Millisecond), 10)})
+	}
 }
+
 func pingCommand(req *proto.Request, conn *ClientConnection) {
-	WriteStringReply(conn, "PONG")
+	argv := req.Argv()
+	if len(argv) > 2 {
+		conn.addReplyErrorArity(req)
+		return
+	}
+	/* A subscribed RESP2 client can't get a plain reply, it would be
+	 * mistaken for a message */
+	if conn.flags&CLIENT_PUBSUB != 0 && conn.resp == 2 {
+		conn.addReplyArrayLen(2)
+		conn.addReplyBulkString("pong")
+		if len(argv) == 1 {
+			conn.addReplyBulkString("")
+		} else {
+			conn.addReplyBulk(argv[1])
+		}
+		return
+	}
+	if len(argv) == 2 {
+		conn.addReplyBulk(argv[1])
+		return
+	}
+	conn.addReplyBytes(shared.pong)
 }
@@ -0,0 +1,125 @@
+package connection
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valarpirai/vardis/cache"
+)
+
+func TestSetOptions(t *testing.T) {
+	c := testClient(t, testServer(t))
+	cases := []struct{ in, want string }{
+		{"set k v NX\r\n", "+OK\r\n"},
+		{"set k w NX\r\n", "$-1\r\n"},
+		{"set k w XX\r\n", "+OK\r\n"},
+		{"set n w XX\r\n", "$-1\r\n"},
+		{"set k v NX XX\r\n", "-ERR syntax error\r\n"},
+		{"set k v EX 10 PX 10\r\n", "-ERR syntax error\r\n"},
+		{"set k v KEEPTTL EX 10\r\n", "-ERR syntax error\r\n"},
+		{"set k v EX\r\n", "-ERR syntax error\r\n"},
+		{"set k v FOO\r\n", "-ERR syntax error\r\n"},
+		{"set k v EX x\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"set k v EX 0\r\n", "-ERR invalid expire time in set\r\n"},
+		{"set k v PX -1\r\n", "-ERR invalid expire time in set\r\n"},
+		{"set k v PXAT 0\r\n", "-ERR invalid expire time in set\r\n"},
+		{"get k\r\n", "$1\r\nw\r\n"},
+	}
+	for _, tc := range cases {
+		c.send(tc.in)
+		c.expect(tc.want)
+	}
+}
+
+func TestSetExpireOverflow(t *testing.T) {
+	c := testClient(t, testServer(t))
+	for _, in := range []string{
+		"set k v EX 9223372036854775807\r\n",
+		"set k v EX 9223372037\r\n",
+		"set k v PX 9223372036854\r\n",
+		"set k v PXAT 9223372036855\r\n",
+	} {
+		c.send(in)
+		c.expect("-ERR invalid expire time in set\r\n")
+	}
+	c.send("exists k\r\n")
+	c.expect(":0\r\n")
+}
+
+func TestSetExpire(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("set k v PX 30\r\nset p v EX 100\r\nset p w KEEPTTL\r\nget k\r\n")
+	c.expect("+OK\r\n+OK\r\n+OK\r\n$1\r\nv\r\n")
+	s.mu.Lock()
+	ttl := s.cache[0].Lookup("p").Expires() - time.Now().UnixNano()
+	s.mu.Unlock()
+	if ttl <= 99*int64(time.Second) || ttl > 100*int64(time.Second) {
+		t.Errorf("KEEPTTL lost the TTL: %d", ttl)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.send("get k\r\n")
+	c.expect("$-1\r\n")
+}
+
+func TestSetPropagatesAbsoluteExpire(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	c.send("set a v EX 100\r\nset b v PX 5000 NX\r\nset c v PXAT 4102444800000\r\nset d v KEEPTTL\r\n")
+	c.expect("+OK\r\n+OK\r\n+OK\r\n+OK\r\n")
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	re := regexp.MustCompile(`^\*5\r\n\$3\r\nset\r\n\$1\r\na\r\n\$1\r\nv\r\n\$4\r\nPXAT\r\n\$13\r\n(\d+)\r\n` +
+		`\*5\r\n\$3\r\nset\r\n\$1\r\nb\r\n\$1\r\nv\r\n\$4\r\nPXAT\r\n\$13\r\n(\d+)\r\n` +
+		`\*5\r\n\$3\r\nset\r\n\$1\r\nc\r\n\$1\r\nv\r\n\$4\r\nPXAT\r\n\$13\r\n4102444800000\r\n` +
+		`\*4\r\n\$3\r\nset\r\n\$1\r\nd\r\n\$1\r\nv\r\n\$7\r\nKEEPTTL\r\n$`)
+	aof := readAOF(t, s)
+	m := re.FindStringSubmatch(aof)
+	if m == nil {
+		t.Fatalf("AOF: %q", aof)
+	}
+	for j, ttl := range []int64{100000, 5000} {
+		at, _ := strconv.ParseInt(m[j+1], 10, 64)
+		if at < before+ttl || at > after+ttl {
+			t.Errorf("PXAT %d not in [%d, %d]", at, before+ttl, after+ttl)
+		}
+	}
+}
+
+func TestSetExpireInMultiPropagatesAbsoluteExpire(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("MULTI\r\nset a v EX 100\r\nEXEC\r\n")
+	c.expect("+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n")
+	if aof := readAOF(t, s); !regexp.MustCompile(`\$4\r\nPXAT\r\n`).MatchString(aof) {
+		t.Errorf("AOF: %q", aof)
+	}
+}
+
+func TestSetExpiredKeyStaysExpiredAfterReplay(t *testing.T) {
+	s := testServer(t)
+	c := testClient(t, s)
+	c.send("set k v PX 20\r\n")
+	c.expect("+OK\r\n")
+	time.Sleep(40 * time.Millisecond)
+
+	/* A new server replays the AOF after the key expired */
+	replay := testServer(t)
+	if err := replay.persistance.AofFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := cache.NewStorage(s.persistance.AofFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.setPersistance(p)
+	if err := replay.LoadFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if replay.cache[0].Lookup("k") != nil {
+		t.Error("the expired key is back after the replay")
+	}
+}
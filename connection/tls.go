@@ -0,0 +1,289 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/* TLS
+ *
+ * With tls-port set the server accepts TLS connections on that port, on the
+ * same bind addresses as the plain TCP port, next to it: port 0 disables
+ * plaintext clients. The TLS clients go through the same dispatcher as
+ * the others once the handshake is done.
+ *
+ * The context is built from the tls-* parameters by tlsConfigure when the
+ * server starts, CONFIG SET of any of them builds it again and the new
+ * connections use the new one.
+ *
+ * Differences with redis, that uses OpenSSL:
+ * - tls-ciphers is a list of TLSv1.2 cipher names separated by ':', either
+ *   the OpenSSL ones like ECDHE-RSA-AES128-GCM-SHA256 or the IANA ones, or
+ *   DEFAULT. The OpenSSL cipher expressions like !MEDIUM are not supported.
+ *   The TLSv1.3 ciphersuites can't be configured, so there is no
+ *   tls-ciphersuites.
+ * - tls-protocols enables every version between the lowest and the highest
+ *   of the list.
+ * - tls-key-file-pass is not supported, the key file must be unencrypted.
+ * - vardis has no replication and no cluster, so there are no links
+ *   between servers to protect, and no tls-replication and tls-cluster. */
+
+/* tls-auth-clients */
+const TLS_CLIENT_AUTH_NO = 0
+const TLS_CLIENT_AUTH_YES = 1
+const TLS_CLIENT_AUTH_OPTIONAL = 2
+
+/* tls-auth-clients-user: the field of the client certificate naming the
+ * ACL user the client is authenticated as */
+const TLS_CLIENT_FIELD_OFF = 0
+const TLS_CLIENT_FIELD_CN = 1
+
+/* Time a new client has to complete the TLS handshake, unless the client
+ * timeout is set */
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type tlsContextConfig struct {
+	certFile   string /* Server side and optionally client side cert file name */
+	keyFile    string /* Private key filename for cert_file */
+	caCertFile string
+	caCertDir  string
+	protocols  string
+	ciphers    string
+}
+
+/* OpenSSL names of the TLSv1.2 ciphers, the IANA names are known by
+ * crypto/tls. */
+var tlsOpensslCipherNames = map[string]string{
+	"ECDHE-ECDSA-AES128-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-ECDSA-AES256-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-RSA-AES128-SHA":          "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-RSA-AES256-SHA":          "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-ECDSA-AES128-GCM-SHA256": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-RSA-AES128-GCM-SHA256":   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-ECDSA-AES256-GCM-SHA384": "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-RSA-AES256-GCM-SHA384":   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-ECDSA-CHACHA20-POLY1305": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-RSA-CHACHA20-POLY1305":   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+// parseProtocolsConfig returns the lowest and the highest TLS version
+// of tls-protocols, TLSv1.2 and TLSv1.3 when empty
+func parseProtocolsConfig(str string) (uint16, uint16, error) {
+	if str == "" {
+		return tls.VersionTLS12, tls.VersionTLS13, nil
+	}
+	var min, max uint16
+	for _, proto := range strings.Fields(str) {
+		var version uint16
+		switch strings.ToLower(proto) {
+		case "tlsv1":
+			version = tls.VersionTLS10
+		case "tlsv1.1":
+			version = tls.VersionTLS11
+		case "tlsv1.2":
+			version = tls.VersionTLS12
+		case "tlsv1.3":
+			version = tls.VersionTLS13
+		default:
+			return 0, 0, errors.New("Invalid tls-protocols specified. Use a combination of 'TLSv1', 'TLSv1.1', 'TLSv1.2' and 'TLSv1.3'.")
+		}
+		if min == 0 || version < min {
+			min = version
+		}
+		if version > max {
+			max = version
+		}
+	}
+	return min, max, nil
+}
+
+// parseCiphersConfig returns the cipher suites of tls-ciphers, nil for
+// the crypto/tls defaults
+func parseCiphersConfig(str string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(str, ":") {
+		if name == "" || name == "DEFAULT" {
+			continue
+		}
+		if iana, ok := tlsOpensslCipherNames[name]; ok {
+			name = iana
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Failed to configure ciphers: unknown cipher '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadCACerts returns the pool of the CA bundle file and of the
+// certificates of the CA directory
+func loadCACerts(ctxConfig *tlsContextConfig) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if ctxConfig.caCertFile != "" {
+		data, err := os.ReadFile(ctxConfig.caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file/directory: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file/directory: no certificate found in %s", ctxConfig.caCertFile)
+		}
+	}
+	if ctxConfig.caCertDir != "" {
+		entries, err := os.ReadDir(ctxConfig.caCertDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file/directory: %s", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			/* The files that are not PEM certificates are skipped, like
+			 * the CRLs of an OpenSSL hashed directory. */
+			if data, err := os.ReadFile(filepath.Join(ctxConfig.caCertDir, entry.Name())); err == nil {
+				pool.AppendCertsFromPEM(data)
+			}
+		}
+	}
+	return pool, nil
+}
+
+// createTLSContext builds the server TLS config of the tls-* parameters
+func (s *Server) createTLSContext() (*tls.Config, error) {
+	ctxConfig := &s.tlsCtxConfig
+	if ctxConfig.certFile == "" {
+		return nil, errors.New("No tls-cert-file configured!")
+	}
+	if ctxConfig.keyFile == "" {
+		return nil, errors.New("No tls-key-file configured!")
+	}
+	if s.tlsAuthClients != TLS_CLIENT_AUTH_NO && ctxConfig.caCertFile == "" && ctxConfig.caCertDir == "" {
+		return nil, errors.New("Either tls-ca-cert-file or tls-ca-cert-dir must be specified when tls-auth-clients is enabled!")
+	}
+
+	cert, err := tls.LoadX509KeyPair(ctxConfig.certFile, ctxConfig.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate: %s: %s", ctxConfig.certFile, err)
+	}
+	min, max, err := parseProtocolsConfig(ctxConfig.protocols)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := parseCiphersConfig(ctxConfig.ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   min,
+		MaxVersion:   max,
+		CipherSuites: ciphers,
+	}
+	if ctxConfig.caCertFile != "" || ctxConfig.caCertDir != "" {
+		if config.ClientCAs, err = loadCACerts(ctxConfig); err != nil {
+			return nil, err
+		}
+	}
+	switch s.tlsAuthClients {
+	case TLS_CLIENT_AUTH_YES:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLS_CLIENT_AUTH_OPTIONAL:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+	return config, nil
+}
+
+// tlsConfigure builds the TLS context used by the new connections
+func (s *Server) tlsConfigure() error {
+	config, err := s.createTLSContext()
+	if err != nil {
+		return err
+	}
+	s.tlsContext.Store(config)
+	return nil
+}
+
+// applyTlsCfg rebuilds the TLS context after CONFIG SET, once the server
+// is started with a tls-port: before, Start builds it
+func applyTlsCfg(s *Server) error {
+	if nil == s.tlsContext.Load() {
+		return nil
+	}
+	if err := s.tlsConfigure(); err != nil {
+		return fmt.Errorf("Unable to update TLS configuration: %s", err)
+	}
+	return nil
+}
+
+// tlsListenerConfig returns the config of the TLS listeners, that hands
+// the current context to every new connection
+func (s *Server) tlsListenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsContext.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// tlsHandshake completes the TLS handshake of a new client, then
+// authenticates it as the ACL user named in its certificate when
+// tls-auth-clients-user is set. Returns false if the handshake failed
+func (s *Server) tlsHandshake(c *ClientConnection) bool {
+	conn, ok := c.cconn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+
+	/* A client that never completes the handshake must not hold a
+	 * connection forever: it has the client timeout to do it, or
+	 * TLS_HANDSHAKE_TIMEOUT without one. */
+	s.mu.Lock()
+	timeout := TLS_HANDSHAKE_TIMEOUT
+	if s.maxidletime > 0 {
+		timeout = time.Duration(s.maxidletime) * time.Second
+	}
+	s.mu.Unlock()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		log.Infof("Error accepting a client connection: %s (addr=%s laddr=%s)",
+			err, conn.RemoteAddr(), conn.LocalAddr())
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsAuthClientsUser == TLS_CLIENT_FIELD_OFF {
+		return true
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return true
+	}
+	name := certs[0].Subject.CommonName
+	u := s.users[name]
+	if nil == u || u.flags&USER_FLAG_DISABLED != 0 {
+		/* No such user: the client authenticates as usual */
+		log.Debugf("No enabled ACL user matches the certificate CN '%s'", name)
+		return true
+	}
+	c.user = u
+	c.authenticated = true
+	return true
+}
@@ -0,0 +1,183 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// makeCert creates a certificate for 127.0.0.1 signed by parent, self
+// signed if parent is nil
+func makeCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  nil == parent,
+		BasicConstraintsValid: true,
+	}
+	pcert, pkey := tmpl, key
+	if nil != parent {
+		pcert, pkey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pcert, &key.PublicKey, pkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// write saves the certificate and its key in dir as PEM files
+func (c *testCert) write(t *testing.T, dir, name string) (certFile string, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSServer starts a server with a TLS port, returns the CA of its
+// certificates
+func startTLSServer(t *testing.T, s *Server) *testCert {
+	t.Helper()
+	dir := t.TempDir()
+	ca := makeCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := makeCert(t, "server", ca).write(t, dir, "server")
+	s.tlsPort = int(freePort(t))
+	config := "tls-cert-file " + certFile + "\ntls-key-file " + keyFile + "\ntls-ca-cert-file " + caFile + "\n"
+	if err := s.loadServerConfigFromString(config); err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, s)
+	return ca
+}
+
+func dialTLS(t *testing.T, s *Server, ca *testCert, cfg *tls.Config) (*testConn, error) {
+	t.Helper()
+	cfg.RootCAs = x509.NewCertPool()
+	cfg.RootCAs.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(s.tlsPort), cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t, conn, bufio.NewReader(conn)}, nil
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	s := testServer(t)
+	s.tlsAuthClientsUser = TLS_CLIENT_FIELD_CN
+	ca := startTLSServer(t, s)
+	admin := dialServer(t, s)
+	admin.send("ACL SETUSER app on nopass +@all ~*\r\n")
+	admin.expect("+OK\r\n")
+
+	/* Authenticated as the user named by the certificate CN */
+	cert := makeCert(t, "app", ca)
+	c, err := dialTLS(t, s, ca, &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{cert.der}, PrivateKey: cert.key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send("ACL WHOAMI\r\nSET k v\r\nGET k\r\n")
+	c.expect("$3\r\napp\r\n+OK\r\n$1\r\nv\r\n")
+
+	/* A client certificate is required with tls-auth-clients yes */
+	if c, err := dialTLS(t, s, ca, &tls.Config{}); err == nil {
+		c.send("PING\r\n")
+		if line, err := c.r.ReadString('\n'); err == nil {
+			t.Errorf("got %q without a client certificate", line)
+		}
+	}
+	admin.send("CONFIG SET tls-auth-clients optional\r\n")
+	admin.expect("+OK\r\n")
+	c, err = dialTLS(t, s, ca, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send("ACL WHOAMI\r\n")
+	c.expect("$7\r\ndefault\r\n")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	/* A client that never sends its hello is closed after the timeout */
+	s := testServer(t)
+	s.maxidletime = 1
+	cert := makeCert(t, "server", nil)
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &ClientConnection{server: s, cconn: tls.Server(a, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}}})}
+	done := make(chan bool, 1)
+	start := time.Now()
+	go func() { done <- s.tlsHandshake(c) }()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("handshake succeeded")
+		}
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("handshake failed after %s", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("handshake still running")
+	}
+
+	/* The deadline is cleared once the handshake is done */
+	s = testServer(t)
+	ca := startTLSServer(t, s)
+	admin := dialServer(t, s)
+	admin.send("CONFIG SET tls-auth-clients no timeout 1\r\n")
+	admin.expect("+OK\r\n")
+	tc, err := dialTLS(t, s, ca, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.send("CONFIG SET timeout 0\r\n")
+	tc.expect("+OK\r\n")
+	time.Sleep(1100 * time.Millisecond)
+	tc.send("PING\r\n")
+	tc.expect("+PONG\r\n")
+}
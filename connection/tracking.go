@@ -0,0 +1,447 @@
+package connection
+
+import (
+	"strconv"
+	"strings"
+)
+
+/* Client side caching: keys tracking and invalidation, from redis tracking.c
+ *
+ * In the default mode the server remembers, in trackingTable, which clients
+ * read each key. When the key is modified the clients are sent an
+ * invalidation message, and the key is forgotten until they read it again.
+ *
+ * In BCAST mode the clients subscribe to key prefixes instead, and are
+ * sent the modified keys matching their prefixes, no matter what they read.
+ * The keys are collected in prefixTable and sent once the command that
+ * modified them is done.
+ *
+ * Invalidations are RESP3 push messages, or messages of the
+ * __redis__:invalidate channel when a RESP2 client redirects them to a
+ * subscribed connection. */
+
+/* Client tracking flags */
+var CLIENT_TRACKING uint64 = (1 << 31)              /* Client enabled keys tracking in order to perform client side caching. */
+var CLIENT_TRACKING_BROKEN_REDIR uint64 = (1 << 32) /* Target client is invalid. */
+var CLIENT_TRACKING_BCAST uint64 = (1 << 33)        /* Tracking in BCAST mode. */
+var CLIENT_TRACKING_OPTIN uint64 = (1 << 34)        /* Tracking in opt-in mode. */
+var CLIENT_TRACKING_OPTOUT uint64 = (1 << 35)       /* Tracking in opt-out mode. */
+var CLIENT_TRACKING_CACHING uint64 = (1 << 36)      /* CACHING yes/no was given, depending on optin/optout mode. */
+var CLIENT_TRACKING_NOLOOP uint64 = (1 << 37)       /* Don't send invalidation messages about writes performed by myself.*/
+
+const TrackingChannelName = "__redis__:invalidate"
+
+/* BCAST state of a prefix: the subscribed clients, and the keys modified
+ * since the last broadcast with the client that modified them, nil if
+ * more than one client did. */
+type bcastState struct {
+	keys    map[string]*ClientConnection
+	clients map[*ClientConnection]struct{}
+}
+
+// disableTracking removes the tracking state of the client
+// The keys it read are forgotten lazily, when they are invalidated.
+func disableTracking(c *ClientConnection) {
+	s := c.server
+	if c.flags&CLIENT_TRACKING == 0 {
+		return
+	}
+	/* If this client is in broadcasting mode, we need to unsubscribe it
+	 * from all the prefixes it is registered to. */
+	if c.flags&CLIENT_TRACKING_BCAST != 0 {
+		for prefix := range c.clientTrackingPrefixes {
+			bs := s.prefixTable[prefix]
+			delete(bs.clients, c)
+			/* Was it the last client? Remove the prefix from the table. */
+			if len(bs.clients) == 0 {
+				delete(s.prefixTable, prefix)
+			}
+		}
+		c.clientTrackingPrefixes = nil
+	}
+
+	/* Clear flags and adjust the count. */
+	s.trackingClients--
+	c.flags &= ^(CLIENT_TRACKING | CLIENT_TRACKING_BROKEN_REDIR |
+		CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN |
+		CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_CACHING |
+		CLIENT_TRACKING_NOLOOP)
+}
+
+// checkPrefixCollisionsOrReply makes sure no prefix of the client is the
+// prefix of another one, as the same key would be sent twice
+func checkPrefixCollisionsOrReply(c *ClientConnection, prefixes []string) bool {
+	for i, prefix := range prefixes {
+		/* Check input list has no overlap with existing prefixes. */
+		for existing := range c.clientTrackingPrefixes {
+			if strings.HasPrefix(existing, prefix) || strings.HasPrefix(prefix, existing) {
+				c.addReplyErrorFormat("Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, existing)
+				return false
+			}
+		}
+		/* Check input has no overlap with itself. */
+		for j := i + 1; j < len(prefixes); j++ {
+			if strings.HasPrefix(prefixes[j], prefix) || strings.HasPrefix(prefix, prefixes[j]) {
+				c.addReplyErrorFormat("Prefix '%s' overlaps with another provided prefix '%s'. Prefixes for a single client must not overlap.", prefix, prefixes[j])
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// enableTracking turns tracking on for the client, with the options of
+// CLIENT TRACKING. It can be called again to add BCAST prefixes.
+func enableTracking(c *ClientConnection, redirectTo int64, options uint64, prefixes []string) {
+	s := c.server
+	if c.flags&CLIENT_TRACKING == 0 {
+		s.trackingClients++
+	}
+	c.flags |= CLIENT_TRACKING
+	c.flags &= ^(CLIENT_TRACKING_BROKEN_REDIR | CLIENT_TRACKING_BCAST |
+		CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT |
+		CLIENT_TRACKING_NOLOOP)
+	c.clientTrackingRedirection = redirectTo
+
+	/* This may be the first client we ever enable. Create the tracking
+	 * table if it does not exist. */
+	if nil == s.trackingTable {
+		s.trackingTable = make(map[string]map[int64]struct{})
+		s.prefixTable = make(map[string]*bcastState)
+	}
+
+	/* For broadcasting, set the list of prefixes in the client. */
+	if options&CLIENT_TRACKING_BCAST != 0 {
+		c.flags |= CLIENT_TRACKING_BCAST
+		if len(prefixes) == 0 {
+			enableBcastTrackingForPrefix(c, "")
+		}
+		for _, prefix := range prefixes {
+			enableBcastTrackingForPrefix(c, prefix)
+		}
+	}
+
+	/* Set the remaining flags that don't need any special handling. */
+	c.flags |= options & (CLIENT_TRACKING_OPTIN | CLIENT_TRACKING_OPTOUT |
+		CLIENT_TRACKING_NOLOOP)
+}
+
+func enableBcastTrackingForPrefix(c *ClientConnection, prefix string) {
+	s := c.server
+	bs := s.prefixTable[prefix]
+	if nil == bs {
+		bs = &bcastState{keys: make(map[string]*ClientConnection), clients: make(map[*ClientConnection]struct{})}
+		s.prefixTable[prefix] = bs
+	}
+	if _, ok := bs.clients[c]; !ok {
+		bs.clients[c] = struct{}{}
+		if nil == c.clientTrackingPrefixes {
+			c.clientTrackingPrefixes = make(map[string]struct{})
+		}
+		c.clientTrackingPrefixes[prefix] = struct{}{}
+	}
+}
+
+// trackingRememberKeys remembers the keys read by the command, so that
+// the client is sent an invalidation message when they change
+func trackingRememberKeys(c *ClientConnection, cmd *RedisCommand, argv [][]byte) {
+	s := c.server
+	/* Return if we are in optin/out mode and the right CACHING command
+	 * was/wasn't given in order to modify the default behavior. */
+	optin := c.flags & CLIENT_TRACKING_OPTIN
+	optout := c.flags & CLIENT_TRACKING_OPTOUT
+	caching := c.flags & CLIENT_TRACKING_CACHING
+	if (optin != 0 && caching == 0) || (optout != 0 && caching != 0) {
+		return
+	}
+
+	for _, pos := range getKeysFromCommand(cmd, argv) {
+		key := string(argv[pos])
+		ids := s.trackingTable[key]
+		if nil == ids {
+			ids = make(map[int64]struct{})
+			s.trackingTable[key] = ids
+		}
+		ids[c.id] = struct{}{}
+	}
+	trackingLimitUsedSlots(s)
+}
+
+// sendTrackingMessage sends the invalidation of keys to the client, or
+// to the client it redirects to. A nil keys array invalidates everything.
+func sendTrackingMessage(c *ClientConnection, keys []string) {
+	s := c.server
+	using := c
+	usingRedirection := false
+	if c.clientTrackingRedirection != 0 {
+		redir := s.clients[c.clientTrackingRedirection]
+		if nil == redir {
+			/* We need to signal to the original connection that we
+			 * are unable to send invalidation messages to the redirected
+			 * connection, because the client no longer exist. */
+			if c.resp > 2 && c.flags&CLIENT_TRACKING_BROKEN_REDIR == 0 {
+				c.addReplyPushLen(2)
+				c.addReplyBulkString("tracking-redir-broken")
+				c.addReplyLongLong(c.clientTrackingRedirection)
+				c.flush()
+			}
+			c.flags |= CLIENT_TRACKING_BROKEN_REDIR
+			return
+		}
+		using = redir
+		usingRedirection = true
+	}
+
+	/* Only send such info for clients in RESP version 3 or more. However
+	 * if redirection is active, and the connection we redirect to is
+	 * in Pub/Sub mode, we can support the feature with RESP 2 as well,
+	 * by sending Pub/Sub messages in the __redis__:invalidate channel. */
+	if using.resp > 2 {
+		using.addReplyPushLen(2)
+		using.addReplyBulkString("invalidate")
+	} else if usingRedirection && using.flags&CLIENT_PUBSUB != 0 {
+		using.addReplyPushLen(3)
+		using.addReplyBulkString("message")
+		using.addReplyBulkString(TrackingChannelName)
+	} else {
+		/* If are here, the client is not using RESP3, nor is
+		 * redirecting to another client. We can't send anything to
+		 * it since RESP2 does not support push messages in the same
+		 * connection. */
+		return
+	}
+
+	/* Send the "value" part, which is the array of keys. */
+	if nil == keys {
+		using.addReplyNull()
+	} else {
+		using.addReplyArrayLen(len(keys))
+		for _, key := range keys {
+			using.addReplyBulkString(key)
+		}
+	}
+	using.flush()
+}
+
+// trackingRememberKeyToBroadcast queues the key for the BCAST clients of
+// the matching prefixes
+func trackingRememberKeyToBroadcast(s *Server, c *ClientConnection, key string) {
+	for prefix, bs := range s.prefixTable {
+		if strings.HasPrefix(key, prefix) {
+			if modifier, ok := bs.keys[key]; ok && modifier != c {
+				bs.keys[key] = nil
+			} else {
+				bs.keys[key] = c
+			}
+		}
+	}
+}
+
+// trackingInvalidateKey is called when key is modified by the client c,
+// nil for expired keys, and sends the invalidation to the clients that
+// read it. The BCAST clients are notified too unless bcast is false, as
+// for the keys evicted from the tracking table, that were not modified.
+func (s *Server) trackingInvalidateKey(c *ClientConnection, key string, bcast bool) {
+	if s.trackingClients == 0 {
+		return
+	}
+	if bcast && len(s.prefixTable) > 0 {
+		trackingRememberKeyToBroadcast(s, c, key)
+	}
+
+	ids, ok := s.trackingTable[key]
+	if !ok {
+		return
+	}
+	for id := range ids {
+		target := s.clients[id]
+		/* Note that if the client is in BCAST mode, we don't want to
+		 * send invalidation messages that were pending in the case
+		 * previously the client was not in BCAST mode. This can happen if
+		 * TRACKING is enabled normally, and then the client switches to
+		 * BCAST mode. */
+		if nil == target || target.flags&CLIENT_TRACKING == 0 ||
+			target.flags&CLIENT_TRACKING_BCAST != 0 {
+			continue
+		}
+
+		/* If the client enabled the NOLOOP mode, don't send notifications
+		 * about keys changed by the client itself. */
+		if target.flags&CLIENT_TRACKING_NOLOOP != 0 && target == c {
+			continue
+		}
+		sendTrackingMessage(target, []string{key})
+	}
+
+	/* Free the tracking table: we'll create the radix tree and populate it
+	 * again if more keys will be modified in this caching slot. */
+	delete(s.trackingTable, key)
+}
+
+// trackingBroadcastInvalidationMessages sends the keys modified by the
+// last command to the BCAST clients
+func (s *Server) trackingBroadcastInvalidationMessages() {
+	for _, bs := range s.prefixTable {
+		if len(bs.keys) == 0 {
+			continue
+		}
+		for c := range bs.clients {
+			var keys []string
+			for key, modifier := range bs.keys {
+				/* NOLOOP clients are not sent the keys only they modified */
+				if c.flags&CLIENT_TRACKING_NOLOOP != 0 && modifier == c {
+					continue
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) > 0 {
+				sendTrackingMessage(c, keys)
+			}
+		}
+		bs.keys = make(map[string]*ClientConnection)
+	}
+}
+
+// trackingLimitUsedSlots keeps the tracking table under
+// tracking-table-max-keys, evicting random keys. The clients that read
+// an evicted key are sent its invalidation, since it's not tracked anymore.
+func trackingLimitUsedSlots(s *Server) {
+	if s.trackingTableMaxKeys == 0 {
+		return /* No limits set. */
+	}
+	for key := range s.trackingTable {
+		if len(s.trackingTable) <= s.trackingTableMaxKeys {
+			return
+		}
+		s.trackingInvalidateKey(nil, key, false)
+	}
+}
+
+/* CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST] [PREFIX prefix ...]
+ *                        [OPTIN] [OPTOUT] [NOLOOP] */
+func clientTrackingCommand(argv [][]byte, c *ClientConnection) {
+	s := c.server
+	var options uint64
+	var redir int64
+	var prefixes []string
+
+	/* Parse the options. */
+	for j := 3; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		opt := strings.ToLower(string(argv[j]))
+		if opt == "redirect" && moreargs > 0 {
+			j++
+			if redir != 0 {
+				c.addReplyError("A client can only redirect to a single other client")
+				return
+			}
+			id, err := strconv.ParseInt(string(argv[j]), 10, 64)
+			if err != nil {
+				c.addReplyError("value is not an integer or out of range")
+				return
+			}
+			redir = id
+			/* We will require the client with the specified ID to exist
+			 * right now, even if it is possible that it gets disconnected
+			 * later. Still a valid sanity check. */
+			if nil == s.clients[redir] {
+				c.addReplyError("The client ID you want redirect to does not exist")
+				return
+			}
+		} else if opt == "bcast" {
+			options |= CLIENT_TRACKING_BCAST
+		} else if opt == "optin" {
+			options |= CLIENT_TRACKING_OPTIN
+		} else if opt == "optout" {
+			options |= CLIENT_TRACKING_OPTOUT
+		} else if opt == "noloop" {
+			options |= CLIENT_TRACKING_NOLOOP
+		} else if opt == "prefix" && moreargs > 0 {
+			j++
+			prefixes = append(prefixes, string(argv[j]))
+		} else {
+			c.addReplyBytes(shared.syntaxerr)
+			return
+		}
+	}
+
+	/* Options are ok: enable or disable the tracking for this client. */
+	mode := strings.ToLower(string(argv[2]))
+	if mode == "on" {
+		/* Before enabling tracking, make sure options are compatible
+		 * among each other and with the current state of the client. */
+		if options&CLIENT_TRACKING_BCAST == 0 && len(prefixes) > 0 {
+			c.addReplyError("PREFIX option requires BCAST mode to be enabled")
+			return
+		}
+
+		if c.flags&CLIENT_TRACKING != 0 {
+			oldbcast := c.flags&CLIENT_TRACKING_BCAST != 0
+			newbcast := options&CLIENT_TRACKING_BCAST != 0
+			if oldbcast != newbcast {
+				c.addReplyError("You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+				return
+			}
+		}
+
+		if options&CLIENT_TRACKING_BCAST != 0 &&
+			options&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+			c.addReplyError("OPTIN and OPTOUT are not compatible with BCAST")
+			return
+		}
+
+		if options&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 {
+			c.addReplyError("You can't use both OPTIN and OPTOUT")
+			return
+		}
+
+		if (options&CLIENT_TRACKING_OPTIN != 0 && c.flags&CLIENT_TRACKING_OPTOUT != 0) ||
+			(options&CLIENT_TRACKING_OPTOUT != 0 && c.flags&CLIENT_TRACKING_OPTIN != 0) {
+			c.addReplyError("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+			return
+		}
+
+		if options&CLIENT_TRACKING_BCAST != 0 && !checkPrefixCollisionsOrReply(c, prefixes) {
+			return
+		}
+
+		enableTracking(c, redir, options, prefixes)
+	} else if mode == "off" {
+		disableTracking(c)
+	} else {
+		c.addReplyBytes(shared.syntaxerr)
+		return
+	}
+	c.addReplyBytes(shared.ok)
+}
+
+/* CLIENT CACHING YES|NO */
+func clientCachingCommand(argv [][]byte, c *ClientConnection) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		c.addReplyError("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+		return
+	}
+
+	opt := strings.ToLower(string(argv[2]))
+	if opt == "yes" {
+		if c.flags&CLIENT_TRACKING_OPTIN != 0 {
+			c.flags |= CLIENT_TRACKING_CACHING
+		} else {
+			c.addReplyError("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			return
+		}
+	} else if opt == "no" {
+		if c.flags&CLIENT_TRACKING_OPTOUT != 0 {
+			c.flags |= CLIENT_TRACKING_CACHING
+		} else {
+			c.addReplyError("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			return
+		}
+	} else {
+		c.addReplyBytes(shared.syntaxerr)
+		return
+	}
+
+	/* Common reply for when we succeeded. */
+	c.addReplyBytes(shared.ok)
+}
@@ -0,0 +1,155 @@
+package connection
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valarpirai/vardis/proto"
+)
+
+// resp3Client returns a new client switched to RESP3
+func resp3Client(t *testing.T, s *Server) *testConn {
+	c := testClient(t, s)
+	c.send("HELLO 3\r\nPING\r\n")
+	c.skip("+PONG\r\n")
+	return c
+}
+
+func invalidate(keys ...string) string {
+	reply := []byte(">2\r\n$10\r\ninvalidate\r\n")
+	args := make([][]byte, len(keys))
+	for j, key := range keys {
+		args[j] = []byte(key)
+	}
+	return string(proto.AppendCommand(reply, args))
+}
+
+func TestTrackingErrors(t *testing.T) {
+	c := resp3Client(t, testServer(t))
+	tests := []struct{ request, reply string }{
+		{"CLIENT TRACKING maybe", "-ERR syntax error"},
+		{"CLIENT TRACKING on FOO", "-ERR syntax error"},
+		{"CLIENT TRACKING on PREFIX a", "-ERR PREFIX option requires BCAST mode to be enabled"},
+		{"CLIENT TRACKING on REDIRECT 99", "-ERR The client ID you want redirect to does not exist"},
+		{"CLIENT TRACKING on OPTIN OPTOUT", "-ERR You can't use both OPTIN and OPTOUT"},
+		{"CLIENT TRACKING on BCAST PREFIX user: PREFIX us",
+			"-ERR Prefix 'user:' overlaps with another provided prefix 'us'. Prefixes for a single client must not overlap."},
+		{"CLIENT CACHING yes", "-ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"},
+		{"CLIENT TRACKING on", "+OK"},
+		{"CLIENT TRACKING on BCAST", "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."},
+		{"CLIENT CACHING yes", "-ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."},
+		{"CLIENT CACHING no", "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."},
+		{"CLIENT GETREDIR", ":0"},
+		{"CLIENT TRACKING off", "+OK"},
+		{"CLIENT GETREDIR", ":-1"},
+	}
+	for _, tt := range tests {
+		c.send(tt.request + "\r\n")
+		c.expect(tt.reply + "\r\n")
+	}
+}
+
+func TestTracking(t *testing.T) {
+	s := testServer(t)
+	a := resp3Client(t, s)
+	b := testClient(t, s)
+
+	/* The key is invalidated once, until it's read again */
+	a.send("CLIENT TRACKING on\r\nGET k\r\n")
+	a.expect("+OK\r\n_\r\n")
+	b.send("SET k 1\r\nSET k 2\r\n")
+	b.expect("+OK\r\n+OK\r\n")
+	a.send("PING\r\n")
+	a.expect(invalidate("k") + "+PONG\r\n")
+
+	/* No invalidation for its own writes with NOLOOP */
+	a.send("CLIENT TRACKING on NOLOOP\r\nGET k\r\nSET k 3\r\nPING\r\n")
+	a.expect("+OK\r\n$1\r\n2\r\n+OK\r\n+PONG\r\n")
+	a.send("GET k\r\nCLIENT TRACKING on\r\nSET k 4\r\n")
+	a.expect("$1\r\n3\r\n+OK\r\n" + invalidate("k") + "+OK\r\n")
+
+	/* FLUSHALL invalidates the tracked keys */
+	a.send("GET k\r\n")
+	a.expect("$1\r\n4\r\n")
+	b.send("FLUSHALL\r\n")
+	b.expect("+OK\r\n")
+	a.send("PING\r\n")
+	a.expect(invalidate("k") + "+PONG\r\n")
+}
+
+func TestTrackingOptInOptOut(t *testing.T) {
+	s := testServer(t)
+	a := resp3Client(t, s)
+	b := testClient(t, s)
+	a.send("CLIENT TRACKING on OPTIN\r\nGET x\r\nCLIENT CACHING yes\r\nGET y\r\nGET z\r\n")
+	a.expect("+OK\r\n_\r\n+OK\r\n_\r\n_\r\n")
+	b.send("SET x 1\r\nSET y 1\r\nSET z 1\r\n")
+	b.expect("+OK\r\n+OK\r\n+OK\r\n")
+	a.send("PING\r\n")
+	a.expect(invalidate("y") + "+PONG\r\n")
+
+	a.send("CLIENT TRACKING off\r\nCLIENT TRACKING on OPTOUT\r\nGET x\r\nCLIENT CACHING no\r\nGET y\r\n")
+	a.expect("+OK\r\n+OK\r\n$1\r\n1\r\n+OK\r\n$1\r\n1\r\n")
+	b.send("DEL x y\r\n")
+	b.expect(":2\r\n")
+	a.send("PING\r\n")
+	a.expect(invalidate("x") + "+PONG\r\n")
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	s := testServer(t)
+	a := resp3Client(t, s)
+	b := testClient(t, s)
+	a.send("CLIENT TRACKING on BCAST PREFIX user: PREFIX obj:\r\n")
+	a.expect("+OK\r\n")
+	b.send("SET user:1 a\r\nSET other b\r\nSET obj:2 c\r\n")
+	b.expect("+OK\r\n+OK\r\n+OK\r\n")
+	a.send("PING\r\n")
+	a.expect(invalidate("user:1") + invalidate("obj:2") + "+PONG\r\n")
+
+	a.send("CLIENT LIST ID 1\r\n")
+	a.r.ReadString('\n')
+	if list, _ := a.r.ReadString('\n'); !strings.Contains(list, " flags=tB ") || !strings.Contains(list, " redir=0 ") {
+		t.Errorf("CLIENT LIST: %q", list)
+	}
+}
+
+/* RESP2 clients get the invalidations through the __redis__:invalidate
+ * channel of the client they redirect to */
+func TestTrackingRedirect(t *testing.T) {
+	s := testServer(t)
+	sub := testClient(t, s)
+	c := testClient(t, s)
+	sub.send("SUBSCRIBE __redis__:invalidate\r\n")
+	sub.skip(":1\r\n")
+	c.send("CLIENT TRACKING on REDIRECT 1\r\nGET z\r\nCLIENT GETREDIR\r\nSET z 1\r\n")
+	c.expect("+OK\r\n$-1\r\n:1\r\n+OK\r\n")
+	sub.expect("*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\nz\r\n")
+
+	/* The client is told when its redirection target is gone */
+	c.send("GET z\r\nHELLO 3\r\n")
+	c.expect("$1\r\n1\r\n")
+	c.skip("*0\r\n")
+	sub.conn.Close()
+	waitFor(t, s, "the redirection client to be freed", func() bool { return nil == s.clients[1] })
+	c.send("SET z 2\r\n")
+	c.expect(">2\r\n$21\r\ntracking-redir-broken\r\n:1\r\n+OK\r\n")
+}
+
+func TestTrackingTableMaxKeys(t *testing.T) {
+	s := testServer(t)
+	a := resp3Client(t, s)
+	b := resp3Client(t, s)
+	b.send("CLIENT TRACKING on BCAST PREFIX m\r\n")
+	b.expect("+OK\r\n")
+	a.send("CONFIG SET tracking-table-max-keys 1\r\nCLIENT TRACKING on\r\nGET m1\r\nGET m2\r\n")
+	a.expect("+OK\r\n+OK\r\n_\r\n_\r\n")
+	/* A random key is evicted from the table with an invalidation */
+	a.expect(">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\n")
+	if key, _ := a.r.ReadString('\n'); key != "m1\r\n" && key != "m2\r\n" {
+		t.Fatalf("evicted %q", key)
+	}
+	/* The key was not modified, the BCAST clients are not told */
+	b.send("PING\r\n")
+	b.expect("+PONG\r\n")
+}
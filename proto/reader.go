@@ -0,0 +1,479 @@
+package proto
+
+// Request reader
+// Reads multi bulk and inline requests into a reusable argument vector.
+// Arguments are slices of a per request buffer, so once the buffers have
+// grown to the size of the largest request no further allocation happens.
+// Buffers grown over maxReusableBufLen by a big request are released.
+//
+// The lengths announced by the client are checked against the limits
+// before anything is allocated, and big bulks are read in chunks of
+// protoIOBufLen: the buffer grows with the data actually received, not
+// with the length the client claims it will send.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	maxMultiBulkLength = 1024 * 1024
+	maxInlineLength    = 64 * 1024
+	protoIOBufLen      = 16 * 1024
+	maxReusableBufLen  = 1024 * 1024
+)
+
+// ErrQueryBufferLimit is returned when the request being read is bigger
+// than the query buffer limit, the connection must be closed
+var ErrQueryBufferLimit = errors.New("max query buffer length reached")
+
+// ProtocolError is returned for malformed requests, the connection
+// must reply with the error and be closed since the stream can't be resynced
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolError(msg string) error {
+	return &ProtocolError{msg}
+}
+
+type Request struct {
+	argv [][]byte
+	buf  []byte
+	offs []int
+
+	inline []byte /* Inline line longer than the reader buffer */
+
+	maxBulkLen     int   /* proto-max-bulk-len, 0 for bulkStringMaxLength */
+	maxQueryBufLen int   /* client-query-buffer-limit, 0 for no limit */
+	bufSize        int64 /* cap(buf), atomic: read by other goroutines */
+}
+
+// ********* Request Interface Start ************
+
+type RequestInterface interface {
+	String() string
+	Command() string
+	Key() string
+	Value() []byte
+	ArgsLength() int
+	Args() [][]byte
+	Argv() [][]byte
+	CommandLength() int
+}
+
+// NewRequest returns a request for an argument vector built by the caller
+func NewRequest(argv [][]byte) *Request {
+	return &Request{argv: argv}
+}
+
+// Rewrite replaces the argument vector, for commands propagated to the
+// AOF in a different form than the one received
+func (req *Request) Rewrite(argv [][]byte) {
+	req.argv = argv
+}
+
+// SetLimits sets the max length of a bulk argument and of the whole
+// request read by ReadRequest, 0 for the defaults
+func (req *Request) SetLimits(maxBulkLen int, maxQueryBufLen int) {
+	req.maxBulkLen = maxBulkLen
+	req.maxQueryBufLen = maxQueryBufLen
+}
+
+// BufferSize returns the memory used by the request buffer, it can be
+// called while another goroutine reads the request
+func (req *Request) BufferSize() int {
+	return int(atomic.LoadInt64(&req.bufSize))
+}
+
+// Reset makes the request reusable, keeping the allocated buffers
+// unless a big request made them grow over maxReusableBufLen
+func (req *Request) Reset() {
+	req.argv = req.argv[:0]
+	if cap(req.buf) > maxReusableBufLen {
+		req.buf = nil
+		atomic.StoreInt64(&req.bufSize, 0)
+	}
+	req.buf = req.buf[:0]
+	req.offs = req.offs[:0]
+}
+
+// Returns printable command, for logging
+func (req *Request) String() string {
+	var buf []byte
+	for i, arg := range req.argv {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = strconv.AppendQuote(buf, string(arg))
+	}
+	return string(buf)
+}
+
+// Command returns the lower cased command name
+func (req *Request) Command() string {
+	if len(req.argv) < 1 {
+		return ""
+	}
+	return string(req.argv[0])
+}
+
+func (req *Request) Key() string {
+	if len(req.argv) < 2 {
+		return ""
+	}
+	return string(req.argv[1])
+}
+
+func (req *Request) Value() []byte {
+	if len(req.argv) < 3 {
+		return nil
+	}
+	return req.argv[2]
+}
+
+func (req *Request) CommandLength() int {
+	return len(req.argv)
+}
+
+func (req *Request) ArgsLength() int {
+	return len(req.Args())
+}
+
+// Args returns the arguments following the key
+func (req *Request) Args() [][]byte {
+	if len(req.argv) < 3 {
+		return nil
+	}
+	return req.argv[2:]
+}
+
+// Argv returns the full argument vector, command name included
+// The slices are only valid until the next Reset
+func (req *Request) Argv() [][]byte {
+	return req.argv
+}
+
+// ********* Request Interface End ************
+
+// ReadRequest reads the next request from r into req
+// A line not starting with '*' is parsed as an inline command.
+// An empty inline line leaves req with no arguments.
+func ReadRequest(r *bufio.Reader, req *Request) error {
+	req.Reset()
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if b[0] == '*' {
+		err = readMultiBulk(r, req)
+	} else {
+		err = readInline(r, req)
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(req.offs); i += 2 {
+		req.argv = append(req.argv, req.buf[req.offs[i]:req.offs[i+1]])
+	}
+	if len(req.argv) > 0 {
+		lower(req.argv[0])
+	}
+	return nil
+}
+
+func readMultiBulk(r *bufio.Reader, req *Request) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	argc, ok := btoi(line[1:])
+	if !ok || argc > maxMultiBulkLength {
+		return protocolError("invalid multibulk length")
+	}
+	for i := 0; i < argc; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return protocolError("expected '$', got '" + printable(line) + "'")
+		}
+		argLen, ok := btoi(line[1:])
+		maxBulkLen := req.maxBulkLen
+		if maxBulkLen == 0 {
+			maxBulkLen = bulkStringMaxLength
+		}
+		if !ok || argLen < 0 || argLen > maxBulkLen {
+			return protocolError("invalid bulk length")
+		}
+		start := len(req.buf)
+		if req.maxQueryBufLen > 0 && start+argLen+2 > req.maxQueryBufLen {
+			return ErrQueryBufferLimit
+		}
+		upTo := 0
+		if argLen+2 > protoIOBufLen {
+			upTo = start + argLen + 2
+		}
+		for remaining := argLen + 2; remaining > 0; {
+			chunk := remaining
+			if chunk > protoIOBufLen {
+				chunk = protoIOBufLen
+			}
+			n := len(req.buf)
+			req.grow(chunk, upTo)
+			if _, err = io.ReadFull(r, req.buf[n:]); err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+		if req.buf[start+argLen] != '\r' || req.buf[start+argLen+1] != '\n' {
+			return protocolError("invalid bulk terminator")
+		}
+		req.offs = append(req.offs, start, start+argLen)
+	}
+	return nil
+}
+
+func readInline(r *bufio.Reader, req *Request) error {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		/* The line doesn't fit in the reader buffer: it is gathered in
+		 * req.inline, up to maxInlineLength. */
+		req.inline = append(req.inline[:0], line...)
+		for err == bufio.ErrBufferFull && len(req.inline) <= maxInlineLength {
+			line, err = r.ReadSlice('\n')
+			req.inline = append(req.inline, line...)
+		}
+		line = req.inline
+	}
+	if err == bufio.ErrBufferFull || len(line) > maxInlineLength {
+		return protocolError("too big inline request")
+	}
+	if err != nil {
+		return err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	ok := splitArgs(req, line)
+	atomic.StoreInt64(&req.bufSize, int64(cap(req.buf)))
+	if !ok {
+		return protocolError("unbalanced quotes in request")
+	}
+	return nil
+}
+
+/* Split a line into arguments, following the rules of sdssplitargs() in redis:
+ *
+ * foo bar "newline are supported\n" and "\xff\x00otherstuff"
+ *
+ * Arguments are separated by any amount of white space. Double quoted
+ * arguments support the \n \r \t \b \a \\ \" and \xHH escapes, single
+ * quoted arguments only support \'. A closing quote must be followed by
+ * white space or the end of the line.
+ *
+ * The arguments are copied to req.buf. Returns false on unbalanced quotes. */
+func splitArgs(req *Request, line []byte) bool {
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return true
+		}
+		start := len(req.buf)
+		inq, insq, done := false, false, false
+		for !done {
+			if inq {
+				if p == len(line) {
+					return false
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHex(line[p+2]) && isHex(line[p+3]) {
+					req.buf = append(req.buf, fromHex(line[p+2])<<4|fromHex(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					var c byte
+					switch line[p] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[p]
+					}
+					req.buf = append(req.buf, c)
+				} else if line[p] == '"' {
+					/* closing quote must be followed by a space or
+					 * nothing at all. */
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return false
+					}
+					done = true
+				} else {
+					req.buf = append(req.buf, line[p])
+				}
+			} else if insq {
+				if p == len(line) {
+					return false
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					req.buf = append(req.buf, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return false
+					}
+					done = true
+				} else {
+					req.buf = append(req.buf, line[p])
+				}
+			} else {
+				if p == len(line) {
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					req.buf = append(req.buf, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		req.offs = append(req.offs, start, len(req.buf))
+	}
+}
+
+// SplitArgs splits line with the rules of inline requests, for the
+// configuration files. Returns false on unbalanced quotes
+func SplitArgs(line []byte) ([][]byte, bool) {
+	req := new(Request)
+	if !splitArgs(req, line) {
+		return nil, false
+	}
+	argv := make([][]byte, 0, len(req.offs)/2)
+	for i := 0; i < len(req.offs); i += 2 {
+		argv = append(argv, req.buf[req.offs[i]:req.offs[i+1]])
+	}
+	return argv, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func fromHex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// readLine returns the next CRLF terminated line without the terminator
+// The slice points into the reader buffer and is valid until the next read
+func readLine(r *bufio.Reader) ([]byte, error) {
+	p, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big request header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	i := len(p) - 2
+	if i < 0 || p[i] != '\r' {
+		return nil, protocolError("invalid CRLF")
+	}
+	return p[:i], nil
+}
+
+// grow extends the request buffer by n bytes, the capacity doubles but
+// stays under upTo when not 0: the length of the buffer once a big bulk
+// is read
+func (req *Request) grow(n int, upTo int) {
+	b := req.buf
+	if cap(b)-len(b) < n {
+		size := 2*cap(b) + n
+		if upTo != 0 && size > upTo {
+			size = upTo
+		}
+		nb := make([]byte, len(b), size)
+		copy(nb, b)
+		b = nb
+		atomic.StoreInt64(&req.bufSize, int64(cap(b)))
+	}
+	req.buf = b[:len(b)+n]
+}
+
+func btoi(data []byte) (int, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	i := 0
+	sign := 1
+	if data[0] == '-' {
+		i++
+		sign = -1
+	}
+	if i >= len(data) || len(data) > 18 {
+		return 0, false
+	}
+	var l int
+	for ; i < len(data); i++ {
+		c := data[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		l = l*10 + int(c-'0')
+	}
+	return sign * l, true
+}
+
+func lower(data []byte) {
+	for i := 0; i < len(data); i++ {
+		if data[i] >= 'A' && data[i] <= 'Z' {
+			data[i] += 'a' - 'A'
+		}
+	}
+}
+
+func printable(b []byte) string {
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	return string(bytes.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, b))
+}
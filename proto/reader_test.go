@@ -0,0 +1,307 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* Payloads that must go through the protocol untouched */
+var binaryPayloads = []string{
+	"",
+	"plain",
+	"a\r\nb",
+	"\r\n",
+	"\x00",
+	"k\x00y",
+	"\r\n\x00\r\n",
+	"$3\r\nfoo\r\n",
+	"*1\r\n",
+	"\xff\xfe\x80",
+}
+
+func readAll(t *testing.T, in string) [][]string {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(in))
+	req := new(Request)
+	var reqs [][]string
+	for {
+		err := ReadRequest(r, req)
+		if err == io.EOF {
+			return reqs
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", in, err)
+		}
+		argv := []string{}
+		for _, arg := range req.Argv() {
+			argv = append(argv, string(arg))
+		}
+		reqs = append(reqs, argv)
+	}
+}
+
+func TestReadRequestBinarySafe(t *testing.T) {
+	for _, key := range binaryPayloads {
+		for _, val := range binaryPayloads {
+			argv := [][]byte{[]byte("SET"), []byte(key), []byte(val)}
+			in := string(AppendCommand(nil, argv))
+			got := readAll(t, in)
+			want := [][]string{{"set", key, val}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%q: got %q want %q", in, got, want)
+			}
+		}
+	}
+}
+
+func TestReadRequestMultiBulk(t *testing.T) {
+	cases := []struct {
+		in   string
+		want [][]string
+	}{
+		{"*1\r\n$4\r\nPING\r\n", [][]string{{"ping"}}},
+		{"*2\r\n$3\r\nGET\r\n$3\r\nk\x00y\r\n", [][]string{{"get", "k\x00y"}}},
+		{"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$0\r\n\r\n", [][]string{{"set", "k", ""}}},
+		{"*0\r\n", [][]string{{}}},
+		{"*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nping\r\n", [][]string{{"ping"}, {"ping"}}},
+	}
+	for _, c := range cases {
+		if got := readAll(t, c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %q want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadRequestProtocolErrors(t *testing.T) {
+	cases := []struct {
+		in  string
+		err string
+	}{
+		{"*x\r\n", "Protocol error: invalid multibulk length"},
+		{"*2000000\r\n", "Protocol error: invalid multibulk length"},
+		{"*1\r\n+x\r\n", "Protocol error: expected '$', got '+x'"},
+		{"*1\r\n$-1\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$600000000\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$1\r\nab\r\n", "Protocol error: invalid bulk terminator"},
+		{"*1\n", "Protocol error: invalid CRLF"},
+	}
+	for _, c := range cases {
+		err := ReadRequest(bufio.NewReader(strings.NewReader(c.in)), new(Request))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got %v want %q", c.in, err, c.err)
+		}
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: %T is not a *ProtocolError", c.in, err)
+		}
+	}
+}
+
+func TestReadRequestTruncated(t *testing.T) {
+	full := "*2\r\n$3\r\nget\r\n$3\r\nkey\r\n"
+	for i := 1; i < len(full); i++ {
+		err := ReadRequest(bufio.NewReader(strings.NewReader(full[:i])), new(Request))
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("%q: got %v", full[:i], err)
+		}
+	}
+}
+
+func TestReadRequestReusesBuffers(t *testing.T) {
+	in := bytes.Repeat(AppendCommand(nil, [][]byte{[]byte("get"), []byte("key")}), 2)
+	r := bufio.NewReader(bytes.NewReader(in))
+	req := new(Request)
+	if err := ReadRequest(r, req); err != nil {
+		t.Fatal(err)
+	}
+	first := &req.buf[0]
+	if err := ReadRequest(r, req); err != nil {
+		t.Fatal(err)
+	}
+	if &req.buf[0] != first {
+		t.Error("the request buffer was reallocated")
+	}
+}
+
+func TestReadRequestInlineLimit(t *testing.T) {
+	/* The reader buffer is smaller than the longest inline request */
+	long := "set k " + strings.Repeat("v", 40*1024) + "\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(long+"ping\r\n"), 16*1024)
+	req := new(Request)
+	if err := ReadRequest(r, req); err != nil {
+		t.Fatal(err)
+	}
+	if req.CommandLength() != 3 || len(req.Value()) != 40*1024 {
+		t.Fatalf("got %d arguments", req.CommandLength())
+	}
+	if err := ReadRequest(r, req); err != nil || req.Command() != "ping" {
+		t.Fatalf("got %v %q", err, req.Command())
+	}
+
+	tooLong := "set k " + strings.Repeat("v", maxInlineLength) + "\r\n"
+	r = bufio.NewReaderSize(strings.NewReader(tooLong), 16*1024)
+	err := ReadRequest(r, req)
+	if err == nil || err.Error() != "Protocol error: too big inline request" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	cases := []struct {
+		in         string
+		maxBulkLen int
+		maxQuery   int
+		err        string
+	}{
+		{"*1\r\n$10\r\n0123456789\r\n", 10, 0, ""},
+		{"*1\r\n$11\r\n", 10, 0, "Protocol error: invalid bulk length"},
+		{"*2\r\n$40\r\n" + strings.Repeat("x", 40) + "\r\n$40\r\n" + strings.Repeat("x", 40) + "\r\n", 0, 84, ""},
+		{"*2\r\n$40\r\n" + strings.Repeat("x", 40) + "\r\n$41\r\n", 0, 84, ErrQueryBufferLimit.Error()},
+	}
+	for _, c := range cases {
+		req := new(Request)
+		req.SetLimits(c.maxBulkLen, c.maxQuery)
+		err := ReadRequest(bufio.NewReader(strings.NewReader(c.in)), req)
+		if c.err == "" && err != nil {
+			t.Errorf("%q: got %v", c.in, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%q: got %v want %q", c.in, err, c.err)
+		}
+	}
+}
+
+func TestReadRequestBigBulk(t *testing.T) {
+	/* The buffer grows with the data received, not with the length
+	 * announced by the client */
+	req := new(Request)
+	err := ReadRequest(bufio.NewReader(strings.NewReader("*1\r\n$500000000\r\nabc")), req)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v", err)
+	}
+	if size := req.BufferSize(); size > 2*protoIOBufLen {
+		t.Errorf("%d bytes allocated for 3 bytes received", size)
+	}
+
+	/* A big request doesn't keep its buffer once reset */
+	big := AppendCommand(nil, [][]byte{[]byte("set"), []byte("k"), bytes.Repeat([]byte("v"), 2*maxReusableBufLen)})
+	if err := ReadRequest(bufio.NewReader(bytes.NewReader(big)), req); err != nil {
+		t.Fatal(err)
+	}
+	if size := req.BufferSize(); size < 2*maxReusableBufLen {
+		t.Errorf("buffer of %d bytes", size)
+	}
+	req.Reset()
+	if size := req.BufferSize(); size != 0 {
+		t.Errorf("buffer of %d bytes after Reset", size)
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	argv := [][]byte{[]byte("SET"), []byte("key:000001"), bytes.Repeat([]byte("x"), 64)}
+	in := bytes.Repeat(AppendCommand(nil, argv), 1024)
+	src := bytes.NewReader(in)
+	r := bufio.NewReaderSize(src, 16*1024)
+	req := new(Request)
+	b.SetBytes(int64(len(in) / 1024))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1024 == 0 {
+			src.Reset(in)
+			r.Reset(src)
+		}
+		if err := ReadRequest(r, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadRequestInline(b *testing.B) {
+	in := bytes.Repeat([]byte("SET key:000001 \"hello world\"\r\n"), 1024)
+	src := bytes.NewReader(in)
+	r := bufio.NewReaderSize(src, 16*1024)
+	req := new(Request)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1024 == 0 {
+			src.Reset(in)
+			r.Reset(src)
+		}
+		if err := ReadRequest(r, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		want []string
+		ok   bool
+	}{
+		{"set k v", []string{"set", "k", "v"}, true},
+		{"  set \t a    b  ", []string{"set", "a", "b"}, true},
+		{"", []string{}, true},
+		{"set k \"hello world\"", []string{"set", "k", "hello world"}, true},
+		{"set k \"\"", []string{"set", "k", ""}, true},
+		{"set k ''", []string{"set", "k", ""}, true},
+		{"set k \"a\\nb\\r\\t\\b\\a\\\\\\\"\"", []string{"set", "k", "a\nb\r\t\b\a\\\""}, true},
+		{"set k \"\\x41\\x00\\xff\"", []string{"set", "k", "A\x00\xff"}, true},
+		{"set k \"\\x4\"", []string{"set", "k", "x4"}, true},
+		{"set k \"\\q\"", []string{"set", "k", "q"}, true},
+		{"set k 'it\\'s \"x\"'", []string{"set", "k", "it's \"x\""}, true},
+		{"set k 'a\\nb'", []string{"set", "k", "a\\nb"}, true},
+		{"set k a\"b c\" d", []string{"set", "k", "ab c", "d"}, true},
+		{"set k \"abc", nil, false},
+		{"set k 'abc", nil, false},
+		{"set k \"abc\"def", nil, false},
+		{"set k 'abc'def", nil, false},
+	}
+	for _, c := range cases {
+		argv, ok := SplitArgs([]byte(c.line))
+		if ok != c.ok {
+			t.Errorf("%q: got ok=%v", c.line, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		got := []string{}
+		for _, arg := range argv {
+			got = append(got, string(arg))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %q want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestReadRequestInline(t *testing.T) {
+	cases := []struct {
+		in   string
+		want [][]string
+		err  string
+	}{
+		{"PING\r\n", [][]string{{"ping"}}, ""},
+		{"PING\n", [][]string{{"ping"}}, ""},
+		{"SET k \"a b\"\r\nGET k\r\n", [][]string{{"set", "k", "a b"}, {"get", "k"}}, ""},
+		{"   \r\n", [][]string{{}}, ""},
+		{"set k \"abc\r\n", nil, "Protocol error: unbalanced quotes in request"},
+	}
+	for _, c := range cases {
+		if c.err == "" {
+			if got := readAll(t, c.in); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%q: got %q want %q", c.in, got, c.want)
+			}
+			continue
+		}
+		err := ReadRequest(bufio.NewReader(strings.NewReader(c.in)), new(Request))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got %v want %q", c.in, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proto
+
+// RESP3 types
+// https://github.com/antirez/RESP3/blob/master/spec.md
+// These are only sent to clients that switched protocol with HELLO 3,
+// connections map them to their RESP2 equivalent otherwise.
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	typeMap        = "%"
+	typeSet        = "~"
+	typeAttribute  = "|"
+	typePush       = ">"
+	typeDouble     = ","
+	typeBoolean    = "#"
+	typeBigNumber  = "("
+	typeVerbatim   = "="
+	typeNil        = "_"
+	verbatimExtLen = 3
+)
+
+// AppendMapLen appends a map header, the caller appends n key value pairs
+func AppendMapLen(dst []byte, n int) []byte {
+	return appendHeader(dst, typeMap, n)
+}
+
+// AppendSetLen appends a set header, the caller appends n elements
+func AppendSetLen(dst []byte, n int) []byte {
+	return appendHeader(dst, typeSet, n)
+}
+
+// AppendAttributeLen appends an attribute header, the caller appends n
+// key value pairs followed by the reply the attributes describe
+func AppendAttributeLen(dst []byte, n int) []byte {
+	return appendHeader(dst, typeAttribute, n)
+}
+
+// AppendPushLen appends an out of band push header, the caller appends n elements
+func AppendPushLen(dst []byte, n int) []byte {
+	return appendHeader(dst, typePush, n)
+}
+
+// AppendDouble appends a double
+func AppendDouble(dst []byte, f float64) []byte {
+	dst = append(dst, typeDouble...)
+	dst = FormatDouble(dst, f)
+	return append(dst, crlf...)
+}
+
+// AppendBoolean appends a boolean
+func AppendBoolean(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, typeBoolean+"t"+crlf...)
+	}
+	return append(dst, typeBoolean+"f"+crlf...)
+}
+
+// AppendBigNumber appends a big number, given in its decimal representation
+func AppendBigNumber(dst []byte, n string) []byte {
+	dst = append(dst, typeBigNumber...)
+	dst = append(dst, n...)
+	return append(dst, crlf...)
+}
+
+// AppendVerbatim appends a verbatim string, ext is the three chars format
+// such as "txt" or "mkd"
+func AppendVerbatim(dst []byte, ext string, b []byte) []byte {
+	if len(ext) != verbatimExtLen {
+		panic("Verbatim string format must be 3 characters")
+	}
+	dst = appendHeader(dst, typeVerbatim, len(b)+verbatimExtLen+1)
+	dst = append(dst, ext...)
+	dst = append(dst, ':')
+	dst = append(dst, b...)
+	return append(dst, crlf...)
+}
+
+// AppendNil appends the RESP3 null
+func AppendNil(dst []byte) []byte {
+	return append(dst, typeNil+crlf...)
+}
+
+// FormatDouble appends the textual form of f used both for RESP3 doubles and
+// for RESP2 replies, where doubles are sent as bulk strings
+func FormatDouble(dst []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(dst, "inf"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-inf"...)
+	case math.IsNaN(f):
+		return append(dst, "nan"...)
+	}
+	return strconv.AppendFloat(dst, f, 'g', -1, 64)
+}
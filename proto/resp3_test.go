@@ -0,0 +1,45 @@
+package proto
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRESP3Encoders(t *testing.T) {
+	cases := []struct {
+		got  []byte
+		want string
+	}{
+		{AppendMapLen(nil, 2), "%2\r\n"},
+		{AppendSetLen(nil, 0), "~0\r\n"},
+		{AppendAttributeLen(nil, 1), "|1\r\n"},
+		{AppendPushLen(nil, 3), ">3\r\n"},
+		{AppendDouble(nil, 1.5), ",1.5\r\n"},
+		{AppendDouble(nil, -3), ",-3\r\n"},
+		{AppendDouble(nil, 1e300), ",1e+300\r\n"},
+		{AppendDouble(nil, math.Inf(1)), ",inf\r\n"},
+		{AppendDouble(nil, math.Inf(-1)), ",-inf\r\n"},
+		{AppendDouble(nil, math.NaN()), ",nan\r\n"},
+		{AppendBoolean(nil, true), "#t\r\n"},
+		{AppendBoolean(nil, false), "#f\r\n"},
+		{AppendBigNumber(nil, "3492890328409238509324850943850943825024385"), "(3492890328409238509324850943850943825024385\r\n"},
+		{AppendVerbatim(nil, "txt", []byte("Some string")), "=15\r\ntxt:Some string\r\n"},
+		{AppendVerbatim(nil, "mkd", []byte("a\r\n\x00")), "=8\r\nmkd:a\r\n\x00\r\n"},
+		{AppendNil(nil), "_\r\n"},
+		{FormatDouble(nil, 0.1), "0.1"},
+	}
+	for _, c := range cases {
+		if string(c.got) != c.want {
+			t.Errorf("got %q want %q", c.got, c.want)
+		}
+	}
+}
+
+func TestAppendVerbatimRejectsFormat(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a verbatim string with a 4 chars format was encoded")
+		}
+	}()
+	AppendVerbatim(nil, "text", []byte("x"))
+}
@@ -5,11 +5,6 @@ package proto
 // https://redis.io/topics/protocol
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"fmt"
-	"io"
 	"strconv"
 	"strings"
 )
@@ -17,261 +12,162 @@ import (
 // Data types and constants
 const (
 	typeSimpleStrings = "+"
-	typeErrors        = "-ERR "
+	typeErrors        = "-"
 	typeIntegers      = ":"
 	typeBulkStrings   = "$"
 	typeArrays        = "*"
 
+	errGeneric          = "ERR"
 	typeNull            = "-1"
 	crlf                = "\r\n"
 	bulkStringMaxLength = 512 * 1024 * 1024
 )
 
-type Request struct {
-	rawCmd string
-	cmd    string
-	key    string
-	args   []string
-	err    bool
-}
-
-// ********* Request Interface Start ************
-
-type RequestInterface interface {
-	String() string
-	Command() string
-	Key() string
-	Value() string
-	ArgsLength() int
-	Args() []string
-	Error() bool
-	CommandLength() int
+// EncodeString encodes a simple string
+func EncodeString(s string) []byte {
+	return AppendString(nil, s)
 }
 
-func (req *Request) SetRawCommand(cmd string) {
-	req.rawCmd = cmd
+// EncodeError encodes a generic ERR error string
+// CR and LF are replaced by spaces, since error messages may echo user input
+func EncodeError(s string) []byte {
+	return AppendError(nil, s)
 }
 
-// Returns raw command
-func (req *Request) String() string {
-	if req.Error() {
-		return ""
-	}
-	return req.rawCmd
+// EncodeErrorCode encodes an error with the given code, such as WRONGTYPE or NOAUTH
+func EncodeErrorCode(code string, s string) []byte {
+	return AppendErrorCode(nil, code, s)
 }
 
-func (req *Request) Command() string {
-	if req.Error() {
-		return ""
-	}
-	return req.cmd
+// EncodeInt encodes an int
+func EncodeInt(s int64) []byte {
+	return AppendInt(nil, s)
 }
 
-func (req *Request) Key() string {
-	if req.Error() {
-		return ""
-	}
-	return req.key
+// EncodeBulkString encodes a bulk string
+func EncodeBulkString(s string) []byte {
+	return AppendBulkString(nil, s)
 }
 
-func (req *Request) Value() string {
-	if req.Error() || req.ArgsLength() < 1 {
-		return ""
-	}
-	return req.args[0]
+// EncodeBulk encodes a binary safe bulk string
+func EncodeBulk(b []byte) []byte {
+	return AppendBulk(make([]byte, 0, len(b)+16), b)
 }
 
-func (req *Request) CommandLength() int {
-	if req.Error() {
-		return 0
-	}
-	// TODO - handle if key is nil
-	return 2 + req.ArgsLength()
+// EncodeNull encodes null value
+func EncodeNull() []byte {
+	return AppendNull(nil)
 }
 
-func (req *Request) ArgsLength() int {
-	if req.Error() || nil == req.Args() {
-		return 0
-	}
-	return len(req.args)
+// EncodeNullArray encodes null array
+func EncodeNullArray() []byte {
+	return AppendNullArray(nil)
 }
 
-func (req *Request) Args() []string {
-	if req.Error() {
-		return nil
+// EncodeArray encode a slice of byte slice. It accepts the results of other encode method including itself.
+// For example: EncodeArray([][]byte{EncodeInt(1), EncodeNull()})
+func EncodeArray(s [][]byte) []byte {
+	buf := AppendArrayLen(nil, len(s))
+	for _, val := range s {
+		buf = append(buf, val...)
 	}
-	return req.args
-}
-
-func (req *Request) Error() bool {
-	return req.err
+	return buf
 }
 
-// ********* Request Interface End ************
+// ********* Append encoders ************
+// Append* variants encode into dst and return the extended slice,
+// so that replies can be built in a reusable buffer without allocations
 
-// EncodeString encodes a simple string
-func EncodeString(s string) []byte {
+// AppendString appends a simple string
+func AppendString(dst []byte, s string) []byte {
 	if strings.ContainsAny(s, crlf) {
 		panic("SimpleString cannot contain a CR or LF character")
 	}
-	return []byte(typeSimpleStrings + s + crlf)
+	dst = append(dst, typeSimpleStrings...)
+	dst = append(dst, s...)
+	return append(dst, crlf...)
 }
 
-// EncodeError encodes a error string
-func EncodeError(s string) []byte {
-	return []byte(typeErrors + s + crlf)
+// AppendError appends a generic ERR error string
+func AppendError(dst []byte, s string) []byte {
+	return AppendErrorCode(dst, errGeneric, s)
 }
 
-// EncodeInt encodes an int
-func EncodeInt(s int64) []byte {
-	return []byte(typeIntegers + strconv.FormatInt(s, 10) + crlf)
+// AppendErrorCode appends an error string prefixed by code
+// Clients branch on the code, the first word of the error
+func AppendErrorCode(dst []byte, code string, s string) []byte {
+	dst = append(dst, typeErrors...)
+	dst = appendSanitized(dst, code)
+	dst = append(dst, ' ')
+	dst = appendSanitized(dst, s)
+	return append(dst, crlf...)
 }
 
-// EncodeBulkString encodes a bulk string
-func EncodeBulkString(s string) []byte {
+// AppendInt appends an int
+func AppendInt(dst []byte, n int64) []byte {
+	dst = append(dst, typeIntegers...)
+	dst = strconv.AppendInt(dst, n, 10)
+	return append(dst, crlf...)
+}
+
+// AppendBulkString appends a bulk string
+func AppendBulkString(dst []byte, s string) []byte {
 	if len(s) > bulkStringMaxLength {
 		panic("BulkString is over 512 MB")
 	}
-	return []byte(typeBulkStrings + strconv.Itoa(len(s)) + crlf + s + crlf)
+	dst = appendHeader(dst, typeBulkStrings, len(s))
+	dst = append(dst, s...)
+	return append(dst, crlf...)
 }
 
-// EncodeNull encodes null value
-func EncodeNull() []byte {
-	return []byte(typeBulkStrings + typeNull + crlf)
+// AppendBulk appends a binary safe bulk string
+func AppendBulk(dst []byte, b []byte) []byte {
+	if len(b) > bulkStringMaxLength {
+		panic("BulkString is over 512 MB")
+	}
+	dst = appendHeader(dst, typeBulkStrings, len(b))
+	dst = append(dst, b...)
+	return append(dst, crlf...)
 }
 
-// EncodeNullArray encodes null array
-func EncodeNullArray() []byte {
-	return []byte(typeArrays + typeNull + crlf)
+// AppendNull appends null value
+func AppendNull(dst []byte) []byte {
+	return append(dst, typeBulkStrings+typeNull+crlf...)
 }
 
-// EncodeArray encode a slice of byte slice. It accepts the results of other encode method including itself.
-// For example: EncodeArray([][]byte{EncodeInt(1), EncodeNull()})
-func EncodeArray(s [][]byte) []byte {
-	var buf bytes.Buffer
-	buf.WriteString(typeArrays)
-	buf.WriteString(strconv.Itoa(len(s)))
-	buf.WriteString(crlf)
-	for _, val := range s {
-		buf.Write(val)
-	}
-	return buf.Bytes()
+// AppendNullArray appends null array
+func AppendNullArray(dst []byte) []byte {
+	return append(dst, typeArrays+typeNull+crlf...)
 }
 
-// Decode decode from reader
-// Add support for \n delimitter
-func Decode(reader *bufio.Reader) (result interface{}, rawCmd string, err error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	rawCmd = line
-	lineLen := len(line)
-	if lineLen < 3 {
-		err = fmt.Errorf(`line is too short: %#v`, line)
-		return
-	}
-	if line[lineLen-1] != '\n' {
-		err = fmt.Errorf("invalid CRLF: %#v", line)
-		return
-	}
-	delimiter_len := 1
-	if line[lineLen-2] == '\r' {
-		delimiter_len = 2
-	}
-
-	msgType, line := string(line[0]), line[1:lineLen-delimiter_len]
-	switch msgType {
-	case typeSimpleStrings:
-		result = line
-	case typeErrors:
-		result = errors.New(line)
-	case typeIntegers:
-		result, err = strconv.ParseInt(line, 10, 64)
-	case typeBulkStrings:
-		var length int
-
-		if length, err = strconv.Atoi(line); err != nil || length == -1 {
-			return
-		}
+// AppendArrayLen appends an array header, the caller appends the n elements
+func AppendArrayLen(dst []byte, n int) []byte {
+	return appendHeader(dst, typeArrays, n)
+}
 
-		if length > bulkStringMaxLength || length < -1 {
-			err = fmt.Errorf("invalid Bulk Strings length: %#v", length)
-			return
-		}
-		buff := make([]byte, length+2)
-		_, err = io.ReadFull(reader, buff)
-		if err != nil {
-			return
-		}
-		if buff[length] != '\r' || buff[length+1] != '\n' {
-			err = fmt.Errorf("invalid CRLF: %#v", string(buff))
-			return
-		}
-		result = string(buff[:length])
-		rawCmd += string(buff)
-	case typeArrays:
-		var length int
-		length, err = strconv.Atoi(line)
-		if length == -1 {
-			return
-		}
-		array := make([]interface{}, length)
-		for i := 0; i < length; i++ {
-			var raw string
-			array[i], raw, err = Decode(reader)
-			if err != nil {
-				return
-			}
-			rawCmd += raw
-		}
-		result = array
-	default:
-		// Default treat as String
-		// log.Debugln(command)
-		result = msgType + line
+// AppendCommand appends argv as a multi bulk request, the format used by
+// clients and by the AOF
+func AppendCommand(dst []byte, argv [][]byte) []byte {
+	dst = AppendArrayLen(dst, len(argv))
+	for _, arg := range argv {
+		dst = AppendBulk(dst, arg)
 	}
-	return
+	return dst
 }
 
-func ParseCommand(cmd interface{}) *Request {
-	var request = new(Request)
-	var args []string
-	switch cmd.(type) {
-	case []interface{}:
-		// Parsing Array of commands
-		args = ConvertInterfaceArrToStringArr(cmd)
-	case interface{}:
-		args = strings.Split(cmd.(string), " ")
-	default:
-		request.err = true
-	}
+func appendHeader(dst []byte, prefix string, n int) []byte {
+	dst = append(dst, prefix...)
+	dst = strconv.AppendInt(dst, int64(n), 10)
+	return append(dst, crlf...)
+}
 
-	if request.Error() == false {
-		argsLen := len(args)
-		if argsLen > 2 {
-			request.cmd = args[0]
-			request.key = args[1]
-			request.args = args[2:argsLen]
-		} else if argsLen > 1 {
-			request.cmd = args[0]
-			request.key = args[1]
+func appendSanitized(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' {
+			dst = append(dst, ' ')
 		} else {
-			request.cmd = args[0]
+			dst = append(dst, s[i])
 		}
-		request.cmd = strings.ToLower(request.cmd)
-	}
-	return request
-}
-
-func ConvertInterfaceArrToStringArr(netData interface{}) (aString []string) {
-	params, ok := netData.([]interface{})
-	if !ok {
-		return
-	}
-	aString = make([]string, len(params))
-	for i, v := range params {
-		aString[i] = v.(string)
 	}
-	return
+	return dst
 }
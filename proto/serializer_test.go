@@ -0,0 +1,52 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestSerializer(t *testing.T) {
+	cases := []struct {
+		got  []byte
+		want string
+	}{
+		{EncodeString("OK"), "+OK\r\n"},
+		{EncodeError("bad"), "-ERR bad\r\n"},
+		{EncodeError("bad\r\ninput"), "-ERR bad  input\r\n"},
+		{EncodeErrorCode("WRONGTYPE", "Operation"), "-WRONGTYPE Operation\r\n"},
+		{EncodeInt(-42), ":-42\r\n"},
+		{EncodeBulkString(""), "$0\r\n\r\n"},
+		{EncodeBulkString("a\r\nb"), "$4\r\na\r\nb\r\n"},
+		{EncodeBulk([]byte("k\x00y")), "$3\r\nk\x00y\r\n"},
+		{EncodeBulk([]byte("\r\n\x00")), "$3\r\n\r\n\x00\r\n"},
+		{EncodeNull(), "$-1\r\n"},
+		{EncodeNullArray(), "*-1\r\n"},
+		{EncodeArray([][]byte{EncodeBulk([]byte("\x00")), EncodeInt(1)}), "*2\r\n$1\r\n\x00\r\n:1\r\n"},
+		{AppendCommand(nil, [][]byte{[]byte("set"), []byte("\r\n"), []byte("")}), "*3\r\n$3\r\nset\r\n$2\r\n\r\n\r\n$0\r\n\r\n"},
+	}
+	for _, c := range cases {
+		if string(c.got) != c.want {
+			t.Errorf("got %q want %q", c.got, c.want)
+		}
+	}
+}
+
+func TestAppendStringRejectsCRLF(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a simple string with CRLF was encoded")
+		}
+	}()
+	EncodeString("a\r\nb")
+}
+
+func TestAppendReusesBuffer(t *testing.T) {
+	buf := make([]byte, 0, 64)
+	out := AppendBulk(buf, []byte("value"))
+	out = AppendInt(out, 7)
+	if &out[0] != &buf[:1][0] {
+		t.Error("the buffer was reallocated")
+	}
+	if string(out) != "$5\r\nvalue\r\n:7\r\n" {
+		t.Errorf("got %q", out)
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Histogram counts non negative values in log-linear buckets, in the
+// spirit of the hdr_histogram used by redis: every power of two is split
+// in histogramSubBuckets buckets, so values are reported with a relative
+// error below 1/histogramSubBuckets.
+type Histogram struct {
+	counts [histogramBuckets]int64
+	total  int64
+	min    int64
+	max    int64
+}
+
+const histogramSubBits = 5
+const histogramSubBuckets = 1 << histogramSubBits
+const histogramBuckets = (64 - histogramSubBits) * histogramSubBuckets
+
+func histogramIndex(v int64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(uint64(v)) - histogramSubBits - 1
+	return (exp+1)*histogramSubBuckets + int((v>>uint(exp))&(histogramSubBuckets-1))
+}
+
+// histogramHighest returns the highest value counted in the bucket
+func histogramHighest(idx int) int64 {
+	if idx < histogramSubBuckets {
+		return int64(idx)
+	}
+	exp := idx/histogramSubBuckets - 1
+	sub := int64(idx % histogramSubBuckets)
+	return ((histogramSubBuckets+sub)<<uint(exp) + 1<<uint(exp)) - 1
+}
+
+// Record counts the value, negative values are counted as 0
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.counts[histogramIndex(v)]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.total++
+}
+
+// TotalCount returns the number of values recorded
+func (h *Histogram) TotalCount() int64 {
+	return h.total
+}
+
+// Max returns the highest value recorded
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// ValueAtPercentile returns the value under which percentile percent of
+// the recorded values are, 0 for an empty histogram
+func (h *Histogram) ValueAtPercentile(percentile float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	if percentile > 100 {
+		percentile = 100
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for idx, count := range h.counts {
+		seen += count
+		if seen >= target {
+			v := histogramHighest(idx)
+			if v > h.max {
+				v = h.max
+			}
+			if v < h.min {
+				v = h.min
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// CumulativeCounts calls fn for first and its successive doublings, up
+// to the one holding the highest value recorded, with the number of
+// values lower than or equal to it, like the hdr_histogram log iterator
+func (h *Histogram) CumulativeCounts(first int64, fn func(upTo int64, count int64)) {
+	if h.total == 0 || first < 1 {
+		return
+	}
+	var seen int64
+	idx := 0
+	for upTo := first; ; upTo <<= 1 {
+		for ; idx < histogramBuckets && histogramHighest(idx) <= upTo; idx++ {
+			seen += h.counts[idx]
+		}
+		fn(upTo, seen)
+		if upTo >= h.max || upTo >= math.MaxInt64/2 {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+/* Every value falls in the bucket whose range holds it */
+func TestHistogramBuckets(t *testing.T) {
+	values := []int64{0, 1, 31, 32, 33, 63, 64, 65, 1000, 1023, 1024, 1025, 123456789, math.MaxInt64 - 1, math.MaxInt64}
+	for shift := uint(0); shift < 63; shift++ {
+		values = append(values, 1<<shift-1, 1<<shift, 1<<shift+1)
+	}
+	for _, v := range values {
+		idx := histogramIndex(v)
+		if idx < 0 || idx >= histogramBuckets {
+			t.Fatalf("%d: bucket %d out of range", v, idx)
+		}
+		if histogramHighest(idx) < v || (idx > 0 && histogramHighest(idx-1) >= v) {
+			t.Errorf("%d: in bucket %d of [%d, %d]", v, idx, histogramHighest(idx-1)+1, histogramHighest(idx))
+		}
+		/* The relative error stays below 1/histogramSubBuckets */
+		if v > 0 && float64(histogramHighest(idx)-v)/float64(v) > 1.0/histogramSubBuckets {
+			t.Errorf("%d: bucket %d up to %d", v, idx, histogramHighest(idx))
+		}
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h Histogram
+	if h.ValueAtPercentile(50) != 0 || h.TotalCount() != 0 {
+		t.Fatal("empty histogram")
+	}
+	for i := int64(1); i <= 1000; i++ {
+		h.Record(i * 1000)
+	}
+	tests := []struct {
+		percentile float64
+		want       int64
+	}{
+		{0, 1000},
+		{50, 500000},
+		{99, 990000},
+		{99.9, 999000},
+		{100, 1000000},
+		{200, 1000000},
+	}
+	for _, tt := range tests {
+		got := h.ValueAtPercentile(tt.percentile)
+		if got < tt.want || float64(got) > float64(tt.want)*(1+1.0/histogramSubBuckets) {
+			t.Errorf("p%v: got %d want %d", tt.percentile, got, tt.want)
+		}
+	}
+	if h.TotalCount() != 1000 || h.Max() != 1000000 {
+		t.Errorf("got %d values up to %d", h.TotalCount(), h.Max())
+	}
+
+	/* The percentiles never go past the values recorded */
+	var one Histogram
+	one.Record(1000001)
+	one.Record(-5)
+	if one.ValueAtPercentile(100) != 1000001 || one.ValueAtPercentile(10) != 0 {
+		t.Errorf("got %d and %d", one.ValueAtPercentile(100), one.ValueAtPercentile(10))
+	}
+}
+
+func TestHistogramCumulativeCounts(t *testing.T) {
+	var h Histogram
+	h.CumulativeCounts(1, func(upTo, count int64) { t.Error("empty histogram") })
+	for _, v := range []int64{1, 2, 3, 700, 1000, 5000} {
+		h.Record(v)
+	}
+	var got [][2]int64
+	h.CumulativeCounts(1024, func(upTo, count int64) { got = append(got, [2]int64{upTo, count}) })
+	want := [][2]int64{{1024, 5}, {2048, 5}, {4096, 5}, {8192, 6}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	for j := range want {
+		if got[j] != want[j] {
+			t.Errorf("got %v want %v", got, want)
+		}
+	}
+}
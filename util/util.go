@@ -1,7 +1,11 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -35,3 +39,188 @@ func StringToBytes(s string) []byte {
 		}{s, len(s)},
 	))
 }
+
+// StringMatch reports whether str matches the glob-style pattern, a port of
+// stringmatchlen() from redis. Supports *, ?, [abc], [^abc], [a-z] and \ escapes.
+func StringMatch(pattern, str []byte, nocase bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true /* match */
+			}
+			for len(str) > 0 {
+				if StringMatch(pattern[1:], str, nocase) {
+					return true /* match */
+				}
+				str = str[1:]
+			}
+			return false /* no match */
+		case '?':
+			if len(str) == 0 {
+				return false /* no match */
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[0], str[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				/* [ without ], the string must be consumed anyway */
+				return false
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false /* no match */
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || !equalByte(pattern[0], str[0], nocase) {
+				return false /* no match */
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// AppendRepr appends to dst the quoted representation of s, escaping non
+// printable characters, a port of sdscatrepr() from redis
+func AppendRepr(dst []byte, s []byte) []byte {
+	dst = append(dst, '"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\a':
+			dst = append(dst, '\\', 'a')
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		default:
+			if c >= 0x20 && c < 0x7f {
+				dst = append(dst, c)
+			} else {
+				dst = append(dst, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+		}
+	}
+	return append(dst, '"')
+}
+
+const hexDigits = "0123456789abcdef"
+
+// Memtoull converts a string representing an amount of memory into the
+// number of bytes, so for instance "1Gb" returns 1073741824, a port of
+// memtoull() from redis. Returns false if the string is invalid
+func Memtoull(p string) (uint64, bool) {
+	/* Search the first non digit character. */
+	i := 0
+	for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+		i++
+	}
+	var mul uint64
+	switch strings.ToLower(p[i:]) {
+	case "", "b":
+		mul = 1
+	case "k":
+		mul = 1000
+	case "kb":
+		mul = 1024
+	case "m":
+		mul = 1000 * 1000
+	case "mb":
+		mul = 1024 * 1024
+	case "g":
+		mul = 1000 * 1000 * 1000
+	case "gb":
+		mul = 1024 * 1024 * 1024
+	default:
+		return 0, false
+	}
+	val, err := strconv.ParseUint(p[:i], 10, 64)
+	if err != nil || val > math.MaxUint64/mul {
+		return 0, false
+	}
+	return val * mul, true
+}
+
+// RandomHex returns n random hex characters, like getRandomHexChars()
+// from redis, for run ids and replication ids
+func RandomHex(n int) string {
+	buf := make([]byte, (n+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)[:n]
+}
@@ -0,0 +1,77 @@
+package util
+
+import "testing"
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		nocase       bool
+		match        bool
+	}{
+		{"*", "", false, true},
+		{"*", "abc", false, true},
+		{"**", "abc", false, true},
+		{"a*", "", false, false},
+		{"a*", "abc", false, true},
+		{"a*c", "abbbc", false, true},
+		{"a*c", "abcd", false, false},
+		{"*b", "ab", false, true},
+		{"a?c", "abc", false, true},
+		{"a?c", "ac", false, false},
+		{"abc", "abcd", false, false},
+		{"h[ae]llo", "hello", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hello", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{"h[\\]]llo", "h]llo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"news.*", "news.tech", false, true},
+		{"news.*", "new", false, false},
+		{"__keyspace@0__:*", "__keyspace@0__:foo", false, true},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"h[A-Z]llo", "hello", true, true},
+		{"a\x00*", "a\x00b", false, true},
+	}
+	for _, tt := range tests {
+		if got := StringMatch([]byte(tt.pattern), []byte(tt.str), tt.nocase); got != tt.match {
+			t.Errorf("StringMatch(%q, %q, %v) = %v", tt.pattern, tt.str, tt.nocase, got)
+		}
+	}
+}
+
+func TestMemtoull(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"100b", 100, true},
+		{"1k", 1000, true},
+		{"1kb", 1024, true},
+		{"2m", 2000000, true},
+		{"2MB", 2 * 1024 * 1024, true},
+		{"1g", 1000000000, true},
+		{"1Gb", 1024 * 1024 * 1024, true},
+		{"18446744073709551615", 18446744073709551615, true},
+		{"18446744073709551616", 0, false},
+		{"17179869184gb", 0, false},
+		{"", 0, false},
+		{"kb", 0, false},
+		{"-1", 0, false},
+		{"1x", 0, false},
+		{"1 kb", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := Memtoull(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Memtoull(%q) = %d, %v want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -3,17 +3,19 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	cache "github.com/valarpirai/vardis/cache"
 	"github.com/valarpirai/vardis/connection"
+	"github.com/valarpirai/vardis/util"
 )
 
 type VardisApp struct {
 	server *connection.Server
-	PORT   uint16
 }
 
+// Usage: vardis [/path/to/vardis.conf] [--port 6380] [--loglevel debug] ...
 func main() {
 	confgureApp()
 
@@ -22,32 +24,66 @@ func main() {
 	log.Debugln("Arguments...")
 	log.Debugln(arguments)
 
+	configfile, options := parseArguments(arguments[1:])
 	app := new(VardisApp)
-	if len(arguments) > 1 {
-		port, err := strconv.ParseUint(arguments[1], 10, 16)
-		if nil == err {
-			app.PORT = uint16(port)
+	NewApp(app, configfile, options)
+}
+
+// parseArguments returns the config file and the options of the command
+// line as config file lines: "--port 6380" becomes "port 6380". For
+// compatibility a lone port number is accepted as the first argument.
+func parseArguments(args []string) (configfile string, options string) {
+	var lines []string
+	j := 0
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		if _, err := strconv.ParseUint(args[0], 10, 16); nil == err {
+			lines = append(lines, "port "+args[0])
+		} else {
+			configfile = args[0]
 		}
+		j = 1
 	}
-	if 0 == app.PORT {
-		app.PORT = 6379
+	for ; j < len(args); j++ {
+		if strings.HasPrefix(args[j], "--") && len(args[j]) > 2 {
+			lines = append(lines, args[j][2:])
+		} else if len(lines) > 0 {
+			/* Option argument */
+			lines[len(lines)-1] += " " + string(util.AppendRepr(nil, []byte(args[j])))
+		}
 	}
-
-	NewApp(app)
+	return configfile, strings.Join(lines, "\n")
 }
 
-func NewApp(app *VardisApp) {
+func NewApp(app *VardisApp, configfile string, options string) {
 	cacheStore := cache.NewCache()
-	persistant := cache.NewStorage()
 
-	log.Info("Loading data from disk")
+	app.server = connection.NewServer(0, cacheStore, nil)
+	if err := app.server.LoadServerConfig(configfile, options); err != nil {
+		log.Fatalln(err)
+	}
+	if configfile != "" {
+		log.Infof("Configuration loaded from %s", configfile)
+	}
+	if err := app.server.LoadACLUsersAtStartup(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := app.server.OpenAppendOnlyFile(); err != nil {
+		log.Fatalln(err)
+	}
 
-	app.server = connection.NewServer(app.PORT, cacheStore, persistant)
+	log.Info("Loading data from disk")
 
-	go app.server.LoadFromDisk()
-	cacheStore.Exists("Test")
+	/* The clients get -LOADING until the AOF is replayed. If it can't be
+	 * replayed, the server is shut down without serving them. */
+	app.server.StartLoading()
+	go func() {
+		if err := app.server.LoadFromDisk(); err != nil {
+			log.Errorln(err)
+			app.server.AbortStartup()
+		}
+	}()
 
-	app.server.Start()
+	os.Exit(app.server.Start())
 }
 
 func confgureApp() {
@@ -57,5 +93,5 @@ func confgureApp() {
 	})
 
 	log.SetOutput(os.Stdout)
-	log.SetLevel(log.DebugLevel)
+	log.SetLevel(log.InfoLevel)
 }